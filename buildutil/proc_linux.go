@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package buildutil
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+)
+
+// startCommand starts `cmd` in a new process group and returns a function
+// which waits for it to exit. If `ctx` is done first, the whole group is
+// killed so that none of the processes the command started (e.g., compilers
+// run by a test or pip's subprocesses) outlive the build, and the context's
+// error is returned. Because the command isn't in the terminal's foreground
+// process group, Ctrl-C reaches it only through `ctx`.
+func startCommand(ctx context.Context, cmd *exec.Cmd) (func() error, error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return waitCommand(ctx, cmd, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}), nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package buildutil
+
+import (
+	"context"
+	"os/exec"
+)
+
+// startCommand starts `cmd` and returns a function which waits for it to
+// exit. If `ctx` is done first, the command is killed and the context's error
+// is returned. Unlike on Linux, processes which the command started aren't
+// killed along with it.
+func startCommand(ctx context.Context, cmd *exec.Cmd) (func() error, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return waitCommand(ctx, cmd, func() { cmd.Process.Kill() }), nil
+}
@@ -0,0 +1,245 @@
+package buildutil
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/weberc2/builder/core"
+)
+
+// SandboxCommand is the hidden subcommand via which `builder` re-executes
+// itself inside of a sandbox. `main()` must call `SandboxMain()` when it's
+// invoked with this as its first argument.
+const SandboxCommand = "__sandbox"
+
+// DefaultSandboxPaths are the host paths that sandboxed commands may read in
+// addition to their declared inputs. These cover the toolchains installed on
+// a typical Linux system.
+var DefaultSandboxPaths = []string{
+	"/bin",
+	"/sbin",
+	"/usr",
+	"/lib",
+	"/lib32",
+	"/lib64",
+	"/libx32",
+	"/etc",
+}
+
+// sandboxDevices are the only devices (in /dev) which sandboxed commands may
+// use.
+var sandboxDevices = []string{"null", "zero", "urandom", "tty"}
+
+// Sandbox configures the isolation of commands run via `BuildContext.Call()`.
+// A sandboxed command sees only the artifacts declared as inputs to its
+// target (read-only), the `AllowedPaths` (read-only), its build workspace
+// (which contains `$OUTPUT`), a private `/tmp`, a minimal read-only `/dev`,
+// and a `/proc` which only shows the sandbox's own processes. Sandboxing is
+// only supported on Linux, where it's implemented with user, mount, and PID
+// namespaces.
+type Sandbox struct {
+	AllowedPaths []string
+}
+
+// Sandboxing is the sandbox applied to every command run via
+// `BuildContext.Call()`. If it's nil, commands aren't sandboxed.
+var Sandboxing *Sandbox
+
+// SandboxViolationErr is returned when a sandboxed command fails and its
+// output mentions a host path that was hidden from it by the sandbox.
+type SandboxViolationErr struct {
+	Target core.FrozenTargetID
+	Path   string
+	Err    error
+}
+
+func (err SandboxViolationErr) Error() string {
+	return fmt.Sprintf(
+		"Sandbox violation: %s:%s accessed undeclared path %s (declare it "+
+			"as an input or allow it with --sandbox-allow): %v",
+		err.Target.Package,
+		err.Target.Target,
+		err.Path,
+		err.Err,
+	)
+}
+
+type sandboxMount struct {
+	Path     string
+	Writable bool
+}
+
+// sandboxSpec is passed from the `builder` process to its sandboxed child,
+// which sets up the mounts and then execs the command.
+type sandboxSpec struct {
+	Root    string
+	Dir     string
+	Mounts  []sandboxMount
+	Command string
+	Args    []string
+	Env     []string
+}
+
+// mounts returns the paths that the sandbox exposes for the current target,
+// ordered such that parent directories are mounted before their children.
+func (s *Sandbox) mounts(ctx *BuildContext) []sandboxMount {
+	var mounts []sandboxMount
+	for _, path := range s.AllowedPaths {
+		if _, err := os.Stat(path); err == nil {
+			mounts = append(mounts, sandboxMount{Path: path})
+		}
+	}
+	// An artifact may be referred to more than once (e.g., via several of
+	// its named outputs), but it must only be mounted once.
+	seen := map[core.ArtifactID]struct{}{}
+	for _, id := range append(
+		core.ArtifactIDs(ctx.DAG.Inputs),
+		ctx.ExtraInputs...,
+	) {
+		if _, found := seen[id]; found {
+			continue
+		}
+		seen[id] = struct{}{}
+		mounts = append(mounts, sandboxMount{Path: ctx.Cache.Path(id)})
+		if _, err := os.Stat(ctx.Cache.OutputsDir(id)); err == nil {
+			mounts = append(
+				mounts,
+				sandboxMount{Path: ctx.Cache.OutputsDir(id)},
+			)
+		}
+	}
+	mounts = append(
+		mounts,
+		sandboxMount{Path: ctx.Workspace, Writable: true},
+	)
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return len(mounts[i].Path) < len(mounts[j].Path)
+	})
+	return mounts
+}
+
+// visible reports whether `path` is reachable inside of the sandbox.
+func visible(mounts []sandboxMount, path string) bool {
+	for _, mount := range mounts {
+		if path == mount.Path ||
+			strings.HasPrefix(path, mount.Path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	for _, prefix := range []string{"/tmp", "/proc"} {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	for _, name := range sandboxDevices {
+		if path == "/dev/"+name {
+			return true
+		}
+	}
+	return false
+}
+
+var absolutePathPattern = regexp.MustCompile(`/[^\s:'"(),;]+`)
+
+// findViolation scans a failed command's output for host paths which exist
+// but which the sandbox hid from the command. This is a heuristic: a command
+// that fails because of a missing file almost always names the file in its
+// error message.
+func findViolation(mounts []sandboxMount, output []byte) (string, bool) {
+	for _, match := range absolutePathPattern.FindAll(output, -1) {
+		path := filepath.Clean(string(bytes.TrimRight(match, ".")))
+		if visible(mounts, path) {
+			continue
+		}
+		if _, err := os.Lstat(path); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// tailBuffer retains the last `size` bytes written to it.
+type tailBuffer struct {
+	size int
+	data []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	if len(b.data) > b.size {
+		b.data = b.data[len(b.data)-b.size:]
+	}
+	return len(p), nil
+}
+
+func (ctx *BuildContext) callSandboxed(
+	command string,
+	dir string,
+	env []string,
+	args ...string,
+) error {
+	mounts := Sandboxing.mounts(ctx)
+
+	// Commands that aren't paths are resolved against $PATH inside of the
+	// sandbox, but we resolve them on the host as well so that we can
+	// report a helpful error if the resolved path is hidden.
+	if !strings.Contains(command, "/") {
+		if path, err := lookPath(command, env); err == nil &&
+			!visible(mounts, path) {
+			return SandboxViolationErr{
+				Target: ctx.DAG.ID,
+				Path:   path,
+				Err:    errors.Errorf("Command '%s' not found", command),
+			}
+		}
+	}
+
+	output := &tailBuffer{size: 64 * 1024}
+	err := runSandboxed(
+		ctx.Context,
+		sandboxSpec{
+			Dir:     dir,
+			Mounts:  mounts,
+			Command: command,
+			Args:    args,
+			Env:     env,
+		},
+		ctx.Stdout,
+		ctx.Stderr,
+		output,
+	)
+	if err != nil {
+		if path, found := findViolation(mounts, output.data); found {
+			return SandboxViolationErr{
+				Target: ctx.DAG.ID,
+				Path:   path,
+				Err:    err,
+			}
+		}
+	}
+	return err
+}
+
+// lookPath resolves `command` against the PATH in `env`.
+func lookPath(command string, env []string) (string, error) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], "PATH=") {
+			for _, dir := range filepath.SplitList(env[i][len("PATH="):]) {
+				path := filepath.Join(dir, command)
+				if info, err := os.Stat(path); err == nil &&
+					!info.IsDir() &&
+					info.Mode()&0111 != 0 {
+					return path, nil
+				}
+			}
+			break
+		}
+	}
+	return "", errors.Errorf("Command '%s' not found", command)
+}
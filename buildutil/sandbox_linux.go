@@ -0,0 +1,312 @@
+//go:build linux
+// +build linux
+
+package buildutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// runSandboxed re-executes `builder` in new user and mount namespaces. The
+// child reads `spec` from file descriptor 3, builds the sandbox's filesystem
+// under `spec.Root`, chroots into it, and execs the command. The command's
+// stdout and stderr are copied to `output` as well. The sandbox is killed if
+// `ctx` is done before it exits.
+func runSandboxed(
+	ctx context.Context,
+	spec sandboxSpec,
+	stdout io.Writer,
+	stderr io.Writer,
+	output io.Writer,
+) error {
+	root, err := ioutil.TempDir("", "sandbox")
+	if err != nil {
+		return errors.Wrap(err, "Creating sandbox root")
+	}
+	defer os.RemoveAll(root)
+	spec.Root = root
+
+	self, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "Locating builder executable")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(self, SandboxCommand)
+	cmd.Stdout = io.MultiWriter(stdout, output)
+	cmd.Stderr = io.MultiWriter(stderr, output)
+	cmd.ExtraFiles = []*os.File{r}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		// A new PID namespace hides the host's processes (and, with them,
+		// their roots under /proc/<pid>/root).
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWPID,
+		// Map the current user to root inside of the namespace so that the
+		// child retains the capabilities it needs to set up its mounts.
+		UidMappings: []syscall.SysProcIDMap{{
+			ContainerID: 0,
+			HostID:      os.Getuid(),
+			Size:        1,
+		}},
+		GidMappings: []syscall.SysProcIDMap{{
+			ContainerID: 0,
+			HostID:      os.Getgid(),
+			Size:        1,
+		}},
+		GidMappingsEnableSetgroups: false,
+	}
+	wait, err := startCommand(ctx, cmd)
+	if err != nil {
+		w.Close()
+		return errors.Wrap(err, "Starting sandbox")
+	}
+
+	encodeErr := json.NewEncoder(w).Encode(spec)
+	w.Close()
+	if err := wait(); err != nil {
+		return err
+	}
+	return errors.Wrap(encodeErr, "Sending sandbox spec")
+}
+
+// SandboxMain is the entrypoint for the sandboxed child process. It never
+// returns.
+func SandboxMain() {
+	if err := sandboxMain(); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(127)
+	}
+}
+
+func sandboxMain() error {
+	var spec sandboxSpec
+	if err := json.NewDecoder(os.NewFile(3, "spec")).Decode(
+		&spec,
+	); err != nil {
+		return errors.Wrap(err, "Reading sandbox spec")
+	}
+
+	// Keep our mounts from propagating back to the host.
+	if err := syscall.Mount(
+		"",
+		"/",
+		"",
+		syscall.MS_REC|syscall.MS_PRIVATE,
+		"",
+	); err != nil {
+		return errors.Wrap(err, "Making mounts private")
+	}
+
+	if err := syscall.Mount(
+		"tmpfs",
+		spec.Root,
+		"tmpfs",
+		0,
+		"",
+	); err != nil {
+		return errors.Wrap(err, "Mounting sandbox root")
+	}
+
+	// The host's /proc would expose the host's filesystem via the roots of
+	// its processes, so the sandbox gets its own, which only shows the
+	// processes in the sandbox's PID namespace.
+	proc := filepath.Join(spec.Root, "proc")
+	if err := os.MkdirAll(proc, 0555); err != nil {
+		return err
+	}
+	if err := syscall.Mount(
+		"proc",
+		proc,
+		"proc",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC,
+		"",
+	); err != nil {
+		return errors.Wrap(err, "Mounting /proc")
+	}
+	if err := mountDev(spec.Root); err != nil {
+		return err
+	}
+	tmp := filepath.Join(spec.Root, "tmp")
+	if err := os.MkdirAll(tmp, 01777); err != nil {
+		return err
+	}
+	if err := syscall.Mount(
+		"tmpfs",
+		tmp,
+		"tmpfs",
+		0,
+		"",
+	); err != nil {
+		return errors.Wrap(err, "Mounting /tmp")
+	}
+
+	for _, mount := range spec.Mounts {
+		if err := bindMount(spec.Root, mount); err != nil {
+			return err
+		}
+	}
+
+	if err := pivotRoot(spec.Root); err != nil {
+		return err
+	}
+	if err := os.Chdir(spec.Dir); err != nil {
+		return errors.Wrap(err, "Changing to working directory")
+	}
+
+	command := spec.Command
+	if !filepath.IsAbs(command) {
+		os.Setenv("PATH", "")
+		for _, kv := range spec.Env {
+			if strings.HasPrefix(kv, "PATH=") {
+				os.Setenv("PATH", kv[len("PATH="):])
+			}
+		}
+		path, err := exec.LookPath(command)
+		if err != nil {
+			return err
+		}
+		command = path
+	}
+
+	return syscall.Exec(
+		command,
+		append([]string{spec.Command}, spec.Args...),
+		spec.Env,
+	)
+}
+
+// mountDev creates a minimal, read-only /dev under `root` which contains only
+// the `sandboxDevices` (bind-mounted from the host, since device nodes can't
+// be created in a user namespace) and the usual links to /proc/self/fd.
+func mountDev(root string) error {
+	dev := filepath.Join(root, "dev")
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(
+		"tmpfs",
+		dev,
+		"tmpfs",
+		syscall.MS_NOSUID|syscall.MS_NOEXEC,
+		"mode=755",
+	); err != nil {
+		return errors.Wrap(err, "Mounting /dev")
+	}
+	for _, name := range sandboxDevices {
+		path := filepath.Join("/dev", name)
+		if _, err := os.Stat(path); err != nil {
+			// E.g., /dev/tty doesn't exist in some containers.
+			continue
+		}
+		if err := bindMount(
+			root,
+			sandboxMount{Path: path, Writable: true},
+		); err != nil {
+			return err
+		}
+	}
+	for name, target := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount(
+		"",
+		dev,
+		"",
+		syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|
+			syscall.MS_NOEXEC,
+		"",
+	); err != nil {
+		return errors.Wrap(err, "Making /dev read-only")
+	}
+	return nil
+}
+
+// pivotRoot makes `root` (which must be a mount point) the root of the
+// mount namespace and detaches the host's root, so that, unlike with a
+// chroot, there's no path by which the command can get back to it.
+func pivotRoot(root string) error {
+	if err := os.Chdir(root); err != nil {
+		return errors.Wrap(err, "Entering sandbox root")
+	}
+	// Pivoting "." onto itself stacks the old root on top of the new one,
+	// from which it can be unmounted without needing a directory for it.
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return errors.Wrap(err, "Pivoting to sandbox root")
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return errors.Wrap(err, "Unmounting host root")
+	}
+	return errors.Wrap(os.Chdir("/"), "Entering sandbox root")
+}
+
+// bindMount makes the host path `mount.Path` visible at the same path under
+// `root`. Unless the mount is writable, it's remounted read-only.
+func bindMount(root string, mount sandboxMount) error {
+	info, err := os.Stat(mount.Path)
+	if err != nil {
+		return err
+	}
+
+	target := filepath.Join(root, mount.Path)
+	if info.IsDir() {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	}
+
+	if err := syscall.Mount(
+		mount.Path,
+		target,
+		"",
+		syscall.MS_BIND|syscall.MS_REC,
+		"",
+	); err != nil {
+		return errors.Wrapf(err, "Mounting %s", mount.Path)
+	}
+
+	if !mount.Writable {
+		if err := syscall.Mount(
+			"",
+			target,
+			"",
+			syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|
+				syscall.MS_NOSUID|syscall.MS_NODEV,
+			"",
+		); err != nil {
+			return errors.Wrapf(err, "Making %s read-only", mount.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+//go:build linux
+// +build linux
+
+package buildutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/weberc2/builder/core"
+)
+
+// TestMain lets the test binary stand in for `builder` when it re-executes
+// itself inside of a sandbox.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == SandboxCommand {
+		SandboxMain()
+	}
+	os.Exit(m.Run())
+}
+
+func TestCallSandboxed(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	cache := core.NewLocalCache("workspace", filepath.Join(dir, "cache"))
+	workspace := filepath.Join(dir, "workspace")
+	if err := os.Mkdir(workspace, 0755); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	input := core.ArtifactID{
+		Package:  "pkg",
+		Target:   "input",
+		Checksum: core.ChecksumString("input"),
+	}
+	if err := cache.Write(input, func(w io.Writer) error {
+		_, err := io.WriteString(w, "declared")
+		return err
+	}); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	// The sandbox has a private /tmp, so the undeclared file must live
+	// elsewhere on the host to be hidden.
+	hidden, err := ioutil.TempDir(".", ".sandbox-test-")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer os.RemoveAll(hidden)
+	undeclared, err := filepath.Abs(filepath.Join(hidden, "undeclared"))
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if visible(nil, undeclared) {
+		t.Skipf("%s is visible in every sandbox", undeclared)
+	}
+	err = ioutil.WriteFile(undeclared, []byte("undeclared"), 0644)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	Sandboxing = &Sandbox{AllowedPaths: DefaultSandboxPaths}
+	defer func() { Sandboxing = nil }()
+	var stdout, stderr bytes.Buffer
+	ctx := &BuildContext{
+		Context: context.Background(),
+		DAG: core.DAG{FrozenTarget: core.FrozenTarget{
+			ID: core.FrozenTargetID{
+				Package:  "pkg",
+				Target:   "target",
+				Checksum: core.ChecksumString("target"),
+			},
+			Inputs: core.FrozenObject{{Key: "input", Value: input}},
+		}},
+		Cache:     cache,
+		Stdout:    &stdout,
+		Stderr:    &stderr,
+		Workspace: workspace,
+	}
+	env := []string{"PATH=/usr/bin:/bin"}
+	if err := ctx.Call("true", workspace, env); err != nil {
+		t.Skipf("Sandboxing is unavailable: %v: %s", err, stderr.String())
+	}
+
+	if err := ctx.Call("cat", workspace, env, cache.Path(input)); err != nil {
+		t.Fatalf("Unexpected err: %v: %s", err, stderr.String())
+	}
+	if stdout.String() != "declared" {
+		t.Fatalf("Wanted 'declared'; got '%s'", stdout.String())
+	}
+
+	// The host's filesystem can't be reached via the roots of the host's
+	// processes in /proc, which aren't even listed there.
+	stdout.Reset()
+	if err := ctx.Call(
+		"sh",
+		workspace,
+		env,
+		"-c",
+		"cat /proc/*/root"+undeclared,
+	); err == nil || strings.Contains(stdout.String(), "undeclared") {
+		t.Fatalf("Read %s via /proc: %v: %s", undeclared, err, stdout.String())
+	}
+	if err := ctx.Call(
+		"test",
+		workspace,
+		env,
+		"!",
+		"-e",
+		fmt.Sprintf("/proc/%d", os.Getpid()),
+	); err != nil {
+		t.Fatalf("Host process %d is visible in the sandbox", os.Getpid())
+	}
+
+	// Nor can it be reached by escaping a nested chroot, since the host's
+	// root isn't mounted in the sandbox at all.
+	if _, err := exec.LookPath("perl"); err == nil {
+		stdout.Reset()
+		if err := ctx.Call(
+			"perl",
+			workspace,
+			env,
+			"-e",
+			`mkdir "/tmp/jail"; chroot("/tmp/jail") or die "chroot: $!"; `+
+				`chdir("../../../../../../..") or die "chdir: $!"; `+
+				`chroot(".") or die "chroot: $!"; exec("cat", $ARGV[0]);`,
+			undeclared,
+		); err == nil || strings.Contains(stdout.String(), "undeclared") {
+			t.Fatalf(
+				"Read %s by escaping a chroot: %v: %s",
+				undeclared,
+				err,
+				stdout.String(),
+			)
+		}
+	}
+
+	// Only a few devices exist, but those can be used.
+	if err := ctx.Call(
+		"sh",
+		workspace,
+		env,
+		"-c",
+		"echo discarded > /dev/null && test ! -e /dev/mem",
+	); err != nil {
+		t.Fatalf("Unexpected err: %v: %s", err, stderr.String())
+	}
+
+	err = ctx.Call("cat", workspace, env, undeclared)
+	violation, ok := err.(SandboxViolationErr)
+	if !ok {
+		t.Fatalf("Wanted a SandboxViolationErr; got %v", err)
+	}
+	if violation.Path != undeclared {
+		t.Fatalf(
+			"Wanted a violation for %s; got %s",
+			undeclared,
+			violation.Path,
+		)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package buildutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func runSandboxed(
+	ctx context.Context,
+	spec sandboxSpec,
+	stdout io.Writer,
+	stderr io.Writer,
+	output io.Writer,
+) error {
+	return errors.New("Sandboxing is only supported on Linux")
+}
+
+// SandboxMain is the entrypoint for the sandboxed child process. It never
+// returns.
+func SandboxMain() {
+	fmt.Fprintln(os.Stderr, "sandbox: Sandboxing is only supported on Linux")
+	os.Exit(127)
+}
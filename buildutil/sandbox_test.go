@@ -0,0 +1,185 @@
+package buildutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/weberc2/builder/core"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestVisible(t *testing.T) {
+	mounts := []sandboxMount{
+		{Path: "/usr"},
+		{Path: "/cache/pkg/targets/a/abc"},
+		{Path: "/workspace", Writable: true},
+	}
+	for _, c := range []struct {
+		path    string
+		visible bool
+	}{
+		{path: "/usr", visible: true},
+		{path: "/usr/bin/python3", visible: true},
+		{path: "/usrlocal", visible: false},
+		{path: "/cache/pkg/targets/a/abc/lib.py", visible: true},
+		{path: "/cache/pkg/targets/a/abcd", visible: false},
+		{path: "/cache/pkg/targets/a", visible: false},
+		{path: "/workspace/output", visible: true},
+		{path: "/tmp/scratch", visible: true},
+		{path: "/dev/null", visible: true},
+		{path: "/dev/sda", visible: false},
+		{path: "/proc/self/exe", visible: true},
+		{path: "/tmpfoo", visible: false},
+		{path: "/etc/passwd", visible: false},
+	} {
+		if got := visible(mounts, c.path); got != c.visible {
+			t.Errorf(
+				"visible(%s): wanted %v; got %v",
+				c.path,
+				c.visible,
+				got,
+			)
+		}
+	}
+}
+
+func TestFindViolation(t *testing.T) {
+	// Host paths beneath /tmp are always "visible" (the sandbox has its own
+	// /tmp), so the hidden path must live elsewhere.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if visible(nil, wd) {
+		t.Skipf("%s is visible in every sandbox", wd)
+	}
+
+	output := []byte(
+		"python3: can't open file '/nonexistent/main.py': No such file\n" +
+			"cat: " + wd + ": Permission denied.\n",
+	)
+	path, found := findViolation([]sandboxMount{{Path: "/usr"}}, output)
+	if !found || path != wd {
+		t.Fatalf("Wanted (%s, true); got (%s, %v)", wd, path, found)
+	}
+
+	// Paths which were mounted aren't violations.
+	mounts := []sandboxMount{{Path: filepath.Dir(wd)}}
+	if path, found := findViolation(mounts, output); found {
+		t.Fatalf("Wanted no violation; got %s", path)
+	}
+}
+
+func TestLookPath(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	for name, mode := range map[string]os.FileMode{
+		"tool": 0755,
+		"data": 0644,
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, mode); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0755); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	// The last PATH in the environment wins, as it does for exec.
+	env := []string{
+		"PATH=/nonexistent",
+		"HOME=/",
+		"PATH=/nonexistent:" + dir,
+	}
+	path, err := lookPath("tool", env)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if wanted := filepath.Join(dir, "tool"); path != wanted {
+		t.Fatalf("Wanted %s; got %s", wanted, path)
+	}
+
+	for _, command := range []string{"data", "subdir", "missing"} {
+		if path, err := lookPath(command, env); err == nil {
+			t.Errorf("%s: Wanted an error; got %s", command, path)
+		}
+	}
+	path, err = lookPath("tool", []string{"PATH=/nonexistent"})
+	if err == nil {
+		t.Errorf("Wanted an error; got %s", path)
+	}
+}
+
+func TestSandbox_mounts(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	cache := core.NewLocalCache("workspace", filepath.Join(dir, "cache"))
+	id := func(target core.TargetName) core.ArtifactID {
+		return core.ArtifactID{
+			Package:  "pkg",
+			Target:   target,
+			Checksum: core.ChecksumString(string(target)),
+		}
+	}
+	lib, sources, extra := id("lib"), id(""), id("extra")
+
+	// Only the outputs directories which exist are mounted.
+	if err := os.MkdirAll(cache.OutputsDir(lib), 0755); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	sandbox := Sandbox{AllowedPaths: []string{dir, "/nonexistent"}}
+	mounts := sandbox.mounts(&BuildContext{
+		DAG: core.DAG{FrozenTarget: core.FrozenTarget{
+			ID: core.FrozenTargetID(id("bin")),
+			Inputs: core.FrozenObject{
+				{Key: "lib", Value: lib},
+				{
+					Key:   "docs",
+					Value: core.OutputID{Artifact: lib, Output: "docs"},
+				},
+				{Key: "sources", Value: sources},
+			},
+		}},
+		Cache:       cache,
+		Workspace:   filepath.Join(dir, "workspace"),
+		ExtraInputs: []core.ArtifactID{extra},
+	})
+
+	wanted := []sandboxMount{
+		{Path: dir},
+		{Path: filepath.Join(dir, "workspace"), Writable: true},
+		{Path: cache.Path(sources)},
+		{Path: cache.Path(lib)},
+		{Path: cache.Path(extra)},
+		{Path: cache.OutputsDir(lib)},
+	}
+	if !reflect.DeepEqual(mounts, wanted) {
+		t.Fatalf("Wanted %v; got %v", wanted, mounts)
+	}
+
+	// Parents are mounted before their children.
+	for i := range mounts {
+		for _, later := range mounts[i+1:] {
+			if strings.HasPrefix(mounts[i].Path, later.Path+"/") {
+				t.Fatalf(
+					"%s is mounted after %s",
+					later.Path,
+					mounts[i].Path,
+				)
+			}
+		}
+	}
+}
@@ -1,9 +1,9 @@
 package buildutil
 
 import (
+	"context"
 	"encoding/base64"
 	"io"
-	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/exec"
@@ -15,40 +15,137 @@ import (
 )
 
 type BuildContext struct {
+	// Context is cancelled when the build is interrupted or the target
+	// times out, at which point commands run via Call() are killed.
+	Context context.Context
+
 	DAG       core.DAG
-	Cache     core.Cache
+	Cache     core.LocalCache
 	Stdout    io.Writer
 	Stderr    io.Writer
 	Workspace string
 	Output    string
+
+	// Providers are the providers that the build script returns. They're
+	// stored in the cache alongside the artifact.
+	Providers core.Providers
+
+	// ExtraInputs are artifacts besides the target's inputs which sandboxed
+	// commands may read, e.g., the files in the providers of the inputs.
+	ExtraInputs []core.ArtifactID
+
+	// outputs maps the names of the target's named outputs to their
+	// locations in the workspace.
+	outputs map[string]string
+}
+
+// NamedOutput returns the location in the workspace to which the build script
+// should write the named output `name`. Build() moves each named output that
+// exists into the cache alongside the artifact; outputs which weren't written
+// are skipped (targets which depend on them fail instead).
+func (ctx *BuildContext) NamedOutput(name string) (string, error) {
+	if err := core.ValidateOutputName(name); err != nil {
+		return "", err
+	}
+	if path, found := ctx.outputs[name]; found {
+		return path, nil
+	}
+	dir := filepath.Join(ctx.Workspace, ".outputs")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrap(err, "Creating outputs dir")
+	}
+	if ctx.outputs == nil {
+		ctx.outputs = map[string]string{}
+	}
+	ctx.outputs[name] = filepath.Join(dir, name)
+	return ctx.outputs[name], nil
+}
+
+// moveOutputs moves the named outputs which the build script wrote into the
+// cache.
+func (ctx *BuildContext) moveOutputs() error {
+	if len(ctx.outputs) < 1 {
+		return nil
+	}
+	dir := ctx.Cache.OutputsDir(ctx.DAG.ID.ArtifactID())
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrap(err, "Removing stale outputs")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "Creating outputs dir in cache")
+	}
+	for name, path := range ctx.outputs {
+		err := os.Rename(path, filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Moving output %s into cache", name)
+		}
+	}
+	return nil
 }
 
+// Call runs a command, killing it and any processes it started if the build's
+// context is done before it exits.
 func (ctx *BuildContext) Call(
 	command string,
 	dir string,
 	env []string,
 	args ...string,
 ) error {
+	if Sandboxing != nil {
+		return ctx.callSandboxed(command, dir, env, args...)
+	}
+
 	cmd := exec.Command(command, args...)
 	cmd.Stdout = ctx.Stdout
 	cmd.Stderr = ctx.Stderr
 	cmd.Dir = dir
 	cmd.Env = env
-	return cmd.Run()
+	wait, err := startCommand(ctx.Context, cmd)
+	if err != nil {
+		return err
+	}
+	return wait()
 }
 
+// waitCommand returns a function which waits for the started command `cmd`
+// to exit, calling `kill` if `ctx` is done first.
+func waitCommand(ctx context.Context, cmd *exec.Cmd, kill func()) func() error {
+	return func() error {
+		exited := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				kill()
+			case <-exited:
+			}
+		}()
+		err := cmd.Wait()
+		close(exited)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+}
+
+// Build runs `script` in a temporary workspace, which is removed afterwards
+// (including if the build fails or is cancelled), and moves the artifact,
+// named outputs, and providers which it wrote into the cache.
 func Build(
+	ctx context.Context,
 	dag core.DAG,
-	cache core.Cache,
+	cache core.LocalCache,
 	stdout io.Writer,
 	stderr io.Writer,
 	script func(*BuildContext) error,
 ) error {
-	workspace, err := ioutil.TempDir("", "")
+	// The workspace is staged in the cache so that the artifact and its
+	// outputs can be renamed into place.
+	workspace, err := cache.MkdirTemp()
 	if err != nil {
 		return errors.Wrap(err, "Creating temp dir")
 	}
-	defer os.Remove(workspace)
+	defer os.RemoveAll(workspace)
 
 	data := make([]byte, 16)
 	rand.Seed(time.Now().UnixNano())
@@ -58,17 +155,28 @@ func Build(
 		base64.RawURLEncoding.EncodeToString(data),
 	)
 
-	if err := script(&BuildContext{
+	buildCtx := BuildContext{
+		Context:   ctx,
 		DAG:       dag,
 		Cache:     cache,
 		Stdout:    stdout,
 		Stderr:    stderr,
 		Workspace: workspace,
 		Output:    output,
-	}); err != nil {
+	}
+	if err := script(&buildCtx); err != nil {
 		return errors.Wrap(err, "Running build script")
 	}
 
+	if buildCtx.Providers != nil {
+		if err := cache.WriteProviders(
+			dag.ID.ArtifactID(),
+			buildCtx.Providers,
+		); err != nil {
+			return errors.Wrap(err, "Writing providers")
+		}
+	}
+
 	if err := os.MkdirAll(
 		filepath.Dir(cache.Path(dag.ID.ArtifactID())),
 		0700,
@@ -76,14 +184,14 @@ func Build(
 		return errors.Wrap(err, "Creating artifact's parent dir in cache")
 	}
 
-	if err := os.Rename(
-		filepath.Join(output),
-		cache.Path(dag.ID.ArtifactID()),
-	); err != nil {
-		if os.IsNotExist(err) {
-			return errors.Errorf("Build script failed to create artifact")
-		}
-		return errors.Wrap(err, "Moving artifact into cache")
+	if err := buildCtx.moveOutputs(); err != nil {
+		return err
 	}
-	return nil
+
+	// The artifact is moved last, since that marks it (along with its
+	// providers and outputs) complete.
+	if _, err := os.Lstat(output); os.IsNotExist(err) {
+		return errors.Errorf("Build script failed to create artifact")
+	}
+	return cache.Move(output, dag.ID.ArtifactID())
 }
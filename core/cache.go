@@ -1,11 +1,11 @@
 package core
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"path"
 	"path/filepath"
 
 	"github.com/pkg/errors"
@@ -13,25 +13,176 @@ import (
 
 var ErrArtifactNotFound = errors.New("Artifact not found")
 
-type Cache func(id ArtifactID) string
+// ErrLocked is returned by TryLockFile() if another process (or caller) holds
+// the lock.
+var ErrLocked = errors.New("Locked by another process")
 
-func (c Cache) Exists(id ArtifactID) error {
-	if _, err := os.Stat(c(id)); err != nil {
-		if os.IsNotExist(err) {
-			return ErrArtifactNotFound
-		}
+// Cache is a store of build artifacts, addressed by artifact ID. An artifact
+// is either a single file or a directory tree.
+type Cache interface {
+	// Exists returns nil if the artifact is in the cache and
+	// ErrArtifactNotFound if it isn't. Any other error indicates that the
+	// cache couldn't be queried.
+	Exists(id ArtifactID) error
+
+	// Read calls `f` with the contents of a file artifact.
+	Read(id ArtifactID, f func(r io.Reader) error) error
+
+	// Write stores the data written by `f` as a file artifact. The artifact
+	// only appears in the cache once `f` succeeds.
+	Write(id ArtifactID, f func(w io.Writer) error) error
+
+	// TempDir provisions a temporary directory for the callback `f`. This
+	// manages cleaning up the temporary directory when `f` finishes. If `f`
+	// succeeds, it will return a path relative to the temporary directory
+	// that should be moved into the cache (the first return argument) and an
+	// artifact ID that is the address in the cache where the relative path
+	// should be moved. If `f` fails, the temporary directory is cleaned up
+	// and nothing is moved into the cache.
+	TempDir(f func(dir string) (string, ArtifactID, error)) (ArtifactID, error)
+}
+
+// RemoteCache is a cache which is shared between machines. Artifacts are
+// pulled from it into a local cache before they're used, and pushed to it
+// from a local cache after they're built.
+type RemoteCache interface {
+	Cache
+
+	// Pull copies the artifact from the remote cache into `dst`.
+	Pull(id ArtifactID, dst LocalCache) error
+
+	// Push copies the artifact from `src` into the remote cache.
+	Push(id ArtifactID, src LocalCache) error
+}
+
+// artifactPath returns the location of an artifact relative to the root of a
+// cache. Local caches store artifacts at this path on disk and remote caches
+// serve them at this path.
+func artifactPath(workspaceID string, id ArtifactID) string {
+	if id.Target == "" {
+		return path.Join(
+			workspaceID,
+			"packages",
+			string(id.Package),
+			"filegroups",
+			id.Checksum.String(),
+		)
+	}
+	if id.Package == "" {
+		id.Package = "__ROOT__"
+	}
+	return path.Join(
+		workspaceID,
+		"packages",
+		string(id.Package),
+		"targets",
+		string(id.Target),
+		id.Checksum.String(),
+	)
+}
+
+// completeSuffix names the empty companion file which marks an artifact as
+// complete. Artifacts (and their companions) are written to temporary files
+// and renamed into place, and the marker is only created once the artifact
+// and its companions are all in place, so an artifact which was interrupted
+// by a crash is never mistaken for a cache hit. Artifacts written by older
+// versions of builder have no marker, so they're rebuilt (and replaced) once.
+//
+// lockSuffix names the companion file which is locked (see LockFile()) while
+// the artifact is being written, so that builder processes which share a
+// cache wait for one another instead of writing the same artifact at once.
+const (
+	completeSuffix = ".complete"
+	lockSuffix     = ".lock"
+)
+
+// isComplete returns true if the artifact at `path` has been completely
+// written.
+func isComplete(path string) (bool, error) {
+	_, err := os.Stat(path + completeSuffix)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// commit replaces the artifact at `dst` with the file or directory at `src`,
+// which must be on the same filesystem, and then marks it complete. The
+// caller must hold the artifact's lock.
+func commit(src, dst string) error {
+	if err := os.Remove(dst + completeSuffix); err != nil &&
+		!os.IsNotExist(err) {
+		return errors.Wrap(err, "Removing completion marker")
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return errors.Wrap(err, "Removing incomplete artifact")
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return errors.Wrap(err, "Moving artifact into place")
+	}
+	file, err := os.Create(dst + completeSuffix)
+	if err != nil {
+		return errors.Wrap(err, "Creating completion marker")
+	}
+	return errors.Wrap(file.Close(), "Creating completion marker")
+}
+
+// LocalCache is a cache on the local filesystem. Artifacts are stored at
+// paths named by the hex encoding of their SHA-256 checksums. Caches written
+// by older versions of builder named artifacts by decimal adler32 checksums;
+// those entries can never collide with the new names, so they coexist in the
+// same directory until they're removed by garbage collection.
+type LocalCache struct {
+	Directory   string
+	WorkspaceID string
+}
+
+func NewLocalCache(workspaceID, directory string) LocalCache {
+	return LocalCache{Directory: directory, WorkspaceID: workspaceID}
+}
+
+func (c LocalCache) Path(id ArtifactID) string {
+	return filepath.Join(
+		c.Directory,
+		filepath.FromSlash(artifactPath(c.WorkspaceID, id)),
+	)
+}
+
+// Exists checks whether the artifact is in the cache. Artifacts which
+// weren't completely written aren't. Hits are recorded as uses of the
+// artifact for the purposes of garbage collection.
+func (c LocalCache) Exists(id ArtifactID) error {
+	path := c.Path(id)
+	complete, err := isComplete(path)
+	if err != nil {
 		return err
 	}
+	if !complete {
+		return ErrArtifactNotFound
+	}
+	touch(path)
 	return nil
 }
 
-func (c Cache) Path(id ArtifactID) string { return c(id) }
+// Contains is like Exists(), but it doesn't record a use of the artifact,
+// so merely inspecting the cache doesn't keep artifacts from being garbage
+// collected.
+func (c LocalCache) Contains(id ArtifactID) (bool, error) {
+	return isComplete(c.Path(id))
+}
 
-func (c Cache) Open(id ArtifactID) (*os.File, error) {
-	return os.Open(c(id))
+// Lock acquires the artifact's lock, waiting for any other builder process
+// which holds it (e.g., because it's building the same target) until `ctx`
+// is done. The returned function releases the lock.
+func (c LocalCache) Lock(ctx context.Context, id ArtifactID) (func(), error) {
+	return LockFile(ctx, c.Path(id)+lockSuffix)
 }
 
-func (c Cache) Read(id ArtifactID, f func(r io.Reader) error) error {
+func (c LocalCache) Open(id ArtifactID) (*os.File, error) {
+	return os.Open(c.Path(id))
+}
+
+func (c LocalCache) Read(id ArtifactID, f func(r io.Reader) error) error {
 	file, err := c.Open(id)
 	if err != nil {
 		return err
@@ -41,35 +192,72 @@ func (c Cache) Read(id ArtifactID, f func(r io.Reader) error) error {
 	return f(file)
 }
 
-func (c Cache) Write(id ArtifactID, f func(w io.Writer) error) error {
-	if err := os.MkdirAll(filepath.Dir(c.Path(id)), 0755); err != nil {
+// Write writes the artifact to a temporary file next to its location in the
+// cache, which is renamed into place once `f` succeeds.
+func (c LocalCache) Write(id ArtifactID, f func(w io.Writer) error) error {
+	path := c.Path(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return err
 	}
 
-	file, err := os.Create(c.Path(id))
+	file, err := ioutil.TempFile(
+		filepath.Dir(path),
+		filepath.Base(path)+".tmp-",
+	)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			log.Printf("ERROR closing file %v", err)
-		}
-	}()
+	defer os.Remove(file.Name())
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		return err
+	}
+	if err := f(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return commit(file.Name(), path)
+}
 
-	return f(file)
+// MkdirTemp creates a new temporary directory in the cache's staging area,
+// which is on the same filesystem as the artifacts, so that whatever is
+// written to it can be renamed into the cache (see Move()). The caller must
+// remove the directory.
+func (c LocalCache) MkdirTemp() (string, error) {
+	staging, err := c.stagingDir()
+	if err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(staging, "")
 }
 
-func withTempDir(f func(dir string) error) error {
-	dir, err := ioutil.TempDir("", "")
+// stagingDir returns the cache's staging area, creating it if necessary. It's
+// outside of the `packages` tree, so it's never mistaken for artifacts.
+func (c LocalCache) stagingDir() (string, error) {
+	staging := filepath.Join(c.Directory, c.WorkspaceID, "tmp")
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return "", errors.Wrap(err, "Creating cache staging directory")
+	}
+	return staging, nil
+}
+
+// withTempDir calls `f` with a new temporary directory beneath `parent` (or
+// beneath the system's temporary directory if `parent` is empty).
+func withTempDir(parent string, f func(dir string) error) error {
+	dir, err := ioutil.TempDir(parent, "")
 	if err != nil {
 		return err
 	}
 
 	if err := f(dir); err != nil {
+		os.RemoveAll(dir)
 		return err
 	}
 
-	if err := os.Remove(dir); err != nil {
+	if err := os.RemoveAll(dir); err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
@@ -80,17 +268,16 @@ func withTempDir(f func(dir string) error) error {
 	return nil
 }
 
-// TempDir provisions a temporary directory for the callback `f`. This manages
-// cleaning up the temporary directory when `f` finishes. If `f` succeeds, it
-// will return a path relative to the temporary directory that should be moved
-// into the cache (the first return argument) and an artifact ID that is the
-// address in the cache where the relative path should be moved. If `f` fails,
-// the temporary directory is cleaned up and nothing is moved into the cache.
-func (c Cache) TempDir(
+func (c LocalCache) TempDir(
 	f func(dir string) (string, ArtifactID, error),
 ) (ArtifactID, error) {
+	staging, err := c.stagingDir()
+	if err != nil {
+		return ArtifactID{}, err
+	}
+
 	var aid ArtifactID
-	err := withTempDir(func(dir string) error {
+	err = withTempDir(staging, func(dir string) error {
 		relpath, id, err := f(dir)
 		if err != nil {
 			if removeErr := os.RemoveAll(dir); removeErr != nil {
@@ -103,55 +290,24 @@ func (c Cache) TempDir(
 			return err
 		}
 		aid = id
-		cachePath := c.Path(id)
-		cacheParentDir := filepath.Dir(cachePath)
-		if err := os.MkdirAll(cacheParentDir, 0755); err != nil {
-			return errors.Wrapf(
-				err,
-				"Creating parent directory '%s' in cache",
-				cacheParentDir,
-			)
-		}
-
-		if err := os.RemoveAll(cachePath); err != nil {
-			return errors.Wrap(err, "Removing old cache directory")
-		}
-
-		if err := os.Rename(
-			filepath.Join(dir, relpath),
-			cachePath,
-		); err != nil {
-			return errors.Wrap(err, "Moving temporary directory into cache")
-		}
-
-		return nil
+		return c.Move(filepath.Join(dir, relpath), id)
 	})
 	return aid, err
 }
 
-func LocalCache(workspaceID, directory string) Cache {
-	return func(id ArtifactID) string {
-		if id.Target == "" {
-			return filepath.Join(
-				directory,
-				workspaceID,
-				"packages",
-				string(id.Package),
-				"filegroups",
-				fmt.Sprint(id.Checksum),
-			)
-		}
-		if id.Package == "" {
-			id.Package = "__ROOT__"
-		}
-		return filepath.Join(
-			directory,
-			workspaceID,
-			"packages",
-			string(id.Package),
-			"targets",
-			string(id.Target),
-			fmt.Sprint(id.Checksum),
+// Move renames the file or directory at `src` into the cache at `id`,
+// replacing any incomplete artifact, and marks the artifact complete. Any
+// companions of the artifact (e.g., its providers) must be written first.
+func (c LocalCache) Move(src string, id ArtifactID) error {
+	cachePath := c.Path(id)
+	cacheParentDir := filepath.Dir(cachePath)
+	if err := os.MkdirAll(cacheParentDir, 0755); err != nil {
+		return errors.Wrapf(
+			err,
+			"Creating parent directory '%s' in cache",
+			cacheParentDir,
 		)
 	}
+
+	return commit(src, cachePath)
 }
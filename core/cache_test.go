@@ -0,0 +1,172 @@
+package core
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestLocalCache_Write(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	id := ArtifactID{Package: "pkg", Target: "a", Checksum: ChecksumString("a")}
+
+	// A failed write leaves nothing behind.
+	if err := cache.Write(id, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("crashed")
+	}); err == nil {
+		t.Fatal("Wanted an error")
+	}
+	if err := cache.Exists(id); err != ErrArtifactNotFound {
+		t.Fatalf("Wanted ErrArtifactNotFound; got %v", err)
+	}
+	if _, err := os.Stat(cache.Path(id)); !os.IsNotExist(err) {
+		t.Fatalf("Wanted no artifact; got %v", err)
+	}
+
+	// An artifact without a completion marker (e.g., one which was being
+	// written when the machine crashed) isn't a hit, and it's replaced.
+	err := ioutil.WriteFile(cache.Path(id), []byte("partial"), 0644)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := cache.Exists(id); err != ErrArtifactNotFound {
+		t.Fatalf("Wanted ErrArtifactNotFound; got %v", err)
+	}
+	if err := cache.Write(id, func(w io.Writer) error {
+		_, err := io.WriteString(w, "complete")
+		return err
+	}); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := cache.Exists(id); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	data, err := ioutil.ReadFile(cache.Path(id))
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if string(data) != "complete" {
+		t.Fatalf("Wanted 'complete'; got '%s'", data)
+	}
+}
+
+func TestLocalCache_Lock(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	id := ArtifactID{Package: "pkg", Target: "a", Checksum: ChecksumString("a")}
+
+	unlock, err := cache.Lock(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	// Waiting for a held lock gives up when the context is done.
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		10*time.Millisecond,
+	)
+	defer cancel()
+	if _, err := cache.Lock(ctx, id); err != context.DeadlineExceeded {
+		t.Fatalf("Wanted %v; got %v", context.DeadlineExceeded, err)
+	}
+
+	unlock()
+	unlock, err = cache.Lock(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	unlock()
+}
+
+func TestLocalExecutor_ConcurrentBuilds(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	var lock sync.Mutex
+	builds := 0
+	plugin := Plugin{
+		Type: "slow",
+		BuildScript: func(
+			_ context.Context,
+			dag DAG,
+			cache LocalCache,
+			_, _ io.Writer,
+		) error {
+			lock.Lock()
+			builds++
+			lock.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			return cache.Write(dag.ID.ArtifactID(), func(w io.Writer) error {
+				_, err := io.WriteString(w, "slow")
+				return err
+			})
+		},
+	}
+	dag := leaf("a")
+	dag.BuilderType = "slow"
+
+	// Each executor stands in for a separate builder process sharing the
+	// cache; the second waits for the first and then finds the artifact.
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = LocalExecutor(
+				[]Plugin{plugin},
+				cache,
+				nil,
+				func(Event) {},
+			)(context.Background(), dag)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+	if builds != 1 {
+		t.Fatalf("Wanted the target to be built once; built %d times", builds)
+	}
+}
+
+func TestLocalCache_TempDir(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	id := ArtifactID{Package: "pkg", Target: "a", Checksum: ChecksumString("a")}
+
+	// Artifacts are staged within the cache directory so that they can be
+	// renamed into place even if the system's temp dir is another
+	// filesystem.
+	var staged string
+	if _, err := cache.TempDir(func(dir string) (string, ArtifactID, error) {
+		staged = dir
+		return "artifact", id, ioutil.WriteFile(
+			filepath.Join(dir, "artifact"),
+			[]byte("artifact"),
+			0644,
+		)
+	}); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if !strings.HasPrefix(staged, cache.Directory+string(filepath.Separator)) {
+		t.Fatalf("Wanted %s to be within %s", staged, cache.Directory)
+	}
+	if _, err := os.Stat(staged); !os.IsNotExist(err) {
+		t.Fatalf("Wanted the staging directory to be removed; got %v", err)
+	}
+	if err := cache.Exists(id); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+}
@@ -1,18 +1,180 @@
 package core
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
-	"hash/adler32"
+	"encoding/hex"
+	"hash"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Checksum is a SHA-256 digest. Checksums identify frozen targets and file
+// groups, and they name artifacts in the cache.
+type Checksum [sha256.Size]byte
+
+func (c Checksum) String() string { return hex.EncodeToString(c[:]) }
+
+// starlarkHash truncates the checksum to the 32-bit hash that starlark uses
+// for dict keys and set membership.
+func (c Checksum) starlarkHash() uint32 {
+	return binary.BigEndian.Uint32(c[:4])
+}
+
+func (c Checksum) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Checksum) UnmarshalText(data []byte) error {
+	parsed, err := ParseChecksum(string(data))
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+// ParseChecksum parses the hex representation of a checksum.
+func ParseChecksum(s string) (Checksum, error) {
+	var c Checksum
+	if hex.DecodedLen(len(s)) != len(c) {
+		return c, errors.Errorf("Invalid checksum '%s': wrong length", s)
+	}
+	if _, err := hex.Decode(c[:], []byte(s)); err != nil {
+		return c, errors.Wrapf(err, "Invalid checksum '%s'", s)
+	}
+	return c, nil
+}
+
+// Each kind of value is hashed with a distinct tag so that values of
+// different kinds never share an encoding (e.g., the string "1" and the int
+// 1, or a list of two strings and a dict with one field).
+const (
+	tagBytes byte = iota
+	tagInt
+	tagString
+	tagBool
+	tagObject
+	tagArray
+	tagFileGroup
+	tagTarget
+	tagArtifact
+	tagJoin
+	tagOutput
 )
 
-func ChecksumBytes(bs []byte) uint32 { return adler32.Checksum(bs) }
+// hasher builds an unambiguous encoding of a structured value. Variable-length
+// values are length-prefixed, so no two distinct sequences of writes produce
+// the same digest.
+type hasher struct{ h hash.Hash }
+
+func newHasher(tag byte) hasher {
+	h := hasher{sha256.New()}
+	h.h.Write([]byte{tag})
+	return h
+}
+
+func (h hasher) uint64(i uint64) hasher {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], i)
+	h.h.Write(buf[:])
+	return h
+}
+
+func (h hasher) bytes(bs []byte) hasher {
+	h.uint64(uint64(len(bs)))
+	h.h.Write(bs)
+	return h
+}
+
+func (h hasher) string(s string) hasher { return h.bytes([]byte(s)) }
+
+func (h hasher) checksum(c Checksum) hasher {
+	h.h.Write(c[:])
+	return h
+}
+
+func (h hasher) sum() Checksum {
+	var c Checksum
+	copy(c[:], h.h.Sum(nil))
+	return c
+}
+
+func ChecksumBytes(bs []byte) Checksum {
+	return newHasher(tagBytes).bytes(bs).sum()
+}
+
+func ChecksumString(s string) Checksum { return ChecksumBytes([]byte(s)) }
+
+// ChecksumReader computes the same checksum as ChecksumBytes for the `size`
+// bytes read from `r` without holding them in memory. It's an error if `r`
+// yields more or fewer than `size` bytes.
+func ChecksumReader(r io.Reader, size int64) (Checksum, error) {
+	h := newHasher(tagBytes).uint64(uint64(size))
+	n, err := io.Copy(h.h, io.LimitReader(r, size+1))
+	if err != nil {
+		return Checksum{}, err
+	}
+	if n != size {
+		return Checksum{}, errors.Errorf(
+			"Expected %d bytes; read %d (was it modified?)",
+			size,
+			n,
+		)
+	}
+	return h.sum(), nil
+}
+
+// JoinChecksums combines an ordered sequence of checksums into one.
+func JoinChecksums(checksums ...Checksum) Checksum {
+	h := newHasher(tagJoin).uint64(uint64(len(checksums)))
+	for _, checksum := range checksums {
+		h.checksum(checksum)
+	}
+	return h.sum()
+}
+
+// checksumFields hashes a set of key/value pairs canonically: the pairs are
+// sorted by key, so the result doesn't depend on the order in which the keys
+// were declared.
+func checksumFields(keys []string, values []Checksum) Checksum {
+	indices := make([]int, len(keys))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		return keys[indices[i]] < keys[indices[j]]
+	})
+
+	h := newHasher(tagObject).uint64(uint64(len(keys)))
+	for _, i := range indices {
+		h.string(keys[i]).checksum(values[i])
+	}
+	return h.sum()
+}
 
-func ChecksumString(s string) uint32 { return ChecksumBytes([]byte(s)) }
+func checksumArray(values []Checksum) Checksum {
+	h := newHasher(tagArray).uint64(uint64(len(values)))
+	for _, value := range values {
+		h.checksum(value)
+	}
+	return h.sum()
+}
+
+func checksumInt(i int64) Checksum {
+	return newHasher(tagInt).uint64(uint64(i)).sum()
+}
+
+func checksumString(s string) Checksum {
+	return newHasher(tagString).string(s).sum()
+}
 
-func JoinChecksums(checksums ...uint32) uint32 {
-	buf := make([]byte, len(checksums)*4)
-	for i, checksum := range checksums {
-		binary.BigEndian.PutUint32(buf[i*4:i*4+4], checksum)
+func checksumBool(b bool) Checksum {
+	var i uint64
+	if b {
+		i = 1
 	}
-	return ChecksumBytes(buf)
+	return newHasher(tagBool).uint64(i).sum()
 }
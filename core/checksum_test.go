@@ -0,0 +1,78 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChecksum_ObjectKeyOrderIndependent(t *testing.T) {
+	a := FrozenObject{
+		{Key: "foo", Value: String("bar")},
+		{Key: "baz", Value: Int(1)},
+	}
+	b := FrozenObject{
+		{Key: "baz", Value: Int(1)},
+		{Key: "foo", Value: String("bar")},
+	}
+	if a.checksum() != b.checksum() {
+		t.Fatalf("Wanted equal checksums; got %s and %s", a.checksum(), b.checksum())
+	}
+}
+
+func TestChecksum_DistinctKinds(t *testing.T) {
+	inputs := []FrozenInput{
+		String("1"),
+		Int(1),
+		Bool(true),
+		FrozenArray{String("1")},
+		FrozenArray{String("a"), String("b")},
+		FrozenObject{{Key: "a", Value: String("b")}},
+		FrozenArray{FrozenArray{String("a")}, String("b")},
+		FrozenArray{String("a"), FrozenArray{String("b")}},
+		FrozenObject{{Key: "ab", Value: String("")}},
+		FrozenObject{{Key: "a", Value: String("b")}, {Key: "", Value: String("")}},
+	}
+	seen := map[Checksum]int{}
+	for i, input := range inputs {
+		checksum := input.checksum()
+		if j, found := seen[checksum]; found {
+			t.Fatalf(
+				"Inputs %d (%v) and %d (%v) have the same checksum %s",
+				j,
+				inputs[j],
+				i,
+				input,
+				checksum,
+			)
+		}
+		seen[checksum] = i
+	}
+}
+
+func TestParseChecksum_RoundTrip(t *testing.T) {
+	checksum := ChecksumString("foo")
+	parsed, err := ParseChecksum(checksum.String())
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if parsed != checksum {
+		t.Fatalf("Wanted %s; got %s", checksum, parsed)
+	}
+}
+
+func TestChecksumReader(t *testing.T) {
+	data := "hello, world"
+	got, err := ChecksumReader(strings.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if wanted := ChecksumString(data); got != wanted {
+		t.Fatalf("Wanted %s; got %s", wanted, got)
+	}
+
+	for _, size := range []int64{5, 50} {
+		if _, err := ChecksumReader(strings.NewReader(data), size); err == nil {
+			t.Fatalf("Expected an error for size %d", size)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	sl "github.com/weberc2/builder/slutil"
@@ -50,72 +51,99 @@ func (err UnknownBuiltinModuleErr) Error() string {
 	return fmt.Sprintf("Unknown builtin module: %s", string(err))
 }
 
+// newThread returns a thread for evaluating the module `name` which knows
+// about the rules defined so far in the evaluation.
+func newThread(
+	name string,
+	rules ruleRegistry,
+	load func(th *starlark.Thread, mod string) (starlark.StringDict, error),
+) *starlark.Thread {
+	th := &starlark.Thread{Name: name, Load: load}
+	th.SetLocal(ruleRegistryKey, rules)
+	return th
+}
+
 func loadBuiltin(
 	cache map[string]*entry,
+	rules ruleRegistry,
 	builtinModules map[string]string,
 	builtin string,
 ) (starlark.StringDict, error) {
 	if script, found := builtinModules[builtin]; found {
-		return starlark.ExecFile(
-			&starlark.Thread{
-				Name: builtin,
-				Load: cacheLoad(
+		globals, err := starlark.ExecFile(
+			newThread(
+				builtin,
+				rules,
+				cacheLoad(
 					cache,
 					func(
 						th *starlark.Thread,
 						lib string,
 					) (starlark.StringDict, error) {
-						return loadBuiltin(cache, builtinModules, lib)
+						return loadBuiltin(cache, rules, builtinModules, lib)
 					},
 				),
-			},
+			),
 			"builtin://"+builtin,
 			script,
 			starlark.StringDict{
 				"mktarget": starlark.NewBuiltin("mktarget", mktarget),
+				"rule":     starlark.NewBuiltin("rule", rule),
+				"attr":     attrModule,
 			},
 		)
+		rules.exportRules(globals)
+		return globals, err
 	}
 	return nil, UnknownBuiltinModuleErr(builtin)
 }
 
 func loadPackage(
 	cache map[string]*entry,
+	rules ruleRegistry,
 	builtinModules map[string]string,
 	pkgroot string,
 	pkg string,
 ) (starlark.StringDict, error) {
-	return starlark.ExecFile(
-		&starlark.Thread{
-			Name: pkg,
-			Load: cacheLoad(
+	span := Tracing.Start("evaluate", "//"+pkg)
+	defer span.End()
+	globals, err := starlark.ExecFile(
+		newThread(
+			pkg,
+			rules,
+			cacheLoad(
 				cache,
 				func(
 					th *starlark.Thread,
 					pkg string,
 				) (starlark.StringDict, error) {
-					return load(cache, builtinModules, pkgroot, pkg)
+					return load(cache, rules, builtinModules, pkgroot, pkg)
 				},
 			),
-		},
+		),
 		filepath.Join(pkgroot, pkg, "BUILD"),
 		nil,
 		starlark.StringDict{
 			"mktarget": starlark.NewBuiltin("mktarget", mktarget),
 			"glob":     starlark.NewBuiltin("glob", glob),
+			"rule":     starlark.NewBuiltin("rule", rule),
+			"attr":     attrModule,
 		},
 	)
+	rules.exportRules(globals)
+	return globals, err
 }
 
 func load(
 	cache cache,
+	rules ruleRegistry,
 	builtinModules map[string]string,
 	pkgroot string,
 	mod string,
 ) (starlark.StringDict, error) {
-	globals, err := loadBuiltin(cache, builtinModules, mod)
+	globals, err := loadBuiltin(cache, rules, builtinModules, mod)
 	if _, ok := err.(UnknownBuiltinModuleErr); ok {
-		globals, err = loadPackage(cache, builtinModules, pkgroot, mod)
+		globals, err = loadPackage(cache, rules, builtinModules, pkgroot, mod)
 	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "Loading %s", mod)
@@ -129,14 +157,35 @@ func Evaluate(
 	packageRoot string,
 	builtinModules map[string]string,
 ) ([]Target, error) {
+	targets, _, err := evaluate(p, packageRoot, builtinModules)
+	return targets, err
+}
+
+// evaluate is like Evaluate(), but it also returns the packages whose BUILD
+// files were read, i.e., `p` and the packages which it (transitively)
+// loads. These are returned even if evaluation fails so that callers can
+// tell when a fix might have been made.
+func evaluate(
+	p PackageName,
+	packageRoot string,
+	builtinModules map[string]string,
+) ([]Target, []PackageName, error) {
+	loaded := map[string]*entry{}
 	globals, err := loadPackage(
-		map[string]*entry{},
+		loaded,
+		ruleRegistry{},
 		builtinModules,
 		packageRoot,
 		string(p),
 	)
+	packages := []PackageName{p}
+	for mod := range loaded {
+		if _, builtin := builtinModules[mod]; !builtin {
+			packages = append(packages, PackageName(mod))
+		}
+	}
 	if err != nil {
-		return nil, errors.Wrapf(err, "Loading %s", p)
+		return nil, packages, errors.Wrapf(err, "Loading %s", p)
 	}
 
 	var targets []Target
@@ -146,7 +195,7 @@ func Evaluate(
 		}
 	}
 
-	return targets, nil
+	return targets, packages, nil
 }
 
 func findKwarg(kwargs []starlark.Tuple, kw string) (starlark.Value, error) {
@@ -165,6 +214,7 @@ func mktarget(
 	kwargs []starlark.Tuple,
 ) (starlark.Value, error) {
 	t := Target{ID: TargetID{Package: PackageName(th.Name)}}
+	var inputArgs *starlark.Dict
 	err := sl.ParseArgs(
 		"mktarget",
 		sl.Args{Pos: args, Kw: kwargs},
@@ -189,6 +239,7 @@ func mktarget(
 			}, {
 				Keyword: "args",
 				Value: sl.AssertDict(func(d *starlark.Dict) error {
+					inputArgs = d
 					inputs, err := starlarkDictToObject(t.ID, d)
 					if err != nil {
 						return errors.Wrap(err, "Parsing target args")
@@ -197,9 +248,61 @@ func mktarget(
 					return nil
 				}),
 			}},
+			KwSpecs: []sl.KwSpec{{
+				Keyword: "timeout",
+				Default: starlark.None,
+				Value: func(v starlark.Value) error {
+					timeout, err := parseTimeout(v)
+					t.Timeout = timeout
+					return err
+				},
+			}},
 		},
 	)
-	return t, err
+	if err != nil {
+		return nil, err
+	}
+
+	// Targets of rule types are validated by the rule, which also emits
+	// their actions.
+	r, found, err := lookupRule(th, string(t.BuilderType))
+	if err != nil || !found {
+		return t, err
+	}
+	attrs := []starlark.Tuple{{
+		starlark.String("name"),
+		starlark.String(t.ID.Target),
+	}}
+	for _, item := range inputArgs.Items() {
+		attrs = append(attrs, item)
+	}
+	if t.Timeout > 0 {
+		attrs = append(attrs, starlark.Tuple{
+			starlark.String("timeout"),
+			starlark.String(t.Timeout.String()),
+		})
+	}
+	return starlark.Call(th, r, nil, attrs)
+}
+
+// parseTimeout parses a target's `timeout` argument, which is either None
+// (no timeout) or a duration string such as "90s" or "10m".
+func parseTimeout(v starlark.Value) (time.Duration, error) {
+	if v == starlark.None {
+		return 0, nil
+	}
+	s, ok := v.(starlark.String)
+	if !ok {
+		return 0, sl.NewTypeErr("str", v)
+	}
+	timeout, err := time.ParseDuration(string(s))
+	if err != nil {
+		return 0, errors.Wrap(err, "ValueError: Invalid value for 'timeout'")
+	}
+	if timeout <= 0 {
+		return 0, errors.New("ValueError: 'timeout' must be positive")
+	}
+	return timeout, nil
 }
 
 func starlarkValueToInput(tid TargetID, value starlark.Value) (Input, error) {
@@ -209,6 +312,8 @@ func starlarkValueToInput(tid TargetID, value starlark.Value) (Input, error) {
 		return x, nil
 	case Target:
 		return x, nil
+	case ProviderRef:
+		return x.input(), nil
 	case Input:
 		return x, nil
 	case starlark.String:
@@ -247,25 +352,32 @@ func starlarkDictToObject(tid TargetID, d *starlark.Dict) (Object, error) {
 	out := make(Object, len(keys))
 
 	for i, keyValue := range keys {
-		if key, ok := keyValue.(starlark.String); ok {
-			value, found, err := d.Get(key)
-			if err != nil {
-				return nil, err
-			}
-			if !found {
-				panic(fmt.Sprintf(
-					"starlark.Dict reports key %s but value not found",
-					key,
-				))
-			}
+		key, ok := keyValue.(starlark.String)
+		if !ok {
+			return nil, errors.Wrapf(
+				NewTypeErr("str", keyValue),
+				"Invalid dict key %s",
+				keyValue,
+			)
+		}
 
-			input, err := starlarkValueToInput(tid, value)
-			if err != nil {
-				return nil, err
-			}
+		value, found, err := d.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			panic(fmt.Sprintf(
+				"starlark.Dict reports key %s but value not found",
+				key,
+			))
+		}
 
-			out[i] = Field{Key: string(key), Value: input}
+		input, err := starlarkValueToInput(tid, value)
+		if err != nil {
+			return nil, err
 		}
+
+		out[i] = Field{Key: string(key), Value: input}
 	}
 
 	return out, nil
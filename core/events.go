@@ -0,0 +1,237 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+type EventType string
+
+const (
+	// EventTargetStarted is emitted when the executor begins processing a
+	// target, before the caches are checked.
+	EventTargetStarted EventType = "target_started"
+
+	// EventCacheHit is emitted when the target's artifact is found in the
+	// local cache or pulled from the remote cache. Event.Cache says which.
+	EventCacheHit EventType = "cache_hit"
+
+	// EventCacheMiss is emitted when the target's artifact isn't in any
+	// cache and the target is about to be built.
+	EventCacheMiss EventType = "cache_miss"
+
+	// EventStdout and EventStderr carry a chunk of the build script's output
+	// in Event.Data. Chunks aren't necessarily whole lines.
+	EventStdout EventType = "stdout"
+	EventStderr EventType = "stderr"
+
+	// EventWarning reports a non-fatal problem (e.g., failing to push an
+	// artifact to the remote cache) in Event.Error.
+	EventWarning EventType = "warning"
+
+	// EventTargetFinished is emitted when the target's artifact is available
+	// in the local cache. Event.Duration is the time since the target
+	// started.
+	EventTargetFinished EventType = "target_finished"
+
+	// EventTargetFailed is emitted when the target couldn't be built.
+	// Event.Error describes the failure and Event.Duration is the time since
+	// the target started.
+	EventTargetFailed EventType = "target_failed"
+)
+
+// Event is a single occurrence in the build of a target. Which of the
+// optional fields are set depends on the event's type.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Target   FrozenTargetID
+	Cache    string
+	Data     string
+	Duration time.Duration
+	Error    string
+}
+
+// jsonEvent is the JSON representation of an Event.
+type jsonEvent struct {
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	Package    string    `json:"package"`
+	Target     string    `json:"target"`
+	Checksum   Checksum  `json:"checksum"`
+	Cache      string    `json:"cache,omitempty"`
+	Data       string    `json:"data,omitempty"`
+	DurationNS int64     `json:"duration_ns,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonEvent{
+		Type:       e.Type,
+		Time:       e.Time,
+		Package:    string(e.Target.Package),
+		Target:     string(e.Target.Target),
+		Checksum:   e.Target.Checksum,
+		Cache:      e.Cache,
+		Data:       e.Data,
+		DurationNS: int64(e.Duration),
+		Error:      e.Error,
+	})
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var je jsonEvent
+	if err := json.Unmarshal(data, &je); err != nil {
+		return err
+	}
+	*e = Event{
+		Type: je.Type,
+		Time: je.Time,
+		Target: FrozenTargetID{
+			Package:  PackageName(je.Package),
+			Target:   TargetName(je.Target),
+			Checksum: je.Checksum,
+		},
+		Cache:    je.Cache,
+		Data:     je.Data,
+		Duration: time.Duration(je.DurationNS),
+		Error:    je.Error,
+	}
+	return nil
+}
+
+// EventSink receives build events. Targets build concurrently, so sinks must
+// be safe to call from multiple goroutines.
+type EventSink func(e Event)
+
+// MultiSink returns a sink which forwards each event to every one of `sinks`
+// in order.
+func MultiSink(sinks ...EventSink) EventSink {
+	return func(e Event) {
+		for _, sink := range sinks {
+			sink(e)
+		}
+	}
+}
+
+// JSONSink returns a sink which writes each event to `w` as a single line of
+// JSON. Write errors are logged rather than failing the build.
+func JSONSink(w io.Writer) EventSink {
+	var lock sync.Mutex
+	encoder := json.NewEncoder(w)
+	return func(e Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err := encoder.Encode(e); err != nil {
+			log.Printf("ERROR writing build event: %v", err)
+		}
+	}
+}
+
+// writePrefixed copies `r` line-by-line to `w`, prefixing each line with
+// `prefix` and coloring it with `c`.
+func writePrefixed(
+	w io.Writer,
+	prefix string,
+	c *color.Color,
+	r io.Reader,
+) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if _, err := c.Fprintf(w, "%s %s\n", prefix, scanner.Text()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// consoleOutput is the output of a single target that's building, retained
+// in case it fails.
+type consoleOutput struct {
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+}
+
+// ConsoleSink returns a sink which renders events for humans. Status lines
+// are colored and written to `stdout`. A target's build output is buffered
+// and only written (to `stderr`) if the target fails, with each line
+// prefixed by the target so it can be told apart from the output of targets
+// that are building concurrently.
+func ConsoleSink(stdout, stderr io.Writer) EventSink {
+	var lock sync.Mutex
+	outputs := map[FrozenTargetID]*consoleOutput{}
+	green := color.New(color.FgGreen)
+	yellow := color.New(color.FgYellow)
+	red := color.New(color.FgRed)
+	return func(e Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		id := e.Target.ArtifactID()
+		switch e.Type {
+		case EventCacheHit:
+			if e.Cache == "remote" {
+				green.Fprintf(stdout, "Downloaded artifact %s\n", id)
+			} else {
+				green.Fprintf(stdout, "Found artifact %s\n", id)
+			}
+		case EventCacheMiss:
+			yellow.Fprintf(stdout, "Building %s\n", id)
+			outputs[e.Target] = &consoleOutput{}
+		case EventStdout:
+			if output, found := outputs[e.Target]; found {
+				output.stdout.WriteString(e.Data)
+			}
+		case EventStderr:
+			if output, found := outputs[e.Target]; found {
+				output.stderr.WriteString(e.Data)
+			}
+		case EventWarning:
+			red.Fprintf(stdout, "WARNING: %s\n", e.Error)
+		case EventTargetFinished:
+			delete(outputs, e.Target)
+		case EventTargetFailed:
+			output, found := outputs[e.Target]
+			if !found {
+				return
+			}
+			delete(outputs, e.Target)
+			prefix := fmt.Sprintf("[%s]", e.Target)
+			if err := writePrefixed(
+				stderr,
+				prefix,
+				color.New(color.Reset),
+				&output.stdout,
+			); err != nil {
+				log.Printf("ERROR writing build output: %v", err)
+			}
+			if err := writePrefixed(
+				stderr,
+				prefix,
+				red,
+				&output.stderr,
+			); err != nil {
+				log.Printf("ERROR writing build output: %v", err)
+			}
+		}
+	}
+}
+
+// eventWriter emits each chunk written to it as an event.
+type eventWriter struct {
+	emit      func(e Event)
+	eventType EventType
+}
+
+func (w eventWriter) Write(p []byte) (int, error) {
+	w.emit(Event{Type: w.eventType, Data: string(p)})
+	return len(p), nil
+}
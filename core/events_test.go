@@ -0,0 +1,145 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func recordEvents(events *[]Event) EventSink {
+	return func(e Event) { *events = append(*events, e) }
+}
+
+func eventTypes(events []Event) []EventType {
+	types := make([]EventType, len(events))
+	for i, e := range events {
+		types[i] = e.Type
+	}
+	return types
+}
+
+func TestLocalExecutor_Events(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+
+	plugin := Plugin{
+		Type: "test",
+		BuildScript: func(
+			_ context.Context,
+			dag DAG,
+			cache LocalCache,
+			stdout io.Writer,
+			stderr io.Writer,
+		) error {
+			io.WriteString(stdout, "hello\n")
+			return cache.Write(dag.ID.ArtifactID(), func(w io.Writer) error {
+				_, err := io.WriteString(w, "artifact")
+				return err
+			})
+		},
+	}
+	dag := leaf("a")
+	dag.BuilderType = "test"
+
+	var events []Event
+	execute := LocalExecutor(
+		[]Plugin{plugin},
+		cache,
+		nil,
+		recordEvents(&events),
+	)
+	if err := execute(context.Background(), dag); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := execute(context.Background(), dag); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	wanted := []EventType{
+		EventTargetStarted,
+		EventCacheMiss,
+		EventStdout,
+		EventTargetFinished,
+		EventTargetStarted,
+		EventCacheHit,
+		EventTargetFinished,
+	}
+	if got := eventTypes(events); !equalEventTypes(wanted, got) {
+		t.Fatalf("Wanted events %v; got %v", wanted, got)
+	}
+	if events[2].Data != "hello\n" || events[2].Target != dag.ID {
+		t.Fatalf("Unexpected stdout event: %+v", events[2])
+	}
+}
+
+func TestLocalExecutor_FailedEvent(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+
+	plugin := Plugin{
+		Type: "test",
+		BuildScript: func(
+			_ context.Context,
+			dag DAG,
+			cache LocalCache,
+			stdout io.Writer,
+			stderr io.Writer,
+		) error {
+			io.WriteString(stderr, "oops\n")
+			return errors.New("failed")
+		},
+	}
+	dag := leaf("a")
+	dag.BuilderType = "test"
+
+	var events []Event
+	var console bytes.Buffer
+	if err := LocalExecutor(
+		[]Plugin{plugin},
+		cache,
+		nil,
+		MultiSink(recordEvents(&events), ConsoleSink(&console, &console)),
+	)(context.Background(), dag); err == nil {
+		t.Fatal("Expected an error; got nil")
+	}
+
+	last := events[len(events)-1]
+	if last.Type != EventTargetFailed || !strings.Contains(
+		last.Error,
+		"failed",
+	) {
+		t.Fatalf("Wanted a failure event; got %+v", last)
+	}
+	if !strings.Contains(console.String(), "oops") {
+		t.Fatalf("Wanted stderr in console output; got %q", console.String())
+	}
+
+	var decoded map[string]interface{}
+	data, err := json.Marshal(last)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if decoded["type"] != "target_failed" || decoded["target"] != "a" {
+		t.Fatalf("Unexpected JSON event: %s", data)
+	}
+}
+
+func equalEventTypes(a, b []EventType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,95 +1,515 @@
 package core
 
 import (
-	"bytes"
-	"io"
-	"os"
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
 
-	"github.com/fatih/color"
 	"github.com/pkg/errors"
 )
 
 var ErrPluginNotFound = errors.New("Plugin not found")
 
-type ExecuteFunc func(dag DAG) error
-
-func LocalExecutor(plugins []Plugin, cache Cache) ExecuteFunc {
-	return func(dag DAG) error {
-		for _, plugin := range plugins {
-			if plugin.Type == dag.BuilderType {
-				if err := cache.Exists(
-					dag.ID.ArtifactID(),
-				); err != ErrArtifactNotFound {
-					if err == nil {
-						color.Green(
-							"Found artifact %s",
-							dag.ID.ArtifactID(),
-						)
-					}
+// TimeoutErr is returned when a target's build runs for longer than its
+// timeout.
+type TimeoutErr struct {
+	Target  FrozenTargetID
+	Timeout time.Duration
+}
+
+func (err TimeoutErr) Error() string {
+	return fmt.Sprintf("Target %s timed out after %s", err.Target, err.Timeout)
+}
+
+// ExecuteFunc builds a target. Once `ctx` is done, the build should stop as
+// soon as possible (killing any processes it started) and fail.
+type ExecuteFunc func(ctx context.Context, dag DAG) error
+
+// LocalExecutor returns an ExecuteFunc which builds targets on this machine
+// using the plugin whose type matches the target's builder type. If the
+// artifact is already in the local cache, nothing is built. Otherwise, if a
+// remote cache is provided (`remote` may be nil), the artifact is pulled from
+// it if possible, and freshly built artifacts are pushed to it. The progress
+// of each target, including its build output, is reported to `events`, and
+// the build output is stored in the cache as well (see LocalCache.Logs()).
+func LocalExecutor(
+	plugins []Plugin,
+	cache LocalCache,
+	remote RemoteCache,
+	events EventSink,
+) ExecuteFunc {
+	return executor(cache, events, func(
+		ctx context.Context,
+		dag DAG,
+		span *Span,
+		emit func(e Event),
+	) error {
+		return executeLocal(ctx, plugins, cache, remote, dag, span, emit)
+	})
+}
+
+// executor returns an ExecuteFunc which reports the start and the outcome of
+// each target that `execute` processes, traces it, and records the output of
+// its build (if any) in `cache`.
+func executor(
+	cache LocalCache,
+	events EventSink,
+	execute func(
+		ctx context.Context,
+		dag DAG,
+		span *Span,
+		emit func(e Event),
+	) error,
+) ExecuteFunc {
+	return func(ctx context.Context, dag DAG) error {
+		span := Tracing.StartParallel(
+			"target",
+			fmt.Sprintf("//%s:%s", dag.ID.Package, dag.ID.Target),
+		)
+		defer span.End()
+		span.Arg("checksum", dag.ID.Checksum.String())
+
+		start := time.Now()
+		emit := recordLog(cache, dag.ID.ArtifactID(), func(e Event) {
+			e.Time = time.Now()
+			e.Target = dag.ID
+			events(e)
+		})
+		emit(Event{Type: EventTargetStarted})
+
+		if err := execute(ctx, dag, span, emit); err != nil {
+			span.Arg("error", err.Error())
+			emit(Event{
+				Type:     EventTargetFailed,
+				Duration: time.Since(start),
+				Error:    err.Error(),
+			})
+			return err
+		}
+		emit(Event{
+			Type:     EventTargetFinished,
+			Duration: time.Since(start),
+		})
+		return nil
+	}
+}
+
+func executeLocal(
+	ctx context.Context,
+	plugins []Plugin,
+	cache LocalCache,
+	remote RemoteCache,
+	dag DAG,
+	span *Span,
+	emit func(e Event),
+) error {
+	for _, plugin := range plugins {
+		if plugin.Type == dag.BuilderType {
+			return executeCached(ctx, cache, remote, dag, span, emit, func(
+				ctx context.Context,
+				_ *Span,
+			) error {
+				if err := checkOutputs(cache, dag); err != nil {
 					return err
 				}
-				color.Yellow("Building %s", dag.ID.ArtifactID())
-
-				var stdout, stderr bytes.Buffer
-				if err := plugin.BuildScript(
+				return plugin.BuildScript(
+					ctx,
 					dag,
 					cache,
-					&stdout,
-					&stderr,
-				); err != nil {
-					// If the build script failed, copy the build script's
-					// stdout and stderr to system stderr
-					if handleErr := func() error {
-						if _, err := io.Copy(os.Stderr, &stdout); err != nil {
-							return err
-						}
-
-						if _, err := color.New(color.FgRed).Fprintln(
-							os.Stderr,
-							stderr.String(),
-						); err != nil {
-							return err
-						}
-
-						return nil
-					}(); handleErr != nil {
-						err = errors.Wrapf(handleErr, "Handling '%v'", err)
-					}
-
-					return errors.Wrapf(
-						err,
-						"Building target %s",
-						dag.ID.ArtifactID(),
-					)
+					eventWriter{emit: emit, eventType: EventStdout},
+					eventWriter{emit: emit, eventType: EventStderr},
+				)
+			})
+		}
+	}
+
+	return errors.Wrapf(ErrPluginNotFound, "plugin = %s", dag.BuilderType)
+}
+
+// executeCached calls `build` to put the target's artifact into the local
+// cache unless it's already there or it can be pulled from the remote cache
+// (if any). Freshly built artifacts are pushed to the remote cache. The
+// artifact is locked while it's pulled or built, so that builder processes
+// which share the local cache build it once and wait for one another. If the
+// target has a timeout, it only bounds `build` (not waiting for the lock or
+// pulling the artifact); `build`'s context is cancelled once it elapses and
+// a TimeoutErr is returned.
+func executeCached(
+	ctx context.Context,
+	cache LocalCache,
+	remote RemoteCache,
+	dag DAG,
+	span *Span,
+	emit func(e Event),
+	build func(ctx context.Context, span *Span) error,
+) error {
+	id := dag.ID.ArtifactID()
+	found, err := lookup(cache, nil, id, span)
+	if err != nil {
+		return err
+	}
+	if found != "" {
+		emit(Event{Type: EventCacheHit, Cache: found})
+		return nil
+	}
+
+	lockSpan := span.Child("lock", "artifact lock")
+	unlock, err := cache.Lock(ctx, id)
+	lockSpan.End()
+	if err != nil {
+		return errors.Wrapf(err, "Locking artifact %s", id)
+	}
+	defer unlock()
+
+	// Another process may have put the artifact into the cache while we
+	// waited for the lock.
+	found, err = lookup(cache, remote, id, span)
+	if err != nil {
+		return err
+	}
+	if found != "" {
+		emit(Event{Type: EventCacheHit, Cache: found})
+		return nil
+	}
+
+	emit(Event{Type: EventCacheMiss})
+	buildSpan := span.Child("build", string(dag.BuilderType))
+	err = buildWithTimeout(ctx, dag, buildSpan, build)
+	buildSpan.End()
+	if err != nil {
+		if _, ok := err.(TimeoutErr); ok {
+			return err
+		}
+		return errors.Wrapf(err, "Building target %s", id)
+	}
+
+	// A failure to share the artifact shouldn't fail the build; the artifact
+	// is in the local cache regardless.
+	if remote != nil {
+		if err := remote.Push(id, cache); err != nil {
+			emit(Event{Type: EventWarning, Error: err.Error()})
+		}
+	}
+	return nil
+}
+
+// buildWithTimeout calls `build`, cancelling it once the target's timeout (if
+// any) elapses.
+func buildWithTimeout(
+	ctx context.Context,
+	dag DAG,
+	span *Span,
+	build func(ctx context.Context, span *Span) error,
+) error {
+	if dag.Timeout <= 0 {
+		return build(ctx, span)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dag.Timeout)
+	defer cancel()
+	err := build(ctx, span)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return TimeoutErr{Target: dag.ID, Timeout: dag.Timeout}
+	}
+	return err
+}
+
+// lookup checks the local cache and then the remote cache (if any) for an
+// artifact, pulling it into the local cache if it's only in the remote cache.
+// It returns which cache the artifact was found in, or "" if neither.
+func lookup(
+	cache LocalCache,
+	remote RemoteCache,
+	id ArtifactID,
+	span *Span,
+) (string, error) {
+	span = span.Child("cache", "cache lookup")
+	defer span.End()
+
+	if err := cache.Exists(id); err != ErrArtifactNotFound {
+		if err != nil {
+			return "", err
+		}
+		span.Arg("result", "local")
+		return "local", nil
+	}
+
+	if remote != nil {
+		err := remote.Pull(id, cache)
+		if err == nil {
+			span.Arg("result", "remote")
+			return "remote", nil
+		}
+		if err != ErrArtifactNotFound {
+			return "", errors.Wrapf(
+				err,
+				"Pulling artifact %s from remote cache",
+				id,
+			)
+		}
+	}
+	span.Arg("result", "miss")
+	return "", nil
+}
+
+// node is a single target in the build schedule.
+type node struct {
+	dag DAG
+
+	// The number of this node's dependencies that haven't finished building.
+	pending int
+
+	// The nodes which depend on this node.
+	dependents []*node
+
+	// The failed targets among this node's transitive dependencies, if any,
+	// because of which it won't be built.
+	blockedBy []FrozenTargetID
+}
+
+// block marks the transitive dependents of the failed node `failed` as
+// blocked by it and returns those which weren't already blocked.
+func block(failed *node) []*node {
+	var blocked []*node
+	var visit func(n *node)
+	visit = func(n *node) {
+	DEPENDENTS:
+		for _, dependent := range n.dependents {
+			for _, id := range dependent.blockedBy {
+				if id == failed.dag.ID {
+					continue DEPENDENTS
 				}
+			}
+			if len(dependent.blockedBy) < 1 {
+				blocked = append(blocked, dependent)
+			}
+			dependent.blockedBy = append(dependent.blockedBy, failed.dag.ID)
+			visit(dependent)
+		}
+	}
+	visit(failed)
+	return blocked
+}
 
-				return nil
+// schedule flattens DAGs into a set of nodes, deduplicated by frozen target
+// ID. It returns the nodes with no dependencies in the order in which they
+// were discovered (depth-first, dependencies before dependents) as well as
+// the total number of nodes.
+func schedule(dags ...DAG) ([]*node, int) {
+	var leaves []*node
+	seen := map[FrozenTargetID]*node{}
+	var visit func(dag DAG) *node
+	visit = func(dag DAG) *node {
+		if n, found := seen[dag.ID]; found {
+			return n
+		}
+		n := &node{dag: dag}
+		seen[dag.ID] = n
+
+		// A target may reference the same dependency more than once (e.g.,
+		// in two different inputs), but it should only wait on it once.
+		deps := map[FrozenTargetID]struct{}{}
+		for _, dependency := range dag.Dependencies {
+			if _, found := deps[dependency.ID]; found {
+				continue
 			}
+			deps[dependency.ID] = struct{}{}
+			dep := visit(dependency)
+			dep.dependents = append(dep.dependents, n)
+			n.pending++
 		}
+		if n.pending == 0 {
+			leaves = append(leaves, n)
+		}
+		return n
+	}
+	for _, dag := range dags {
+		visit(dag)
+	}
+	return leaves, len(seen)
+}
+
+type result struct {
+	node *node
+	err  error
+}
+
+// TargetFailure is a target which failed to build.
+type TargetFailure struct {
+	Target FrozenTargetID
+	Err    error
+}
+
+// SkippedTarget is a target which wasn't built because some of its
+// transitive dependencies failed.
+type SkippedTarget struct {
+	Target    FrozenTargetID
+	BlockedBy []FrozenTargetID
+}
+
+// BuildSummary is the outcome of each target of a build, ordered by target.
+type BuildSummary struct {
+	Succeeded []FrozenTargetID
+	Failed    []TargetFailure
+	Skipped   []SkippedTarget
+}
 
-		return errors.Wrapf(ErrPluginNotFound, "plugin = %s", dag.BuilderType)
+func (summary *BuildSummary) sort() {
+	less := func(a, b FrozenTargetID) bool {
+		return a.ArtifactID().String() < b.ArtifactID().String()
+	}
+	sort.Slice(summary.Succeeded, func(i, j int) bool {
+		return less(summary.Succeeded[i], summary.Succeeded[j])
+	})
+	sort.Slice(summary.Failed, func(i, j int) bool {
+		return less(summary.Failed[i].Target, summary.Failed[j].Target)
+	})
+	sort.Slice(summary.Skipped, func(i, j int) bool {
+		return less(summary.Skipped[i].Target, summary.Skipped[j].Target)
+	})
+	for _, skipped := range summary.Skipped {
+		sort.Slice(skipped.BlockedBy, func(i, j int) bool {
+			return less(skipped.BlockedBy[i], skipped.BlockedBy[j])
+		})
 	}
 }
 
-func Build(execute ExecuteFunc, dag DAG) error {
-	return build(execute, dag, map[FrozenTargetID]struct{}{})
+// Build executes `dags` and all of their dependencies. Targets shared between
+// DAGs are executed once. A target is only executed once all of its
+// dependencies have finished. Up to `jobs` independent targets are executed
+// concurrently; if `jobs` is less than 1, it defaults to the number of CPUs.
+// If any target fails, no further targets are started and the first error is
+// returned once the in-flight targets have finished. Likewise, once `ctx` is
+// done, no further targets are started, the in-flight targets are cancelled,
+// and the context's error is returned.
+func Build(
+	ctx context.Context,
+	execute ExecuteFunc,
+	jobs int,
+	dags ...DAG,
+) error {
+	_, err := build(ctx, execute, jobs, false, dags...)
+	return err
 }
 
+// KeepGoing is like Build(), except that a failed target only stops the
+// targets which (transitively) depend on it from being built; every other
+// target is still built. The summary reports which targets succeeded, which
+// failed, and which were skipped because of which failures. If any target
+// failed, an error is returned along with the summary. If `ctx` is done, the
+// context's error is returned and the targets which weren't built yet appear
+// nowhere in the summary.
+func KeepGoing(
+	ctx context.Context,
+	execute ExecuteFunc,
+	jobs int,
+	dags ...DAG,
+) (BuildSummary, error) {
+	summary, err := build(ctx, execute, jobs, true, dags...)
+	if err == nil || err == ctx.Err() {
+		return summary, err
+	}
+	return summary, errors.Errorf(
+		"%d target(s) failed and %d were skipped",
+		len(summary.Failed),
+		len(summary.Skipped),
+	)
+}
+
+// build implements Build() and KeepGoing(). It returns the first error (or
+// the context's error) along with the summary of the build.
 func build(
+	ctx context.Context,
 	execute ExecuteFunc,
-	dag DAG,
-	seen map[FrozenTargetID]struct{},
-) error {
-	for _, dependency := range dag.Dependencies {
-		if _, found := seen[dependency.ID]; found {
-			continue
+	jobs int,
+	keepGoing bool,
+	dags ...DAG,
+) (BuildSummary, error) {
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+
+	// The ready queue and the bookkeeping for each node are only ever
+	// touched by this goroutine; workers communicate exclusively via the
+	// `work` and `results` channels.
+	ready, remaining := schedule(dags...)
+	work := make(chan *node)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range work {
+				results <- result{node: n, err: execute(ctx, n.dag)}
+			}
+		}()
+	}
+	defer func() {
+		close(work)
+		wg.Wait()
+	}()
+
+	var summary BuildSummary
+	var skipped []*node
+	var firstErr error
+	inflight := 0
+	for remaining > 0 {
+		// Hand out as much ready work as we have idle workers for, unless
+		// something has already failed (and we aren't keeping going) or the
+		// build was cancelled.
+		for (keepGoing || firstErr == nil) && ctx.Err() == nil &&
+			len(ready) > 0 && inflight < jobs {
+			work <- ready[0]
+			ready = ready[1:]
+			inflight++
 		}
 
-		if err := build(execute, dependency, seen); err != nil {
-			return err
+		if inflight == 0 {
+			break
+		}
+
+		r := <-results
+		inflight--
+		remaining--
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			summary.Failed = append(summary.Failed, TargetFailure{
+				Target: r.node.dag.ID,
+				Err:    r.err,
+			})
+			if keepGoing {
+				// A blocked node never becomes ready, because the failed
+				// dependency never finishes.
+				blocked := block(r.node)
+				skipped = append(skipped, blocked...)
+				remaining -= len(blocked)
+			}
+			continue
+		}
+		summary.Succeeded = append(summary.Succeeded, r.node.dag.ID)
+		for _, dependent := range r.node.dependents {
+			dependent.pending--
+			if dependent.pending == 0 {
+				ready = append(ready, dependent)
+			}
 		}
-		seen[dependency.ID] = struct{}{}
 	}
 
-	return execute(dag)
+	// The failures of targets which were cancelled aren't interesting.
+	if err := ctx.Err(); err != nil {
+		firstErr = err
+	}
+	for _, n := range skipped {
+		summary.Skipped = append(summary.Skipped, SkippedTarget{
+			Target:    n.dag.ID,
+			BlockedBy: n.blockedBy,
+		})
+	}
+	summary.sort()
+	return summary, firstErr
 }
@@ -0,0 +1,281 @@
+package core
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func leaf(name string) DAG {
+	return DAG{FrozenTarget: FrozenTarget{
+		ID: FrozenTargetID{Package: "pkg", Target: TargetName(name)},
+	}}
+}
+
+func dependsOn(name string, deps ...DAG) DAG {
+	dag := leaf(name)
+	dag.Dependencies = deps
+	return dag
+}
+
+func TestBuild_DependenciesBeforeDependents(t *testing.T) {
+	a := leaf("a")
+	b := dependsOn("b", a)
+	c := dependsOn("c", a)
+	d := dependsOn("d", b, c, a)
+
+	var lock sync.Mutex
+	finished := map[TargetName]bool{}
+	counts := map[TargetName]int{}
+	if err := Build(
+		context.Background(),
+		func(_ context.Context, dag DAG) error {
+			lock.Lock()
+			defer lock.Unlock()
+			for _, dependency := range dag.Dependencies {
+				if !finished[dependency.ID.Target] {
+					return errors.Errorf(
+						"%s started before dependency %s finished",
+						dag.ID.Target,
+						dependency.ID.Target,
+					)
+				}
+			}
+			finished[dag.ID.Target] = true
+			counts[dag.ID.Target]++
+			return nil
+		},
+		4,
+		d,
+	); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	for _, target := range []TargetName{"a", "b", "c", "d"} {
+		if counts[target] != 1 {
+			t.Fatalf(
+				"Wanted %s to be executed once; was executed %d times",
+				target,
+				counts[target],
+			)
+		}
+	}
+}
+
+func TestBuild_StopsOnFailure(t *testing.T) {
+	expectedErr := errors.New("failed")
+	a := leaf("a")
+	b := dependsOn("b", a)
+
+	var executed []TargetName
+	err := Build(
+		context.Background(),
+		func(_ context.Context, dag DAG) error {
+			executed = append(executed, dag.ID.Target)
+			return expectedErr
+		},
+		1,
+		b,
+	)
+	if err != expectedErr {
+		t.Fatalf("Expected err '%v'; got '%v'", expectedErr, err)
+	}
+	if len(executed) != 1 || executed[0] != "a" {
+		t.Fatalf("Wanted only 'a' to be executed; got %v", executed)
+	}
+}
+
+func TestBuild_MultipleDAGs(t *testing.T) {
+	a := leaf("a")
+	b := dependsOn("b", a)
+	c := dependsOn("c", a)
+
+	var lock sync.Mutex
+	counts := map[TargetName]int{}
+	if err := Build(
+		context.Background(),
+		func(_ context.Context, dag DAG) error {
+			lock.Lock()
+			defer lock.Unlock()
+			counts[dag.ID.Target]++
+			return nil
+		},
+		2,
+		b,
+		c,
+	); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	for _, target := range []TargetName{"a", "b", "c"} {
+		if counts[target] != 1 {
+			t.Fatalf(
+				"Wanted %s to be executed once; was executed %d times",
+				target,
+				counts[target],
+			)
+		}
+	}
+}
+
+func TestBuild_Cancelled(t *testing.T) {
+	a := leaf("a")
+	b := dependsOn("b", a)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var executed []TargetName
+	err := Build(
+		ctx,
+		func(ctx context.Context, dag DAG) error {
+			executed = append(executed, dag.ID.Target)
+			cancel()
+			<-ctx.Done()
+			return errors.Wrap(ctx.Err(), "killed")
+		},
+		1,
+		b,
+	)
+	if err != context.Canceled {
+		t.Fatalf("Expected err '%v'; got '%v'", context.Canceled, err)
+	}
+	if len(executed) != 1 || executed[0] != "a" {
+		t.Fatalf("Wanted only 'a' to be executed; got %v", executed)
+	}
+}
+
+func TestLocalExecutor_Timeout(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	execute := LocalExecutor(
+		[]Plugin{{
+			Type: "hang",
+			BuildScript: func(
+				ctx context.Context,
+				_ DAG,
+				_ LocalCache,
+				_, _ io.Writer,
+			) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		}},
+		cache,
+		nil,
+		func(Event) {},
+	)
+	dag := leaf("a")
+	dag.BuilderType = "hang"
+	dag.Timeout = 10 * time.Millisecond
+
+	err := execute(context.Background(), dag)
+	wanted := TimeoutErr{Target: dag.ID, Timeout: dag.Timeout}
+	if err != wanted {
+		t.Fatalf("Expected err '%v'; got '%v'", wanted, err)
+	}
+}
+
+func TestLocalExecutor_TimeoutExcludesLockWait(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	execute := LocalExecutor(
+		[]Plugin{{
+			Type: "write",
+			BuildScript: func(
+				_ context.Context,
+				dag DAG,
+				cache LocalCache,
+				_, _ io.Writer,
+			) error {
+				return cache.Write(
+					dag.ID.ArtifactID(),
+					func(w io.Writer) error { return nil },
+				)
+			},
+		}},
+		cache,
+		nil,
+		func(Event) {},
+	)
+	dag := leaf("a")
+	dag.BuilderType = "write"
+	dag.Timeout = 10 * time.Millisecond
+
+	// Waiting for another process which holds the artifact's lock isn't
+	// part of the target's build, so it doesn't count toward its timeout.
+	unlock, err := cache.Lock(context.Background(), dag.ID.ArtifactID())
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	go func() {
+		time.Sleep(5 * dag.Timeout)
+		unlock()
+	}()
+	if err := execute(context.Background(), dag); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	a := leaf("a")
+	b := leaf("b")
+	c := dependsOn("c", a)
+	d := dependsOn("d", c, b)
+	e := dependsOn("e", b)
+	f := leaf("f")
+
+	var lock sync.Mutex
+	var executed []TargetName
+	summary, err := KeepGoing(
+		context.Background(),
+		func(_ context.Context, dag DAG) error {
+			lock.Lock()
+			defer lock.Unlock()
+			executed = append(executed, dag.ID.Target)
+			if dag.ID.Target == "a" || dag.ID.Target == "b" {
+				return errors.New("failed")
+			}
+			return nil
+		},
+		2,
+		d,
+		e,
+		f,
+	)
+	if err == nil {
+		t.Fatal("Wanted an error")
+	}
+	if len(executed) != 3 {
+		t.Fatalf("Wanted only a, b, and f to be executed; got %v", executed)
+	}
+	if len(summary.Succeeded) != 1 || summary.Succeeded[0] != f.ID {
+		t.Fatalf("Wanted f to succeed; got %v", summary.Succeeded)
+	}
+	if len(summary.Failed) != 2 ||
+		summary.Failed[0].Target != a.ID ||
+		summary.Failed[1].Target != b.ID {
+		t.Fatalf("Wanted a and b to fail; got %v", summary.Failed)
+	}
+
+	blockers := map[TargetName][]TargetName{}
+	for _, skipped := range summary.Skipped {
+		for _, id := range skipped.BlockedBy {
+			blockers[skipped.Target.Target] = append(
+				blockers[skipped.Target.Target],
+				id.Target,
+			)
+		}
+	}
+	if len(blockers) != 3 ||
+		len(blockers["c"]) != 1 || blockers["c"][0] != "a" ||
+		len(blockers["d"]) != 2 ||
+		len(blockers["e"]) != 1 || blockers["e"][0] != "b" {
+		t.Fatalf(
+			"Wanted c blocked by a, d by a and b, and e by b; got %v",
+			blockers,
+		)
+	}
+}
@@ -1,8 +1,10 @@
 package core
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
 
@@ -10,19 +12,51 @@ import (
 	"github.com/pkg/errors"
 )
 
-func FreezeTarget(root string, cache Cache, target Target) (DAG, error) {
-	return freezer.freezeTarget(
-		freezer{root: root, cache: cache, seen: map[TargetID]DAG{}},
-		target,
-	)
+func FreezeTarget(root string, cache LocalCache, target Target) (DAG, error) {
+	dags, err := FreezeTargets(root, cache, target)
+	if err != nil {
+		return DAG{}, err
+	}
+	return dags[0], nil
+}
+
+// FreezeTargets freezes several targets at once. Dependencies shared between
+// the targets are only frozen once.
+func FreezeTargets(
+	root string,
+	cache LocalCache,
+	targets ...Target,
+) ([]DAG, error) {
+	f := freezer{
+		root:  root,
+		cache: cache,
+		seen:  map[TargetID]DAG{},
+		stats: loadStatCache(cache.statCachePath()),
+	}
+	dags := make([]DAG, len(targets))
+	for i, target := range targets {
+		dag, err := f.freezeTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		dags[i] = dag
+	}
+
+	// The stat cache only saves time, so failing to save it isn't fatal.
+	if err := f.stats.save(); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
+	return dags, nil
 }
 
 type freezer struct {
 	root  string
-	cache Cache
+	cache LocalCache
 
 	// An in-memory cache to make sure we don't redundantly freeze targets.
 	seen map[TargetID]DAG
+
+	stats *statCache
 }
 
 func (f freezer) freezeArray(a Array) ([]DAG, FrozenArray, error) {
@@ -39,74 +73,124 @@ func (f freezer) freezeArray(a Array) ([]DAG, FrozenArray, error) {
 	return deps, out, nil
 }
 
+// frozenFile is a file in a file group which is being frozen.
+type frozenFile struct {
+	path    string
+	relpath string
+	size    int64
+	digest  Checksum
+}
+
+// copyFrozenFile copies a file in a file group to `dst`, checking that its
+// contents still match the digest from which the file group's checksum was
+// computed.
+func copyFrozenFile(file frozenFile, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.Wrap(err, "Preparing parent directory")
+	}
+	in, err := os.Open(file.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	digest, err := ChecksumReader(io.TeeReader(in, out), file.size)
+	if err != nil {
+		return err
+	}
+	if digest != file.digest {
+		return errors.Errorf("%s was modified while freezing", file.path)
+	}
+	return out.Close()
+}
+
+// freezeFileGroup checksums the files matched by a file group and copies
+// them into the cache. Files whose stat info hasn't changed since they were
+// last checksummed aren't re-read, and if the cache already contains the
+// file group, nothing is copied.
 func (f *freezer) freezeFileGroup(fg FileGroup) (ArtifactID, error) {
-	id, err := f.cache.TempDir(func(dir string) (string, ArtifactID, error) {
-		checksums := []uint32{ChecksumString(string(fg.Package))}
-		for _, pattern := range fg.Patterns {
-			matches, err := doublestar.Glob(
-				filepath.Join(f.root, string(fg.Package), pattern),
-			)
-			if err != nil {
-				return "", ArtifactID{}, err
-			}
+	span := Tracing.Start("freeze", "//"+fg.String())
+	defer span.End()
 
-			for _, match := range matches {
-				data, err := ioutil.ReadFile(match)
-				if err != nil {
-					if pathErr, ok := err.(*os.PathError); ok {
-						if pathErr.Err.Error() == "is a directory" {
-							continue
-						}
-					}
-					return "", ArtifactID{}, err
-				}
-				relpath, err := filepath.Rel(
-					filepath.Join(f.root, string(fg.Package)),
-					match,
-				)
-				if err != nil {
-					return "", ArtifactID{}, err
-				}
-				checksums = append(
-					checksums,
-					JoinChecksums(
-						ChecksumString(relpath),
-						ChecksumBytes(data),
-					),
-				)
+	dir := filepath.Join(f.root, string(fg.Package))
+	var files []frozenFile
+	h := newHasher(tagFileGroup).string(string(fg.Package))
+	for _, pattern := range fg.Patterns {
+		matches, err := doublestar.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return ArtifactID{}, errors.Wrap(err, "Freezing file group")
+		}
 
-				if err := func() error {
-					filePath := filepath.Join(dir, relpath)
-					if err := os.MkdirAll(
-						filepath.Dir(filePath),
-						0755,
-					); err != nil {
-						return errors.Wrap(err, "Preparing parent directory")
-					}
-
-					return ioutil.WriteFile(filePath, data, 0644)
-				}(); err != nil {
-					return "", ArtifactID{}, errors.Wrapf(
-						err,
-						"Writing temp file for file %s in file group for "+
-							"package %s",
-						relpath,
-						fg.Package,
-					)
-				}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return ArtifactID{}, errors.Wrap(err, "Freezing file group")
 			}
+			if info.IsDir() {
+				continue
+			}
+			relpath, err := filepath.Rel(dir, match)
+			if err != nil {
+				return ArtifactID{}, errors.Wrap(err, "Freezing file group")
+			}
+			digest, err := f.stats.digest(match, info)
+			if err != nil {
+				return ArtifactID{}, errors.Wrap(err, "Freezing file group")
+			}
+			h.string(relpath).checksum(digest)
+			files = append(files, frozenFile{
+				path:    match,
+				relpath: relpath,
+				size:    info.Size(),
+				digest:  digest,
+			})
 		}
+	}
 
-		return "", ArtifactID{
-			Package:  fg.Package,
-			Checksum: JoinChecksums(checksums...),
-		}, nil
-	})
+	id := ArtifactID{Package: fg.Package, Checksum: h.sum()}
+	span.Arg("checksum", id.Checksum.String())
+	if err := f.cache.Exists(id); err != ErrArtifactNotFound {
+		span.Arg("cached", "true")
+		return id, errors.Wrap(err, "Freezing file group")
+	}
 
+	// Another process may be freezing the same file group; whichever gets
+	// the lock first writes it.
+	unlock, err := f.cache.Lock(context.Background(), id)
 	if err != nil {
 		return id, errors.Wrap(err, "Freezing file group")
 	}
+	defer unlock()
+	if err := f.cache.Exists(id); err != ErrArtifactNotFound {
+		span.Arg("cached", "true")
+		return id, errors.Wrap(err, "Freezing file group")
+	}
 
+	_, err = f.cache.TempDir(func(tmp string) (string, ArtifactID, error) {
+		for _, file := range files {
+			if err := copyFrozenFile(
+				file,
+				filepath.Join(tmp, file.relpath),
+			); err != nil {
+				return "", ArtifactID{}, errors.Wrapf(
+					err,
+					"Writing temp file for file %s in file group for "+
+						"package %s",
+					file.relpath,
+					fg.Package,
+				)
+			}
+		}
+		return "", id, nil
+	})
+	if err != nil {
+		return id, errors.Wrap(err, "Freezing file group")
+	}
 	return id, nil
 }
 
@@ -120,6 +204,15 @@ func (f freezer) freezeInput(i Input) ([]DAG, FrozenInput, error) {
 			return nil, nil, err
 		}
 		return []DAG{dag}, dag.ID.ArtifactID(), nil
+	case TargetOutput:
+		dag, err := f.freezeTarget(x.Target)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []DAG{dag}, OutputID{
+			Artifact: dag.ID.ArtifactID(),
+			Output:   x.Output,
+		}, nil
 	case FileGroup:
 		artifactID, err := f.freezeFileGroup(x)
 		if err != nil {
@@ -166,6 +259,12 @@ func (f freezer) freezeTarget(t Target) (DAG, error) {
 		return dag, nil
 	}
 
+	span := Tracing.Start(
+		"freeze",
+		fmt.Sprintf("//%s:%s", t.ID.Package, t.ID.Target),
+	)
+	defer span.End()
+
 	deps, frozenInputs, err := f.freezeObject(t.Inputs)
 	if err != nil {
 		return DAG{}, err
@@ -176,19 +275,19 @@ func (f freezer) freezeTarget(t Target) (DAG, error) {
 			ID: FrozenTargetID{
 				Package: t.ID.Package,
 				Target:  t.ID.Target,
-				Checksum: JoinChecksums(
-					ChecksumString(string(t.ID.Package)),
-					ChecksumString(string(t.ID.Target)),
-					ChecksumString(string(t.BuilderType)),
+				Checksum: checksumTarget(
+					t.ID,
+					t.BuilderType,
 					frozenInputs.checksum(),
-					// TODO: Checksum the builder args
 				),
 			},
 			Inputs:      frozenInputs,
 			BuilderType: t.BuilderType,
+			Timeout:     t.Timeout,
 		},
 		Dependencies: deps,
 	}
 	f.seen[t.ID] = dag
+	span.Arg("checksum", dag.ID.Checksum.String())
 	return dag, nil
 }
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFreezeFileGroup_StatCache(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer os.RemoveAll(root)
+	cache := NewLocalCache("workspace", filepath.Join(root, "cache"))
+
+	// Backdate the file so that it's old enough to be recorded in the stat
+	// cache.
+	path := filepath.Join(root, "pkg", "file.txt")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("contents"), 0644); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	target := Target{
+		ID:          TargetID{Package: "pkg", Target: "t"},
+		BuilderType: "noop",
+		Inputs: Object{{
+			Key:   "sources",
+			Value: FileGroup{Package: "pkg", Patterns: []string{"*.txt"}},
+		}},
+	}
+	first, err := FreezeTarget(root, cache, target)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	var id ArtifactID
+	if err := first.Inputs.VisitKey(
+		"sources",
+		ParseArtifactID(&id),
+	); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(cache.Path(id), "file.txt"))
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if string(data) != "contents" {
+		t.Fatalf("Wanted 'contents'; got '%s'", data)
+	}
+
+	stats := loadStatCache(cache.statCachePath())
+	entry, found := stats.entries[path]
+	if !found {
+		t.Fatalf("Expected a stat cache entry for %s", path)
+	}
+	if wanted := ChecksumString("contents"); entry.Digest != wanted {
+		t.Fatalf("Wanted digest %s; got %s", wanted, entry.Digest)
+	}
+
+	// Freezing again uses the recorded digest rather than re-reading the
+	// file, so a (contrived) stale digest yields a different file group
+	// whose copy then fails verification.
+	entry.Digest = ChecksumString("stale")
+	stats.entries[path] = entry
+	stats.dirty = true
+	if err := stats.save(); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	_, err = FreezeTarget(root, cache, target)
+	if err == nil || !strings.Contains(err.Error(), "modified while freezing") {
+		t.Fatalf("Expected a verification error; got %v", err)
+	}
+
+	// Once the file's stat info changes, it's re-read.
+	if err := ioutil.WriteFile(path, []byte("contents"), 0644); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	second, err := FreezeTarget(root, cache, target)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if second.ID != first.ID {
+		t.Fatalf("Wanted %s; got %s", first.ID, second.ID)
+	}
+}
@@ -0,0 +1,411 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CacheEntry is an artifact stored in a local cache.
+type CacheEntry struct {
+	ID   ArtifactID
+	Path string
+
+	// The total size in bytes of the artifact and its companion files.
+	Size int64
+
+	// The last time the artifact was written or found in the cache.
+	LastUsed time.Time
+}
+
+// touch records that an artifact was used so that garbage collection can
+// retain recently-used artifacts.
+func touch(path string) {
+	now := time.Now()
+	// Failing to record the access time isn't fatal; the artifact is merely
+	// more likely to be collected.
+	_ = os.Chtimes(path, now, now)
+}
+
+// companions returns the paths of the files stored alongside the artifact at
+// `path` (e.g., its logs). By convention, these are named
+// `<checksum>.<suffix>`. Artifact names never contain a '.'.
+func companions(path string) ([]string, error) {
+	return filepath.Glob(path + ".*")
+}
+
+func diskUsage(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(
+		_ string,
+		info os.FileInfo,
+		err error,
+	) error {
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+func (c LocalCache) entry(path string, id ArtifactID) (CacheEntry, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	size, err := diskUsage(path)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	others, err := companions(path)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	for _, other := range others {
+		otherSize, err := diskUsage(other)
+		if err != nil {
+			return CacheEntry{}, err
+		}
+		size += otherSize
+	}
+	return CacheEntry{
+		ID:       id,
+		Path:     path,
+		Size:     size,
+		LastUsed: info.ModTime(),
+	}, nil
+}
+
+// isArtifactName returns true if `name` may be the name of an artifact: a
+// checksum or, for artifacts written by older versions of builder, a decimal
+// adler32 checksum.
+func isArtifactName(name string) bool {
+	if _, err := ParseChecksum(name); err == nil {
+		return true
+	}
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// readDirNames returns the names of the directories in `dir`.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Entries lists the artifacts in the cache for the cache's workspace.
+// Artifacts whose names aren't valid checksums (e.g., artifacts named by the
+// adler32 checksums of older versions of builder) are listed with a zero
+// checksum so that they can still be collected.
+//
+// Each package's directory holds its file groups in `filegroups`, its
+// targets' artifacts in `targets/<target>`, and its sub-packages' directories,
+// so the directory of a package whose name ends in `filegroups` or `targets`
+// is also one of its parent package's. Such directories are read both ways,
+// but only names which may be artifacts' are taken for artifacts, so a
+// package's directory is never mistaken for an artifact (and collected).
+func (c LocalCache) Entries() ([]CacheEntry, error) {
+	root := filepath.Join(c.Directory, c.WorkspaceID, "packages")
+	var entries []CacheEntry
+	seen := map[string]struct{}{}
+
+	// list adds an entry for each artifact in `dir`, which is either a
+	// package's `filegroups` directory or the directory for one of a
+	// package's targets. It returns true if `dir` also holds directories
+	// which can't be artifacts, and which therefore belong to a package
+	// nested beneath `dir`.
+	list := func(
+		dir string,
+		pkg PackageName,
+		target TargetName,
+	) (bool, error) {
+		f, err := os.Open(dir)
+		if err != nil {
+			return false, err
+		}
+		infos, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return false, err
+		}
+		nested := false
+		for _, info := range infos {
+			name := info.Name()
+			if !isArtifactName(name) {
+				nested = nested ||
+					(info.IsDir() && !strings.Contains(name, "."))
+				continue
+			}
+			path := filepath.Join(dir, name)
+			if _, found := seen[path]; found {
+				continue
+			}
+			seen[path] = struct{}{}
+			checksum, _ := ParseChecksum(name)
+			entry, err := c.entry(path, ArtifactID{
+				Package:  pkg,
+				Target:   target,
+				Checksum: checksum,
+			})
+			if err != nil {
+				return false, err
+			}
+			entries = append(entries, entry)
+		}
+		return nested, nil
+	}
+
+	// walk lists the artifacts of the package `pkg`, whose directory is
+	// `dir`, and of its sub-packages. If `dir` is also another package's
+	// `filegroups` directory or one of its targets' directories (i.e.,
+	// `holdsArtifacts`), the artifacts in it are skipped; if it's another
+	// package's `targets` directory (i.e., `holdsTargets`), so are the
+	// artifacts in its sub-directories.
+	var walk func(
+		dir string,
+		pkg PackageName,
+		holdsArtifacts bool,
+		holdsTargets bool,
+	) error
+	walk = func(
+		dir string,
+		pkg PackageName,
+		holdsArtifacts bool,
+		holdsTargets bool,
+	) error {
+		names, err := readDirNames(dir)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+			switch {
+			case holdsArtifacts && isArtifactName(name):
+			case name == "filegroups":
+				nested, err := list(path, pkg, "")
+				if err != nil {
+					return err
+				}
+				if nested {
+					err = walk(path, joinPackage(pkg, name), true, false)
+				}
+				if err != nil {
+					return err
+				}
+			// The root package's targets are in `__ROOT__/targets`, so
+			// `targets` in the root directory is a package's.
+			case name == "targets" && dir != root:
+				targets, err := readDirNames(path)
+				if err != nil {
+					return err
+				}
+				nested := false
+				for _, target := range targets {
+					n, err := list(
+						filepath.Join(path, target),
+						pkg,
+						TargetName(target),
+					)
+					if err != nil {
+						return err
+					}
+					nested = nested || n
+				}
+				if nested {
+					if err := walk(
+						path,
+						joinPackage(pkg, name),
+						false,
+						true,
+					); err != nil {
+						return err
+					}
+				}
+			case name == "__ROOT__" && dir == root:
+				if err := walk(path, "", false, false); err != nil {
+					return err
+				}
+			default:
+				if err := walk(
+					path,
+					joinPackage(pkg, name),
+					holdsTargets,
+					false,
+				); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	err := walk(root, "", false, false)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return entries, errors.Wrap(err, "Listing cache entries")
+}
+
+// joinPackage returns the name of the sub-package `name` of `pkg`.
+func joinPackage(pkg PackageName, name string) PackageName {
+	if pkg == "" {
+		return PackageName(name)
+	}
+	return PackageName(string(pkg) + "/" + name)
+}
+
+// Remove deletes a cache entry along with its companion files. The entry's
+// completion marker is removed first so that it's never found half-removed.
+// If another process holds the entry's lock (e.g., because it's writing the
+// artifact), the entry is left alone and ErrLocked is returned. The lock
+// file itself is kept, since removing it would race with other processes
+// waiting on it.
+func (c LocalCache) Remove(entry CacheEntry) error {
+	unlock, err := TryLockFile(entry.Path + lockSuffix)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = os.Remove(entry.Path + completeSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Removing cache entry %s", entry.Path)
+	}
+	others, err := companions(entry.Path)
+	if err != nil {
+		return err
+	}
+	for _, path := range append(others, entry.Path) {
+		if path == entry.Path+lockSuffix {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return errors.Wrapf(err, "Removing cache entry %s", path)
+		}
+	}
+	return nil
+}
+
+// GCPolicy determines which cache entries are garbage collected. An entry is
+// collected if any of the policy's criteria select it; zero-valued criteria
+// are disabled.
+type GCPolicy struct {
+	// Collect the least-recently-used entries until the total size of the
+	// remaining entries is at most MaxSize bytes.
+	MaxSize int64
+
+	// Collect entries which haven't been used for longer than MaxAge.
+	MaxAge time.Duration
+
+	// For each target (and for each package's file groups), retain only
+	// the KeepLast most-recently-used entries.
+	KeepLast int
+
+	// If non-nil, collect every entry which isn't in Reachable.
+	Reachable map[ArtifactID]struct{}
+}
+
+// Collect returns the entries that the policy selects for collection, given
+// the current time.
+func (p GCPolicy) Collect(entries []CacheEntry, now time.Time) []CacheEntry {
+	sorted := make([]CacheEntry, len(entries))
+	copy(sorted, entries)
+	// Most-recently-used first
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].LastUsed.After(sorted[j].LastUsed)
+	})
+
+	collect := make([]bool, len(sorted))
+	seen := map[TargetID]int{}
+	for i, entry := range sorted {
+		if p.Reachable != nil {
+			if _, found := p.Reachable[entry.ID]; !found {
+				collect[i] = true
+			}
+		}
+
+		if p.MaxAge > 0 && now.Sub(entry.LastUsed) > p.MaxAge {
+			collect[i] = true
+		}
+
+		if p.KeepLast > 0 {
+			tid := TargetID{Package: entry.ID.Package, Target: entry.ID.Target}
+			seen[tid]++
+			if seen[tid] > p.KeepLast {
+				collect[i] = true
+			}
+		}
+	}
+
+	if p.MaxSize > 0 {
+		var size int64
+		for i, entry := range sorted {
+			if collect[i] {
+				continue
+			}
+			size += entry.Size
+			if size > p.MaxSize {
+				collect[i] = true
+			}
+		}
+	}
+
+	var collected []CacheEntry
+	for i, entry := range sorted {
+		if collect[i] {
+			collected = append(collected, entry)
+		}
+	}
+	return collected
+}
+
+// Reachable returns the IDs of the artifacts for each target in the DAGs and
+// of the file groups they depend on.
+func Reachable(dags ...DAG) map[ArtifactID]struct{} {
+	reachable := map[ArtifactID]struct{}{}
+	var visit func(dag DAG)
+	visit = func(dag DAG) {
+		if _, found := reachable[dag.ID.ArtifactID()]; found {
+			return
+		}
+		reachable[dag.ID.ArtifactID()] = struct{}{}
+		for _, id := range ArtifactIDs(dag.Inputs) {
+			reachable[id] = struct{}{}
+		}
+		for _, dependency := range dag.Dependencies {
+			visit(dependency)
+		}
+	}
+	for _, dag := range dags {
+		visit(dag)
+	}
+	return reachable
+}
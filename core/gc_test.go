@@ -0,0 +1,199 @@
+package core
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func gcEntry(target string, checksum string, size int64, age int) CacheEntry {
+	return CacheEntry{
+		ID: ArtifactID{
+			Package:  "pkg",
+			Target:   TargetName(target),
+			Checksum: ChecksumString(checksum),
+		},
+		Size:     size,
+		LastUsed: time.Unix(0, 0).Add(-time.Duration(age) * time.Hour),
+	}
+}
+
+func collectedChecksums(entries []CacheEntry) map[Checksum]bool {
+	out := map[Checksum]bool{}
+	for _, entry := range entries {
+		out[entry.ID.Checksum] = true
+	}
+	return out
+}
+
+func assertCollected(t *testing.T, got []CacheEntry, wanted ...string) {
+	if len(got) != len(wanted) {
+		t.Fatalf("Wanted %d entries collected; got %d", len(wanted), len(got))
+	}
+	collected := collectedChecksums(got)
+	for _, checksum := range wanted {
+		if !collected[ChecksumString(checksum)] {
+			t.Fatalf("Wanted entry %s to be collected", checksum)
+		}
+	}
+}
+
+func TestGCPolicy_MaxAge(t *testing.T) {
+	entries := []CacheEntry{gcEntry("a", "new", 1, 1), gcEntry("a", "old", 1, 48)}
+	assertCollected(
+		t,
+		GCPolicy{MaxAge: 24 * time.Hour}.Collect(entries, time.Unix(0, 0)),
+		"old",
+	)
+}
+
+func TestGCPolicy_KeepLast(t *testing.T) {
+	entries := []CacheEntry{
+		gcEntry("a", "a1", 1, 3),
+		gcEntry("a", "a2", 1, 1),
+		gcEntry("a", "a3", 1, 2),
+		gcEntry("b", "b1", 1, 5),
+	}
+	assertCollected(
+		t,
+		GCPolicy{KeepLast: 2}.Collect(entries, time.Unix(0, 0)),
+		"a1",
+	)
+}
+
+func TestGCPolicy_MaxSize(t *testing.T) {
+	entries := []CacheEntry{
+		gcEntry("a", "a1", 10, 3),
+		gcEntry("b", "b1", 10, 1),
+		gcEntry("c", "c1", 10, 2),
+	}
+	assertCollected(
+		t,
+		GCPolicy{MaxSize: 25}.Collect(entries, time.Unix(0, 0)),
+		"a1",
+	)
+}
+
+func TestGCPolicy_Reachable(t *testing.T) {
+	keep := gcEntry("a", "a1", 1, 1)
+	entries := []CacheEntry{keep, gcEntry("a", "a2", 1, 1)}
+	assertCollected(
+		t,
+		GCPolicy{
+			Reachable: map[ArtifactID]struct{}{keep.ID: struct{}{}},
+		}.Collect(entries, time.Unix(0, 0)),
+		"a2",
+	)
+}
+
+func TestLocalCache_Remove(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	id := ArtifactID{Package: "pkg", Target: "a", Checksum: ChecksumString("a")}
+	if err := cache.Write(id, func(w io.Writer) error {
+		_, err := io.WriteString(w, "a")
+		return err
+	}); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	entries, err := cache.Entries()
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Wanted 1 entry; got %v", entries)
+	}
+
+	// Entries which another process is writing are left alone.
+	unlock, err := cache.Lock(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := cache.Remove(entries[0]); err != ErrLocked {
+		t.Fatalf("Wanted ErrLocked; got %v", err)
+	}
+	if err := cache.Exists(id); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	unlock()
+
+	if err := cache.Remove(entries[0]); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := cache.Exists(id); err != ErrArtifactNotFound {
+		t.Fatalf("Wanted ErrArtifactNotFound; got %v", err)
+	}
+	if _, err := os.Stat(cache.Path(id)); !os.IsNotExist(err) {
+		t.Fatalf("Wanted the artifact to be removed; got %v", err)
+	}
+}
+
+func TestLocalCache_Entries(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+
+	// The directories of packages whose names end in `targets` or
+	// `filegroups` are also their parents' `targets` and `filegroups`
+	// directories.
+	var ids []ArtifactID
+	for _, id := range []struct {
+		pkg    PackageName
+		target TargetName
+	}{
+		{pkg: "", target: "root"},
+		{pkg: "", target: ""},
+		{pkg: "targets", target: "a"},
+		{pkg: "targets", target: ""},
+		{pkg: "foo", target: "b"},
+		{pkg: "foo", target: ""},
+		{pkg: "foo/targets", target: "c"},
+		{pkg: "foo/targets/bar", target: "d"},
+		{pkg: "foo/targets/bar", target: ""},
+		{pkg: "foo/filegroups", target: "e"},
+		{pkg: "foo/filegroups", target: ""},
+	} {
+		ids = append(ids, ArtifactID{
+			Package:  id.pkg,
+			Target:   id.target,
+			Checksum: ChecksumString(string(id.pkg) + ":" + string(id.target)),
+		})
+	}
+	for _, id := range ids[1:] {
+		if err := cache.Write(id, func(w io.Writer) error {
+			_, err := io.WriteString(w, id.String())
+			return err
+		}); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+
+	// Directories within directory artifacts aren't mistaken for packages.
+	if _, err := cache.TempDir(func(dir string) (string, ArtifactID, error) {
+		return "out", ids[0], os.MkdirAll(
+			filepath.Join(dir, "out", "targets", "x", "123"),
+			0755,
+		)
+	}); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	entries, err := cache.Entries()
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	got := map[ArtifactID]string{}
+	for _, entry := range entries {
+		got[entry.ID] = entry.Path
+	}
+	if len(entries) != len(ids) || len(got) != len(ids) {
+		t.Fatalf("Wanted %d entries; got %v", len(ids), entries)
+	}
+	for _, id := range ids {
+		if path, found := got[id]; !found || path != cache.Path(id) {
+			t.Errorf("Wanted entry %s at %s; got %v", id, cache.Path(id), got)
+		}
+	}
+}
@@ -0,0 +1,530 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The HTTP cache protocol is deliberately simple. Artifacts live at the same
+// paths relative to the server root as they do relative to a local cache
+// directory (see `artifactPath()`).
+//
+//   - `HEAD <path>` responds 200 if the artifact exists and 404 otherwise.
+//   - `GET <path>` responds with the artifact. The `X-Artifact-Type` header is
+//     either `file` or `directory`. Files are sent verbatim with their
+//     permission bits in the `X-Artifact-Mode` header (octal). Directories are
+//     sent as a tar stream.
+//   - `PUT <path>` stores an artifact, using the same headers and body
+//     encoding as `GET`.
+//
+// An artifact's providers are stored as a file at `<path>.providers` and its
+// named outputs as a directory at `<path>.outputs`; both are pushed before
+// the artifact itself.
+const (
+	headerArtifactType = "X-Artifact-Type"
+	headerArtifactMode = "X-Artifact-Mode"
+
+	artifactTypeFile      = "file"
+	artifactTypeDirectory = "directory"
+)
+
+// HTTPCache is a remote cache which speaks the HTTP cache protocol, e.g., to
+// a `builder cache-server`.
+type HTTPCache struct {
+	URL         string
+	WorkspaceID string
+	Client      *http.Client
+}
+
+func NewHTTPCache(url, workspaceID string) HTTPCache {
+	return HTTPCache{
+		URL:         url,
+		WorkspaceID: workspaceID,
+		Client:      http.DefaultClient,
+	}
+}
+
+// url returns the URL of the artifact `id`, or of its companion file if
+// `suffix` isn't empty.
+func (c HTTPCache) url(id ArtifactID, suffix string) string {
+	return strings.TrimSuffix(c.URL, "/") + (&url.URL{
+		Path: "/" + artifactPath(c.WorkspaceID, id) + suffix,
+	}).EscapedPath()
+}
+
+func (c HTTPCache) do(
+	method string,
+	id ArtifactID,
+	header http.Header,
+	body io.Reader,
+) (*http.Response, error) {
+	return c.doCompanion(method, id, "", header, body)
+}
+
+// doCompanion is like do(), but for the companion file of the artifact `id`
+// whose name ends with `suffix` (e.g., its providers).
+func (c HTTPCache) doCompanion(
+	method string,
+	id ArtifactID,
+	suffix string,
+	header http.Header,
+	body io.Reader,
+) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url(id, suffix), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rsp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s%s", method, id, suffix)
+	}
+	if rsp.StatusCode == http.StatusNotFound {
+		rsp.Body.Close()
+		return nil, ErrArtifactNotFound
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		defer rsp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return nil, errors.Errorf(
+			"%s %s%s: %s: %s",
+			method,
+			id,
+			suffix,
+			rsp.Status,
+			strings.TrimSpace(string(msg)),
+		)
+	}
+	return rsp, nil
+}
+
+func (c HTTPCache) Exists(id ArtifactID) error {
+	rsp, err := c.do(http.MethodHead, id, nil, nil)
+	if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+func (c HTTPCache) Read(id ArtifactID, f func(r io.Reader) error) error {
+	rsp, err := c.do(http.MethodGet, id, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if t := rsp.Header.Get(headerArtifactType); t != artifactTypeFile {
+		return errors.Errorf("Artifact %s is a %s, not a file", id, t)
+	}
+	return f(rsp.Body)
+}
+
+// put uploads an artifact whose body is produced by `f`.
+func (c HTTPCache) put(
+	id ArtifactID,
+	header http.Header,
+	f func(w io.Writer) error,
+) error {
+	r, w := io.Pipe()
+	go func() { w.CloseWithError(f(w)) }()
+	rsp, err := c.do(http.MethodPut, id, header, r)
+	if err != nil {
+		r.CloseWithError(err)
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+func fileHeader(mode os.FileMode) http.Header {
+	return http.Header{
+		headerArtifactType: {artifactTypeFile},
+		headerArtifactMode: {fmt.Sprintf("%o", mode.Perm())},
+	}
+}
+
+var directoryHeader = http.Header{
+	headerArtifactType: {artifactTypeDirectory},
+}
+
+func (c HTTPCache) Write(id ArtifactID, f func(w io.Writer) error) error {
+	return c.put(id, fileHeader(0644), f)
+}
+
+// upload pushes the file or directory at `src` to the cache at `id`.
+func (c HTTPCache) upload(id ArtifactID, src string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return c.put(id, directoryHeader, func(w io.Writer) error {
+			return writeTar(w, src)
+		})
+	}
+	return c.put(id, fileHeader(info.Mode()), func(w io.Writer) error {
+		file, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(w, file)
+		return err
+	})
+}
+
+func (c HTTPCache) TempDir(
+	f func(dir string) (string, ArtifactID, error),
+) (ArtifactID, error) {
+	var aid ArtifactID
+	err := withTempDir("", func(dir string) error {
+		relpath, id, err := f(dir)
+		if err != nil {
+			return err
+		}
+		aid = id
+		return errors.Wrapf(
+			c.upload(id, filepath.Join(dir, relpath)),
+			"Uploading artifact %s",
+			id,
+		)
+	})
+	return aid, err
+}
+
+// pushProviders uploads the artifact's providers from `src`, if it has any.
+func (c HTTPCache) pushProviders(id ArtifactID, src LocalCache) error {
+	data, err := ioutil.ReadFile(src.providersPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rsp, err := c.doCompanion(
+		http.MethodPut,
+		id,
+		providersSuffix,
+		fileHeader(0644),
+		bytes.NewReader(data),
+	)
+	if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+// pushOutputs uploads the artifact's named outputs from `src`, if it has
+// any.
+func (c HTTPCache) pushOutputs(id ArtifactID, src LocalCache) error {
+	if _, err := os.Stat(src.OutputsDir(id)); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	r, w := io.Pipe()
+	go func() { w.CloseWithError(writeTar(w, src.OutputsDir(id))) }()
+	rsp, err := c.doCompanion(
+		http.MethodPut,
+		id,
+		outputsSuffix,
+		directoryHeader,
+		r,
+	)
+	if err != nil {
+		r.CloseWithError(err)
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+// Push uploads the artifact's providers and named outputs (if any) and then
+// the artifact, so that an artifact in the remote cache always has its
+// companions alongside it.
+func (c HTTPCache) Push(id ArtifactID, src LocalCache) error {
+	if err := c.pushProviders(id, src); err != nil {
+		return errors.Wrapf(err, "Pushing providers of %s", id)
+	}
+	if err := c.pushOutputs(id, src); err != nil {
+		return errors.Wrapf(err, "Pushing outputs of %s", id)
+	}
+	return errors.Wrapf(
+		c.upload(id, src.Path(id)),
+		"Pushing artifact %s",
+		id,
+	)
+}
+
+// pullProviders downloads the artifact's providers into `dst`. Artifacts
+// without providers have no providers file in the remote cache either.
+func (c HTTPCache) pullProviders(id ArtifactID, dst LocalCache) error {
+	rsp, err := c.doCompanion(http.MethodGet, id, providersSuffix, nil, nil)
+	if err == ErrArtifactNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	return writeCompanion(dst.providersPath(id), data)
+}
+
+// pullOutputs downloads the artifact's named outputs into `dst`, if it has
+// any.
+func (c HTTPCache) pullOutputs(id ArtifactID, dst LocalCache) error {
+	rsp, err := c.doCompanion(http.MethodGet, id, outputsSuffix, nil, nil)
+	if err == ErrArtifactNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	outputs := dst.OutputsDir(id)
+	parent := filepath.Dir(outputs)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(parent, ".pull-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	received := filepath.Join(tmp, "outputs")
+	if err := receiveArtifact(rsp.Header, rsp.Body, received); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(outputs); err != nil {
+		return err
+	}
+	return os.Rename(received, outputs)
+}
+
+func (c HTTPCache) Pull(id ArtifactID, dst LocalCache) error {
+	rsp, err := c.do(http.MethodGet, id, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := c.pullProviders(id, dst); err != nil {
+		rsp.Body.Close()
+		return errors.Wrapf(err, "Pulling providers of %s", id)
+	}
+	if err := c.pullOutputs(id, dst); err != nil {
+		rsp.Body.Close()
+		return errors.Wrapf(err, "Pulling outputs of %s", id)
+	}
+	defer rsp.Body.Close()
+	_, err = dst.TempDir(func(dir string) (string, ArtifactID, error) {
+		return "artifact", id, receiveArtifact(
+			rsp.Header,
+			rsp.Body,
+			filepath.Join(dir, "artifact"),
+		)
+	})
+	return errors.Wrapf(err, "Pulling artifact %s", id)
+}
+
+// receiveArtifact writes the artifact in `body` to `dst`, which must not
+// exist, according to the artifact headers.
+func receiveArtifact(header http.Header, body io.Reader, dst string) error {
+	switch t := header.Get(headerArtifactType); t {
+	case artifactTypeDirectory:
+		if err := os.Mkdir(dst, 0755); err != nil {
+			return err
+		}
+		return extractTar(body, dst)
+	case artifactTypeFile:
+		mode, err := strconv.ParseUint(
+			header.Get(headerArtifactMode),
+			8,
+			32,
+		)
+		if err != nil {
+			return errors.Wrapf(
+				err,
+				"Parsing %s header",
+				headerArtifactMode,
+			)
+		}
+		return writeFile(dst, os.FileMode(mode), body)
+	default:
+		return errors.Errorf(
+			"Invalid %s header: '%s'",
+			headerArtifactType,
+			t,
+		)
+	}
+}
+
+// CacheServer returns an HTTP handler which serves the cache rooted at
+// `directory` via the HTTP cache protocol. The directory has the same layout
+// as a local cache directory, so a server can share a machine's local cache.
+func CacheServer(directory string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		relpath := path.Clean("/" + r.URL.Path)
+		if relpath == "/" || strings.HasPrefix(path.Base(relpath), ".") {
+			http.Error(w, "Invalid artifact path", http.StatusBadRequest)
+			return
+		}
+		p := filepath.Join(directory, filepath.FromSlash(relpath))
+		if r.Method == http.MethodPut && !isStorablePath(p) {
+			// Clients may only store artifacts and the companions which
+			// are pushed with them; the rest (e.g., locks, completion
+			// markers, and build logs) are managed by the server.
+			http.Error(w, "Invalid artifact path", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		switch r.Method {
+		case http.MethodHead, http.MethodGet:
+			err = serveArtifact(w, r, p)
+		case http.MethodPut:
+			err = storeArtifact(r, p)
+		default:
+			http.Error(
+				w,
+				"Method not allowed",
+				http.StatusMethodNotAllowed,
+			)
+			return
+		}
+		if os.IsNotExist(errors.Cause(err)) {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// isArtifactPath returns true if `p` is the path of an artifact rather than
+// of one of its companions (artifact names never contain a '.').
+func isArtifactPath(p string) bool {
+	return !strings.Contains(filepath.Base(p), ".")
+}
+
+// artifactOf returns the path of the artifact whose companion is at `p` (or
+// `p` itself if it's the path of an artifact).
+func artifactOf(p string) string {
+	base := filepath.Base(p)
+	if i := strings.Index(base, "."); i >= 0 {
+		return filepath.Join(filepath.Dir(p), base[:i])
+	}
+	return p
+}
+
+// isStorablePath returns true if `p` is the path of an artifact or of one of
+// the companions which clients push alongside it (see HTTPCache.Push()).
+func isStorablePath(p string) bool {
+	switch strings.TrimPrefix(p, artifactOf(p)) {
+	case "", providersSuffix, outputsSuffix:
+		return true
+	}
+	return false
+}
+
+func serveArtifact(w http.ResponseWriter, r *http.Request, p string) error {
+	// Artifacts which are still being written (e.g., by a build in the
+	// local cache which the server shares) aren't served.
+	if isArtifactPath(p) {
+		complete, err := isComplete(p)
+		if err != nil {
+			return err
+		}
+		if !complete {
+			return os.ErrNotExist
+		}
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		for key, values := range directoryHeader {
+			w.Header()[key] = values
+		}
+		if r.Method == http.MethodHead {
+			return nil
+		}
+		// Once we've started streaming we can no longer report errors via
+		// the status code, but a truncated tar stream is detected by the
+		// client.
+		return writeTar(w, p)
+	}
+
+	for key, values := range fileHeader(info.Mode()) {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+func storeArtifact(r *http.Request, p string) error {
+	parent := filepath.Dir(p)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+
+	// Receive the artifact next to its final location so the rename into
+	// place doesn't cross filesystems. Dot-prefixed names are never served.
+	tmp, err := ioutil.TempDir(parent, ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	received := filepath.Join(tmp, "artifact")
+	if err := receiveArtifact(r.Header, r.Body, received); err != nil {
+		return errors.Wrap(err, "Receiving artifact")
+	}
+
+	// Artifacts are content-addressed, so if another client stored the
+	// artifact first, it's left alone rather than replaced while it may be
+	// being served. Its companions are written under the same lock and, like
+	// the artifact, are immutable once the artifact is complete.
+	artifact := artifactOf(p)
+	unlock, err := LockFile(r.Context(), artifact+lockSuffix)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	complete, err := isComplete(artifact)
+	if err != nil || complete {
+		return err
+	}
+	if p != artifact {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		return os.Rename(received, p)
+	}
+	return commit(received, p)
+}
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempCache(t *testing.T) (LocalCache, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	return NewLocalCache("workspace", dir), func() { os.RemoveAll(dir) }
+}
+
+func TestHTTPCache_FileArtifact(t *testing.T) {
+	serverCache, cleanupServer := tempCache(t)
+	defer cleanupServer()
+	server := httptest.NewServer(CacheServer(serverCache.Directory))
+	defer server.Close()
+	remote := NewHTTPCache(server.URL, "workspace")
+
+	local, cleanup := tempCache(t)
+	defer cleanup()
+	id := ArtifactID{
+		Package:  "pkg",
+		Target:   "file",
+		Checksum: ChecksumString("file"),
+	}
+
+	if err := remote.Exists(id); err != ErrArtifactNotFound {
+		t.Fatalf("Expected err '%v'; got '%v'", ErrArtifactNotFound, err)
+	}
+	if err := remote.Pull(id, local); err != ErrArtifactNotFound {
+		t.Fatalf("Expected err '%v'; got '%v'", ErrArtifactNotFound, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(local.Path(id)), 0755); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := ioutil.WriteFile(
+		local.Path(id),
+		[]byte("#!/bin/sh"),
+		0755,
+	); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := remote.Push(id, local); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := remote.Exists(id); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	other, cleanupOther := tempCache(t)
+	defer cleanupOther()
+	if err := remote.Pull(id, other); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	info, err := os.Stat(other.Path(id))
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Fatalf("Wanted mode 0755; got %o", info.Mode().Perm())
+	}
+	if err := remote.Read(id, func(r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		if string(data) != "#!/bin/sh" {
+			t.Fatalf("Wanted '#!/bin/sh'; got '%s'", data)
+		}
+		return err
+	}); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+}
+
+func TestHTTPCache_DirectoryArtifact(t *testing.T) {
+	serverCache, cleanupServer := tempCache(t)
+	defer cleanupServer()
+	server := httptest.NewServer(CacheServer(serverCache.Directory))
+	defer server.Close()
+	remote := NewHTTPCache(server.URL, "workspace")
+
+	id, err := remote.TempDir(func(dir string) (string, ArtifactID, error) {
+		if err := os.MkdirAll(filepath.Join(dir, "out", "sub"), 0755); err != nil {
+			return "", ArtifactID{}, err
+		}
+		if err := os.Symlink("sub/file", filepath.Join(dir, "out", "link")); err != nil {
+			return "", ArtifactID{}, err
+		}
+		return "out", ArtifactID{
+			Package:  "pkg",
+			Checksum: ChecksumString("dir"),
+		}, ioutil.WriteFile(
+			filepath.Join(dir, "out", "sub", "file"),
+			[]byte("hello"),
+			0644,
+		)
+	})
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	local, cleanup := tempCache(t)
+	defer cleanup()
+	if err := remote.Pull(id, local); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(local.Path(id), "link"))
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Wanted 'hello'; got '%s'", data)
+	}
+}
+
+func TestCacheServer_Companions(t *testing.T) {
+	serverCache, cleanupServer := tempCache(t)
+	defer cleanupServer()
+	server := httptest.NewServer(CacheServer(serverCache.Directory))
+	defer server.Close()
+	remote := NewHTTPCache(server.URL, "workspace")
+	id := ArtifactID{
+		Package:  "pkg",
+		Target:   "file",
+		Checksum: ChecksumString("file"),
+	}
+	put := func(suffix, body string) int {
+		req, err := http.NewRequest(
+			http.MethodPut,
+			remote.url(id, suffix),
+			strings.NewReader(body),
+		)
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		for key, values := range fileHeader(0644) {
+			req.Header[key] = values
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	// Only the artifact and the companions which are pushed with it may be
+	// stored.
+	for _, suffix := range []string{
+		lockSuffix,
+		completeSuffix,
+		logSuffix,
+		buildingLogSuffix,
+		".tmp-1234",
+	} {
+		if status := put(suffix, ""); status != http.StatusBadRequest {
+			t.Errorf("PUT %s: wanted status 400; got %d", suffix, status)
+		}
+	}
+	if _, err := os.Stat(serverCache.Path(id) + completeSuffix); err == nil {
+		t.Fatal("Completion marker was stored")
+	}
+
+	// Companions may be replaced until the artifact is complete, but not
+	// after.
+	for _, c := range []struct {
+		suffix string
+		body   string
+	}{
+		{suffix: providersSuffix, body: "old"},
+		{suffix: providersSuffix, body: "new"},
+		{suffix: "", body: "artifact"},
+		{suffix: providersSuffix, body: "replaced"},
+	} {
+		if status := put(c.suffix, c.body); status != http.StatusOK {
+			t.Fatalf("PUT %s: wanted status 200; got %d", c.suffix, status)
+		}
+	}
+	data, err := ioutil.ReadFile(serverCache.providersPath(id))
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if string(data) != "new" {
+		t.Fatalf("Wanted providers 'new'; got '%s'", data)
+	}
+}
@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// sharedLocks is true because locks are shared with other processes.
+const sharedLocks = true
+
+// LockFile acquires an exclusive advisory lock (flock(2)) on the file at
+// `path`, creating it if necessary. The lock is shared with other processes
+// (and with other calls in this process), so builder processes which share a
+// cache can coordinate through it. If the lock is held, LockFile waits until
+// it's released or `ctx` is done. The returned function releases the lock.
+// The lock file is left in place, since removing it would race with other
+// processes waiting on it.
+func LockFile(ctx context.Context, path string) (func(), error) {
+	file, err := openLock(path)
+	if err != nil {
+		return nil, err
+	}
+	unlock := func() { file.Close() }
+
+	err = flock(file, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		return unlock, nil
+	}
+	if err != syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, errors.Wrapf(err, "Locking %s", path)
+	}
+
+	// flock(2) can't be interrupted, so wait for it in the background. If
+	// we give up first, the lock is released as soon as it's acquired.
+	locked := make(chan error, 1)
+	go func() { locked <- flock(file, syscall.LOCK_EX) }()
+	select {
+	case err := <-locked:
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrapf(err, "Locking %s", path)
+		}
+		return unlock, nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			file.Close()
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// TryLockFile is like LockFile(), but it returns ErrLocked instead of
+// waiting if the lock is held.
+func TryLockFile(path string) (func(), error) {
+	file, err := openLock(path)
+	if err != nil {
+		return nil, err
+	}
+	err = flock(file, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		return func() { file.Close() }, nil
+	}
+	file.Close()
+	if err == syscall.EWOULDBLOCK {
+		return nil, ErrLocked
+	}
+	return nil, errors.Wrapf(err, "Locking %s", path)
+}
+
+func openLock(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrapf(err, "Creating directory of lock %s", path)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	return file, errors.Wrapf(err, "Opening lock %s", path)
+}
+
+func flock(file *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,41 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import (
+	"context"
+	"sync"
+)
+
+// sharedLocks is false because locks only exclude callers in this process.
+const sharedLocks = false
+
+// fileLocks holds a mutex per lock file path.
+var fileLocks sync.Map
+
+// LockFile acquires an exclusive lock on `path`, waiting until it's released
+// or `ctx` is done. The returned function releases the lock. Only the Linux
+// implementation is shared with other processes; elsewhere, only the callers
+// in this process are excluded.
+func LockFile(ctx context.Context, path string) (func(), error) {
+	lock, _ := fileLocks.LoadOrStore(path, make(chan struct{}, 1))
+	select {
+	case lock.(chan struct{}) <- struct{}{}:
+		return func() { <-lock.(chan struct{}) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// TryLockFile is like LockFile(), but it returns ErrLocked instead of
+// waiting if the lock is held.
+func TryLockFile(path string) (func(), error) {
+	lock, _ := fileLocks.LoadOrStore(path, make(chan struct{}, 1))
+	select {
+	case lock.(chan struct{}) <- struct{}{}:
+		return func() { <-lock.(chan struct{}) }, nil
+	default:
+		return nil, ErrLocked
+	}
+}
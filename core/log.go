@@ -0,0 +1,223 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// logSuffix names the companion file in which the combined output (stdout
+// and stderr, in the order they were written) of an artifact's build is
+// stored. While the target is building, its log is written to a file with
+// `buildingLogSuffix` instead, which is renamed when the build finishes so
+// that readers can tell whether a log is complete.
+const (
+	logSuffix         = ".log"
+	buildingLogSuffix = ".log.building"
+)
+
+// LogPath returns the location of the log of the build of the artifact `id`.
+func (c LocalCache) LogPath(id ArtifactID) string {
+	return c.Path(id) + logSuffix
+}
+
+// buildingLogPath returns the location of the log of the build of the
+// artifact `id` while it's in progress.
+func (c LocalCache) buildingLogPath(id ArtifactID) string {
+	return c.Path(id) + buildingLogSuffix
+}
+
+// buildLog records the output of a target's build in the cache.
+type buildLog struct {
+	lock sync.Mutex
+	file *os.File
+	path string
+
+	// partialLine is true if the last write didn't end with a newline.
+	partialLine bool
+}
+
+func (l *buildLog) write(data string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if data == "" {
+		return nil
+	}
+	l.partialLine = !strings.HasSuffix(data, "\n")
+	_, err := l.file.WriteString(data)
+	return err
+}
+
+// finish closes the log and moves it to `path`.
+func (l *buildLog) finish(path string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(l.path, path)
+}
+
+// recordLog returns an emit function which forwards events to `emit` and
+// records the target's build output in the cache. A log is only written if
+// the target is built (i.e., not on a cache hit), and it's kept whether or
+// not the build succeeds. Failing to write the log doesn't fail the build.
+func recordLog(
+	cache LocalCache,
+	id ArtifactID,
+	emit func(e Event),
+) func(e Event) {
+	var log *buildLog
+	warn := func(err error) {
+		emit(Event{
+			Type:  EventWarning,
+			Error: errors.Wrapf(err, "Writing build log of %s", id).Error(),
+		})
+	}
+	return func(e Event) {
+		switch e.Type {
+		case EventCacheMiss:
+			path := cache.buildingLogPath(id)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				warn(err)
+				break
+			}
+			file, err := os.Create(path)
+			if err != nil {
+				warn(err)
+				break
+			}
+			log = &buildLog{file: file, path: path}
+		case EventStdout, EventStderr:
+			if log != nil {
+				if err := log.write(e.Data); err != nil {
+					warn(err)
+				}
+			}
+		case EventTargetFinished, EventTargetFailed:
+			if log == nil {
+				break
+			}
+			if e.Type == EventTargetFailed {
+				msg := fmt.Sprintf("Build failed: %s\n", e.Error)
+				if log.partialLine {
+					msg = "\n" + msg
+				}
+				if err := log.write(msg); err != nil {
+					warn(err)
+				}
+			}
+			if err := log.finish(cache.LogPath(id)); err != nil {
+				warn(err)
+			}
+			log = nil
+		}
+		emit(e)
+	}
+}
+
+// Building returns true if the artifact `id` is being built, i.e., its log
+// is still being written and its lock is held. A log left behind by a build
+// which was interrupted (e.g., because builder crashed) isn't being written,
+// since the lock was released with the process. Where locks aren't shared
+// between processes (see LockFile()), any log which is being written is
+// assumed to belong to a build in progress.
+func (c LocalCache) Building(id ArtifactID) (bool, error) {
+	if _, err := os.Stat(c.buildingLogPath(id)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !sharedLocks {
+		return true, nil
+	}
+	unlock, err := TryLockFile(c.Path(id) + lockSuffix)
+	if err == ErrLocked {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	unlock()
+	return false, nil
+}
+
+// LogEntry is the stored log of a build of a target.
+type LogEntry struct {
+	ID      ArtifactID
+	Path    string
+	ModTime time.Time
+
+	// Building is true if the build is still in progress, in which case the
+	// log is still being written. The logs of interrupted builds aren't
+	// building (see Building()).
+	Building bool
+}
+
+// Logs returns the stored logs of the builds of the target `tid` at any
+// version, oldest first.
+func (c LocalCache) Logs(tid TargetID) ([]LogEntry, error) {
+	dir := filepath.Dir(c.Path(ArtifactID{
+		Package: tid.Package,
+		Target:  tid.Target,
+	}))
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []LogEntry
+	for _, name := range names {
+		var entry LogEntry
+		var checksum string
+		switch {
+		case strings.HasSuffix(name, buildingLogSuffix):
+			checksum = strings.TrimSuffix(name, buildingLogSuffix)
+			entry.Building = true
+		case strings.HasSuffix(name, logSuffix):
+			checksum = strings.TrimSuffix(name, logSuffix)
+		default:
+			continue
+		}
+		entry.ID = ArtifactID{Package: tid.Package, Target: tid.Target}
+		if entry.ID.Checksum, err = ParseChecksum(checksum); err != nil {
+			continue
+		}
+		entry.Path = filepath.Join(dir, name)
+		info, err := os.Stat(entry.Path)
+		if os.IsNotExist(err) {
+			// The build finished (and its log was renamed) while we were
+			// listing the directory.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry.ModTime = info.ModTime()
+		if entry.Building {
+			if entry.Building, err = c.Building(entry.ID); err != nil {
+				return nil, err
+			}
+		}
+		logs = append(logs, entry)
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].ModTime.Before(logs[j].ModTime)
+	})
+	return logs, nil
+}
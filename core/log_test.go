@@ -0,0 +1,143 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestLocalExecutor_Logs(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	execute := LocalExecutor(
+		[]Plugin{{
+			Type: "echo",
+			BuildScript: func(
+				_ context.Context,
+				dag DAG,
+				cache LocalCache,
+				stdout io.Writer,
+				stderr io.Writer,
+			) error {
+				fmt.Fprintln(stdout, "out")
+				fmt.Fprint(stderr, "err")
+				if dag.ID.Target == "fails" {
+					return errors.New("boom")
+				}
+				return cache.Write(
+					dag.ID.ArtifactID(),
+					func(w io.Writer) error { return nil },
+				)
+			},
+		}},
+		cache,
+		nil,
+		func(Event) {},
+	)
+	dag := func(target TargetName) DAG {
+		return DAG{FrozenTarget: FrozenTarget{
+			ID: FrozenTargetID{
+				Package:  "pkg",
+				Target:   target,
+				Checksum: ChecksumString(string(target)),
+			},
+			BuilderType: "echo",
+		}}
+	}
+	readLog := func(target TargetName) string {
+		logs, err := cache.Logs(TargetID{Package: "pkg", Target: target})
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if len(logs) != 1 || logs[0].Building {
+			t.Fatalf("Wanted one finished log; got %v", logs)
+		}
+		if logs[0].ID != dag(target).ID.ArtifactID() {
+			t.Fatalf("Wanted log of %s; got %s", dag(target).ID, logs[0].ID)
+		}
+		data, err := ioutil.ReadFile(logs[0].Path)
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		return string(data)
+	}
+
+	if err := execute(context.Background(), dag("succeeds")); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if got := readLog("succeeds"); got != "out\nerr" {
+		t.Fatalf("Wanted 'out\\nerr'; got '%s'", got)
+	}
+
+	// A cache hit doesn't replace the log of the build.
+	if err := execute(context.Background(), dag("succeeds")); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if got := readLog("succeeds"); got != "out\nerr" {
+		t.Fatalf("Wanted 'out\\nerr'; got '%s'", got)
+	}
+
+	// Failed builds' logs are kept, along with the error.
+	if err := execute(context.Background(), dag("fails")); err == nil {
+		t.Fatal("Wanted an error")
+	}
+	got := readLog("fails")
+	if !strings.HasPrefix(got, "out\nerr\nBuild failed: ") ||
+		!strings.HasSuffix(got, "boom\n") {
+		t.Fatalf("Wanted the output and the error; got '%s'", got)
+	}
+}
+
+func TestLocalCache_Logs_Interrupted(t *testing.T) {
+	if !sharedLocks {
+		t.Skip("Locks aren't shared between processes")
+	}
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	tid := TargetID{Package: "pkg", Target: "target"}
+	id := ArtifactID{
+		Package:  tid.Package,
+		Target:   tid.Target,
+		Checksum: ChecksumString("target"),
+	}
+	path := cache.buildingLogPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("partial"), 0644); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	building := func() bool {
+		logs, err := cache.Logs(tid)
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if len(logs) != 1 {
+			t.Fatalf("Wanted one log; got %v", logs)
+		}
+		return logs[0].Building
+	}
+
+	// While the artifact is locked, its build is in progress.
+	unlock, err := cache.Lock(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if !building() {
+		t.Fatal("Wanted the log of a build in progress")
+	}
+	unlock()
+
+	// Once it isn't (e.g., because the builder crashed), the log left
+	// behind is no longer being written.
+	if building() {
+		t.Fatal("Wanted the log of an interrupted build")
+	}
+}
@@ -0,0 +1,185 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+)
+
+// Besides its artifact, a target may produce named outputs, e.g., a test's
+// log and JUnit report or a binary's debug symbols. Each output is a file or
+// directory stored in the cache next to the target's artifact (at
+// `<artifact>.outputs/<name>`), and other targets may depend on an output
+// rather than on the whole artifact via `target["name"]` in Starlark. Which
+// outputs a target produces is up to its plugin; a dependency on an output
+// which the target didn't produce is an error when the dependent is built.
+
+var outputNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// ValidateOutputName returns an error unless `name` is a valid output name:
+// a lowercase identifier, such that `OUTPUT_<NAME>` is a valid environment
+// variable.
+func ValidateOutputName(name string) error {
+	if !outputNamePattern.MatchString(name) {
+		return errors.Errorf(
+			"Invalid output name '%s'; output names must be lowercase "+
+				"letters, digits, and underscores, starting with a letter",
+			name,
+		)
+	}
+	return nil
+}
+
+// OutputEnvVar returns the name of the environment variable via which build
+// commands are told where to write the named output.
+func OutputEnvVar(name string) string {
+	return "OUTPUT_" + strings.ToUpper(name)
+}
+
+// outputsSuffix names the companion directory in which an artifact's named
+// outputs are stored.
+const outputsSuffix = ".outputs"
+
+// OutputsDir returns the directory in which the named outputs of the
+// artifact `id` are stored.
+func (c LocalCache) OutputsDir(id ArtifactID) string {
+	return c.Path(id) + outputsSuffix
+}
+
+// OutputPath returns the location of the named output of the artifact `id`.
+func (c LocalCache) OutputPath(id ArtifactID, name string) string {
+	return filepath.Join(c.OutputsDir(id), name)
+}
+
+// TargetOutput refers to a named output of a target, i.e., `target["name"]`.
+type TargetOutput struct {
+	Target Target
+	Output string
+}
+
+func (to TargetOutput) Freeze() {}
+
+func (to TargetOutput) String() string {
+	return fmt.Sprintf("%s[%q]", to.Target, to.Output)
+}
+
+func (to TargetOutput) Type() string { return "TargetOutput" }
+
+func (to TargetOutput) Truth() starlark.Bool { return starlark.True }
+
+func (to TargetOutput) Hash() (uint32, error) {
+	return to.hash().starlarkHash(), nil
+}
+
+func (to TargetOutput) input() {}
+
+func (to TargetOutput) hash() Checksum {
+	return newHasher(tagOutput).
+		checksum(to.Target.hash()).
+		string(to.Output).
+		sum()
+}
+
+func (to TargetOutput) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Target Target `json:"target"`
+		Output string `json:"output"`
+	}{Target: to.Target, Output: to.Output})
+}
+
+// Get implements `target["name"]`.
+func (t Target) Get(k starlark.Value) (starlark.Value, bool, error) {
+	name, ok := k.(starlark.String)
+	if !ok {
+		return nil, false, NewTypeErr("str", k)
+	}
+	if err := ValidateOutputName(string(name)); err != nil {
+		return nil, false, err
+	}
+	return TargetOutput{Target: t, Output: string(name)}, true, nil
+}
+
+// OutputID identifies a named output of an artifact. It's the frozen form of
+// a TargetOutput.
+type OutputID struct {
+	Artifact ArtifactID
+	Output   string
+}
+
+func (id OutputID) String() string {
+	return fmt.Sprintf("%s[%s]", id.Artifact, id.Output)
+}
+
+func (id OutputID) frozenInput() {}
+
+func (id OutputID) checksum() Checksum {
+	return newHasher(tagOutput).
+		checksum(id.Artifact.checksum()).
+		string(id.Output).
+		sum()
+}
+
+// AssertOutputID asserts that the input is a named output of an artifact.
+func AssertOutputID(f func(OutputID) error) func(FrozenInput) error {
+	return func(fi FrozenInput) error {
+		if id, ok := fi.(OutputID); ok {
+			return f(id)
+		}
+		return NewTypeErr("OutputID", fi)
+	}
+}
+
+// OutputIDs returns every named output referenced by `fi`.
+func OutputIDs(fi FrozenInput) []OutputID {
+	switch x := fi.(type) {
+	case OutputID:
+		return []OutputID{x}
+	case FrozenObject:
+		var ids []OutputID
+		for _, field := range x {
+			ids = append(ids, OutputIDs(field.Value)...)
+		}
+		return ids
+	case FrozenArray:
+		var ids []OutputID
+		for _, elt := range x {
+			ids = append(ids, OutputIDs(elt)...)
+		}
+		return ids
+	}
+	return nil
+}
+
+// MissingOutputErr is returned when a target depends on an output which its
+// dependency didn't produce.
+type MissingOutputErr OutputID
+
+func (err MissingOutputErr) Error() string {
+	return fmt.Sprintf(
+		"Target %s has no output '%s'",
+		err.Artifact,
+		err.Output,
+	)
+}
+
+// checkOutputs returns an error if any of the named outputs on which `dag`
+// depends is missing from the cache. Dependencies are built first, so a
+// missing output is one which the dependency didn't produce.
+func checkOutputs(cache LocalCache, dag DAG) error {
+	for _, id := range OutputIDs(dag.Inputs) {
+		_, err := os.Stat(cache.OutputPath(id.Artifact, id.Output))
+		if os.IsNotExist(err) {
+			return MissingOutputErr(id)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Checking output %s", id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTargetOutput(t *testing.T) {
+	targets, err := evaluateRule(
+		t,
+		"dep = mktarget('dep', 'noop', {})\n"+
+			"log = mktarget('log', 'noop', {'input': dep['log']})\n"+
+			"junit = mktarget('junit', 'noop', {'input': dep['junit']})\n",
+	)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer os.RemoveAll(root)
+	cache := NewLocalCache("workspace", filepath.Join(root, "cache"))
+
+	dags := map[TargetName]DAG{}
+	for _, target := range targets {
+		dag, err := FreezeTarget(root, cache, target)
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		dags[target.ID.Target] = dag
+	}
+
+	var id OutputID
+	if err := dags["log"].Inputs.VisitKey(
+		"input",
+		AssertOutputID(func(x OutputID) error {
+			id = x
+			return nil
+		}),
+	); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	wanted := OutputID{
+		Artifact: dags["dep"].ID.ArtifactID(),
+		Output:   "log",
+	}
+	if id != wanted {
+		t.Fatalf("Wanted %v; got %v", wanted, id)
+	}
+
+	// The output is a dependency on its target, and depending on a
+	// different output of the same target is a different input.
+	if len(dags["log"].Dependencies) != 1 ||
+		dags["log"].Dependencies[0].ID != dags["dep"].ID {
+		t.Fatalf("Wanted a dependency on dep; got %v", dags["log"])
+	}
+	if dags["log"].Inputs.checksum() == dags["junit"].Inputs.checksum() {
+		t.Fatal("Wanted different checksums for different outputs")
+	}
+
+	_, err = evaluateRule(
+		t,
+		"dep = mktarget('dep', 'noop', {})\n"+
+			"bad = mktarget('bad', 'noop', {'input': dep['Bad']})\n",
+	)
+	if err == nil || !strings.Contains(err.Error(), "Invalid output name") {
+		t.Fatalf("Wanted an invalid output name error; got %v", err)
+	}
+}
+
+func TestCheckOutputs(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	id := OutputID{
+		Artifact: ArtifactID{
+			Package:  "pkg",
+			Target:   "dep",
+			Checksum: ChecksumString("dep"),
+		},
+		Output: "log",
+	}
+	dag := DAG{FrozenTarget: FrozenTarget{
+		ID:          FrozenTargetID{Package: "pkg", Target: "t"},
+		BuilderType: "noop",
+		Inputs:      FrozenObject{{Key: "log", Value: id}},
+	}}
+
+	if err := checkOutputs(cache, dag); err != MissingOutputErr(id) {
+		t.Fatalf("Wanted MissingOutputErr; got %v", err)
+	}
+
+	path := cache.OutputPath(id.Artifact, id.Output)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := checkOutputs(cache, dag); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+}
+
+func TestOutputs_RemoteCache(t *testing.T) {
+	serverCache, cleanupServer := tempCache(t)
+	defer cleanupServer()
+	server := httptest.NewServer(CacheServer(serverCache.Directory))
+	defer server.Close()
+	remote := NewHTTPCache(server.URL, "workspace")
+
+	local, cleanup := tempCache(t)
+	defer cleanup()
+	id := ArtifactID{
+		Package:  "pkg",
+		Target:   "target",
+		Checksum: ChecksumString("target"),
+	}
+	for path, contents := range map[string]string{
+		local.Path(id):              "artifact",
+		local.OutputPath(id, "log"): "log",
+		filepath.Join(
+			local.OutputPath(id, "docs"),
+			"index.html",
+		): "docs",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+	if err := remote.Push(id, local); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	// Named outputs are pulled along with their artifact.
+	other, cleanupOther := tempCache(t)
+	defer cleanupOther()
+	if err := remote.Pull(id, other); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	for path, wanted := range map[string]string{
+		other.OutputPath(id, "log"): "log",
+		filepath.Join(
+			other.OutputPath(id, "docs"),
+			"index.html",
+		): "docs",
+	} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if string(data) != wanted {
+			t.Fatalf("Wanted '%s'; got '%s'", wanted, data)
+		}
+	}
+}
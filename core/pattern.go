@@ -0,0 +1,323 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TargetPattern matches a set of targets. Patterns take the following forms:
+//
+//   - `//pkg:target` matches a single target
+//   - `//pkg:*` (or `//pkg:all-targets`) matches every target in a package
+//   - `//pkg:all` matches the package's target named `all` if it has one (as
+//     in Bazel) and every target in the package otherwise
+//   - `//pkg/...` matches every target in `pkg` and in every package beneath
+//     it (`//...` matches every target in the workspace)
+//
+// Like target IDs, the package may be relative to the working directory. A
+// pattern prefixed with `-` is negative: it excludes the targets it matches
+// from the targets matched by the other patterns.
+type TargetPattern struct {
+	Package PackageName
+
+	// If Recursive is set, the pattern matches packages beneath Package as
+	// well as Package itself.
+	Recursive bool
+
+	// The name of the target to match, or "" to match every target.
+	Target TargetName
+
+	// All is set if a non-recursive pattern's target is `all`, in which
+	// case Target is "" but the pattern only matches the package's target
+	// named `all` if it has one (see resolve()).
+	All bool
+
+	Negative bool
+}
+
+func (p TargetPattern) String() string {
+	var sb strings.Builder
+	if p.Negative {
+		sb.WriteString("-")
+	}
+	sb.WriteString("//")
+	sb.WriteString(string(p.Package))
+	if p.Recursive {
+		if p.Package != "" {
+			sb.WriteString("/")
+		}
+		sb.WriteString("...")
+		if p.Target == "" {
+			return sb.String()
+		}
+	}
+	sb.WriteString(":")
+	if p.All {
+		sb.WriteString("all")
+	} else if p.Target == "" {
+		sb.WriteString("*")
+	} else {
+		sb.WriteString(string(p.Target))
+	}
+	return sb.String()
+}
+
+// ParseTargetPattern parses a target pattern. Relative packages are resolved
+// against `cwd`, which must be inside of `workspace`.
+func ParseTargetPattern(workspace, cwd, s string) (TargetPattern, error) {
+	var p TargetPattern
+	if strings.HasPrefix(s, "-") {
+		p.Negative = true
+		s = s[1:]
+	}
+
+	packageName, targetName := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		packageName, targetName = s[:i], s[i+1:]
+	}
+
+	if packageName == "..." || strings.HasSuffix(packageName, "/...") {
+		p.Recursive = true
+		packageName = strings.TrimSuffix(packageName, "...")
+		if packageName != "//" {
+			packageName = strings.TrimSuffix(packageName, "/")
+		}
+	} else if !strings.Contains(s, ":") {
+		// Non-recursive patterns must name a target (or `all`)
+		return TargetPattern{}, InvalidTargetIDErr(s)
+	}
+
+	if targetName == "" && !p.Recursive && strings.Contains(s, ":") {
+		return TargetPattern{}, InvalidTargetIDErr(s)
+	}
+	switch targetName {
+	case "all":
+		p.All = !p.Recursive
+	case "*", "all-targets":
+	default:
+		p.Target = TargetName(targetName)
+	}
+
+	// Reuse the target ID parser to resolve the package.
+	tid, err := ParseTargetID(workspace, cwd, packageName+":_")
+	if err != nil {
+		return TargetPattern{}, err
+	}
+	p.Package = tid.Package
+	return p, nil
+}
+
+// resolve returns the pattern which matches the same targets as `p` in a
+// package with `targets`: if `p` names the target `all` and the package has
+// a target by that name, only that target is matched. A BUILD file may
+// declare such a target (e.g., to group the package's deliverables), and it
+// would otherwise be impossible to build it alone.
+func (p TargetPattern) resolve(targets []Target) TargetPattern {
+	if !p.All {
+		return p
+	}
+	p.All = false
+	for _, target := range targets {
+		if target.ID.Target == "all" {
+			p.Target = target.ID.Target
+			break
+		}
+	}
+	return p
+}
+
+// Matches returns true if the pattern matches the target (regardless of
+// whether the pattern is negative). A pattern whose target is `all` matches
+// every target in its package; see resolve().
+func (p TargetPattern) Matches(tid TargetID) bool {
+	if p.Target != "" && p.Target != tid.Target {
+		return false
+	}
+	if tid.Package == p.Package {
+		return true
+	}
+	return p.Recursive && (p.Package == "" ||
+		strings.HasPrefix(string(tid.Package), string(p.Package)+"/"))
+}
+
+// findPackages returns the packages at or beneath `pkg`, i.e., the
+// directories which contain a BUILD file. Hidden directories are skipped.
+func findPackages(root string, pkg PackageName) ([]PackageName, error) {
+	var packages []PackageName
+	start := filepath.Join(root, filepath.FromSlash(string(pkg)))
+	err := filepath.Walk(start, func(
+		path string,
+		info os.FileInfo,
+		err error,
+	) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != start && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() != "BUILD" {
+			return nil
+		}
+		relpath, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if relpath == "." {
+			relpath = ""
+		}
+		packages = append(packages, PackageName(filepath.ToSlash(relpath)))
+		return nil
+	})
+	return packages, errors.Wrapf(err, "Finding packages beneath //%s", pkg)
+}
+
+// excludesPackage returns true if any of the negative patterns match every
+// target in the package.
+func excludesPackage(negatives []TargetPattern, pkg PackageName) bool {
+	for _, p := range negatives {
+		if p.Target == "" && !p.All && p.Matches(TargetID{Package: pkg}) {
+			return true
+		}
+	}
+	return false
+}
+
+// NoTargetsMatchErr is returned when a set of patterns matches no targets.
+type NoTargetsMatchErr []TargetPattern
+
+func (err NoTargetsMatchErr) Error() string {
+	patterns := make([]string, len(err))
+	for i, p := range err {
+		patterns[i] = p.String()
+	}
+	return fmt.Sprintf("No targets match %s", strings.Join(patterns, " "))
+}
+
+// ExpandPatterns evaluates the packages matched by the positive patterns and
+// returns the targets that they match, less the targets matched by the
+// negative patterns. Each package is evaluated once. Targets are returned in
+// order of the patterns which first match them, and by name within a
+// package.
+func ExpandPatterns(
+	root string,
+	builtinModules map[string]string,
+	patterns ...TargetPattern,
+) ([]Target, error) {
+	targets, _, err := ExpandPatternsLoads(root, builtinModules, patterns...)
+	return targets, err
+}
+
+// ExpandPatternsLoads is like ExpandPatterns(), but it also returns every
+// package whose BUILD file was read, including those which were only
+// loaded by other packages. The packages are returned even if evaluation
+// fails.
+func ExpandPatternsLoads(
+	root string,
+	builtinModules map[string]string,
+	patterns ...TargetPattern,
+) ([]Target, []PackageName, error) {
+	var loads []PackageName
+	loaded := map[PackageName]struct{}{}
+	evaluated := map[PackageName][]Target{}
+	evaluateOnce := func(pkg PackageName) ([]Target, error) {
+		if targets, found := evaluated[pkg]; found {
+			return targets, nil
+		}
+		targets, packages, err := evaluate(pkg, root, builtinModules)
+		for _, loadedPkg := range packages {
+			if _, found := loaded[loadedPkg]; !found {
+				loaded[loadedPkg] = struct{}{}
+				loads = append(loads, loadedPkg)
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Evaluation error")
+		}
+		sort.Slice(targets, func(i, j int) bool {
+			return targets[i].ID.Target < targets[j].ID.Target
+		})
+		evaluated[pkg] = targets
+		return targets, nil
+	}
+
+	var negatives []TargetPattern
+	for _, p := range patterns {
+		if p.Negative {
+			negatives = append(negatives, p)
+		}
+	}
+	excluded := func(tid TargetID, targets []Target) bool {
+		for _, p := range negatives {
+			if p.resolve(targets).Matches(tid) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var matched []Target
+	seen := map[TargetID]struct{}{}
+	for _, p := range patterns {
+		if p.Negative {
+			continue
+		}
+
+		packages := []PackageName{p.Package}
+		if p.Recursive {
+			var err error
+			if packages, err = findPackages(root, p.Package); err != nil {
+				return nil, loads, err
+			}
+		}
+
+		found := false
+		for _, pkg := range packages {
+			// Don't bother evaluating packages that are excluded wholesale
+			// (e.g., by `-//3rdParty/...`) unless they were named
+			// explicitly.
+			if pkg != p.Package && excludesPackage(negatives, pkg) {
+				continue
+			}
+			targets, err := evaluateOnce(pkg)
+			if err != nil {
+				return nil, loads, err
+			}
+			resolved := p.resolve(targets)
+			for _, target := range targets {
+				if !resolved.Matches(target.ID) {
+					continue
+				}
+				found = true
+				if _, ok := seen[target.ID]; ok ||
+					excluded(target.ID, targets) {
+					continue
+				}
+				seen[target.ID] = struct{}{}
+				matched = append(matched, target)
+			}
+		}
+
+		// Naming a target that doesn't exist is an error, but wildcards
+		// may legitimately match nothing.
+		if !found && p.Target != "" && !p.Recursive {
+			return nil, loads, errors.Errorf(
+				"Couldn't find target %s",
+				TargetID{Package: p.Package, Target: p.Target},
+			)
+		}
+	}
+
+	if len(matched) < 1 {
+		return nil, loads, NoTargetsMatchErr(patterns)
+	}
+	return matched, loads, nil
+}
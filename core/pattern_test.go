@@ -0,0 +1,141 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseTargetPattern(t *testing.T) {
+	for _, tc := range []struct {
+		input  string
+		wanted TargetPattern
+	}{
+		{"//pkg:target", TargetPattern{Package: "pkg", Target: "target"}},
+		{"//pkg:all", TargetPattern{Package: "pkg", All: true}},
+		{"//pkg:*", TargetPattern{Package: "pkg"}},
+		{"//pkg:all-targets", TargetPattern{Package: "pkg"}},
+		{"//pkg/...:all", TargetPattern{Package: "pkg", Recursive: true}},
+		{"//...", TargetPattern{Recursive: true}},
+		{"//pkg/...", TargetPattern{Package: "pkg", Recursive: true}},
+		{"...", TargetPattern{Package: "cwd", Recursive: true}},
+		{":all", TargetPattern{Package: "cwd", All: true}},
+		{"sub:t", TargetPattern{Package: "cwd/sub", Target: "t"}},
+		{
+			"-//pkg/...",
+			TargetPattern{Package: "pkg", Recursive: true, Negative: true},
+		},
+	} {
+		got, err := ParseTargetPattern("/ws", "/ws/cwd", tc.input)
+		if err != nil {
+			t.Fatalf("%s: Unexpected err: %v", tc.input, err)
+		}
+		if got != tc.wanted {
+			t.Fatalf("%s: Wanted %+v; got %+v", tc.input, tc.wanted, got)
+		}
+	}
+
+	for _, input := range []string{"//pkg", "//pkg:", "-//pkg"} {
+		if _, err := ParseTargetPattern("/ws", "/ws", input); err == nil {
+			t.Fatalf("%s: Expected an error; got nil", input)
+		}
+	}
+}
+
+func TestExpandPatterns(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	for pkg, build := range map[string]string{
+		"a": `
+x = mktarget(name = "x", type = "noop", args = {})
+y = mktarget(name = "y", type = "noop", args = {})
+`,
+		"c": `
+all = mktarget(name = "all", type = "noop", args = {})
+w = mktarget(name = "w", type = "noop", args = {})
+`,
+		"a/b":     `z = mktarget(name = "z", type = "noop", args = {})`,
+		"vendor":  `v = mktarget(name = "v", type = "noop", args = {})`,
+		"broken":  `this isn't starlark`,
+		".hidden": `this isn't starlark either`,
+	} {
+		if err := os.MkdirAll(filepath.Join(root, pkg), 0755); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if err := ioutil.WriteFile(
+			filepath.Join(root, pkg, "BUILD"),
+			[]byte(build),
+			0644,
+		); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+
+	expand := func(patterns ...string) ([]TargetID, error) {
+		parsed := make([]TargetPattern, len(patterns))
+		for i, pattern := range patterns {
+			p, err := ParseTargetPattern(root, root, pattern)
+			if err != nil {
+				t.Fatalf("Unexpected err: %v", err)
+			}
+			parsed[i] = p
+		}
+		targets, err := ExpandPatterns(root, nil, parsed...)
+		ids := make([]TargetID, len(targets))
+		for i, target := range targets {
+			ids[i] = target.ID
+		}
+		return ids, err
+	}
+
+	for _, tc := range []struct {
+		patterns []string
+		wanted   []TargetID
+	}{
+		{
+			[]string{"//a/...", "//vendor:v"},
+			[]TargetID{{"a", "x"}, {"a", "y"}, {"a/b", "z"}, {"vendor", "v"}},
+		},
+		{
+			[]string{"//a:all", "//a:x"},
+			[]TargetID{{"a", "x"}, {"a", "y"}},
+		},
+		{
+			[]string{
+				"//...",
+				"-//broken/...",
+				"-//a:y",
+				"-//a/b:all",
+				"-//c:*",
+			},
+			[]TargetID{{"a", "x"}, {"vendor", "v"}},
+		},
+
+		// A target named `all` takes precedence over the wildcard.
+		{[]string{"//c:all"}, []TargetID{{"c", "all"}}},
+		{[]string{"//c:*"}, []TargetID{{"c", "all"}, {"c", "w"}}},
+		{[]string{"//c:all-targets"}, []TargetID{{"c", "all"}, {"c", "w"}}},
+		{[]string{"//c/...", "-//c:all"}, []TargetID{{"c", "w"}}},
+	} {
+		got, err := expand(tc.patterns...)
+		if err != nil {
+			t.Fatalf("%v: Unexpected err: %v", tc.patterns, err)
+		}
+		if !reflect.DeepEqual(got, tc.wanted) {
+			t.Fatalf("%v: Wanted %v; got %v", tc.patterns, tc.wanted, got)
+		}
+	}
+
+	if _, err := expand("//a:missing"); err == nil {
+		t.Fatal("Expected an error for a missing target; got nil")
+	}
+	if _, err := expand("//a/...", "-//a/..."); err == nil {
+		t.Fatal("Expected an error when no targets match; got nil")
+	}
+}
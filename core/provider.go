@@ -0,0 +1,179 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Provider is a named set of structured metadata which a target returns
+// alongside its artifact, e.g., the wheels that a Python target provides.
+// Providers are computed when the target is built and stored next to its
+// artifact in the cache, so that the build scripts of dependent targets can
+// read them without crawling the dependencies' artifacts. By convention, a
+// provider includes the transitive information that dependents need (e.g.,
+// the wheels of every transitive dependency) so that it's computed once per
+// target.
+type Provider struct {
+	Name   string
+	Fields FrozenObject
+}
+
+// Providers are the providers returned by a target.
+type Providers []Provider
+
+// Get returns the fields of the provider named `name`.
+func (ps Providers) Get(name string) (FrozenObject, error) {
+	for _, p := range ps {
+		if p.Name == name {
+			return p.Fields, nil
+		}
+	}
+	return nil, ProviderNotFoundErr(name)
+}
+
+// ProviderNotFoundErr is returned when an artifact doesn't have a provider.
+type ProviderNotFoundErr string
+
+func (err ProviderNotFoundErr) Error() string {
+	return fmt.Sprintf("Provider not found: %s", string(err))
+}
+
+// File is a file within an artifact. Providers refer to files this way
+// rather than by absolute path so that they're valid in any cache.
+type File struct {
+	Artifact ArtifactID
+
+	// Path is relative to the artifact and slash-separated.
+	Path string
+}
+
+// Input returns the file as a frozen input, i.e., an object with `artifact`
+// and `path` fields.
+func (f File) Input() FrozenObject {
+	return FrozenObject{
+		{Key: "artifact", Value: f.Artifact},
+		{Key: "path", Value: String(f.Path)},
+	}
+}
+
+// AssertFile asserts that the input refers to a file within an artifact (see
+// File.Input()).
+func AssertFile(f func(File) error) func(FrozenInput) error {
+	return AssertObject(func(fo FrozenObject) error {
+		var file File
+		if err := fo.VisitKeys(
+			KeySpec{Key: "artifact", Value: ParseArtifactID(&file.Artifact)},
+			KeySpec{Key: "path", Value: ParseString(&file.Path)},
+		); err != nil {
+			return err
+		}
+		return f(file)
+	})
+}
+
+// FilePath returns the location of a file in the cache.
+func (c LocalCache) FilePath(f File) string {
+	return filepath.Join(c.Path(f.Artifact), filepath.FromSlash(f.Path))
+}
+
+type wireProvider struct {
+	Name   string      `json:"name"`
+	Fields []wireField `json:"fields"`
+}
+
+// providersSuffix names the companion file in which an artifact's providers
+// are stored.
+const providersSuffix = ".providers"
+
+func (c LocalCache) providersPath(id ArtifactID) string {
+	return c.Path(id) + providersSuffix
+}
+
+// WriteProviders stores the providers of the artifact `id`. Build scripts
+// write providers before moving the artifact into the cache, so any artifact
+// in the cache has its providers (if any) alongside it.
+func (c LocalCache) WriteProviders(id ArtifactID, providers Providers) error {
+	wire := make([]wireProvider, len(providers))
+	for i, p := range providers {
+		fields, err := encodeFields(p.Fields)
+		if err != nil {
+			return errors.Wrapf(err, "Encoding provider %s", p.Name)
+		}
+		wire[i] = wireProvider{Name: p.Name, Fields: fields}
+	}
+	data, err := json.Marshal(wire)
+	if err != nil {
+		return err
+	}
+	return writeCompanion(c.providersPath(id), data)
+}
+
+// writeCompanion writes a companion file via a temporary file so that
+// readers never see a partial file. The temporary file's name is unique, so
+// concurrent writers don't clobber each other's partial files.
+func writeCompanion(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(
+		filepath.Dir(path),
+		filepath.Base(path)+".tmp-",
+	)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadProviders returns the providers of the artifact `id`. An artifact
+// without a providers file has no providers.
+func (c LocalCache) ReadProviders(id ArtifactID) (Providers, error) {
+	data, err := ioutil.ReadFile(c.providersPath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var wire []wireProvider
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return nil, errors.Wrapf(err, "Parsing providers of %s", id)
+	}
+	providers := make(Providers, len(wire))
+	for i, p := range wire {
+		fields, err := decodeFields(p.Fields)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Decoding provider %s", p.Name)
+		}
+		providers[i] = Provider{Name: p.Name, Fields: fields}
+	}
+	return providers, nil
+}
+
+// Provider returns the fields of the provider named `name` of the artifact
+// `id`.
+func (c LocalCache) Provider(id ArtifactID, name string) (FrozenObject, error) {
+	providers, err := c.ReadProviders(id)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := providers.Get(name)
+	return fields, errors.Wrapf(err, "Artifact %s", id)
+}
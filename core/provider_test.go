@@ -0,0 +1,98 @@
+package core
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProviders_RemoteCache(t *testing.T) {
+	serverCache, cleanupServer := tempCache(t)
+	defer cleanupServer()
+	server := httptest.NewServer(CacheServer(serverCache.Directory))
+	defer server.Close()
+	remote := NewHTTPCache(server.URL, "workspace")
+
+	local, cleanup := tempCache(t)
+	defer cleanup()
+	dependency := ArtifactID{
+		Package:  "pkg",
+		Target:   "dependency",
+		Checksum: ChecksumString("dependency"),
+	}
+	id := ArtifactID{
+		Package:  "pkg",
+		Target:   "target",
+		Checksum: ChecksumString("target"),
+	}
+	providers := Providers{{
+		Name: "Info",
+		Fields: FrozenObject{
+			{Key: "name", Value: String("target")},
+			{Key: "count", Value: Int(2)},
+			{Key: "files", Value: FrozenArray{
+				File{Artifact: id, Path: "a.txt"}.Input(),
+				File{Artifact: dependency, Path: "dir/b.txt"}.Input(),
+			}},
+		},
+	}}
+
+	// An artifact without a providers file has no providers.
+	if got, err := local.ReadProviders(id); err != nil || got != nil {
+		t.Fatalf("Wanted no providers; got %v (err: %v)", got, err)
+	}
+	if _, err := local.Provider(id, "Info"); err == nil {
+		t.Fatal("Wanted an error for a missing provider")
+	}
+
+	if err := local.WriteProviders(id, providers); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(local.Path(id)), 0755); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := ioutil.WriteFile(local.Path(id), nil, 0644); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := remote.Push(id, local); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	// Providers are pulled along with their artifact.
+	other, cleanupOther := tempCache(t)
+	defer cleanupOther()
+	if err := remote.Pull(id, other); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	got, err := other.ReadProviders(id)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if !reflect.DeepEqual(got, providers) {
+		t.Fatalf("Wanted %v; got %v", providers, got)
+	}
+
+	fields, err := other.Provider(id, "Info")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	var paths []string
+	if err := fields.VisitKey("files", AssertArrayOf(AssertFile(
+		func(f File) error {
+			paths = append(paths, other.FilePath(f))
+			return nil
+		},
+	))); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	wanted := []string{
+		filepath.Join(other.Path(id), "a.txt"),
+		filepath.Join(other.Path(dependency), "dir", "b.txt"),
+	}
+	if !reflect.DeepEqual(paths, wanted) {
+		t.Fatalf("Wanted %v; got %v", wanted, paths)
+	}
+}
@@ -0,0 +1,692 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	sl "github.com/weberc2/builder/slutil"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// RuleBuilderType is the builder type of targets declared by rules, which
+// are defined in Starlark via `rule()`. A rule's implementation runs when the
+// rule is called (i.e., at evaluation time) and emits shell actions, which
+// are stored in the target's `actions` input and run in order at build time.
+// The target's `kind` input is the rule's name, and its `attrs` input holds
+// its attributes.
+const RuleBuilderType BuilderType = "rule"
+
+// Kind returns the kind of the target as it's shown to users (e.g., by
+// queries and graphs): the name of the rule which declared it or, for
+// targets which weren't declared by a rule, its builder type.
+func (t Target) Kind() BuilderType {
+	if t.BuilderType == RuleBuilderType {
+		for _, field := range t.Inputs {
+			if kind, ok := field.Value.(String); ok && field.Key == "kind" {
+				return BuilderType(kind)
+			}
+		}
+	}
+	return t.BuilderType
+}
+
+// Kind is like Target.Kind(), but for frozen targets.
+func (t FrozenTarget) Kind() BuilderType {
+	if t.BuilderType == RuleBuilderType {
+		if kind, err := t.Inputs.GetString("kind"); err == nil {
+			return BuilderType(kind)
+		}
+	}
+	return t.BuilderType
+}
+
+type attrType string
+
+const (
+	attrString    attrType = "string"
+	attrInt       attrType = "int"
+	attrBool      attrType = "bool"
+	attrLabel     attrType = "label"
+	attrLabelList attrType = "label_list"
+	attrFileGroup attrType = "file_group"
+)
+
+// Attr is the schema of a rule attribute, as returned by the `attr.*()`
+// builtins.
+type Attr struct {
+	typ       attrType
+	mandatory bool
+
+	// def is the attribute's default value, or None if it has none.
+	def starlark.Value
+}
+
+func (a *Attr) Freeze()              { a.def.Freeze() }
+func (a *Attr) String() string       { return fmt.Sprintf("attr.%s()", a.typ) }
+func (a *Attr) Truth() starlark.Bool { return starlark.True }
+func (a *Attr) Type() string         { return "attr" }
+
+func (a *Attr) Hash() (uint32, error) {
+	return 0, errors.New("unhashable type: attr")
+}
+
+func (a *Attr) description() string {
+	switch a.typ {
+	case attrString:
+		return "a string"
+	case attrInt:
+		return "an int"
+	case attrBool:
+		return "a bool"
+	case attrLabel:
+		return "a target"
+	case attrLabelList:
+		return "a list of targets"
+	default:
+		return "a file group (see glob())"
+	}
+}
+
+// check returns an error if `v` isn't a valid value for the attribute.
+func (a *Attr) check(v starlark.Value) error {
+	ok := false
+	switch a.typ {
+	case attrString:
+		_, ok = v.(starlark.String)
+	case attrInt:
+		_, ok = v.(starlark.Int)
+	case attrBool:
+		_, ok = v.(starlark.Bool)
+	case attrLabel:
+		_, ok = v.(Target)
+	case attrFileGroup:
+		_, ok = v.(FileGroup)
+	case attrLabelList:
+		if l, isList := v.(*starlark.List); isList {
+			ok = true
+			for i := 0; i < l.Len(); i++ {
+				if _, isTarget := l.Index(i).(Target); !isTarget {
+					return errors.Errorf(
+						"must be %s; got %s at index %d",
+						a.description(),
+						l.Index(i).Type(),
+						i,
+					)
+				}
+			}
+		}
+	}
+	if !ok {
+		return errors.Errorf("must be %s; got %s", a.description(), v.Type())
+	}
+	return nil
+}
+
+// zero returns the value of an attribute which is neither given nor has a
+// default.
+func (a *Attr) zero() starlark.Value {
+	switch a.typ {
+	case attrString:
+		return starlark.String("")
+	case attrInt:
+		return starlark.MakeInt(0)
+	case attrBool:
+		return starlark.False
+	case attrLabelList:
+		return starlark.NewList(nil)
+	default:
+		return starlark.None
+	}
+}
+
+func attrBuiltin(typ attrType) *starlark.Builtin {
+	return starlark.NewBuiltin(
+		"attr."+string(typ),
+		func(
+			_ *starlark.Thread,
+			b *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			a := &Attr{typ: typ}
+			if err := sl.ParseArgs(
+				b.Name(),
+				sl.Args{Pos: args, Kw: kwargs},
+				sl.ArgsSpec{KwSpecs: []sl.KwSpec{{
+					Keyword: "default",
+					Default: starlark.None,
+					Value: func(v starlark.Value) error {
+						a.def = v
+						if v == starlark.None {
+							return nil
+						}
+						return errors.Wrap(a.check(v), "Invalid default")
+					},
+				}, {
+					Keyword: "mandatory",
+					Default: starlark.False,
+					Value:   sl.ParseBool(&a.mandatory),
+				}, {
+					Keyword: "doc",
+					Default: starlark.String(""),
+					Value:   sl.AssertString(func(string) error { return nil }),
+				}}},
+			); err != nil {
+				return nil, err
+			}
+			if a.mandatory && a.def != starlark.None {
+				return nil, errors.Errorf(
+					"%s(): a mandatory attribute can't have a default",
+					b.Name(),
+				)
+			}
+			return a, nil
+		},
+	)
+}
+
+// attrModule is the `attr` global, whose members declare rule attributes.
+var attrModule = starlarkstruct.FromStringDict(
+	starlark.String("attr"),
+	starlark.StringDict{
+		"string":     attrBuiltin(attrString),
+		"int":        attrBuiltin(attrInt),
+		"bool":       attrBuiltin(attrBool),
+		"label":      attrBuiltin(attrLabel),
+		"label_list": attrBuiltin(attrLabelList),
+		"file_group": attrBuiltin(attrFileGroup),
+	},
+)
+
+type ruleAttr struct {
+	name string
+	*Attr
+}
+
+// Rule is a rule type defined in Starlark via `rule()`. Calling a rule
+// declares a target.
+type Rule struct {
+	// kind is the name of the global to which the rule was first assigned.
+	// It's empty until the module which defines the rule is done loading.
+	kind           string
+	implementation starlark.Callable
+	attrs          []ruleAttr
+
+	// outputs are the names of the named outputs which the rule's actions
+	// write (see ValidateOutputName()).
+	outputs []string
+}
+
+func (r *Rule) Freeze() {
+	r.implementation.Freeze()
+	for _, a := range r.attrs {
+		a.Freeze()
+	}
+}
+
+func (r *Rule) String() string {
+	if r.kind == "" {
+		return "<rule>"
+	}
+	return fmt.Sprintf("<rule %s>", r.kind)
+}
+
+func (r *Rule) Name() string         { return r.kind }
+func (r *Rule) Truth() starlark.Bool { return starlark.True }
+func (r *Rule) Type() string         { return "rule" }
+
+func (r *Rule) Hash() (uint32, error) {
+	return 0, errors.New("unhashable type: rule")
+}
+
+func (r *Rule) attr(name string) (*Attr, bool) {
+	for _, a := range r.attrs {
+		if a.name == name {
+			return a.Attr, true
+		}
+	}
+	return nil, false
+}
+
+// CallInternal declares a target of the rule's kind. The attributes are
+// validated against the rule's schema, and then the implementation is
+// called (with a `ctx` describing the target) to emit the target's actions.
+// Like `name`, `timeout` may be passed to any rule.
+func (r *Rule) CallInternal(
+	th *starlark.Thread,
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	if r.kind == "" {
+		return nil, errors.New(
+			"A rule must be assigned to a global and loaded from another " +
+				"package before it can be called",
+		)
+	}
+	if len(args) > 0 {
+		return nil, errors.Errorf(
+			"%s() only takes keyword arguments",
+			r.kind,
+		)
+	}
+
+	tid := TargetID{Package: PackageName(th.Name)}
+	var timeout time.Duration
+	given := map[string]starlark.Value{}
+	for _, kwarg := range kwargs {
+		key := string(kwarg[0].(starlark.String))
+		if key == "timeout" {
+			var err error
+			if timeout, err = parseTimeout(kwarg[1]); err != nil {
+				return nil, errors.Wrapf(err, "%s()", r.kind)
+			}
+			continue
+		}
+		if key == "name" {
+			name, ok := kwarg[1].(starlark.String)
+			if !ok || name == "" || strings.Contains(string(name), "/") {
+				return nil, errors.Errorf(
+					"%s(): Invalid value for 'name'",
+					r.kind,
+				)
+			}
+			tid.Target = TargetName(name)
+			continue
+		}
+		given[key] = kwarg[1]
+	}
+	if tid.Target == "" {
+		return nil, errors.Errorf(
+			"%s() missing required argument 'name'",
+			r.kind,
+		)
+	}
+	label := fmt.Sprintf("%s(name = %q)", r.kind, tid.Target)
+	for _, kwarg := range kwargs {
+		key := string(kwarg[0].(starlark.String))
+		_, found := r.attr(key)
+		if !found && key != "name" && key != "timeout" {
+			return nil, errors.Errorf(
+				"%s: Unknown attribute '%s'",
+				label,
+				key,
+			)
+		}
+	}
+
+	values := starlark.StringDict{}
+	var attrs Object
+	for _, a := range r.attrs {
+		v, found := given[a.name]
+		switch {
+		case found && v != starlark.None:
+			if err := a.check(v); err != nil {
+				return nil, errors.Wrapf(
+					err,
+					"%s: Attribute '%s'",
+					label,
+					a.name,
+				)
+			}
+		case a.mandatory:
+			return nil, errors.Errorf(
+				"%s: Missing mandatory attribute '%s'",
+				label,
+				a.name,
+			)
+		case a.def != starlark.None:
+			v = a.def
+		default:
+			v = a.zero()
+		}
+		values[a.name] = v
+		if v == starlark.None {
+			continue
+		}
+		input, err := starlarkValueToInput(tid, v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: Attribute '%s'", label, a.name)
+		}
+		attrs = append(attrs, Field{Key: a.name, Value: input})
+	}
+
+	var actions Array
+	ctx := starlarkstruct.FromStringDict(
+		starlark.String("ctx"),
+		starlark.StringDict{
+			"name":    starlark.String(tid.Target),
+			"package": starlark.String(tid.Package),
+			"attr": starlarkstruct.FromStringDict(
+				starlark.String("attr"),
+				values,
+			),
+			"actions": starlarkstruct.FromStringDict(
+				starlark.String("actions"),
+				starlark.StringDict{
+					"run_shell": starlark.NewBuiltin(
+						"run_shell",
+						runShell(tid, &actions),
+					),
+				},
+			),
+			"provider": starlark.NewBuiltin("provider", provider),
+		},
+	)
+	result, err := starlark.Call(
+		th,
+		r.implementation,
+		starlark.Tuple{ctx},
+		nil,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: Running implementation", label)
+	}
+	if result != starlark.None {
+		return nil, errors.Errorf(
+			"%s: Implementation must return None, not a %s",
+			label,
+			result.Type(),
+		)
+	}
+	if len(actions) < 1 {
+		return nil, errors.Errorf(
+			"%s: Implementation emitted no actions",
+			label,
+		)
+	}
+
+	inputs := Object{
+		{Key: "kind", Value: String(r.kind)},
+		{Key: "attrs", Value: attrs},
+		{Key: "actions", Value: actions},
+	}
+	if len(r.outputs) > 0 {
+		outputs := make(Array, len(r.outputs))
+		for i, name := range r.outputs {
+			outputs[i] = String(name)
+		}
+		inputs = append(inputs, Field{Key: "outputs", Value: outputs})
+	}
+	return Target{
+		ID:          tid,
+		Inputs:      inputs,
+		BuilderType: RuleBuilderType,
+		Timeout:     timeout,
+	}, nil
+}
+
+// runShell is the implementation of `ctx.actions.run_shell(command, env)`,
+// which appends an action to `actions`. The command is run by bash with
+// `$OUTPUT`, `$OUTPUT_<NAME>` for each of the rule's named outputs, and the
+// variables in `env` set; targets and file groups in `env` become the paths
+// of their artifacts, named outputs of targets become their paths, and lists
+// of them become space-separated paths.
+func runShell(
+	tid TargetID,
+	actions *Array,
+) func(
+	*starlark.Thread,
+	*starlark.Builtin,
+	starlark.Tuple,
+	[]starlark.Tuple,
+) (starlark.Value, error) {
+	return func(
+		_ *starlark.Thread,
+		_ *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var command string
+		var env Object
+		if err := sl.ParseArgs(
+			"run_shell",
+			sl.Args{Pos: args, Kw: kwargs},
+			sl.ArgsSpec{
+				PosSpecs: []sl.PosSpec{{
+					Keyword: "command",
+					Value:   sl.ParseString(&command),
+				}},
+				KwSpecs: []sl.KwSpec{{
+					Keyword: "env",
+					Default: starlark.NewDict(0),
+					Value: sl.AssertDict(func(d *starlark.Dict) error {
+						var err error
+						env, err = starlarkDictToObject(tid, d)
+						return err
+					}),
+				}},
+			},
+		); err != nil {
+			return nil, err
+		}
+		for _, field := range env {
+			if err := checkEnvValue(field.Value); err != nil {
+				return nil, errors.Wrapf(
+					err,
+					"run_shell(): env '%s'",
+					field.Key,
+				)
+			}
+		}
+		*actions = append(*actions, Object{
+			{Key: "command", Value: String(command)},
+			{Key: "environment", Value: env},
+		})
+		return starlark.None, nil
+	}
+}
+
+func checkEnvValue(input Input) error {
+	switch x := input.(type) {
+	case String, Target, TargetOutput, FileGroup:
+		return nil
+	case Object:
+		if len(x) < 1 || x[0].Key != providerRefKey {
+			return NewTypeErr("str, target, file group, or list", input)
+		}
+		return nil
+	case Array:
+		for _, elt := range x {
+			if _, isArray := elt.(Array); isArray {
+				return errors.New("Nested lists aren't allowed")
+			}
+			if err := checkEnvValue(elt); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return NewTypeErr("str, target, file group, or list", input)
+	}
+}
+
+// providerRefKey identifies the object input to which a ProviderRef is
+// converted.
+const providerRefKey = "provider_of"
+
+// ProviderRef refers to a field of a provider of a target's artifact (see
+// Provider). Because providers are only known once the target is built, a
+// ProviderRef is resolved at build time: rule actions may use it as an
+// environment variable. It's converted to an object input with the fields
+// `provider_of` (the target), `provider`, and `field`.
+type ProviderRef struct {
+	Target   Target
+	Provider string
+	Field    string
+}
+
+func (ref ProviderRef) Freeze() {}
+
+func (ref ProviderRef) String() string {
+	return fmt.Sprintf(
+		"provider(%s, %q, %q)",
+		ref.Target.ID,
+		ref.Provider,
+		ref.Field,
+	)
+}
+
+func (ref ProviderRef) Truth() starlark.Bool { return starlark.True }
+func (ref ProviderRef) Type() string         { return "ProviderRef" }
+
+func (ref ProviderRef) Hash() (uint32, error) {
+	return 0, errors.New("unhashable type: ProviderRef")
+}
+
+func (ref ProviderRef) input() Object {
+	return Object{
+		{Key: providerRefKey, Value: ref.Target},
+		{Key: "provider", Value: String(ref.Provider)},
+		{Key: "field", Value: String(ref.Field)},
+	}
+}
+
+// provider is the implementation of `ctx.provider(target, provider, field)`.
+func provider(
+	_ *starlark.Thread,
+	_ *starlark.Builtin,
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	var ref ProviderRef
+	err := sl.ParseArgs(
+		"provider",
+		sl.Args{Pos: args, Kw: kwargs},
+		sl.ArgsSpec{PosSpecs: []sl.PosSpec{{
+			Keyword: "target",
+			Value: func(v starlark.Value) error {
+				t, ok := v.(Target)
+				if !ok {
+					return sl.NewTypeErr("Target", v)
+				}
+				ref.Target = t
+				return nil
+			},
+		}, {
+			Keyword: "provider",
+			Value:   sl.ParseString(&ref.Provider),
+		}, {
+			Keyword: "field",
+			Value:   sl.ParseString(&ref.Field),
+		}}},
+	)
+	return ref, err
+}
+
+func rule(
+	_ *starlark.Thread,
+	_ *starlark.Builtin,
+	args starlark.Tuple,
+	kwargs []starlark.Tuple,
+) (starlark.Value, error) {
+	r := &Rule{}
+	err := sl.ParseArgs(
+		"rule",
+		sl.Args{Pos: args, Kw: kwargs},
+		sl.ArgsSpec{
+			PosSpecs: []sl.PosSpec{{
+				Keyword: "implementation",
+				Value: func(v starlark.Value) error {
+					fn, ok := v.(starlark.Callable)
+					if !ok {
+						return sl.NewTypeErr("function", v)
+					}
+					r.implementation = fn
+					return nil
+				},
+			}},
+			KwSpecs: []sl.KwSpec{{
+				Keyword: "attrs",
+				Default: starlark.NewDict(0),
+				Value: sl.AssertObjectOf(func(
+					name string,
+					v starlark.Value,
+				) error {
+					a, ok := v.(*Attr)
+					if !ok {
+						return sl.NewTypeErr("attr", v)
+					}
+					if name == "name" || name == "timeout" {
+						return errors.Errorf(
+							"'%s' is a reserved attribute",
+							name,
+						)
+					}
+					r.attrs = append(r.attrs, ruleAttr{name: name, Attr: a})
+					return nil
+				}),
+			}, {
+				Keyword: "doc",
+				Default: starlark.String(""),
+				Value:   sl.AssertString(func(string) error { return nil }),
+			}, {
+				Keyword: "outputs",
+				Default: starlark.NewList(nil),
+				Value: func(v starlark.Value) error {
+					l, ok := v.(*starlark.List)
+					if !ok {
+						return sl.NewTypeErr("list", v)
+					}
+					for i := 0; i < l.Len(); i++ {
+						name, ok := l.Index(i).(starlark.String)
+						if !ok {
+							return sl.NewTypeErr("str", l.Index(i))
+						}
+						err := ValidateOutputName(string(name))
+						if err != nil {
+							return err
+						}
+						r.outputs = append(r.outputs, string(name))
+					}
+					return nil
+				},
+			}},
+		},
+	)
+	sort.Slice(r.attrs, func(i, j int) bool {
+		return r.attrs[i].name < r.attrs[j].name
+	})
+	return r, err
+}
+
+// ruleRegistry maps rule kinds to rules so that `mktarget()` can validate
+// targets of those kinds. A nil rule means that more than one rule has the
+// kind.
+type ruleRegistry map[string]*Rule
+
+// exportRules names the rules among a module's `globals` after the globals
+// to which they're assigned, and registers them.
+func (rules ruleRegistry) exportRules(globals starlark.StringDict) {
+	for _, name := range globals.Keys() {
+		r, ok := globals[name].(*Rule)
+		if !ok || r.kind != "" {
+			continue
+		}
+		r.kind = name
+		if existing, found := rules[name]; found && existing != r {
+			rules[name] = nil
+			continue
+		}
+		rules[name] = r
+	}
+}
+
+const ruleRegistryKey = "rules"
+
+// lookupRule returns the rule of `kind` known to the thread's evaluation,
+// if any.
+func lookupRule(th *starlark.Thread, kind string) (*Rule, bool, error) {
+	rules, _ := th.Local(ruleRegistryKey).(ruleRegistry)
+	r, found := rules[kind]
+	if found && r == nil {
+		return nil, true, errors.Errorf(
+			"More than one rule is named '%s'; call the rule directly",
+			kind,
+		)
+	}
+	return r, found, nil
+}
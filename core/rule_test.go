@@ -0,0 +1,210 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRules = `
+def _concat_impl(ctx):
+    ctx.actions.run_shell(
+        "cat $SRCS > $OUTPUT && echo $GREETING >> $OUTPUT",
+        env = {"SRCS": ctx.attr.srcs, "GREETING": ctx.attr.greeting},
+    )
+
+concat = rule(
+    _concat_impl,
+    attrs = {
+        "srcs": attr.label_list(mandatory = True),
+        "greeting": attr.string(default = "hello"),
+        "count": attr.int(),
+        "verbose": attr.bool(),
+        "tool": attr.label(),
+    },
+)
+
+def _no_actions_impl(ctx):
+    pass
+
+no_actions = rule(_no_actions_impl)
+`
+
+// evaluateRule evaluates a package whose BUILD file is `build` and which can
+// load the rules in `testRules` from the `rules` package.
+func evaluateRule(t *testing.T, build string) ([]Target, error) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer os.RemoveAll(root)
+	for pkg, contents := range map[string]string{
+		"rules": testRules,
+		"app":   "load(\"rules\", \"concat\", \"no_actions\")\n" + build,
+	} {
+		if err := os.MkdirAll(filepath.Join(root, pkg), 0755); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if err := ioutil.WriteFile(
+			filepath.Join(root, pkg, "BUILD"),
+			[]byte(contents),
+			0644,
+		); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+	return Evaluate("app", root, nil)
+}
+
+func TestRule(t *testing.T) {
+	for _, build := range []string{
+		"dep = mktarget('dep', 'noop', {})\n" +
+			"out = concat(name = 'out', srcs = [dep])\n",
+		"dep = mktarget('dep', 'noop', {})\n" +
+			"out = mktarget('out', 'concat', {'srcs': [dep]})\n",
+	} {
+		targets, err := evaluateRule(t, build)
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		var out *Target
+		for i := range targets {
+			if targets[i].ID.Target == "out" {
+				out = &targets[i]
+			}
+		}
+		if out == nil {
+			t.Fatalf("Target 'out' not found in %v", targets)
+		}
+		if out.BuilderType != RuleBuilderType {
+			t.Fatalf(
+				"Wanted type '%s'; got '%s'",
+				RuleBuilderType,
+				out.BuilderType,
+			)
+		}
+
+		for _, wanted := range []string{
+			`"kind":"concat"`,
+			// Attributes are sorted, and those without values (e.g., `tool`)
+			// are omitted.
+			`"attrs":{"count":0,"greeting":"hello","srcs":[`,
+			`"verbose":false}`,
+			`"command":"cat $SRCS `,
+			`"environment":{"SRCS":[`,
+		} {
+			data, err := out.Inputs.MarshalJSON()
+			if err != nil {
+				t.Fatalf("Unexpected err: %v", err)
+			}
+			if !strings.Contains(string(data), wanted) {
+				t.Fatalf("Wanted inputs containing %s; got %s", wanted, data)
+			}
+		}
+	}
+}
+
+func TestRule_Timeout(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	for _, build := range []string{
+		"out = concat(name = 'out', srcs = [], timeout = '90s')\n",
+		"out = mktarget('out', 'concat', {'srcs': []}, timeout = '90s')\n",
+	} {
+		targets, err := evaluateRule(t, build)
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if len(targets) != 1 || targets[0].Timeout != 90*time.Second {
+			t.Fatalf("Wanted one target with a 90s timeout; got %v", targets)
+		}
+
+		// The timeout doesn't affect the target's checksum.
+		dag, err := FreezeTarget("", cache, targets[0])
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		targets[0].Timeout = 0
+		untimed, err := FreezeTarget("", cache, targets[0])
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if dag.Timeout != 90*time.Second || dag.ID != untimed.ID {
+			t.Fatalf(
+				"Wanted %s with a 90s timeout; got %s with %s",
+				untimed.ID,
+				dag.ID,
+				dag.Timeout,
+			)
+		}
+	}
+}
+
+func TestRule_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		build     string
+		wantedErr string
+	}{
+		{
+			name:  "missing-mandatory",
+			build: "out = concat(name = 'out')\n",
+			wantedErr: `concat(name = "out"): Missing mandatory ` +
+				`attribute 'srcs'`,
+		},
+		{
+			name:  "wrong-type",
+			build: "out = concat(name = 'out', srcs = ['a.txt'])\n",
+			wantedErr: "Attribute 'srcs': must be a list of targets; got " +
+				"string at index 0",
+		},
+		{
+			name:      "unknown-attribute",
+			build:     "out = concat(name = 'out', srcs = [], color = 'red')\n",
+			wantedErr: "Unknown attribute 'color'",
+		},
+		{
+			name:      "mktarget-wrong-type",
+			build:     "out = mktarget('out', 'concat', {'srcs': 'a'})\n",
+			wantedErr: "must be a list of targets; got string",
+		},
+		{
+			name: "invalid-timeout",
+			build: "out = concat(name = 'out', srcs = [], " +
+				"timeout = 'soon')\n",
+			wantedErr: "Invalid value for 'timeout'",
+		},
+		{
+			name:      "no-actions",
+			build:     "out = no_actions(name = 'out')\n",
+			wantedErr: "Implementation emitted no actions",
+		},
+		{
+			name: "unexported",
+			build: "def _impl(ctx):\n    pass\n" +
+				"local = rule(_impl)\n" +
+				"out = local(name = 'out')\n",
+			wantedErr: "must be assigned to a global and loaded",
+		},
+		{
+			name:      "mandatory-default",
+			build:     "a = attr.string(mandatory = True, default = 'x')\n",
+			wantedErr: "a mandatory attribute can't have a default",
+		},
+		{
+			name:      "invalid-default",
+			build:     "a = attr.int(default = 'x')\n",
+			wantedErr: "must be an int; got string",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := evaluateRule(t, tc.build)
+			if err == nil || !strings.Contains(err.Error(), tc.wantedErr) {
+				t.Fatalf("Wanted error '%s'; got %v", tc.wantedErr, err)
+			}
+		})
+	}
+}
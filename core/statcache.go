@@ -0,0 +1,129 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// racyInterval is how long a file must go unmodified before its digest is
+// recorded in the stat cache. A file modified twice in quick succession may
+// keep the same size and modification time (filesystem timestamps are
+// coarse), so a digest recorded between the two modifications could
+// otherwise be reused for the second version.
+const racyInterval = 2 * time.Second
+
+// fileKey identifies a version of a file without reading it. If any of these
+// change, the file is presumed to have changed.
+type fileKey struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime_ns"`
+	Inode   uint64 `json:"inode"`
+}
+
+func newFileKey(info os.FileInfo) fileKey {
+	return fileKey{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Inode:   inode(info),
+	}
+}
+
+type statEntry struct {
+	fileKey
+	Digest Checksum `json:"digest"`
+}
+
+// statCache remembers the digests of source files by their stat info so that
+// unchanged files needn't be re-read to freeze file groups. It's persisted
+// per workspace in the cache directory. Entries are keyed by absolute path.
+type statCache struct {
+	path    string
+	entries map[string]statEntry
+	dirty   bool
+}
+
+func (c LocalCache) statCachePath() string {
+	return filepath.Join(c.Directory, c.WorkspaceID, "statcache.json")
+}
+
+// loadStatCache reads the stat cache at `path`. A missing or unreadable stat
+// cache is treated as empty; it's only an optimization.
+func loadStatCache(path string) *statCache {
+	c := &statCache{path: path, entries: map[string]statEntry{}}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		c.entries = map[string]statEntry{}
+	}
+	return c
+}
+
+// digest returns the checksum of the contents of the file at `path`, whose
+// stat info is `info`, reading the file only if it has changed since it was
+// last recorded.
+func (c *statCache) digest(path string, info os.FileInfo) (Checksum, error) {
+	key := newFileKey(info)
+	if entry, found := c.entries[path]; found && entry.fileKey == key {
+		return entry.Digest, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return Checksum{}, err
+	}
+	defer file.Close()
+	digest, err := ChecksumReader(file, info.Size())
+	if err != nil {
+		return Checksum{}, errors.Wrapf(err, "Hashing %s", path)
+	}
+
+	if time.Since(info.ModTime()) > racyInterval {
+		c.entries[path] = statEntry{fileKey: key, Digest: digest}
+		c.dirty = true
+	}
+	return digest, nil
+}
+
+// save writes the stat cache back to disk if it has changed. The file is
+// replaced atomically, so concurrent builders never see a partial write
+// (although one builder's additions may be lost to another's).
+func (c *statCache) save() error {
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return errors.Wrap(err, "Marshaling stat cache")
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return errors.Wrap(err, "Creating stat cache directory")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), ".statcache-")
+	if err != nil {
+		return errors.Wrap(err, "Creating stat cache")
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Creating stat cache")
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Writing stat cache")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "Writing stat cache")
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return errors.Wrap(err, "Replacing stat cache")
+	}
+	c.dirty = false
+	return nil
+}
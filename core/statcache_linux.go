@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package core
+
+import (
+	"os"
+	"syscall"
+)
+
+// inode returns the file's inode number, so that replacing a file (e.g., via
+// `git checkout`) invalidates its stat cache entry even if its size and
+// modification time are unchanged.
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+	return 0
+}
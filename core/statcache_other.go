@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import "os"
+
+// inode isn't available portably, so files are identified by their size and
+// modification time alone.
+func inode(info os.FileInfo) uint64 { return 0 }
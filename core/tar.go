@@ -0,0 +1,157 @@
+package core
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// writeTar streams the directory tree rooted at `dir` to `w` as a tar
+// archive. Entry names are relative to `dir`.
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	if err := filepath.Walk(dir, func(
+		path string,
+		info os.FileInfo,
+		err error,
+	) error {
+		if err != nil {
+			return err
+		}
+		relpath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if relpath == "." {
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return errors.Wrapf(err, "Creating tar header for %s", relpath)
+		}
+		header.Name = filepath.ToSlash(relpath)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	}); err != nil {
+		return errors.Wrapf(err, "Archiving directory %s", dir)
+	}
+	return tw.Close()
+}
+
+// extractTar extracts the tar archive in `r` into the directory `dir`, which
+// must already exist. Entries which would escape `dir` are rejected. Symlinks
+// are extracted as they are (artifacts such as virtualenvs legitimately link
+// outside of themselves), but no entry may be written through a symlink, so
+// an archive can't use one to write outside of `dir`.
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "Reading tar archive")
+		}
+
+		path := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if path != dir &&
+			!strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return errors.Errorf(
+				"Tar entry %s escapes destination directory",
+				header.Name,
+			)
+		}
+		if err := checkSymlinks(dir, path); err != nil {
+			return errors.Wrapf(err, "Extracting tar entry %s", header.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeFile(path, mode, tr); err != nil {
+				return err
+			}
+		default:
+			return errors.Errorf(
+				"Unsupported tar entry type '%c' for %s",
+				header.Typeflag,
+				header.Name,
+			)
+		}
+	}
+}
+
+// checkSymlinks returns an error if `path` or any of its parent directories
+// beneath `dir` is a symlink.
+func checkSymlinks(dir, path string) error {
+	relpath, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	}
+	if relpath == "." {
+		return nil
+	}
+	current := dir
+	for _, part := range strings.Split(relpath, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			// Nothing beneath a missing directory exists either.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("%s is a symlink", current)
+		}
+	}
+	return nil
+}
+
+func writeFile(path string, mode os.FileMode, r io.Reader) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
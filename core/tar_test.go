@@ -0,0 +1,117 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	data     string
+}
+
+func makeTar(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Size:     int64(len(entry.data)),
+		}); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if _, err := tw.Write([]byte(entry.data)); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	return &buf
+}
+
+func TestExtractTar_Symlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer os.RemoveAll(root)
+	outside := filepath.Join(root, "outside")
+	victim := filepath.Join(outside, "passwd")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := ioutil.WriteFile(victim, []byte("original"), 0644); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		entries []tarEntry
+		wantErr bool
+	}{
+		{
+			// Links outside of the artifact are fine so long as nothing is
+			// written through them (e.g., a virtualenv's `bin/python`).
+			name: "absolute-link",
+			entries: []tarEntry{{
+				name:     "bin/python",
+				typeflag: tar.TypeSymlink,
+				linkname: "/usr/bin/python3",
+			}},
+		},
+		{
+			name: "write-beneath-link",
+			entries: []tarEntry{
+				{name: "x", typeflag: tar.TypeSymlink, linkname: outside},
+				{name: "x/passwd", typeflag: tar.TypeReg, data: "pwned"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "overwrite-link",
+			entries: []tarEntry{
+				{name: "x", typeflag: tar.TypeSymlink, linkname: victim},
+				{name: "x", typeflag: tar.TypeReg, data: "pwned"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "parent-escape",
+			entries: []tarEntry{
+				{name: "../passwd", typeflag: tar.TypeReg, data: "pwned"},
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir(root, "")
+			if err != nil {
+				t.Fatalf("Unexpected err: %v", err)
+			}
+			err = extractTar(makeTar(t, tc.entries...), dir)
+			if tc.wantErr && err == nil {
+				t.Fatal("Wanted an error")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("Unexpected err: %v", err)
+			}
+			data, err := ioutil.ReadFile(victim)
+			if err != nil {
+				t.Fatalf("Unexpected err: %v", err)
+			}
+			if string(data) != "original" {
+				t.Fatalf("File outside of the destination was overwritten")
+			}
+		})
+	}
+}
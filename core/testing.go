@@ -0,0 +1,220 @@
+package core
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TestBuilderType is the builder type of test targets. A test target's
+// artifact is only stored if the test passes, so passing results are cached
+// by the target's frozen checksum and failing tests are re-run.
+const TestBuilderType BuilderType = "test"
+
+// Test artifacts are directories containing the test's combined output and,
+// if the test runner wrote one, a JUnit XML report.
+const (
+	TestLogFile   = "test.log"
+	TestJUnitFile = "junit.xml"
+)
+
+// TestFailedErr is returned by a test target's build script when the test
+// ran but failed (i.e., exited non-zero), as opposed to when the test
+// couldn't be run at all.
+type TestFailedErr struct {
+	Target FrozenTargetID
+	Err    error
+}
+
+func (err TestFailedErr) Error() string {
+	return fmt.Sprintf(
+		"Test %s:%s failed: %v",
+		err.Target.Package,
+		err.Target.Target,
+		err.Err,
+	)
+}
+
+type TestStatus string
+
+const (
+	TestPassed TestStatus = "PASSED"
+	TestCached TestStatus = "CACHED"
+	TestFailed TestStatus = "FAILED"
+
+	// TestNotRun is the status of tests which weren't run because the build
+	// failed first.
+	TestNotRun TestStatus = "NOT RUN"
+)
+
+// TestResult is the outcome of running (or finding the cached result of) a
+// single test target.
+type TestResult struct {
+	Target   FrozenTargetID
+	Status   TestStatus
+	Duration time.Duration
+
+	// The test's output; only retained for failing tests, whose artifacts
+	// aren't stored.
+	Output string
+}
+
+// failedJUnitSuffix names the companion file in which the JUnit report of
+// the latest failing run of a test is kept. Failing tests' artifacts aren't
+// stored, so their reports would otherwise be lost.
+const failedJUnitSuffix = ".junit.xml"
+
+func (c LocalCache) failedJUnitPath(id ArtifactID) string {
+	return c.Path(id) + failedJUnitSuffix
+}
+
+// KeepFailedJUnit keeps the JUnit report at `src`, which was written by a
+// failing run of the test `id`, for WriteJUnit(). If the run didn't write a
+// report, any report kept from an earlier run is removed.
+func (c LocalCache) KeepFailedJUnit(id FrozenTargetID, src string) error {
+	path := c.failedJUnitPath(id.ArtifactID())
+	data, err := ioutil.ReadFile(src)
+	if os.IsNotExist(err) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return writeCompanion(path, data)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+// junitTestSuite is a test suite as reported by a test runner. Only the
+// attributes are interpreted; the contents are copied verbatim.
+type junitTestSuite struct {
+	XMLName xml.Name   `xml:"testsuite"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+// readJUnit reads the test suites from a JUnit report whose root is either a
+// `testsuites` or a single `testsuite` element.
+func readJUnit(data []byte) ([]junitTestSuite, error) {
+	var suites junitTestSuites
+	if err := xml.Unmarshal(data, &suites); err == nil {
+		return suites.Suites, nil
+	}
+	var suite junitTestSuite
+	if err := xml.Unmarshal(data, &suite); err != nil {
+		return nil, err
+	}
+	return []junitTestSuite{suite}, nil
+}
+
+// syntheticSuite reports a test target as a suite with a single test case,
+// for tests whose runners don't produce JUnit reports.
+func syntheticSuite(result TestResult) junitTestSuite {
+	type failure struct {
+		Message string `xml:"message,attr"`
+		Output  string `xml:",chardata"`
+	}
+	type testCase struct {
+		XMLName xml.Name `xml:"testcase"`
+		Name    string   `xml:"name,attr"`
+		Time    string   `xml:"time,attr"`
+		Failure *failure `xml:"failure,omitempty"`
+	}
+
+	tc := testCase{
+		Name: string(result.Target.Target),
+		Time: fmt.Sprintf("%.3f", result.Duration.Seconds()),
+	}
+	failures := "0"
+	if result.Status == TestFailed {
+		tc.Failure = &failure{Message: "Test failed", Output: result.Output}
+		failures = "1"
+	}
+	inner, err := xml.Marshal(tc)
+	if err != nil {
+		// A struct of strings always marshals.
+		panic(err)
+	}
+
+	name := result.Target.ArtifactID().String()
+	return junitTestSuite{
+		Attrs: []xml.Attr{
+			{Name: xml.Name{Local: "name"}, Value: name},
+			{Name: xml.Name{Local: "tests"}, Value: "1"},
+			{Name: xml.Name{Local: "failures"}, Value: failures},
+			{Name: xml.Name{Local: "time"}, Value: tc.Time},
+		},
+		Inner: string(inner),
+	}
+}
+
+// readJUnitFile reads the test suites from the JUnit report at `path`. It
+// returns false if there is no report.
+func readJUnitFile(path string) ([]junitTestSuite, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	suites, err := readJUnit(data)
+	return suites, true, err
+}
+
+// WriteJUnit writes a single JUnit report for the results. The suites from
+// each test's own JUnit report (if any) are included verbatim, including the
+// reports kept from failing runs (see KeepFailedJUnit()); each test without
+// one is reported as a suite with a single test case. Tests which weren't
+// run are omitted.
+func WriteJUnit(w io.Writer, cache LocalCache, results []TestResult) error {
+	var report junitTestSuites
+	for _, result := range results {
+		if result.Status == TestNotRun {
+			continue
+		}
+		id := result.Target.ArtifactID()
+		path := filepath.Join(cache.Path(id), TestJUnitFile)
+		if result.Status == TestFailed {
+			path = cache.failedJUnitPath(id)
+		}
+		suites, found, err := readJUnitFile(path)
+		if err != nil && result.Status != TestFailed {
+			return errors.Wrapf(
+				err,
+				"Parsing JUnit report for %s",
+				result.Target,
+			)
+		}
+		// A failing test may have been killed while writing its report, so
+		// a report which can't be read is reported as if it were missing.
+		if found && err == nil {
+			report.Suites = append(report.Suites, suites...)
+			continue
+		}
+		report.Suites = append(report.Suites, syntheticSuite(result))
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return errors.Wrap(err, "Writing JUnit report")
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
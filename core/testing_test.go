@@ -0,0 +1,134 @@
+package core
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteJUnit(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+
+	passed := FrozenTargetID{
+		Package:  "pkg",
+		Target:   "passed",
+		Checksum: ChecksumString("passed"),
+	}
+	dir := cache.Path(passed.ArtifactID())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := ioutil.WriteFile(
+		filepath.Join(dir, TestJUnitFile),
+		[]byte(`<testsuite name="runner"><testcase name="a"/></testsuite>`),
+		0644,
+	); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteJUnit(&buf, cache, []TestResult{
+		{Target: passed, Status: TestPassed},
+		{
+			Target: FrozenTargetID{Package: "pkg", Target: "failed"},
+			Status: TestFailed,
+			Output: "boom",
+		},
+		{
+			Target: FrozenTargetID{Package: "pkg", Target: "skipped"},
+			Status: TestNotRun,
+		},
+	}); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	var report struct {
+		Suites []struct {
+			Name     string `xml:"name,attr"`
+			Failures string `xml:"failures,attr"`
+			Cases    []struct {
+				Name    string  `xml:"name,attr"`
+				Failure *string `xml:"failure"`
+			} `xml:"testcase"`
+		} `xml:"testsuite"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("Unexpected err: %v\n%s", err, buf.String())
+	}
+	if len(report.Suites) != 2 {
+		t.Fatalf("Wanted 2 suites; got:\n%s", buf.String())
+	}
+	if report.Suites[0].Name != "runner" {
+		t.Fatalf("Wanted the runner's suite first; got:\n%s", buf.String())
+	}
+	failed := report.Suites[1]
+	if failed.Failures != "1" || len(failed.Cases) != 1 ||
+		failed.Cases[0].Failure == nil || *failed.Cases[0].Failure != "boom" {
+		t.Fatalf("Wanted a synthetic failing suite; got:\n%s", buf.String())
+	}
+}
+
+func TestWriteJUnit_FailedReport(t *testing.T) {
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	failed := FrozenTargetID{
+		Package:  "pkg",
+		Target:   "failed",
+		Checksum: ChecksumString("failed"),
+	}
+	src := filepath.Join(dir, TestJUnitFile)
+	if err := ioutil.WriteFile(
+		src,
+		[]byte(`<testsuites><testsuite name="runner" failures="1">`+
+			`<testcase name="a"><failure message="wrong"/></testcase>`+
+			`</testsuite></testsuites>`),
+		0644,
+	); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := cache.KeepFailedJUnit(failed, src); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	writeReport := func() string {
+		var buf bytes.Buffer
+		if err := WriteJUnit(&buf, cache, []TestResult{{
+			Target: failed,
+			Status: TestFailed,
+			Output: "boom",
+		}}); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		return buf.String()
+	}
+
+	// The failing run's own report is used rather than a synthetic suite.
+	report := writeReport()
+	if !strings.Contains(report, `<testsuite name="runner" failures="1">`) ||
+		!strings.Contains(report, `<failure message="wrong"/>`) ||
+		strings.Contains(report, "boom") {
+		t.Fatalf("Wanted the runner's failing suite; got:\n%s", report)
+	}
+
+	// A later failing run which doesn't write a report replaces it.
+	if err := os.Remove(src); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := cache.KeepFailedJUnit(failed, src); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if report := writeReport(); !strings.Contains(report, "boom") {
+		t.Fatalf("Wanted a synthetic failing suite; got:\n%s", report)
+	}
+}
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Tracer records spans of work (evaluating packages, freezing targets and
+// file groups, checking caches, running build scripts) in the Chrome trace
+// event format, which can be viewed in `chrome://tracing` or Perfetto.
+//
+// Spans are drawn in lanes (trace "threads"), within which they must nest.
+// Lane 0 is for work done sequentially by the main goroutine (evaluating and
+// freezing); targets, which build concurrently, are each given a free lane
+// for their duration.
+type Tracer struct {
+	lock   sync.Mutex
+	start  time.Time
+	events []traceEvent
+
+	// busy[i] is true while lane i+1 is in use.
+	busy []bool
+}
+
+func NewTracer() *Tracer { return &Tracer{start: time.Now()} }
+
+// Tracing is the tracer to which spans are recorded. If it's nil (the
+// default), nothing is recorded. All of the Tracer and Span methods are safe
+// to call on nil receivers, so call sites needn't check.
+var Tracing *Tracer
+
+type traceEvent struct {
+	Name     string            `json:"name"`
+	Category string            `json:"cat,omitempty"`
+	Phase    string            `json:"ph"`
+	Time     int64             `json:"ts"`
+	Duration int64             `json:"dur,omitempty"`
+	PID      int               `json:"pid"`
+	TID      int               `json:"tid"`
+	Args     map[string]string `json:"args,omitempty"`
+}
+
+// Span is a single timed piece of work. Spans must be ended by the goroutine
+// which started them.
+type Span struct {
+	tracer   *Tracer
+	category string
+	name     string
+	lane     int
+	start    time.Time
+	args     map[string]string
+
+	// Whether ending the span frees its lane.
+	release bool
+}
+
+func (t *Tracer) span(category, name string, lane int, release bool) *Span {
+	return &Span{
+		tracer:   t,
+		category: category,
+		name:     name,
+		lane:     lane,
+		start:    time.Now(),
+		args:     map[string]string{},
+		release:  release,
+	}
+}
+
+// Start starts a span in the main lane.
+func (t *Tracer) Start(category, name string) *Span {
+	if t == nil {
+		return nil
+	}
+	return t.span(category, name, 0, false)
+}
+
+// StartParallel starts a span in a lane of its own, for work which happens
+// concurrently with other work. The lane is freed when the span ends.
+func (t *Tracer) StartParallel(category, name string) *Span {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	lane := 0
+	for lane < len(t.busy) && t.busy[lane] {
+		lane++
+	}
+	if lane == len(t.busy) {
+		t.busy = append(t.busy, true)
+	}
+	t.busy[lane] = true
+	t.lock.Unlock()
+	return t.span(category, name, lane+1, true)
+}
+
+// Child starts a span nested within `s`, in the same lane.
+func (s *Span) Child(category, name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.span(category, name, s.lane, false)
+}
+
+// Arg annotates the span with a key/value pair.
+func (s *Span) Arg(key, value string) {
+	if s != nil {
+		s.args[key] = value
+	}
+}
+
+// End records the span.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	t := s.tracer
+	end := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var args map[string]string
+	if len(s.args) > 0 {
+		args = s.args
+	}
+	t.events = append(t.events, traceEvent{
+		Name:     s.name,
+		Category: s.category,
+		Phase:    "X",
+		Time:     s.start.Sub(t.start).Nanoseconds() / 1000,
+		Duration: end.Sub(s.start).Nanoseconds() / 1000,
+		PID:      1,
+		TID:      s.lane,
+		Args:     args,
+	})
+	if s.release {
+		t.busy[s.lane-1] = false
+	}
+}
+
+// WriteJSON writes the spans recorded so far as a Chrome trace.
+func (t *Tracer) WriteJSON(w io.Writer) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	events := make([]traceEvent, 0, len(t.events)+len(t.busy)+1)
+	for lane := 0; lane <= len(t.busy); lane++ {
+		name := "main"
+		if lane > 0 {
+			name = fmt.Sprintf("lane %d", lane)
+		}
+		events = append(events, traceEvent{
+			Name:  "thread_name",
+			Phase: "M",
+			PID:   1,
+			TID:   lane,
+			Args:  map[string]string{"name": name},
+		})
+	}
+	events = append(events, t.events...)
+
+	data, err := json.Marshal(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{events, "ms"})
+	if err != nil {
+		return errors.Wrap(err, "Marshaling trace")
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// CriticalPath returns the chain of targets, dependencies first, whose
+// combined durations are the greatest of any chain in `dags`, along with
+// that combined duration. No build of `dags` can take less time than its
+// critical path, however many jobs run concurrently. Targets missing from
+// `durations` count as taking no time.
+func CriticalPath(
+	dags []DAG,
+	durations map[FrozenTargetID]time.Duration,
+) ([]FrozenTargetID, time.Duration) {
+	type chain struct {
+		next  *DAG
+		total time.Duration
+	}
+	memo := map[FrozenTargetID]chain{}
+	var longest func(dag DAG) time.Duration
+	longest = func(dag DAG) time.Duration {
+		if c, found := memo[dag.ID]; found {
+			return c.total
+		}
+		var c chain
+		for i := range dag.Dependencies {
+			if total := longest(dag.Dependencies[i]); c.next == nil ||
+				total > c.total {
+				c = chain{next: &dag.Dependencies[i], total: total}
+			}
+		}
+		c.total += durations[dag.ID]
+		memo[dag.ID] = c
+		return c.total
+	}
+
+	var start *DAG
+	var total time.Duration
+	for i := range dags {
+		if t := longest(dags[i]); start == nil || t > total {
+			start, total = &dags[i], t
+		}
+	}
+
+	var path []FrozenTargetID
+	for dag := start; dag != nil; dag = memo[dag.ID].next {
+		path = append([]FrozenTargetID{dag.ID}, path...)
+	}
+	return path, total
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCriticalPath(t *testing.T) {
+	a := leaf("a")
+	b := leaf("b")
+	c := dependsOn("c", a, b)
+	d := dependsOn("d", b)
+	durations := map[FrozenTargetID]time.Duration{
+		a.ID: 1 * time.Second,
+		b.ID: 3 * time.Second,
+		c.ID: 1 * time.Second,
+		d.ID: 2 * time.Second,
+	}
+
+	path, total := CriticalPath([]DAG{c, d}, durations)
+	if wanted := []FrozenTargetID{b.ID, d.ID}; !reflect.DeepEqual(
+		path,
+		wanted,
+	) {
+		t.Fatalf("Wanted %v; got %v", wanted, path)
+	}
+	if wanted := 5 * time.Second; total != wanted {
+		t.Fatalf("Wanted %v; got %v", wanted, total)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	// A nil tracer records nothing, and its spans are no-ops.
+	var disabled *Tracer
+	span := disabled.StartParallel("target", "x")
+	span.Child("cache", "y").End()
+	span.Arg("k", "v")
+	span.End()
+
+	tracer := NewTracer()
+	tracer.Start("evaluate", "//pkg").End()
+	first := tracer.StartParallel("target", "//pkg:a")
+	second := tracer.StartParallel("target", "//pkg:b")
+	child := second.Child("build", "command")
+	child.Arg("k", "v")
+	child.End()
+	second.End()
+	first.End()
+
+	// The first lane is free again.
+	third := tracer.StartParallel("target", "//pkg:c")
+	third.End()
+
+	var buf bytes.Buffer
+	if err := tracer.WriteJSON(&buf); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	var trace struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	lanes := map[string]int{}
+	for _, e := range trace.TraceEvents {
+		if e.Phase == "X" {
+			lanes[e.Name] = e.TID
+		}
+	}
+	wanted := map[string]int{
+		"//pkg":   0,
+		"//pkg:a": 1,
+		"//pkg:b": 2,
+		"command": 2,
+		"//pkg:c": 1,
+	}
+	if !reflect.DeepEqual(lanes, wanted) {
+		t.Fatalf("Wanted lanes %v; got %v", wanted, lanes)
+	}
+}
@@ -2,13 +2,13 @@ package core
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/json"
 	"fmt"
-	"hash/adler32"
 	"io"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.starlark.net/starlark"
@@ -104,7 +104,7 @@ func (t Target) String() string {
 func (t Target) Truth() starlark.Bool { return starlark.Bool(true) }
 
 func (t Target) Hash() (uint32, error) {
-	return t.hash(), nil
+	return t.hash().starlarkHash(), nil
 }
 
 func (t Target) Type() string { return "Target" }
@@ -125,7 +125,7 @@ func (fg FileGroup) Type() string { return "FileGroup" }
 func (fg FileGroup) Truth() starlark.Bool { return starlark.Bool(true) }
 
 func (fg FileGroup) Hash() (uint32, error) {
-	return fg.hash(), nil
+	return fg.hash().starlarkHash(), nil
 }
 
 type TargetName string
@@ -186,79 +186,90 @@ type Array []Input
 
 type Input interface {
 	input()
-	hash() uint32
+	hash() Checksum
 }
 
 func (t Target) input() {}
-func (t Target) hash() uint32 {
-	return JoinChecksums(
-		ChecksumString(string(t.ID.Package)),
-		ChecksumString(string(t.ID.Target)),
-		t.Inputs.hash(),
-		ChecksumString(string(t.BuilderType)),
-	)
+func (t Target) hash() Checksum {
+	return checksumTarget(t.ID, t.BuilderType, t.Inputs.hash())
 }
 func (fg FileGroup) input() {}
-func (fg FileGroup) hash() uint32 {
-	checksums := make([]uint32, len(fg.Patterns)+1)
-	checksums[0] = ChecksumString(string(fg.Package))
-	for i, pattern := range fg.Patterns {
-		checksums[i+1] = ChecksumString(pattern)
-	}
-	return JoinChecksums(checksums...)
-}
-func (i Int) input() {}
-func (i Int) hash() uint32 {
-	var buf [8]byte
-	binary.BigEndian.PutUint64(buf[:], uint64(i))
-	return ChecksumBytes(buf[:])
-}
-func (s String) input()       {}
-func (s String) hash() uint32 { return ChecksumString(string(s)) }
-func (b Bool) input()         {}
-func (b Bool) hash() uint32 {
-	var i uint16
-	if bool(b) {
-		i = 1
+func (fg FileGroup) hash() Checksum {
+	h := newHasher(tagFileGroup).
+		string(string(fg.Package)).
+		uint64(uint64(len(fg.Patterns)))
+	for _, pattern := range fg.Patterns {
+		h.string(pattern)
 	}
-	var buf [2]byte
-	binary.BigEndian.PutUint16(buf[:], i)
-	return ChecksumBytes(buf[:])
-}
-func (o Object) input() {}
-func (o Object) hash() uint32 {
-	checksums := make([]uint32, 2*len(o))
+	return h.sum()
+}
+func (i Int) input()            {}
+func (i Int) hash() Checksum    { return checksumInt(int64(i)) }
+func (s String) input()         {}
+func (s String) hash() Checksum { return checksumString(string(s)) }
+func (b Bool) input()           {}
+func (b Bool) hash() Checksum   { return checksumBool(bool(b)) }
+func (o Object) input()         {}
+func (o Object) hash() Checksum {
+	keys := make([]string, len(o))
+	values := make([]Checksum, len(o))
 	for i, f := range o {
-		checksums[2*i] = ChecksumString(f.Key)
-		checksums[2*i+1] = f.Value.hash()
+		keys[i] = f.Key
+		values[i] = f.Value.hash()
 	}
-	return JoinChecksums(checksums...)
+	return checksumFields(keys, values)
 }
 func (a Array) input() {}
-func (a Array) hash() uint32 {
-	checksums := make([]uint32, len(a))
+func (a Array) hash() Checksum {
+	checksums := make([]Checksum, len(a))
 	for i, v := range a {
 		checksums[i] = v.hash()
 	}
-	return JoinChecksums(checksums...)
+	return checksumArray(checksums)
+}
+
+// checksumTarget computes the checksum for a target from its ID, its builder
+// type, and the checksum of its inputs. It's used both for the (unfrozen)
+// starlark hash of a target and for the checksum of a frozen target.
+func checksumTarget(
+	id TargetID,
+	builderType BuilderType,
+	inputs Checksum,
+) Checksum {
+	return newHasher(tagTarget).
+		string(string(id.Package)).
+		string(string(id.Target)).
+		string(string(builderType)).
+		checksum(inputs).
+		sum()
 }
 
 type Target struct {
 	ID          TargetID
 	Inputs      Object
 	BuilderType BuilderType
+
+	// Timeout bounds how long the target's build may run; zero means no
+	// limit (or the default passed to `builder build --timeout`).
+	Timeout time.Duration
 }
 
 func (t Target) MarshalJSON() ([]byte, error) {
+	var timeout string
+	if t.Timeout > 0 {
+		timeout = t.Timeout.String()
+	}
 	return json.Marshal(struct {
 		Package string `json:"package"`
 		Name    string `json:"name"`
 		Type    string `json:"type"`
+		Timeout string `json:"timeout,omitempty"`
 		Inputs  Object `json:"inputs"`
 	}{
 		Package: string(t.ID.Package),
 		Name:    string(t.ID.Target),
 		Type:    string(t.BuilderType),
+		Timeout: timeout,
 		Inputs:  t.Inputs,
 	})
 }
@@ -266,11 +277,11 @@ func (t Target) MarshalJSON() ([]byte, error) {
 type FrozenTargetID struct {
 	Package  PackageName
 	Target   TargetName
-	Checksum uint32
+	Checksum Checksum
 }
 
 func (ftid FrozenTargetID) String() string {
-	return fmt.Sprintf("%s:%s@%d", ftid.Package, ftid.Target, ftid.Checksum)
+	return fmt.Sprintf("%s:%s@%s", ftid.Package, ftid.Target, ftid.Checksum)
 }
 
 func (ftid FrozenTargetID) ArtifactID() ArtifactID {
@@ -342,9 +353,11 @@ func Match(f func(FrozenInput) error, tail ...func(FrozenInput) error) func(Froz
 		if err := f(fi); err != nil {
 			msg = fmt.Sprintf("'%s'", err.Error())
 			for _, f := range tail {
-				if err := f(fi); err != nil {
-					msg = fmt.Sprintf("%s, '%s'", msg, err)
+				err := f(fi)
+				if err == nil {
+					return nil
 				}
+				msg = fmt.Sprintf("%s, '%s'", msg, err)
 			}
 			return errors.Errorf("Failed to match any: %s", msg)
 		}
@@ -370,6 +383,15 @@ func AssertInt(f func(int) error) func(FrozenInput) error {
 	}
 }
 
+func AssertBool(f func(bool) error) func(FrozenInput) error {
+	return func(fi FrozenInput) error {
+		if b, ok := fi.(Bool); ok {
+			return f(bool(b))
+		}
+		return TypeErr{Wanted: "Bool", Got: fmt.Sprintf("%T", fi)}
+	}
+}
+
 func AssertArtifactID(f func(ArtifactID) error) func(FrozenInput) error {
 	return func(fi FrozenInput) error {
 		if aid, ok := fi.(ArtifactID); ok {
@@ -458,48 +480,46 @@ type ArtifactID FrozenTargetID
 
 func (aid ArtifactID) String() string {
 	if aid.Target == "" {
-		return fmt.Sprintf("//%s@%d", aid.Package, aid.Checksum)
+		return fmt.Sprintf("//%s@%s", aid.Package, aid.Checksum)
 	}
-	return fmt.Sprintf("//%s:%s@%d", aid.Package, aid.Target, aid.Checksum)
+	return fmt.Sprintf("//%s:%s@%s", aid.Package, aid.Target, aid.Checksum)
 }
 
-func (aid ArtifactID) checksum() uint32 { return aid.Checksum }
-
-func (i Int) checksum() uint32 {
-	var buf [8]byte
-	binary.PutVarint(buf[:len(buf)], int64(i))
-	return adler32.Checksum(buf[:len(buf)])
+func (aid ArtifactID) checksum() Checksum {
+	return newHasher(tagArtifact).
+		string(string(aid.Package)).
+		string(string(aid.Target)).
+		checksum(aid.Checksum).
+		sum()
 }
 
-func (s String) checksum() uint32 { return ChecksumString(string(s)) }
+func (i Int) checksum() Checksum { return i.hash() }
 
-func (b Bool) checksum() uint32 {
-	if bool(b) {
-		return ChecksumBytes([]byte{0})
-	}
-	return ChecksumBytes([]byte{1})
-}
+func (s String) checksum() Checksum { return s.hash() }
 
-func (fo FrozenObject) checksum() uint32 {
-	checksums := make([]uint32, len(fo)*2)
+func (b Bool) checksum() Checksum { return b.hash() }
+
+func (fo FrozenObject) checksum() Checksum {
+	keys := make([]string, len(fo))
+	values := make([]Checksum, len(fo))
 	for i, field := range fo {
-		checksums[i*2] = ChecksumString(field.Key)
-		checksums[i*2+1] = field.Value.checksum()
+		keys[i] = field.Key
+		values[i] = field.Value.checksum()
 	}
-	return JoinChecksums(checksums...)
+	return checksumFields(keys, values)
 }
 
-func (fa FrozenArray) checksum() uint32 {
-	checksums := make([]uint32, len(fa))
+func (fa FrozenArray) checksum() Checksum {
+	checksums := make([]Checksum, len(fa))
 	for i, elt := range fa {
 		checksums[i] = elt.checksum()
 	}
-	return JoinChecksums(checksums...)
+	return checksumArray(checksums)
 }
 
 type FrozenInput interface {
 	frozenInput()
-	checksum() uint32
+	checksum() Checksum
 }
 
 func (aid ArtifactID) frozenInput()  {}
@@ -509,15 +529,49 @@ func (b Bool) frozenInput()          {}
 func (fo FrozenObject) frozenInput() {}
 func (fa FrozenArray) frozenInput()  {}
 
+// ArtifactIDs returns the IDs of every artifact referenced by `fi`, i.e., the
+// file groups and dependency targets that it (recursively) contains.
+func ArtifactIDs(fi FrozenInput) []ArtifactID {
+	switch x := fi.(type) {
+	case ArtifactID:
+		return []ArtifactID{x}
+	case OutputID:
+		return []ArtifactID{x.Artifact}
+	case FrozenObject:
+		var ids []ArtifactID
+		for _, field := range x {
+			ids = append(ids, ArtifactIDs(field.Value)...)
+		}
+		return ids
+	case FrozenArray:
+		var ids []ArtifactID
+		for _, elt := range x {
+			ids = append(ids, ArtifactIDs(elt)...)
+		}
+		return ids
+	}
+	return nil
+}
+
 type FrozenTarget struct {
 	ID          FrozenTargetID
 	Inputs      FrozenObject
 	BuilderType BuilderType
+
+	// Timeout bounds how long the target's build may run; zero means no
+	// limit. It doesn't affect the target's checksum.
+	Timeout time.Duration
 }
 
 type BuilderType string
 
-type BuildScript func(dag DAG, cache Cache, stdout, stderr io.Writer) error
+type BuildScript func(
+	ctx context.Context,
+	dag DAG,
+	cache LocalCache,
+	stdout io.Writer,
+	stderr io.Writer,
+) error
 
 type Plugin struct {
 	Type        BuilderType
@@ -0,0 +1,180 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WatchDirs returns the directories in which a change may change the
+// targets matched by `patterns`: the directories of the BUILD files which
+// were read while evaluating them (`packages`), the directories covered by
+// the file groups of `targets` and their transitive dependencies, and the
+// directories beneath recursive patterns (in which new packages may appear).
+// Hidden directories are skipped.
+func WatchDirs(
+	root string,
+	patterns []TargetPattern,
+	packages []PackageName,
+	targets []Target,
+) ([]string, error) {
+	dirs := map[string]struct{}{}
+	add := func(dir string, recursive bool) error {
+		if !recursive {
+			if info, err := os.Stat(dir); err == nil && info.IsDir() {
+				dirs[dir] = struct{}{}
+			}
+			return nil
+		}
+		err := filepath.Walk(dir, func(
+			path string,
+			info os.FileInfo,
+			err error,
+		) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			dirs[path] = struct{}{}
+			return nil
+		})
+		return errors.Wrapf(err, "Walking %s", dir)
+	}
+	packageDir := func(pkg PackageName) string {
+		return filepath.Join(root, filepath.FromSlash(string(pkg)))
+	}
+
+	for _, p := range patterns {
+		if p.Recursive && !p.Negative {
+			if err := add(packageDir(p.Package), true); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, pkg := range packages {
+		if err := add(packageDir(pkg), false); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	visitFileGroups(targets, func(fg FileGroup) {
+		for _, pattern := range fg.Patterns {
+			if err != nil {
+				return
+			}
+			base, recursive := globBase(pattern)
+			dir := filepath.Join(packageDir(fg.Package), base)
+			err = add(dir, recursive)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// globBase returns the longest leading directory of a glob pattern which
+// contains no wildcards, and whether the wildcards may match files beneath
+// its subdirectories.
+func globBase(pattern string) (string, bool) {
+	parts := strings.Split(filepath.ToSlash(pattern), "/")
+	last := len(parts) - 1
+	for i, part := range parts[:last] {
+		if strings.ContainsAny(part, "*?[{\\") {
+			return filepath.FromSlash(strings.Join(parts[:i], "/")), true
+		}
+	}
+	return filepath.FromSlash(strings.Join(parts[:last], "/")),
+		strings.Contains(parts[last], "**")
+}
+
+// visitFileGroups calls `f` for each file group in the inputs of `targets`
+// and of their transitive dependencies.
+func visitFileGroups(targets []Target, f func(FileGroup)) {
+	seen := map[TargetID]struct{}{}
+	var visit func(input Input)
+	visit = func(input Input) {
+		switch x := input.(type) {
+		case FileGroup:
+			f(x)
+		case Target:
+			if _, found := seen[x.ID]; found {
+				return
+			}
+			seen[x.ID] = struct{}{}
+			visit(x.Inputs)
+		case TargetOutput:
+			visit(x.Target)
+		case Object:
+			for _, field := range x {
+				visit(field.Value)
+			}
+		case Array:
+			for _, elt := range x {
+				visit(elt)
+			}
+		}
+	}
+	for _, target := range targets {
+		visit(target)
+	}
+}
+
+// ignoredChange returns true for changes to files which editors and other
+// tools create as a side effect of editing (e.g., swap and backup files),
+// which never affect a build.
+func ignoredChange(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~")
+}
+
+// debounce collects changes from `changes` until none has arrived for
+// `quiet`, so that a burst of saves (e.g., an editor writing a file via a
+// temporary file, or a `git checkout`) triggers a single rebuild.
+func debounce(
+	first string,
+	changes <-chan string,
+	quiet time.Duration,
+) []string {
+	seen := map[string]struct{}{first: {}}
+	paths := []string{first}
+	timer := time.NewTimer(quiet)
+	defer timer.Stop()
+	for {
+		select {
+		case path, ok := <-changes:
+			if !ok {
+				return paths
+			}
+			if _, found := seen[path]; !found {
+				seen[path] = struct{}{}
+				paths = append(paths, path)
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(quiet)
+		case <-timer.C:
+			return paths
+		}
+	}
+}
@@ -0,0 +1,156 @@
+//go:build linux
+// +build linux
+
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// watchMask selects the inotify events which indicate that a directory's
+// contents changed.
+const watchMask = syscall.IN_CREATE |
+	syscall.IN_DELETE |
+	syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF
+
+// Watcher reports changes to the files in a set of directories. It's
+// implemented with inotify, which doesn't watch subdirectories, so every
+// directory of interest must be watched explicitly (see WatchDirs()).
+type Watcher struct {
+	file    *os.File
+	changes chan string
+
+	lock sync.Mutex
+	wds  map[string]int
+	dirs map[int]string
+	err  error
+}
+
+// NewWatcher returns a watcher which isn't yet watching any directories.
+func NewWatcher() (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrap(err, "Initializing inotify")
+	}
+	w := &Watcher{
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		changes: make(chan string, 256),
+		wds:     map[string]int{},
+		dirs:    map[int]string{},
+	}
+	go w.read()
+	return w, nil
+}
+
+// Watch replaces the set of watched directories with `dirs`. Directories
+// which no longer exist are skipped.
+func (w *Watcher) Watch(dirs []string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	fd := int(w.file.Fd())
+	wanted := map[string]struct{}{}
+	for _, dir := range dirs {
+		wanted[dir] = struct{}{}
+		if _, found := w.wds[dir]; found {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(fd, dir, watchMask)
+		if err == syscall.ENOENT || err == syscall.ENOTDIR {
+			continue
+		}
+		if err == syscall.ENOSPC {
+			return errors.Errorf(
+				"Watching %s: too many directories to watch (see "+
+					"/proc/sys/fs/inotify/max_user_watches)",
+				dir,
+			)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Watching %s", dir)
+		}
+		w.wds[dir] = wd
+		w.dirs[wd] = dir
+	}
+	for dir, wd := range w.wds {
+		if _, found := wanted[dir]; !found {
+			// The watch may already be gone if the directory was
+			// removed, so errors are ignored.
+			syscall.InotifyRmWatch(fd, uint32(wd))
+			delete(w.wds, dir)
+			delete(w.dirs, wd)
+		}
+	}
+	return nil
+}
+
+// read forwards the paths of changed files to `w.changes` until the watcher
+// is closed.
+func (w *Watcher) read() {
+	defer close(w.changes)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			w.lock.Lock()
+			w.err = err
+			w.lock.Unlock()
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(event.Len)
+			name := string(bytes.TrimRight(buf[start:offset], "\x00"))
+
+			w.lock.Lock()
+			dir, found := w.dirs[int(event.Wd)]
+			if event.Mask&syscall.IN_IGNORED != 0 && found {
+				delete(w.wds, dir)
+				delete(w.dirs, int(event.Wd))
+			}
+			w.lock.Unlock()
+
+			switch {
+			case event.Mask&syscall.IN_Q_OVERFLOW != 0:
+				// Some events were dropped, so we can't say which files
+				// changed, only that something did.
+				w.changes <- ""
+			case event.Mask&syscall.IN_IGNORED != 0 || !found:
+			default:
+				path := filepath.Join(dir, name)
+				if !ignoredChange(path) {
+					w.changes <- path
+				}
+			}
+		}
+	}
+}
+
+// Next blocks until a file in one of the watched directories changes, and
+// then until no further changes have been made for `quiet`. It returns the
+// changed paths.
+func (w *Watcher) Next(quiet time.Duration) ([]string, error) {
+	path, ok := <-w.changes
+	if !ok {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		return nil, errors.Wrap(w.err, "Reading inotify events")
+	}
+	return debounce(path, w.changes, quiet), nil
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	return w.file.Close()
+}
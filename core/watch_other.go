@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Watcher reports changes to the files in a set of directories. Watching is
+// only supported on Linux.
+type Watcher struct{}
+
+// NewWatcher returns an error because watching is only supported on Linux.
+func NewWatcher() (*Watcher, error) {
+	return nil, errors.New("Watching is only supported on Linux")
+}
+
+func (w *Watcher) Watch(dirs []string) error { return nil }
+
+func (w *Watcher) Next(quiet time.Duration) ([]string, error) {
+	return nil, errors.New("Watching is only supported on Linux")
+}
+
+func (w *Watcher) Close() error { return nil }
@@ -0,0 +1,155 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGlobBase(t *testing.T) {
+	for _, c := range []struct {
+		pattern   string
+		base      string
+		recursive bool
+	}{
+		{pattern: "*.go", base: "", recursive: false},
+		{pattern: "src/*.go", base: "src", recursive: false},
+		{pattern: "src/**/*.go", base: "src", recursive: true},
+		{pattern: "src/*/main.go", base: "src", recursive: true},
+		{pattern: "src/**", base: "src", recursive: true},
+	} {
+		base, recursive := globBase(c.pattern)
+		if base != c.base || recursive != c.recursive {
+			t.Errorf(
+				"globBase(%q): wanted (%q, %v); got (%q, %v)",
+				c.pattern,
+				c.base,
+				c.recursive,
+				base,
+				recursive,
+			)
+		}
+	}
+}
+
+func TestWatchDirs(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer os.RemoveAll(root)
+	for _, dir := range []string{
+		"lib/src/nested",
+		"lib/src/.hidden",
+		"lib/other",
+		"app",
+		"rules",
+	} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+
+	lib := Target{
+		ID:          TargetID{Package: "lib", Target: "lib"},
+		BuilderType: "noop",
+		Inputs: Object{{
+			Key: "sources",
+			Value: FileGroup{
+				Package:  "lib",
+				Patterns: []string{"src/**/*.go"},
+			},
+		}},
+	}
+	app := Target{
+		ID:          TargetID{Package: "app", Target: "app"},
+		BuilderType: "noop",
+		Inputs: Object{
+			{Key: "lib", Value: TargetOutput{Target: lib, Output: "docs"}},
+			{
+				Key: "sources",
+				Value: FileGroup{
+					Package:  "app",
+					Patterns: []string{"*.go"},
+				},
+			},
+		},
+	}
+
+	dirs, err := WatchDirs(
+		root,
+		nil,
+		[]PackageName{"app", "rules"},
+		[]Target{app},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	wanted := []string{
+		filepath.Join(root, "app"),
+		filepath.Join(root, "lib", "src"),
+		filepath.Join(root, "lib", "src", "nested"),
+		filepath.Join(root, "rules"),
+	}
+	if !reflect.DeepEqual(dirs, wanted) {
+		t.Fatalf("Wanted %v; got %v", wanted, dirs)
+	}
+
+	// Recursive patterns watch the directories beneath them, in which new
+	// packages may be created.
+	dirs, err = WatchDirs(
+		root,
+		[]TargetPattern{{Package: "lib", Recursive: true}},
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	wanted = []string{
+		filepath.Join(root, "lib"),
+		filepath.Join(root, "lib", "other"),
+		filepath.Join(root, "lib", "src"),
+		filepath.Join(root, "lib", "src", "nested"),
+	}
+	if !reflect.DeepEqual(dirs, wanted) {
+		t.Fatalf("Wanted %v; got %v", wanted, dirs)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	watcher, err := NewWatcher()
+	if err != nil {
+		t.Skipf("Watching isn't supported: %v", err)
+	}
+	defer watcher.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := watcher.Watch([]string{dir}); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	// A burst of changes is reported at once, and changes to hidden files
+	// (e.g., editor swap files) are ignored.
+	for _, name := range []string{".a.swp", "a", "b", "a"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+	changed, err := watcher.Next(100 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	wanted := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	if !reflect.DeepEqual(changed, wanted) {
+		t.Fatalf("Wanted %v; got %v", wanted, changed)
+	}
+}
@@ -0,0 +1,489 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The remote execution protocol lets a client offload building targets to
+// workers (e.g., `builder worker`). A worker serves:
+//
+//   - `/cache/...`: the worker's cache, via the HTTP cache protocol. Before
+//     executing a target, the client uploads whichever of the target's input
+//     artifacts the worker lacks; afterwards it downloads the target's
+//     artifact.
+//   - `POST /execute?workspace=ID`: the body is the JSON-encoded DAG to
+//     build. The worker builds the target with its own plugins and cache and
+//     responds with the build events as JSON lines, streamed as they occur.
+//     The last event is either `target_finished` or `target_failed`. If a
+//     test target failed (as opposed to couldn't be run), the response has an
+//     `X-Test-Failure` trailer describing the failure.
+const (
+	workerCachePrefix = "/cache"
+	workerExecutePath = "/execute"
+
+	trailerTestFailure = "X-Test-Failure"
+)
+
+// wireInput is the JSON encoding of a FrozenInput. The value's type is
+// recorded explicitly because, e.g., artifact IDs and objects would otherwise
+// be indistinguishable.
+type wireInput struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+type wireOutput struct {
+	Artifact FrozenTargetID `json:"artifact"`
+	Output   string         `json:"output"`
+}
+
+type wireField struct {
+	Key   string    `json:"key"`
+	Value wireInput `json:"value"`
+}
+
+type wireDAG struct {
+	ID           FrozenTargetID `json:"id"`
+	BuilderType  BuilderType    `json:"builder_type"`
+	Timeout      time.Duration  `json:"timeout,omitempty"`
+	Inputs       []wireField    `json:"inputs"`
+	Dependencies []wireDAG      `json:"dependencies"`
+}
+
+func encodeFields(fo FrozenObject) ([]wireField, error) {
+	fields := make([]wireField, len(fo))
+	for i, field := range fo {
+		value, err := encodeInput(field.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Encoding field '%s'", field.Key)
+		}
+		fields[i] = wireField{Key: field.Key, Value: value}
+	}
+	return fields, nil
+}
+
+func encodeInput(fi FrozenInput) (wireInput, error) {
+	var t string
+	var value interface{}
+	switch x := fi.(type) {
+	case String:
+		t, value = "string", x
+	case Int:
+		t, value = "int", x
+	case Bool:
+		t, value = "bool", x
+	case ArtifactID:
+		t, value = "artifact", FrozenTargetID(x)
+	case OutputID:
+		t, value = "output", wireOutput{
+			Artifact: FrozenTargetID(x.Artifact),
+			Output:   x.Output,
+		}
+	case FrozenArray:
+		elts := make([]wireInput, len(x))
+		for i, elt := range x {
+			encoded, err := encodeInput(elt)
+			if err != nil {
+				return wireInput{}, err
+			}
+			elts[i] = encoded
+		}
+		t, value = "array", elts
+	case FrozenObject:
+		fields, err := encodeFields(x)
+		if err != nil {
+			return wireInput{}, err
+		}
+		t, value = "object", fields
+	default:
+		return wireInput{}, errors.Errorf("Invalid frozen input: %T", fi)
+	}
+	data, err := json.Marshal(value)
+	return wireInput{Type: t, Value: data}, err
+}
+
+func decodeFields(fields []wireField) (FrozenObject, error) {
+	fo := make(FrozenObject, len(fields))
+	for i, field := range fields {
+		value, err := decodeInput(field.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Decoding field '%s'", field.Key)
+		}
+		fo[i] = FrozenField{Key: field.Key, Value: value}
+	}
+	return fo, nil
+}
+
+func decodeInput(wi wireInput) (FrozenInput, error) {
+	switch wi.Type {
+	case "string":
+		var s String
+		err := json.Unmarshal(wi.Value, &s)
+		return s, err
+	case "int":
+		var i Int
+		err := json.Unmarshal(wi.Value, &i)
+		return i, err
+	case "bool":
+		var b Bool
+		err := json.Unmarshal(wi.Value, &b)
+		return b, err
+	case "artifact":
+		var id FrozenTargetID
+		err := json.Unmarshal(wi.Value, &id)
+		return ArtifactID(id), err
+	case "output":
+		var output wireOutput
+		err := json.Unmarshal(wi.Value, &output)
+		return OutputID{
+			Artifact: ArtifactID(output.Artifact),
+			Output:   output.Output,
+		}, err
+	case "array":
+		var elts []wireInput
+		if err := json.Unmarshal(wi.Value, &elts); err != nil {
+			return nil, err
+		}
+		fa := make(FrozenArray, len(elts))
+		for i, elt := range elts {
+			decoded, err := decodeInput(elt)
+			if err != nil {
+				return nil, err
+			}
+			fa[i] = decoded
+		}
+		return fa, nil
+	case "object":
+		var fields []wireField
+		if err := json.Unmarshal(wi.Value, &fields); err != nil {
+			return nil, err
+		}
+		return decodeFields(fields)
+	}
+	return nil, errors.Errorf("Invalid input type '%s'", wi.Type)
+}
+
+func encodeDAG(dag DAG) (wireDAG, error) {
+	inputs, err := encodeFields(dag.Inputs)
+	if err != nil {
+		return wireDAG{}, errors.Wrapf(err, "Encoding target %s", dag.ID)
+	}
+	dependencies := make([]wireDAG, len(dag.Dependencies))
+	for i, dependency := range dag.Dependencies {
+		if dependencies[i], err = encodeDAG(dependency); err != nil {
+			return wireDAG{}, err
+		}
+	}
+	return wireDAG{
+		ID:           dag.ID,
+		BuilderType:  dag.BuilderType,
+		Timeout:      dag.Timeout,
+		Inputs:       inputs,
+		Dependencies: dependencies,
+	}, nil
+}
+
+func decodeDAG(wd wireDAG) (DAG, error) {
+	inputs, err := decodeFields(wd.Inputs)
+	if err != nil {
+		return DAG{}, errors.Wrapf(err, "Decoding target %s", wd.ID)
+	}
+	dependencies := make([]DAG, len(wd.Dependencies))
+	for i, dependency := range wd.Dependencies {
+		if dependencies[i], err = decodeDAG(dependency); err != nil {
+			return DAG{}, err
+		}
+	}
+	return DAG{
+		FrozenTarget: FrozenTarget{
+			ID:          wd.ID,
+			Inputs:      inputs,
+			BuilderType: wd.BuilderType,
+			Timeout:     wd.Timeout,
+		},
+		Dependencies: dependencies,
+	}, nil
+}
+
+// inputArtifacts returns the artifacts referenced by the inputs of `dag` and
+// of each of its dependencies, any of which its build script may read.
+func inputArtifacts(dag DAG) []ArtifactID {
+	var ids []ArtifactID
+	seen := map[ArtifactID]struct{}{}
+	visited := map[FrozenTargetID]struct{}{}
+	var visit func(dag DAG)
+	visit = func(dag DAG) {
+		if _, found := visited[dag.ID]; found {
+			return
+		}
+		visited[dag.ID] = struct{}{}
+		for _, id := range ArtifactIDs(dag.Inputs) {
+			if _, found := seen[id]; !found {
+				seen[id] = struct{}{}
+				ids = append(ids, id)
+			}
+		}
+		for _, dependency := range dag.Dependencies {
+			visit(dependency)
+		}
+	}
+	visit(dag)
+	return ids
+}
+
+// WorkerServer returns an HTTP handler which builds targets on behalf of
+// RemoteExecutor clients using `plugins`. Artifacts are stored in the cache
+// rooted at `directory`, which has the same layout as a local cache
+// directory. At most `jobs` targets are built concurrently; if `jobs` is less
+// than 1, it defaults to the number of CPUs.
+func WorkerServer(plugins []Plugin, directory string, jobs int) http.Handler {
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+	slots := make(chan struct{}, jobs)
+
+	mux := http.NewServeMux()
+	mux.Handle(
+		workerCachePrefix+"/",
+		http.StripPrefix(workerCachePrefix, CacheServer(directory)),
+	)
+	mux.HandleFunc(workerExecutePath, func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		if r.Method != http.MethodPost {
+			http.Error(
+				w,
+				"Method not allowed",
+				http.StatusMethodNotAllowed,
+			)
+			return
+		}
+		workspace := r.URL.Query().Get("workspace")
+		if workspace == "" || strings.ContainsAny(workspace, `/\`) ||
+			strings.HasPrefix(workspace, ".") {
+			http.Error(w, "Invalid workspace", http.StatusBadRequest)
+			return
+		}
+		var wd wireDAG
+		if err := json.NewDecoder(r.Body).Decode(&wd); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dag, err := decodeDAG(wd)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		slots <- struct{}{}
+		defer func() { <-slots }()
+
+		// The outcome is reported by the final event, so the status is
+		// always OK once the target has been accepted.
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Trailer", trailerTestFailure)
+		flusher, _ := w.(http.Flusher)
+		var lock sync.Mutex
+		encoder := json.NewEncoder(w)
+		execute := LocalExecutor(
+			plugins,
+			NewLocalCache(workspace, directory),
+			nil,
+			func(e Event) {
+				lock.Lock()
+				defer lock.Unlock()
+				// If the client has gone away, there's nobody to report
+				// the error to.
+				if encoder.Encode(e) == nil && flusher != nil {
+					flusher.Flush()
+				}
+			},
+		)
+		// If the client goes away (e.g., because the build was cancelled),
+		// so does the request's context, which cancels the target's build.
+		err = execute(r.Context(), dag)
+		if testErr, ok := errors.Cause(err).(TestFailedErr); ok {
+			w.Header().Set(
+				trailerTestFailure,
+				strings.Replace(testErr.Err.Error(), "\n", " ", -1),
+			)
+		}
+	})
+	return mux
+}
+
+// Worker is a remote execution worker as seen by a RemoteExecutor.
+type Worker struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWorker(url string) Worker {
+	return Worker{URL: url, Client: http.DefaultClient}
+}
+
+// cache returns the worker's cache for the workspace.
+func (worker Worker) cache(workspaceID string) HTTPCache {
+	return HTTPCache{
+		URL:         strings.TrimSuffix(worker.URL, "/") + workerCachePrefix,
+		WorkspaceID: workspaceID,
+		Client:      worker.Client,
+	}
+}
+
+// upload copies the target's input artifacts to the worker's cache, skipping
+// those it already has.
+func (worker Worker) upload(cache LocalCache, dag DAG) error {
+	remote := worker.cache(cache.WorkspaceID)
+	for _, id := range inputArtifacts(dag) {
+		err := remote.Exists(id)
+		if err == ErrArtifactNotFound {
+			err = remote.Push(id, cache)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Uploading input artifact %s", id)
+		}
+	}
+	return nil
+}
+
+// execute builds the target on the worker, forwarding its output and
+// warnings to `emit`, and then downloads the target's artifact into the
+// local cache. Cancelling `ctx` closes the connection, which cancels the
+// build on the worker.
+func (worker Worker) execute(
+	ctx context.Context,
+	cache LocalCache,
+	dag DAG,
+	emit func(e Event),
+) error {
+	if err := worker.upload(cache, dag); err != nil {
+		return err
+	}
+
+	wd, err := encodeDAG(dag)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(wd)
+	if err != nil {
+		return errors.Wrap(err, "Encoding DAG")
+	}
+	req, err := http.NewRequest(
+		"POST",
+		strings.TrimSuffix(worker.URL, "/")+workerExecutePath+"?"+
+			url.Values{"workspace": {cache.WorkspaceID}}.Encode(),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rsp, err := worker.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return errors.Errorf(
+			"%s: %s",
+			rsp.Status,
+			strings.TrimSpace(string(msg)),
+		)
+	}
+
+	decoder := json.NewDecoder(rsp.Body)
+	for {
+		var e Event
+		if err := decoder.Decode(&e); err != nil {
+			if err == io.EOF {
+				err = errors.New("Worker closed the connection")
+			}
+			return errors.Wrap(err, "Reading build events")
+		}
+		switch e.Type {
+		case EventStdout, EventStderr, EventWarning:
+			emit(Event{Type: e.Type, Data: e.Data, Error: e.Error})
+		case EventTargetFailed:
+			// Trailers are only available once the body has been read.
+			io.Copy(ioutil.Discard, rsp.Body)
+			if msg := rsp.Trailer.Get(trailerTestFailure); msg != "" {
+				return TestFailedErr{Target: dag.ID, Err: errors.New(msg)}
+			}
+			return errors.New(e.Error)
+		case EventTargetFinished:
+			return worker.cache(cache.WorkspaceID).Pull(
+				dag.ID.ArtifactID(),
+				cache,
+			)
+		}
+	}
+}
+
+// RemoteExecutor returns an ExecuteFunc which builds targets on `workers`
+// (see WorkerServer) instead of on this machine. Each target is sent to the
+// worker with the fewest targets in flight. Artifacts are checked for in and
+// pulled into the local and remote caches just as with LocalExecutor; only
+// building happens remotely. Artifacts must therefore be relocatable, i.e.,
+// they mustn't refer to absolute paths in the worker's cache.
+func RemoteExecutor(
+	workers []Worker,
+	cache LocalCache,
+	remote RemoteCache,
+	events EventSink,
+) ExecuteFunc {
+	var lock sync.Mutex
+	inflight := make([]int, len(workers))
+	acquire := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		least := 0
+		for i := range inflight {
+			if inflight[i] < inflight[least] {
+				least = i
+			}
+		}
+		inflight[least]++
+		return least
+	}
+	release := func(i int) {
+		lock.Lock()
+		defer lock.Unlock()
+		inflight[i]--
+	}
+
+	return executor(cache, events, func(
+		ctx context.Context,
+		dag DAG,
+		span *Span,
+		emit func(e Event),
+	) error {
+		return executeCached(ctx, cache, remote, dag, span, emit, func(
+			ctx context.Context,
+			span *Span,
+		) error {
+			i := acquire()
+			defer release(i)
+			span.Arg("worker", workers[i].URL)
+			return errors.Wrapf(
+				workers[i].execute(ctx, cache, dag, emit),
+				"Executing on worker %s",
+				workers[i].URL,
+			)
+		})
+	})
+}
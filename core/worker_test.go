@@ -0,0 +1,171 @@
+package core
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRemoteExecutor(t *testing.T) {
+	dep := leaf("dep")
+	dep.ID.Checksum = ChecksumString("dep")
+	top := dependsOn("top", dep)
+	top.ID.Checksum = ChecksumString("top")
+	top.BuilderType = "concat"
+	top.Inputs = FrozenObject{
+		{Key: "dep", Value: dep.ID.ArtifactID()},
+		{Key: "options", Value: FrozenObject{
+			{Key: "n", Value: Int(3)},
+			{Key: "flags", Value: FrozenArray{Bool(true), String("x")}},
+		}},
+	}
+
+	plugin := Plugin{
+		Type: "concat",
+		BuildScript: func(
+			_ context.Context,
+			dag DAG,
+			cache LocalCache,
+			stdout io.Writer,
+			stderr io.Writer,
+		) error {
+			if !reflect.DeepEqual(dag.FrozenTarget, top.FrozenTarget) {
+				return errors.Errorf("Wanted %v; got %v", top, dag)
+			}
+			if len(dag.Dependencies) != 1 {
+				return errors.New("Missing dependency")
+			}
+			io.WriteString(stdout, "building\n")
+			var data []byte
+			if err := cache.Read(
+				dep.ID.ArtifactID(),
+				func(r io.Reader) error {
+					var err error
+					data, err = ioutil.ReadAll(r)
+					return err
+				},
+			); err != nil {
+				return err
+			}
+			return cache.Write(dag.ID.ArtifactID(), func(w io.Writer) error {
+				_, err := w.Write(append(data, '!'))
+				return err
+			})
+		},
+	}
+
+	var workers []Worker
+	for i := 0; i < 2; i++ {
+		workerCache, cleanup := tempCache(t)
+		defer cleanup()
+		server := httptest.NewServer(
+			WorkerServer([]Plugin{plugin}, workerCache.Directory, 1),
+		)
+		defer server.Close()
+		workers = append(workers, NewWorker(server.URL))
+	}
+
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	if err := cache.Write(dep.ID.ArtifactID(), func(w io.Writer) error {
+		_, err := io.WriteString(w, "dep")
+		return err
+	}); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	var events []Event
+	if err := Build(
+		context.Background(),
+		RemoteExecutor(workers, cache, nil, recordEvents(&events)),
+		2,
+		top,
+	); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(cache.Path(top.ID.ArtifactID()))
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if wanted := "dep!"; string(data) != wanted {
+		t.Fatalf("Wanted '%s'; got '%s'", wanted, data)
+	}
+
+	var output string
+	for _, e := range events {
+		if e.Type == EventStdout && e.Target == top.ID {
+			output += e.Data
+		}
+	}
+	if wanted := "building\n"; output != wanted {
+		t.Fatalf("Wanted output '%s'; got '%s'", wanted, output)
+	}
+}
+
+func TestRemoteExecutor_Failure(t *testing.T) {
+	plugins := []Plugin{{
+		Type: "fail",
+		BuildScript: func(
+			context.Context,
+			DAG,
+			LocalCache,
+			io.Writer,
+			io.Writer,
+		) error {
+			return errors.New("boom")
+		},
+	}, {
+		Type: TestBuilderType,
+		BuildScript: func(
+			_ context.Context,
+			dag DAG,
+			_ LocalCache,
+			_, _ io.Writer,
+		) error {
+			return TestFailedErr{Target: dag.ID, Err: errors.New("boom")}
+		},
+	}}
+	workerCache, cleanupWorker := tempCache(t)
+	defer cleanupWorker()
+	server := httptest.NewServer(
+		WorkerServer(plugins, workerCache.Directory, 1),
+	)
+	defer server.Close()
+
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+	execute := RemoteExecutor(
+		[]Worker{NewWorker(server.URL)},
+		cache,
+		nil,
+		func(Event) {},
+	)
+	for _, builderType := range []BuilderType{"fail", TestBuilderType} {
+		dag := leaf(string(builderType))
+		dag.BuilderType = builderType
+		err := execute(context.Background(), dag)
+		if err == nil || !strings.Contains(err.Error(), "boom") {
+			t.Fatalf("Expected an error containing 'boom'; got %v", err)
+		}
+		_, isTestErr := errors.Cause(err).(TestFailedErr)
+		if wanted := builderType == TestBuilderType; isTestErr != wanted {
+			t.Fatalf(
+				"%s: Wanted TestFailedErr: %v; got %v",
+				builderType,
+				wanted,
+				err,
+			)
+		}
+		err = cache.Exists(dag.ID.ArtifactID())
+		if err != ErrArtifactNotFound {
+			t.Fatalf("Expected err '%v'; got '%v'", ErrArtifactNotFound, err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/weberc2/builder/core"
+)
+
+// parseSize parses a size in bytes with an optional K, M, G, or T suffix
+// (powers of 1024).
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	s = strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(s), "B"))
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(s, suffix) {
+			multiplier = 1 << (10 * uint(i+1))
+			s = strings.TrimSuffix(s, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Invalid size '%s'", s)
+	}
+	return n * multiplier, nil
+}
+
+// parseAge parses a duration, additionally accepting a 'd' suffix for days.
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, errors.Wrapf(err, "Invalid age '%s'", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+func gc(ctx *cli.Context) error {
+	workspace, pwd, err := currentWorkspace()
+	if err != nil {
+		return err
+	}
+	cache := core.NewLocalCache(workspace.id, cacheDirectory())
+
+	var policy core.GCPolicy
+	if s := ctx.String("max-size"); s != "" {
+		if policy.MaxSize, err = parseSize(s); err != nil {
+			return err
+		}
+	}
+	if s := ctx.String("max-age"); s != "" {
+		if policy.MaxAge, err = parseAge(s); err != nil {
+			return err
+		}
+	}
+	policy.KeepLast = ctx.Int("keep-last")
+
+	if len(ctx.Args()) > 0 {
+		targets, err := loadTargets(workspace, pwd, ctx.Args())
+		if err != nil {
+			return err
+		}
+		dags, err := freeze(workspace, cache, targets)
+		if err != nil {
+			return err
+		}
+		policy.Reachable = core.Reachable(dags...)
+	}
+
+	if policy.MaxSize == 0 && policy.MaxAge == 0 && policy.KeepLast == 0 &&
+		policy.Reachable == nil {
+		return errors.New(
+			"Specify at least one of --max-size, --max-age, --keep-last, " +
+				"or a target to keep",
+		)
+	}
+
+	entries, err := cache.Entries()
+	if err != nil {
+		return err
+	}
+
+	var freed int64
+	removed := 0
+	collected := policy.Collect(entries, time.Now())
+	for _, entry := range collected {
+		if ctx.Bool("verbose") || ctx.Bool("dry-run") {
+			fmt.Printf("%s (%s)\n", entry.ID, formatSize(entry.Size))
+		}
+		if !ctx.Bool("dry-run") {
+			err := cache.Remove(entry)
+			if err == core.ErrLocked {
+				// Another builder process is writing the artifact.
+				fmt.Printf("Skipping %s, which is in use\n", entry.ID)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		removed++
+		freed += entry.Size
+	}
+
+	verb := "Removed"
+	if ctx.Bool("dry-run") {
+		verb = "Would remove"
+	}
+	fmt.Printf(
+		"%s %d of %d artifacts (%s)\n",
+		verb,
+		removed,
+		len(entries),
+		formatSize(freed),
+	)
+	return nil
+}
+
+var gcCommand = cli.Command{
+	Name:      "gc",
+	Usage:     "Removes artifacts from the cache",
+	UsageText: "Removes artifacts from the cache",
+	Description: "Removes artifacts from the local cache for the current " +
+		"workspace according to one or more retention policies. An " +
+		"artifact is removed if any policy selects it. If targets are " +
+		"given, every artifact which isn't part of one of the targets' " +
+		"current dependency graphs is removed.",
+	ArgsUsage: "Takes zero or more target patterns (e.g., '//...')",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "max-size",
+			Usage: "Remove least-recently-used artifacts until the cache " +
+				"is at most this size (e.g., 10G)",
+		},
+		cli.StringFlag{
+			Name: "max-age",
+			Usage: "Remove artifacts which haven't been used for this long " +
+				"(e.g., 30d, 12h)",
+		},
+		cli.IntFlag{
+			Name: "keep-last",
+			Usage: "Keep only this many of the most-recently-used " +
+				"artifacts for each target",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run, n",
+			Usage: "Print the artifacts that would be removed",
+		},
+		cli.BoolFlag{
+			Name:  "verbose, v",
+			Usage: "Print each artifact that is removed",
+		},
+	},
+	Action: gc,
+}
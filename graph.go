@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/weberc2/builder/core"
+	"github.com/weberc2/builder/graph"
+)
+
+var graphCommand = cli.Command{
+	Name:      "graph",
+	Usage:     "Graphs the dependencies",
+	UsageText: "Graphs the dependencies",
+	Description: "Renders the frozen dependency graph of the targets. Each " +
+		"target and file group appears once, annotated with its type, " +
+		"checksum, and whether it's in the local cache (hit or miss), and " +
+		"each dependency is labelled with the input it came from (e.g., " +
+		"'environment.DEPENDENCY_0'). --output selects text (the default), " +
+		"json, dot (Graphviz), or mermaid.",
+	ArgsUsage: patternsUsage,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "The output format: text, json, dot, or mermaid",
+			Value: "text",
+		},
+		cli.IntFlag{
+			Name:  "depth",
+			Usage: "Only graph dependencies up to this many edges away",
+			Value: -1,
+		},
+		cli.BoolFlag{
+			Name:  "exclude-file-groups",
+			Usage: "Leave file groups out of the graph",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		var write func(w io.Writer, g graph.Graph) error
+		switch output := ctx.String("output"); output {
+		case "text":
+			write = graph.WriteText
+		case "json":
+			write = graph.WriteJSON
+		case "dot":
+			write = graph.WriteDOT
+		case "mermaid":
+			write = graph.WriteMermaid
+		default:
+			return errors.Errorf("Invalid output format '%s'", output)
+		}
+
+		return dagsAction(func(
+			ctx *cli.Context,
+			cache core.LocalCache,
+			dags []core.DAG,
+		) error {
+			g, err := graph.New(
+				graph.Options{
+					MaxDepth:          ctx.Int("depth"),
+					ExcludeFileGroups: ctx.Bool("exclude-file-groups"),
+					Cached:            cache.Contains,
+				},
+				dags...,
+			)
+			if err != nil {
+				return errors.Wrap(err, "Checking the cache")
+			}
+			return write(os.Stdout, g)
+		})(ctx)
+	},
+}
@@ -0,0 +1,201 @@
+// Package graph renders the frozen dependency graph of a set of targets,
+// e.g., as a Graphviz or Mermaid diagram. Unlike the nested DAGs that the
+// build operates on, a Graph lists each target (and file group) once, no
+// matter how many targets depend on it, and labels each dependency edge with
+// the input it came from.
+package graph
+
+import (
+	"fmt"
+
+	"github.com/weberc2/builder/core"
+)
+
+// FileGroupType is the type of the nodes for file groups, which have no
+// kind of their own.
+const FileGroupType core.BuilderType = "filegroup"
+
+// Node is a target or file group in the graph.
+type Node struct {
+	ID core.ArtifactID
+
+	// Type is the target's kind (see core.FrozenTarget.Kind()) or
+	// FileGroupType.
+	Type core.BuilderType
+
+	// Cached is true if the node's artifact is in the local cache (i.e.,
+	// building it would be a cache hit).
+	Cached bool
+}
+
+// FileGroup returns true if the node is a file group rather than a target.
+func (n Node) FileGroup() bool { return n.ID.Target == "" }
+
+// Label returns the node's label, e.g., `//pkg:target@<checksum>`.
+func (n Node) Label() string { return n.ID.String() }
+
+// Name returns the node's name without its checksum, e.g., `//pkg:target`
+// (or `//pkg` for a file group).
+func (n Node) Name() string {
+	if n.FileGroup() {
+		return fmt.Sprintf("//%s", n.ID.Package)
+	}
+	return fmt.Sprintf("//%s:%s", n.ID.Package, n.ID.Target)
+}
+
+// CacheStatus returns "hit" if the node is cached and "miss" otherwise.
+func (n Node) CacheStatus() string {
+	if n.Cached {
+		return "hit"
+	}
+	return "miss"
+}
+
+// Edge is a dependency of the target `From` on `To` via the input at `Key`,
+// the path of the input within the target's inputs: object keys joined by
+// `.` and list indices in brackets, e.g., `environment.DEPENDENCY_0` or
+// `sources[1]`.
+type Edge struct {
+	From core.ArtifactID
+	To   core.ArtifactID
+	Key  string
+}
+
+// Graph is a deduplicated dependency graph. Nodes are ordered by their
+// distance from the roots (breadth-first) and edges by their source node and
+// then by the order of the inputs.
+type Graph struct {
+	Nodes []Node
+	Edges []Edge
+}
+
+// Options selects the parts of the dependency graph to include.
+type Options struct {
+	// MaxDepth limits the graph to the nodes at most MaxDepth edges away
+	// from the roots (and the edges from the nodes nearer than that); a
+	// negative MaxDepth means no limit.
+	MaxDepth int
+
+	// ExcludeFileGroups omits file groups (and the edges to them).
+	ExcludeFileGroups bool
+
+	// Cached reports whether an artifact is in the cache. If it's nil, no
+	// node is cached.
+	Cached func(id core.ArtifactID) (bool, error)
+}
+
+// New builds the graph of the `roots` and their transitive dependencies.
+func New(options Options, roots ...core.DAG) (Graph, error) {
+	dags := map[core.ArtifactID]core.DAG{}
+	var index func(dag core.DAG)
+	index = func(dag core.DAG) {
+		id := dag.ID.ArtifactID()
+		if _, found := dags[id]; found {
+			return
+		}
+		dags[id] = dag
+		for _, dependency := range dag.Dependencies {
+			index(dependency)
+		}
+	}
+	for _, root := range roots {
+		index(root)
+	}
+
+	var graph Graph
+	depths := map[core.ArtifactID]int{}
+	var queue []core.ArtifactID
+	visit := func(id core.ArtifactID, depth int) error {
+		if _, found := depths[id]; found {
+			return nil
+		}
+		depths[id] = depth
+		node := Node{ID: id, Type: FileGroupType}
+		if dag, found := dags[id]; found {
+			node.Type = dag.Kind()
+		}
+		if options.Cached != nil {
+			cached, err := options.Cached(id)
+			if err != nil {
+				return err
+			}
+			node.Cached = cached
+		}
+		graph.Nodes = append(graph.Nodes, node)
+		queue = append(queue, id)
+		return nil
+	}
+	for _, root := range roots {
+		if err := visit(root.ID.ArtifactID(), 0); err != nil {
+			return Graph{}, err
+		}
+	}
+
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		dag, found := dags[id]
+		if !found {
+			continue
+		}
+		depth := depths[id] + 1
+		if options.MaxDepth >= 0 && depth > options.MaxDepth {
+			continue
+		}
+		seen := map[Edge]struct{}{}
+		for _, ref := range references("", dag.Inputs) {
+			if options.ExcludeFileGroups && ref.id.Target == "" {
+				continue
+			}
+			edge := Edge{From: id, To: ref.id, Key: ref.key}
+			if _, found := seen[edge]; found {
+				continue
+			}
+			seen[edge] = struct{}{}
+			if err := visit(ref.id, depth); err != nil {
+				return Graph{}, err
+			}
+			graph.Edges = append(graph.Edges, edge)
+		}
+	}
+	return graph, nil
+}
+
+type reference struct {
+	id  core.ArtifactID
+	key string
+}
+
+// references returns the artifacts referenced by the input `fi` at `key`,
+// in order, along with the paths of the inputs which reference them.
+func references(key string, fi core.FrozenInput) []reference {
+	switch x := fi.(type) {
+	case core.ArtifactID:
+		return []reference{{id: x, key: key}}
+	case core.OutputID:
+		return []reference{{id: x.Artifact, key: key}}
+	case core.FrozenObject:
+		var refs []reference
+		for _, field := range x {
+			fieldKey := field.Key
+			if key != "" {
+				fieldKey = key + "." + field.Key
+			}
+			refs = append(
+				refs,
+				references(fieldKey, field.Value)...,
+			)
+		}
+		return refs
+	case core.FrozenArray:
+		var refs []reference
+		for i, elt := range x {
+			refs = append(
+				refs,
+				references(fmt.Sprintf("%s[%d]", key, i), elt)...,
+			)
+		}
+		return refs
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package graph
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/weberc2/builder/core"
+)
+
+func id(pkg core.PackageName, target core.TargetName) core.ArtifactID {
+	return core.ArtifactID{
+		Package:  pkg,
+		Target:   target,
+		Checksum: core.ChecksumString(string(pkg) + ":" + string(target)),
+	}
+}
+
+func dag(
+	aid core.ArtifactID,
+	inputs core.FrozenObject,
+	dependencies ...core.DAG,
+) core.DAG {
+	return core.DAG{
+		FrozenTarget: core.FrozenTarget{
+			ID:          core.FrozenTargetID(aid),
+			Inputs:      inputs,
+			BuilderType: "command",
+		},
+		Dependencies: dependencies,
+	}
+}
+
+// testDAGs returns two roots, //app:bin and //app:tool (a `concat` rule
+// target), which both depend on //lib:lib (which depends on a file group).
+func testDAGs() []core.DAG {
+	lib := dag(
+		id("lib", "lib"),
+		core.FrozenObject{{Key: "sources", Value: id("lib", "")}},
+	)
+	bin := dag(
+		id("app", "bin"),
+		core.FrozenObject{
+			{
+				Key: "environment",
+				Value: core.FrozenObject{
+					{Key: "DEPENDENCY_0", Value: id("lib", "lib")},
+				},
+			},
+			{
+				Key: "docs",
+				Value: core.FrozenArray{
+					core.String("README.md"),
+					core.OutputID{Artifact: id("lib", "lib"), Output: "docs"},
+				},
+			},
+		},
+		lib,
+	)
+	tool := dag(
+		id("app", "tool"),
+		core.FrozenObject{
+			{Key: "kind", Value: core.String("concat")},
+			{Key: "lib", Value: id("lib", "lib")},
+		},
+		lib,
+	)
+	tool.BuilderType = core.RuleBuilderType
+	return []core.DAG{bin, tool}
+}
+
+func TestNew(t *testing.T) {
+	cached := func(aid core.ArtifactID) (bool, error) {
+		return aid.Target != "bin", nil
+	}
+	for _, tc := range []struct {
+		name    string
+		options Options
+		nodes   []Node
+		edges   []Edge
+	}{
+		{
+			name:    "all",
+			options: Options{MaxDepth: -1, Cached: cached},
+			nodes: []Node{
+				{ID: id("app", "bin"), Type: "command"},
+				{ID: id("app", "tool"), Type: "concat", Cached: true},
+				{ID: id("lib", "lib"), Type: "command", Cached: true},
+				{ID: id("lib", ""), Type: FileGroupType, Cached: true},
+			},
+			edges: []Edge{
+				{
+					From: id("app", "bin"),
+					To:   id("lib", "lib"),
+					Key:  "environment.DEPENDENCY_0",
+				},
+				{From: id("app", "bin"), To: id("lib", "lib"), Key: "docs[1]"},
+				{From: id("app", "tool"), To: id("lib", "lib"), Key: "lib"},
+				{From: id("lib", "lib"), To: id("lib", ""), Key: "sources"},
+			},
+		},
+		{
+			name:    "depth",
+			options: Options{MaxDepth: 0},
+			nodes: []Node{
+				{ID: id("app", "bin"), Type: "command"},
+				{ID: id("app", "tool"), Type: "concat"},
+			},
+		},
+		{
+			name:    "exclude-file-groups",
+			options: Options{MaxDepth: -1, ExcludeFileGroups: true},
+			nodes: []Node{
+				{ID: id("app", "bin"), Type: "command"},
+				{ID: id("app", "tool"), Type: "concat"},
+				{ID: id("lib", "lib"), Type: "command"},
+			},
+			edges: []Edge{
+				{
+					From: id("app", "bin"),
+					To:   id("lib", "lib"),
+					Key:  "environment.DEPENDENCY_0",
+				},
+				{From: id("app", "bin"), To: id("lib", "lib"), Key: "docs[1]"},
+				{From: id("app", "tool"), To: id("lib", "lib"), Key: "lib"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g, err := New(tc.options, testDAGs()...)
+			if err != nil {
+				t.Fatalf("Unexpected err: %v", err)
+			}
+			if !reflect.DeepEqual(g.Nodes, tc.nodes) {
+				t.Fatalf("Wanted nodes %v; got %v", tc.nodes, g.Nodes)
+			}
+			if !reflect.DeepEqual(g.Edges, tc.edges) {
+				t.Fatalf("Wanted edges %v; got %v", tc.edges, g.Edges)
+			}
+		})
+	}
+}
+
+func TestWriteMermaid(t *testing.T) {
+	g, err := New(
+		Options{
+			MaxDepth:          -1,
+			ExcludeFileGroups: true,
+			Cached: func(aid core.ArtifactID) (bool, error) {
+				return aid.Target == "lib", nil
+			},
+		},
+		testDAGs()[1],
+	)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteMermaid(&buf, g); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	wanted := `flowchart TD
+  n0["//app:tool<br/>concat<br/>` + shortChecksum(g.Nodes[0]) +
+		`<br/>miss"]
+  n1["//lib:lib<br/>command<br/>` + shortChecksum(g.Nodes[1]) +
+		`<br/>hit"]
+  classDef miss stroke-dasharray: 5 5
+  class n0 miss
+  n0 -->|"lib"| n1
+`
+	if got := buf.String(); got != wanted {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", wanted, got)
+	}
+}
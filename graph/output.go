@@ -0,0 +1,211 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// shortChecksumLength is the number of hex digits of each node's checksum
+// shown in diagrams, which is plenty to tell versions apart.
+const shortChecksumLength = 12
+
+func shortChecksum(n Node) string {
+	checksum := n.ID.Checksum.String()
+	if len(checksum) > shortChecksumLength {
+		return checksum[:shortChecksumLength]
+	}
+	return checksum
+}
+
+// WriteText writes each node on its own line, followed by its dependencies
+// (indented and prefixed by the key they came from). Every node is listed
+// once, however many nodes depend on it.
+func WriteText(w io.Writer, g Graph) error {
+	edges := map[string][]Edge{}
+	for _, edge := range g.Edges {
+		from := edge.From.String()
+		edges[from] = append(edges[from], edge)
+	}
+	for _, node := range g.Nodes {
+		if _, err := fmt.Fprintf(
+			w,
+			"%s (%s, %s)\n",
+			node.Label(),
+			node.Type,
+			node.CacheStatus(),
+		); err != nil {
+			return err
+		}
+		for _, edge := range edges[node.Label()] {
+			if _, err := fmt.Fprintf(
+				w,
+				"  %s -> %s\n",
+				edge.Key,
+				edge.To,
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type jsonNode struct {
+	ID       string `json:"id"`
+	Package  string `json:"package"`
+	Target   string `json:"target,omitempty"`
+	Type     string `json:"type"`
+	Checksum string `json:"checksum"`
+	Cache    string `json:"cache"`
+}
+
+type jsonEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Key  string `json:"key"`
+}
+
+type jsonGraph struct {
+	Nodes []jsonNode `json:"nodes"`
+	Edges []jsonEdge `json:"edges"`
+}
+
+// WriteJSON writes the graph as a JSON object with a list of `nodes` and a
+// list of `edges`, which refer to the nodes by their `id`.
+func WriteJSON(w io.Writer, g Graph) error {
+	result := jsonGraph{
+		Nodes: make([]jsonNode, len(g.Nodes)),
+		Edges: make([]jsonEdge, len(g.Edges)),
+	}
+	for i, node := range g.Nodes {
+		result.Nodes[i] = jsonNode{
+			ID:       node.Label(),
+			Package:  string(node.ID.Package),
+			Target:   string(node.ID.Target),
+			Type:     string(node.Type),
+			Checksum: node.ID.Checksum.String(),
+			Cache:    node.CacheStatus(),
+		}
+	}
+	for i, edge := range g.Edges {
+		result.Edges[i] = jsonEdge{
+			From: edge.From.String(),
+			To:   edge.To.String(),
+			Key:  edge.Key,
+		}
+	}
+	data, err := json.MarshalIndent(result, "", "    ")
+	if err != nil {
+		return errors.Wrap(err, "Marshaling graph")
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// WriteDOT writes the graph as a Graphviz digraph. File groups are drawn as
+// folders, and targets which would be rebuilt (cache misses) are dashed.
+func WriteDOT(w io.Writer, g Graph) error {
+	if _, err := fmt.Fprintln(w, "digraph dependencies {"); err != nil {
+		return err
+	}
+	for _, node := range g.Nodes {
+		attrs := ""
+		if node.FileGroup() {
+			attrs += ", shape=folder"
+		}
+		if !node.Cached {
+			attrs += ", style=dashed"
+		}
+		if _, err := fmt.Fprintf(
+			w,
+			"  %q [label=%q%s];\n",
+			node.Label(),
+			fmt.Sprintf(
+				"%s\n%s\n%s\n%s",
+				node.Name(),
+				node.Type,
+				shortChecksum(node),
+				node.CacheStatus(),
+			),
+			attrs,
+		); err != nil {
+			return err
+		}
+	}
+	for _, edge := range g.Edges {
+		if _, err := fmt.Fprintf(
+			w,
+			"  %q -> %q [label=%q];\n",
+			edge.From.String(),
+			edge.To.String(),
+			edge.Key,
+		); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// mermaidEscaper escapes the characters which would end a quoted Mermaid
+// label.
+var mermaidEscaper = strings.NewReplacer(`"`, "#quot;")
+
+// WriteMermaid writes the graph as a Mermaid flowchart, e.g., for embedding
+// in Markdown. Nodes are named by their position in the graph since Mermaid
+// IDs can't contain most of the characters in labels. As in WriteDOT(),
+// cache misses are dashed.
+func WriteMermaid(w io.Writer, g Graph) error {
+	if _, err := fmt.Fprintln(w, "flowchart TD"); err != nil {
+		return err
+	}
+	names := map[string]string{}
+	for i, node := range g.Nodes {
+		names[node.Label()] = fmt.Sprintf("n%d", i)
+		if _, err := fmt.Fprintf(
+			w,
+			"  n%d[\"%s\"]\n",
+			i,
+			mermaidEscaper.Replace(fmt.Sprintf(
+				"%s<br/>%s<br/>%s<br/>%s",
+				node.Name(),
+				node.Type,
+				shortChecksum(node),
+				node.CacheStatus(),
+			)),
+		); err != nil {
+			return err
+		}
+	}
+	var misses []string
+	for _, node := range g.Nodes {
+		if !node.Cached {
+			misses = append(misses, names[node.Label()])
+		}
+	}
+	if len(misses) > 0 {
+		if _, err := fmt.Fprintf(
+			w,
+			"  classDef miss stroke-dasharray: 5 5\n  class %s miss\n",
+			strings.Join(misses, ","),
+		); err != nil {
+			return err
+		}
+	}
+	for _, edge := range g.Edges {
+		if _, err := fmt.Fprintf(
+			w,
+			"  %s -->|\"%s\"| %s\n",
+			names[edge.From.String()],
+			mermaidEscaper.Replace(edge.Key),
+			names[edge.To.String()],
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
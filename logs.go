@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/weberc2/builder/core"
+)
+
+// logPollInterval is how often `builder logs --stream` checks for new output
+// and for a build to start.
+const logPollInterval = 100 * time.Millisecond
+
+// findLog returns the newest log of the target whose checksum starts with
+// `prefix` (which may be empty).
+func findLog(
+	cache core.LocalCache,
+	tid core.TargetID,
+	prefix string,
+) (core.LogEntry, error) {
+	logs, err := cache.Logs(tid)
+	if err != nil {
+		return core.LogEntry{}, errors.Wrapf(err, "Listing logs of %s", tid)
+	}
+	var matches []core.LogEntry
+	for _, log := range logs {
+		if strings.HasPrefix(log.ID.Checksum.String(), prefix) {
+			matches = append(matches, log)
+		}
+	}
+	if len(matches) < 1 {
+		if prefix != "" {
+			return core.LogEntry{}, errors.Errorf(
+				"No log of %s with checksum %s",
+				tid,
+				prefix,
+			)
+		}
+		return core.LogEntry{}, errors.Errorf(
+			"No logs of %s; logs are only kept for targets which were built "+
+				"(not found in a cache)",
+			tid,
+		)
+	}
+	if prefix != "" {
+		checksums := map[core.Checksum]struct{}{}
+		for _, match := range matches {
+			checksums[match.ID.Checksum] = struct{}{}
+		}
+		if len(checksums) > 1 {
+			return core.LogEntry{}, errors.Errorf(
+				"Checksum %s is ambiguous; it matches %d logs of %s",
+				prefix,
+				len(checksums),
+				tid,
+			)
+		}
+	}
+	return matches[len(matches)-1], nil
+}
+
+// waitForBuild polls until a build of the target starts and returns its
+// log.
+func waitForBuild(
+	cache core.LocalCache,
+	tid core.TargetID,
+) (core.LogEntry, error) {
+	waiting := false
+	for {
+		logs, err := cache.Logs(tid)
+		if err != nil {
+			return core.LogEntry{}, err
+		}
+		for i := len(logs) - 1; i >= 0; i-- {
+			if logs[i].Building {
+				return logs[i], nil
+			}
+		}
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "Waiting for %s to build...\n", tid)
+			waiting = true
+		}
+		time.Sleep(logPollInterval)
+	}
+}
+
+// followLog copies a build's log to `w` as it's written, until the build
+// finishes (or is found to have been interrupted).
+func followLog(
+	w io.Writer,
+	cache core.LocalCache,
+	log core.LogEntry,
+) error {
+	file, err := os.Open(log.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	interrupted := false
+	for {
+		n, err := io.Copy(w, file)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		// The log is renamed once the build finishes and it's closed, so
+		// anything left to read is already in the file.
+		if _, err := os.Stat(log.Path); os.IsNotExist(err) {
+			_, err := io.Copy(w, file)
+			return err
+		}
+
+		// The artifact's lock is released just before the log is renamed,
+		// so the log is only taken to be abandoned if it still isn't
+		// renamed a poll later.
+		building, err := cache.Building(log.ID)
+		if err != nil {
+			return err
+		}
+		if !building && interrupted {
+			fmt.Fprintf(
+				os.Stderr,
+				"The build of %s was interrupted\n",
+				log.ID,
+			)
+			return nil
+		}
+		interrupted = !building
+		time.Sleep(logPollInterval)
+	}
+}
+
+func logs(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.New("Expected exactly one PACKAGE:TARGET argument")
+	}
+	workspace, pwd, err := currentWorkspace()
+	if err != nil {
+		return err
+	}
+	tid, err := core.ParseTargetID(workspace.root, pwd, ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+	cache := core.NewLocalCache(workspace.id, cacheDirectory())
+
+	if ctx.Bool("stream") {
+		log, err := waitForBuild(cache, tid)
+		if err != nil {
+			return err
+		}
+		return followLog(os.Stdout, cache, log)
+	}
+
+	log, err := findLog(cache, tid, ctx.String("checksum"))
+	if err != nil {
+		return err
+	}
+	if log.Building {
+		return followLog(os.Stdout, cache, log)
+	}
+	file, err := os.Open(log.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(os.Stdout, file)
+	return err
+}
+
+var logsCommand = cli.Command{
+	Name:      "logs",
+	Usage:     "Prints the build log of a target",
+	UsageText: "Prints the build log of a target",
+	Description: "Prints the combined stdout and stderr of the most recent " +
+		"build of the target (or of the build of the version whose " +
+		"checksum starts with --checksum), whether or not it succeeded. " +
+		"Logs are stored in the cache next to the artifacts, so only " +
+		"targets which were built on this machine have logs. If the " +
+		"build is still in progress, its output is followed until it " +
+		"finishes. With --stream, waits for the target's next build to " +
+		"start (unless one is in progress) and prints its output live.",
+	ArgsUsage: "Takes a target in the format 'PACKAGE:TARGET'",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "checksum",
+			Usage: "Print the log of the build with this checksum (prefix)",
+		},
+		cli.BoolFlag{
+			Name:  "stream",
+			Usage: "Follow the output of the target's build as it runs",
+		},
+	},
+	Action: logs,
+}
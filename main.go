@@ -1,19 +1,28 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"github.com/weberc2/builder/buildutil"
 	"github.com/weberc2/builder/core"
 	"github.com/weberc2/builder/plugins/command"
+	"github.com/weberc2/builder/plugins/download"
 	"github.com/weberc2/builder/plugins/git"
 	"github.com/weberc2/builder/plugins/golang"
 	"github.com/weberc2/builder/plugins/python"
@@ -52,14 +61,24 @@ func findRoot(start string) (workspace, error) {
 
 var plugins = []core.Plugin{
 	git.Clone,
+	download.File,
+	download.Archive,
 	command.Command,
+	command.Test,
+	command.Rule,
+	golang.Library,
+	golang.Module,
+	golang.Binary,
+	python.Wheel,
+	python.VirtualEnv,
 
 	// Create a noop plugin. This is useful for meta-packages.
 	core.Plugin{
 		Type: core.BuilderType("noop"),
 		BuildScript: func(
+			_ context.Context,
 			dag core.DAG,
-			cache core.Cache,
+			cache core.LocalCache,
 			stdout io.Writer,
 			stderr io.Writer,
 		) error {
@@ -74,11 +93,218 @@ var plugins = []core.Plugin{
 	},
 }
 
-func build(ctx *cli.Context, cache core.Cache, dag core.DAG) error {
-	return core.Build(core.LocalExecutor(plugins, cache), dag)
+var jobsFlag = cli.IntFlag{
+	Name:  "jobs, j",
+	Usage: "The maximum number of targets to build concurrently",
+	Value: runtime.NumCPU(),
 }
 
-func run(ctx *cli.Context, cache core.Cache, dag core.DAG) error {
+// remoteCache returns the remote cache configured by the global
+// `--remote-cache` flag, or nil if none is configured.
+func remoteCache(ctx *cli.Context, workspaceID string) core.RemoteCache {
+	if url := ctx.GlobalString("remote-cache"); url != "" {
+		return core.NewHTTPCache(url, workspaceID)
+	}
+	return nil
+}
+
+// executor returns the ExecuteFunc for building targets: on the workers named
+// by the global `--worker` flag if any are configured, otherwise locally.
+// Targets without a timeout of their own get the global `--timeout`, if any.
+func executor(
+	ctx *cli.Context,
+	cache core.LocalCache,
+	events core.EventSink,
+) core.ExecuteFunc {
+	remote := remoteCache(ctx, cache.WorkspaceID)
+	var workers []core.Worker
+	for _, urls := range ctx.GlobalStringSlice("worker") {
+		for _, url := range strings.Split(urls, ",") {
+			if url != "" {
+				workers = append(workers, core.NewWorker(url))
+			}
+		}
+	}
+	execute := core.LocalExecutor(plugins, cache, remote, events)
+	if len(workers) > 0 {
+		execute = core.RemoteExecutor(workers, cache, remote, events)
+	}
+	timeout := ctx.GlobalDuration("timeout")
+	if timeout <= 0 {
+		return execute
+	}
+	return func(buildCtx context.Context, dag core.DAG) error {
+		if dag.Timeout == 0 {
+			dag.Timeout = timeout
+		}
+		return execute(buildCtx, dag)
+	}
+}
+
+// errInterrupted is returned by builds which were interrupted by SIGINT or
+// SIGTERM.
+var errInterrupted = errors.New("Interrupted")
+
+// interruptible returns a context which is cancelled when the process
+// receives SIGINT or SIGTERM, so that an interrupted build kills the commands
+// it started (which are in their own process groups and therefore don't
+// receive the terminal's signals) and cleans up after them. The returned
+// function stops intercepting the signals.
+func interruptible() (context.Context, func()) {
+	buildCtx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-buildCtx.Done():
+		}
+	}()
+	return buildCtx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// buildDAGs builds `dags` with `execute`, stopping when interrupted. With
+// `--keep-going`, it builds every target whose dependencies succeeded and
+// then prints a summary of the build.
+func buildDAGs(
+	ctx *cli.Context,
+	cache core.LocalCache,
+	execute core.ExecuteFunc,
+	dags ...core.DAG,
+) error {
+	buildCtx, stop := interruptible()
+	defer stop()
+	var err error
+	if ctx.Bool("keep-going") {
+		var summary core.BuildSummary
+		summary, err = core.KeepGoing(
+			buildCtx,
+			execute,
+			ctx.Int("jobs"),
+			dags...,
+		)
+		if err != context.Canceled {
+			printBuildSummary(cache, summary)
+		}
+	} else {
+		err = core.Build(buildCtx, execute, ctx.Int("jobs"), dags...)
+	}
+	if err == context.Canceled {
+		return errInterrupted
+	}
+	return err
+}
+
+// printBuildSummary lists the targets which failed (with the locations of
+// their build logs), the targets which were skipped (with the failed
+// dependencies which blocked them), and the targets which succeeded.
+func printBuildSummary(cache core.LocalCache, summary core.BuildSummary) {
+	label := func(id core.FrozenTargetID) string {
+		return fmt.Sprintf("//%s:%s", id.Package, id.Target)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w)
+	if len(summary.Failed) > 0 {
+		fmt.Fprintf(w, "Failed (%d):\n", len(summary.Failed))
+		for _, failure := range summary.Failed {
+			// Targets which failed before they were built (e.g., because
+			// their artifact couldn't be pulled) have no log.
+			logPath := "-"
+			path := cache.LogPath(failure.Target.ArtifactID())
+			if _, err := os.Stat(path); err == nil {
+				logPath = path
+			}
+			fmt.Fprintf(
+				w,
+				"  %s\tlog: %s\n",
+				label(failure.Target),
+				logPath,
+			)
+		}
+	}
+	if len(summary.Skipped) > 0 {
+		fmt.Fprintf(w, "Skipped (%d):\n", len(summary.Skipped))
+		for _, skipped := range summary.Skipped {
+			blockers := make([]string, len(skipped.BlockedBy))
+			for i, id := range skipped.BlockedBy {
+				blockers[i] = label(id)
+			}
+			fmt.Fprintf(
+				w,
+				"  %s\tblocked by %s\n",
+				label(skipped.Target),
+				strings.Join(blockers, ", "),
+			)
+		}
+	}
+	if len(summary.Succeeded) > 0 {
+		fmt.Fprintf(w, "Succeeded (%d):\n", len(summary.Succeeded))
+		for _, id := range summary.Succeeded {
+			fmt.Fprintf(w, "  %s\n", label(id))
+		}
+	}
+	w.Flush()
+	fmt.Printf(
+		"\n%d succeeded, %d failed, %d skipped\n",
+		len(summary.Succeeded),
+		len(summary.Failed),
+		len(summary.Skipped),
+	)
+}
+
+var buildEventFileFlag = cli.StringFlag{
+	Name:  "build-event-file",
+	Usage: "Write build events to this file as JSON lines",
+}
+
+// eventSink returns the sink for build events: the console, plus the file
+// named by `--build-event-file` if it's set. The returned function closes the
+// file.
+func eventSink(ctx *cli.Context) (core.EventSink, func() error, error) {
+	console := core.ConsoleSink(os.Stdout, os.Stderr)
+	path := ctx.String("build-event-file")
+	if path == "" {
+		return console, func() error { return nil }, nil
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Opening build event file")
+	}
+	return core.MultiSink(console, core.JSONSink(file)), file.Close, nil
+}
+
+func build(ctx *cli.Context, cache core.LocalCache, dags ...core.DAG) error {
+	events, closeEvents, err := eventSink(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeEvents()
+
+	if core.Tracing == nil {
+		return buildDAGs(ctx, cache, executor(ctx, cache, events), dags...)
+	}
+
+	// When profiling, report the chain of targets that bounded the build.
+	recorder := durationRecorder{
+		durations: map[core.FrozenTargetID]time.Duration{},
+	}
+	start := time.Now()
+	err = buildDAGs(
+		ctx,
+		cache,
+		executor(ctx, cache, core.MultiSink(events, recorder.record)),
+		dags...,
+	)
+	printCriticalPath(dags, recorder.durations, time.Since(start))
+	return err
+}
+
+func run(ctx *cli.Context, cache core.LocalCache, dag core.DAG) error {
 	if err := build(ctx, cache, dag); err != nil {
 		return err
 	}
@@ -90,128 +316,304 @@ func run(ctx *cli.Context, cache core.Cache, dag core.DAG) error {
 	return cmd.Run()
 }
 
-func graph(dag core.DAG, indent string) {
-	fmt.Printf("%s%s", indent, dag.ID)
-	if len(dag.Dependencies) > 0 {
-		fmt.Println(" {")
-		for _, dependency := range dag.Dependencies {
-			graph(dependency, indent+"  ")
-			fmt.Println(",")
+// printPerTarget prints a value for each DAG. If there's more than one DAG,
+// each value is followed by its target.
+func printPerTarget(dags []core.DAG, value func(dag core.DAG) string) error {
+	for _, dag := range dags {
+		var err error
+		if len(dags) == 1 {
+			_, err = fmt.Println(value(dag))
+		} else {
+			_, err = fmt.Printf(
+				"%s  //%s:%s\n",
+				value(dag),
+				dag.ID.Package,
+				dag.ID.Target,
+			)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const patternsUsage = "Takes one or more target patterns: " +
+	"'PACKAGE:TARGET', 'PACKAGE:all' (or 'PACKAGE:*') for every target in " +
+	"a package, 'PACKAGE/...' for every target in or beneath a package, " +
+	"or any of these prefixed with '-' to exclude the targets it matches"
+
+var builtinModules = map[string]string{
+	"std/python":   python.BuiltinModule,
+	"std/command":  command.BuiltinModule,
+	"std/golang":   golang.BuiltinModule,
+	"std/git":      git.BuiltinModule,
+	"std/download": download.BuiltinModule,
+}
+
+// parsePatterns parses target patterns relative to `pwd`.
+func parsePatterns(
+	workspace workspace,
+	pwd string,
+	args []string,
+) ([]core.TargetPattern, error) {
+	patterns := make([]core.TargetPattern, len(args))
+	for i, arg := range args {
+		pattern, err := core.ParseTargetPattern(workspace.root, pwd, arg)
+		if err != nil {
+			return nil, errors.Errorf("Failed to parse target pattern: %v", err)
 		}
-		fmt.Print(indent + "}")
+		patterns[i] = pattern
+	}
+	return patterns, nil
+}
+
+// evaluationError replaces Starlark errors with their backtraces, which
+// point at the offending BUILD file lines.
+func evaluationError(err error) error {
+	if evalErr, ok := errors.Cause(err).(*starlark.EvalError); ok {
+		return errors.New(evalErr.Backtrace())
 	}
+	return err
 }
 
-func targetAction(
-	f func(ctx *cli.Context, t *core.Target, workspace workspace) error,
+// loadTargets parses target patterns (relative to `pwd`) and evaluates the
+// packages they match to find the targets.
+func loadTargets(
+	workspace workspace,
+	pwd string,
+	args []string,
+) ([]core.Target, error) {
+	patterns, err := parsePatterns(workspace, pwd, args)
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := core.ExpandPatterns(
+		workspace.root,
+		builtinModules,
+		patterns...,
+	)
+	if err != nil {
+		return nil, evaluationError(err)
+	}
+	return targets, nil
+}
+
+func currentWorkspace() (workspace, string, error) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		return workspace{}, "", err
+	}
+	workspace, err := findRoot(pwd)
+	return workspace, pwd, err
+}
+
+// targetsAction loads the targets matched by the command's arguments, which
+// are target patterns.
+func targetsAction(
+	f func(ctx *cli.Context, targets []core.Target, workspace workspace) error,
 ) cli.ActionFunc {
 	return func(ctx *cli.Context) error {
 		if len(ctx.Args()) < 1 {
 			return errors.New("Missing PACKAGE:TARGET argument")
 		}
 
-		pwd, err := os.Getwd()
-		if err != nil {
-			return err
-		}
-		workspace, err := findRoot(pwd)
+		workspace, pwd, err := currentWorkspace()
 		if err != nil {
 			return err
 		}
 
-		targetID, err := core.ParseTargetID(workspace.root, pwd, ctx.Args()[0])
+		targets, err := loadTargets(workspace, pwd, ctx.Args())
 		if err != nil {
-			return errors.Errorf("Failed to parse target ID: %v", err)
+			return err
 		}
+		return f(ctx, targets, workspace)
+	}
+}
 
-		targets, err := core.Evaluate(
-			targetID.Package,
-			workspace.root,
-			map[string]string{
-				"std/python":  python.BuiltinModule,
-				"std/command": command.BuiltinModule,
-				"std/golang":  golang.BuiltinModule,
-				"std/git":     git.BuiltinModule,
-			},
-		)
-
-		if err != nil {
-			if evalErr, ok := errors.Cause(err).(*starlark.EvalError); ok {
-				return errors.New(evalErr.Backtrace())
-			}
-			return errors.Errorf("Evaluation error: %v", err)
-		}
+func cacheDirectory() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".cache/builder")
+	}
+	return "/tmp/cache"
+}
 
-		for i, target := range targets {
-			if target.ID == targetID {
-				return f(ctx, &targets[i], workspace)
-			}
-		}
-		return errors.Errorf("Couldn't find target %s", targetID)
+func freeze(
+	workspace workspace,
+	cache core.LocalCache,
+	targets []core.Target,
+) ([]core.DAG, error) {
+	dags, err := core.FreezeTargets(workspace.root, cache, targets...)
+	if err != nil {
+		return nil, evaluationError(err)
 	}
+	return dags, nil
 }
 
-func dagAction(
-	f func(ctx *cli.Context, cache core.Cache, dag core.DAG) error,
+// dagsAction loads and freezes the targets matched by the command's
+// arguments, which are target patterns.
+func dagsAction(
+	f func(ctx *cli.Context, cache core.LocalCache, dags []core.DAG) error,
 ) cli.ActionFunc {
-	return targetAction(func(
+	return targetsAction(func(
 		ctx *cli.Context,
-		t *core.Target,
+		targets []core.Target,
 		workspace workspace,
 	) error {
-		cacheDir := "/tmp/cache"
-		if home := os.Getenv("HOME"); home != "" {
-			cacheDir = filepath.Join(home, ".cache/builder")
+		cache := core.NewLocalCache(workspace.id, cacheDirectory())
+		dags, err := freeze(workspace, cache, targets)
+		if err != nil {
+			return err
 		}
-		cache := core.LocalCache(workspace.id, cacheDir)
+		return f(ctx, cache, dags)
+	})
+}
 
-		dag, err := core.FreezeTarget(workspace.root, cache, *t)
+// dagAction loads and freezes the single target matched by the command's
+// first argument. The remaining arguments are left to `f`.
+func dagAction(
+	f func(ctx *cli.Context, cache core.LocalCache, dag core.DAG) error,
+) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return errors.New("Missing PACKAGE:TARGET argument")
+		}
+
+		workspace, pwd, err := currentWorkspace()
 		if err != nil {
-			if evalErr, ok := err.(*starlark.EvalError); ok {
-				return errors.New(evalErr.Backtrace())
-			}
 			return err
 		}
-		return f(ctx, cache, dag)
-	})
+
+		targets, err := loadTargets(workspace, pwd, ctx.Args()[:1])
+		if err != nil {
+			return err
+		}
+		if len(targets) > 1 {
+			return errors.Errorf(
+				"%s matches %d targets; expected exactly one",
+				ctx.Args()[0],
+				len(targets),
+			)
+		}
+
+		cache := core.NewLocalCache(workspace.id, cacheDirectory())
+		dags, err := freeze(workspace, cache, targets)
+		if err != nil {
+			return err
+		}
+		return f(ctx, cache, dags[0])
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == buildutil.SandboxCommand {
+		buildutil.SandboxMain()
+	}
+
 	app := cli.NewApp()
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "remote-cache",
+			Usage:  "The URL of a remote cache (e.g., a `builder cache-server`)",
+			EnvVar: "BUILDER_REMOTE_CACHE",
+		},
+		cli.StringSliceFlag{
+			Name: "worker",
+			Usage: "The URL of a remote execution worker (e.g., a `builder " +
+				"worker`) to build targets on; may be repeated or " +
+				"comma-separated",
+			EnvVar: "BUILDER_WORKERS",
+		},
+		cli.BoolFlag{
+			Name: "sandbox",
+			Usage: "Run build commands in a sandbox which exposes only " +
+				"their declared inputs (Linux only)",
+			EnvVar: "BUILDER_SANDBOX",
+		},
+		cli.StringSliceFlag{
+			Name: "sandbox-allow",
+			Usage: "An additional host path that sandboxed build commands " +
+				"may read (e.g., a toolchain directory); may be repeated",
+		},
+		cli.DurationFlag{
+			Name: "timeout",
+			Usage: "The maximum duration of each target's build (e.g., " +
+				"'10m'), for targets without a timeout of their own",
+			EnvVar: "BUILDER_TIMEOUT",
+		},
+	}
+	app.Before = func(ctx *cli.Context) error {
+		if ctx.GlobalBool("sandbox") {
+			buildutil.Sandboxing = &buildutil.Sandbox{
+				AllowedPaths: append(
+					buildutil.DefaultSandboxPaths,
+					ctx.GlobalStringSlice("sandbox-allow")...,
+				),
+			}
+		}
+		return nil
+	}
 	app.Commands = []cli.Command{
 		cli.Command{
-			Name:        "build",
-			Usage:       "Build a target",
-			UsageText:   "Build a target",
-			Description: "Build a target",
-			ArgsUsage: "Takes a single argument in the format " +
-				"'PACKAGE:TARGET'",
-			Action: dagAction(build),
+			Name:      "build",
+			Usage:     "Build targets",
+			UsageText: "Build targets",
+			Description: "Build the targets matched by one or more target " +
+				"patterns. Dependencies shared between targets are only " +
+				"built once. By default, the build stops at the first " +
+				"failure; with --keep-going, every target whose " +
+				"dependencies succeeded is still built, and the build " +
+				"ends with a summary of the failed targets (and their " +
+				"logs), the skipped targets (and the failures which " +
+				"blocked them), and the succeeded targets.",
+			ArgsUsage: patternsUsage,
+			Flags: []cli.Flag{
+				jobsFlag,
+				buildEventFileFlag,
+				profileFlag,
+				cli.BoolFlag{
+					Name: "keep-going, k",
+					Usage: "Keep building the targets whose dependencies " +
+						"succeeded after a failure, and summarize the build",
+				},
+			},
+			Before: startProfiling,
+			After:  writeProfile,
+			Action: dagsAction(func(
+				ctx *cli.Context,
+				cache core.LocalCache,
+				dags []core.DAG,
+			) error {
+				return build(ctx, cache, dags...)
+			}),
 		},
 		cli.Command{
 			Name:      "show",
 			Aliases:   []string{"eval", "json"},
 			Usage:     "Print JSON representation for a given target",
 			UsageText: "Print JSON representation for a given target",
-			Description: "Takes a target identifier (PACKAGE:TARGET), finds " +
-				"the corresponding target definition (starlark), evaluates " +
-				"it into a target, and renders the target as JSON.",
-			ArgsUsage: "Takes a single argument in the format " +
-				"'PACKAGE:TARGET'",
-			Action: targetAction(func(
+			Description: "Takes target patterns (e.g., PACKAGE:TARGET), " +
+				"finds the corresponding target definitions (starlark), " +
+				"evaluates them into targets, and renders each target as " +
+				"JSON.",
+			ArgsUsage: patternsUsage,
+			Action: targetsAction(func(
 				ctx *cli.Context,
-				t *core.Target,
+				targets []core.Target,
 				workspace workspace,
 			) error {
-				data, err := json.MarshalIndent(t, "", "    ")
-				if err != nil {
-					return errors.Wrapf(
-						err,
-						"Failed to marshal target %s",
-						t.ID,
-					)
+				for _, t := range targets {
+					data, err := json.MarshalIndent(t, "", "    ")
+					if err != nil {
+						return errors.Wrapf(
+							err,
+							"Failed to marshal target %s",
+							t.ID,
+						)
+					}
+					fmt.Printf("%s\n", data)
 				}
-				fmt.Printf("%s\n", data)
 				return nil
 			}),
 		},
@@ -220,15 +622,17 @@ func main() {
 			Aliases:   []string{"fingerprint"},
 			Usage:     "Print the checksum of a target",
 			UsageText: "Print the checksum for a target",
-			ArgsUsage: "Takes a single argument in the format " +
-				"'PACKAGE:TARGET'",
-			Action: dagAction(func(
+			Description: "Prints the checksum of each target. If more than " +
+				"one target matches, each checksum is followed by its target.",
+			ArgsUsage: patternsUsage,
+			Action: dagsAction(func(
 				ctx *cli.Context,
-				cache core.Cache,
-				dag core.DAG,
+				cache core.LocalCache,
+				dags []core.DAG,
 			) error {
-				_, err := fmt.Println(dag.ID.Checksum)
-				return err
+				return printPerTarget(dags, func(dag core.DAG) string {
+					return dag.ID.Checksum.String()
+				})
 			}),
 		},
 		cli.Command{
@@ -241,16 +645,34 @@ func main() {
 				"evaluates and fully hashes the target to determine where " +
 				"the final cache path for the artifact. This does not build " +
 				"the artifact nor does it depend on the artifact having " +
-				"been built previously at the current version.",
-			ArgsUsage: "Takes a single argument in the format " +
-				"'PACKAGE:TARGET'",
-			Action: dagAction(func(
+				"been built previously at the current version. If more " +
+				"than one target matches, each path is followed by its " +
+				"target. With --output, the path of the target's named " +
+				"output is printed instead.",
+			ArgsUsage: patternsUsage,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "Print the path of the named output NAME",
+				},
+			},
+			Action: dagsAction(func(
 				ctx *cli.Context,
-				cache core.Cache,
-				dag core.DAG,
+				cache core.LocalCache,
+				dags []core.DAG,
 			) error {
-				_, err := fmt.Println(cache.Path(dag.ID.ArtifactID()))
-				return err
+				output := ctx.String("output")
+				if output != "" {
+					if err := core.ValidateOutputName(output); err != nil {
+						return err
+					}
+				}
+				return printPerTarget(dags, func(dag core.DAG) string {
+					if output != "" {
+						return cache.OutputPath(dag.ID.ArtifactID(), output)
+					}
+					return cache.Path(dag.ID.ArtifactID())
+				})
 			}),
 		},
 		cli.Command{
@@ -264,26 +686,84 @@ func main() {
 				os.Args[0],
 				os.Args[0],
 			),
-			ArgsUsage: "Takes a single argument in the format " +
-				"'PACKAGE:TARGET'",
+			ArgsUsage: "Takes a target in the format 'PACKAGE:TARGET' " +
+				"followed by the arguments to pass to the artifact",
+			Flags:  []cli.Flag{jobsFlag, buildEventFileFlag},
 			Action: dagAction(run),
 		},
+		graphCommand,
+		testCommand,
+		watchCommand,
+		logsCommand,
+		gcCommand,
+		queryCommand,
 		cli.Command{
-			Name:        "graph",
-			Usage:       "Graphs the dependencies",
-			UsageText:   "Graphs the dependencies",
-			Description: "Render the dependency graph as plaintext",
-			ArgsUsage: "Takes a single argument in the format " +
-				"'PACKAGE:TARGET'",
-			Action: dagAction(func(
-				_ *cli.Context,
-				_ core.Cache,
-				dag core.DAG,
-			) error {
-				graph(dag, "")
-				fmt.Println()
-				return nil
-			}),
+			Name:      "worker",
+			Usage:     "Builds targets on behalf of other machines",
+			UsageText: "Builds targets on behalf of other machines",
+			Description: "Serves the remote execution protocol spoken by " +
+				"the --worker flag: clients upload a target's inputs, the " +
+				"worker builds the target with its own cache, and the " +
+				"client downloads the artifact.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "addr",
+					Usage: "The address to listen on",
+					Value: ":8081",
+				},
+				cli.StringFlag{
+					Name:  "directory",
+					Usage: "The worker's cache directory",
+					Value: cacheDirectory(),
+				},
+				jobsFlag,
+			},
+			Action: func(ctx *cli.Context) error {
+				fmt.Printf(
+					"Serving builds from %s on %s\n",
+					ctx.String("directory"),
+					ctx.String("addr"),
+				)
+				return http.ListenAndServe(
+					ctx.String("addr"),
+					core.WorkerServer(
+						plugins,
+						ctx.String("directory"),
+						ctx.Int("jobs"),
+					),
+				)
+			},
+		},
+		cli.Command{
+			Name:      "cache-server",
+			Usage:     "Serves a cache directory over HTTP",
+			UsageText: "Serves a cache directory over HTTP",
+			Description: "Serves the cache directory via the protocol " +
+				"spoken by the --remote-cache flag so that artifacts can " +
+				"be shared between machines.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "addr",
+					Usage: "The address to listen on",
+					Value: ":8080",
+				},
+				cli.StringFlag{
+					Name:  "directory",
+					Usage: "The cache directory to serve",
+					Value: cacheDirectory(),
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				fmt.Printf(
+					"Serving %s on %s\n",
+					ctx.String("directory"),
+					ctx.String("addr"),
+				)
+				return http.ListenAndServe(
+					ctx.String("addr"),
+					core.CacheServer(ctx.String("directory")),
+				)
+			},
 		},
 	}
 	if err := app.Run(os.Args); err != nil {
@@ -1,84 +1,160 @@
 package command
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
 
 	"github.com/pkg/errors"
 	"github.com/weberc2/builder/buildutil"
 	"github.com/weberc2/builder/core"
 )
 
+// parseInputs parses the `command`, `args`, and `environment` inputs shared
+// by command and test targets. Artifacts and named outputs are resolved to
+// their cache paths.
+func parseInputs(
+	dag core.DAG,
+	cache core.LocalCache,
+) (string, []string, []string, error) {
+	var command string
+	var args []string
+	var environment []string
+	err := dag.Inputs.VisitKeys(
+		core.KeySpec{
+			Key: "command",
+			Value: core.Match(
+				core.ParseString(&command),
+				core.AssertArtifactID(func(id core.ArtifactID) error {
+					command = cache.Path(id)
+					return nil
+				}),
+			),
+		},
+		core.KeySpec{
+			Key: "args",
+			Value: core.AssertArrayOf(core.Match(
+				core.AssertString(func(s string) error {
+					args = append(args, s)
+					return nil
+				}),
+				core.AssertArtifactID(func(id core.ArtifactID) error {
+					args = append(args, cache.Path(id))
+					return nil
+				}),
+				core.AssertOutputID(func(id core.OutputID) error {
+					args = append(
+						args,
+						cache.OutputPath(id.Artifact, id.Output),
+					)
+					return nil
+				}),
+			)),
+		},
+		core.KeySpec{
+			Key: "environment",
+			Value: core.AssertObjectOf(func(field core.FrozenField) error {
+				var s string
+				switch x := field.Value.(type) {
+				case core.String:
+					s = string(x)
+				case core.ArtifactID:
+					s = cache.Path(x)
+				case core.OutputID:
+					s = cache.OutputPath(x.Artifact, x.Output)
+				default:
+					return core.NewTypeErr(
+						"Union[str, Target]",
+						field.Value,
+					)
+				}
+				environment = append(
+					environment,
+					fmt.Sprintf("%s=%s", field.Key, s),
+				)
+				return nil
+			}),
+		},
+	)
+	return command, args, environment, err
+}
+
+// parseOutputs parses the optional `outputs` input, the names of the named
+// outputs that the command writes. The input is omitted rather than empty
+// when there are no named outputs so that existing targets' checksums don't
+// change.
+func parseOutputs(dag core.DAG) ([]string, error) {
+	value, err := dag.Inputs.Get("outputs")
+	if _, ok := err.(core.KeyNotFoundErr); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var outputs []string
+	return outputs, errors.Wrap(
+		core.AssertArrayOf(core.AssertString(func(name string) error {
+			if err := core.ValidateOutputName(name); err != nil {
+				return err
+			}
+			outputs = append(outputs, name)
+			return nil
+		}))(value),
+		"Visiting key 'outputs'",
+	)
+}
+
+// outputEnvironment returns the `OUTPUT_<NAME>` environment variables which
+// tell the command where to write each of its named outputs.
+func outputEnvironment(
+	ctx *buildutil.BuildContext,
+	outputs []string,
+) ([]string, error) {
+	environment := make([]string, len(outputs))
+	for i, name := range outputs {
+		path, err := ctx.NamedOutput(name)
+		if err != nil {
+			return nil, err
+		}
+		environment[i] = fmt.Sprintf("%s=%s", core.OutputEnvVar(name), path)
+	}
+	return environment, nil
+}
+
 var Command = core.Plugin{
 	Type: core.BuilderType("command"),
 	BuildScript: func(
+		ctx context.Context,
 		dag core.DAG,
-		cache core.Cache,
+		cache core.LocalCache,
 		stdout io.Writer,
 		stderr io.Writer,
 	) error {
-		var command string
-		var args []string
-		var environment []string
-		if err := dag.Inputs.VisitKeys(
-			core.KeySpec{
-				Key: "command",
-				Value: core.Match(
-					core.ParseString(&command),
-					core.AssertArtifactID(func(id core.ArtifactID) error {
-						command = cache.Path(id)
-						return nil
-					}),
-				),
-			},
-			core.KeySpec{
-				Key: "args",
-				Value: core.AssertArrayOf(core.Match(
-					core.AssertString(func(s string) error {
-						args = append(args, s)
-						return nil
-					}),
-					core.AssertArtifactID(func(id core.ArtifactID) error {
-						args = append(args, cache.Path(id))
-						return nil
-					}),
-				)),
-			},
-			core.KeySpec{
-				Key: "environment",
-				Value: core.AssertObjectOf(func(field core.FrozenField) error {
-					var s string
-					switch x := field.Value.(type) {
-					case core.String:
-						s = string(x)
-					case core.ArtifactID:
-						s = cache.Path(x)
-					default:
-						return core.NewTypeErr(
-							"Union[str, Target]",
-							field.Value,
-						)
-					}
-					environment = append(
-						environment,
-						fmt.Sprintf("%s=%s", field.Key, s),
-					)
-					return nil
-				}),
-			},
-		); err != nil {
+		command, args, environment, err := parseInputs(dag, cache)
+		if err != nil {
+			return errors.Wrap(err, "Running command() build script")
+		}
+		outputs, err := parseOutputs(dag)
+		if err != nil {
 			return errors.Wrap(err, "Running command() build script")
 		}
 
 		return buildutil.Build(
+			ctx,
 			dag,
 			cache,
 			stdout,
 			stderr,
 			func(ctx *buildutil.BuildContext) error {
+				outputEnv, err := outputEnvironment(ctx, outputs)
+				if err != nil {
+					return err
+				}
 				environment = append(
-					environment,
+					append(environment, outputEnv...),
 					fmt.Sprintf("OUTPUT=%s", ctx.Output),
 				)
 				return ctx.Call(
@@ -92,15 +168,159 @@ var Command = core.Plugin{
 	},
 }
 
+// Test runs a test command. The test passes if the command exits zero. The
+// command may write a JUnit XML report to `$JUNIT_OUTPUT`. The artifact is a
+// directory containing the command's output and the report (if any), which
+// are also available as the named outputs `log` and `junit`.
+var Test = core.Plugin{
+	Type: core.TestBuilderType,
+	BuildScript: func(
+		ctx context.Context,
+		dag core.DAG,
+		cache core.LocalCache,
+		stdout io.Writer,
+		stderr io.Writer,
+	) error {
+		command, args, environment, err := parseInputs(dag, cache)
+		if err != nil {
+			return errors.Wrap(err, "Running test() build script")
+		}
+		outputs, err := parseOutputs(dag)
+		if err != nil {
+			return errors.Wrap(err, "Running test() build script")
+		}
+
+		return buildutil.Build(
+			ctx,
+			dag,
+			cache,
+			stdout,
+			stderr,
+			func(ctx *buildutil.BuildContext) error {
+				if err := os.Mkdir(ctx.Output, 0755); err != nil {
+					return errors.Wrap(err, "Creating test output directory")
+				}
+				log, err := os.Create(
+					filepath.Join(ctx.Output, core.TestLogFile),
+				)
+				if err != nil {
+					return errors.Wrap(err, "Creating test log")
+				}
+				defer log.Close()
+
+				outputEnv, err := outputEnvironment(ctx, outputs)
+				if err != nil {
+					return err
+				}
+				environment = append(
+					append(environment, outputEnv...),
+					fmt.Sprintf(
+						"JUNIT_OUTPUT=%s",
+						filepath.Join(ctx.Output, core.TestJUnitFile),
+					),
+				)
+				testCtx := *ctx
+				testCtx.Stdout = io.MultiWriter(ctx.Stdout, log)
+				testCtx.Stderr = io.MultiWriter(ctx.Stderr, log)
+				if err := testCtx.Call(
+					command,
+					ctx.Workspace,
+					append(os.Environ(), environment...),
+					args...,
+				); err != nil {
+					if _, ok := errors.Cause(err).(*exec.ExitError); ok {
+						// The failing test's artifact isn't stored, so its
+						// report is kept for `builder test --junit`.
+						if err := cache.KeepFailedJUnit(
+							dag.ID,
+							filepath.Join(ctx.Output, core.TestJUnitFile),
+						); err != nil {
+							return errors.Wrap(err, "Keeping JUnit report")
+						}
+						return core.TestFailedErr{Target: dag.ID, Err: err}
+					}
+					return err
+				}
+				return linkTestOutputs(ctx)
+			},
+		)
+	},
+}
+
+// linkTestOutputs exposes the test's log and JUnit report (if any) as the
+// named outputs `log` and `junit`.
+func linkTestOutputs(ctx *buildutil.BuildContext) error {
+	for name, file := range map[string]string{
+		"log":   core.TestLogFile,
+		"junit": core.TestJUnitFile,
+	} {
+		src := filepath.Join(ctx.Output, file)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		dst, err := ctx.NamedOutput(name)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(src, dst); err != nil {
+			return errors.Wrapf(err, "Linking test output %s", name)
+		}
+	}
+	return nil
+}
+
 const BuiltinModule = `
-def bash(name, script, environment = None):
+def _with_outputs(args, outputs):
+    if outputs:
+        args["outputs"] = outputs
+    return args
+
+def bash(name, script, environment = None, outputs = None, timeout = None):
     return mktarget(
         name = name,
         type = "command",
-        args = {
-            "command": "bash",
-            "environment": environment if environment != None else {},
-            "args": [ "-c", "set -e\nset -o pipefail\n{}".format(script) ],
-        },
+        timeout = timeout,
+        args = _with_outputs(
+            {
+                "command": "bash",
+                "environment": environment if environment != None else {},
+                "args": [
+                    "-c",
+                    "set -e\nset -o pipefail\n{}".format(script),
+                ],
+            },
+            outputs,
+        ),
+    )
+
+def test(
+        name,
+        command,
+        args = None,
+        environment = None,
+        outputs = None,
+        timeout = None):
+    return mktarget(
+        name = name,
+        type = "test",
+        timeout = timeout,
+        args = _with_outputs(
+            {
+                "command": command,
+                "environment": environment if environment != None else {},
+                "args": args if args != None else [],
+            },
+            outputs,
+        ),
+    )
+
+def bash_test(name, script, environment = None, outputs = None, timeout = None):
+    return test(
+        name = name,
+        command = "bash",
+        environment = environment,
+        args = [ "-c", "set -e\nset -o pipefail\n{}".format(script) ],
+        outputs = outputs,
+        timeout = timeout,
     )
 `
@@ -0,0 +1,210 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/weberc2/builder/buildutil"
+	"github.com/weberc2/builder/core"
+)
+
+type action struct {
+	command     string
+	environment []string
+}
+
+// envValues renders an action's environment variable value as strings.
+// Artifacts become their paths, and provider references become the values of
+// the provider fields (see core.ProviderRef); any artifacts to which those
+// refer are added to `extra`.
+func envValues(
+	cache core.LocalCache,
+	input core.FrozenInput,
+	extra *[]core.ArtifactID,
+) ([]string, error) {
+	switch x := input.(type) {
+	case core.String:
+		return []string{string(x)}, nil
+	case core.Int:
+		return []string{fmt.Sprint(x)}, nil
+	case core.Bool:
+		return []string{fmt.Sprint(x)}, nil
+	case core.ArtifactID:
+		return []string{cache.Path(x)}, nil
+	case core.OutputID:
+		return []string{cache.OutputPath(x.Artifact, x.Output)}, nil
+	case core.FrozenArray:
+		var values []string
+		for _, elt := range x {
+			eltValues, err := envValues(cache, elt, extra)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, eltValues...)
+		}
+		return values, nil
+	case core.FrozenObject:
+		var file core.File
+		if err := core.AssertFile(func(f core.File) error {
+			file = f
+			return nil
+		})(x); err == nil {
+			return []string{cache.FilePath(file)}, nil
+		}
+		if _, err := x.Get("provider_of"); err == nil {
+			return providerValues(cache, x, extra)
+		}
+		return nil, errors.New(
+			"Objects other than files can't be environment variables",
+		)
+	default:
+		return nil, core.NewTypeErr("Union[str, Target]", input)
+	}
+}
+
+// providerValues renders the provider field referred to by `ref`.
+func providerValues(
+	cache core.LocalCache,
+	ref core.FrozenObject,
+	extra *[]core.ArtifactID,
+) ([]string, error) {
+	var id core.ArtifactID
+	var provider, field string
+	if err := ref.VisitKeys(
+		core.KeySpec{Key: "provider_of", Value: core.ParseArtifactID(&id)},
+		core.KeySpec{Key: "provider", Value: core.ParseString(&provider)},
+		core.KeySpec{Key: "field", Value: core.ParseString(&field)},
+	); err != nil {
+		return nil, errors.Wrap(err, "Parsing provider reference")
+	}
+	fields, err := cache.Provider(id, provider)
+	if err != nil {
+		return nil, err
+	}
+	value, err := fields.Get(field)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Provider %s of %s", provider, id)
+	}
+	*extra = append(*extra, core.ArtifactIDs(value)...)
+	return envValues(cache, value, extra)
+}
+
+// parseActions parses the actions emitted by a rule's implementation. The
+// artifacts referred to by the providers in the actions' environments are
+// returned as well.
+func parseActions(
+	dag core.DAG,
+	cache core.LocalCache,
+) ([]action, []core.ArtifactID, error) {
+	var actions []action
+	var extra []core.ArtifactID
+	err := dag.Inputs.VisitKey(
+		"actions",
+		core.AssertArrayOf(core.AssertObject(func(fo core.FrozenObject) error {
+			var a action
+			if err := fo.VisitKeys(
+				core.KeySpec{
+					Key:   "command",
+					Value: core.ParseString(&a.command),
+				},
+				core.KeySpec{
+					Key: "environment",
+					Value: core.AssertObjectOf(func(ff core.FrozenField) error {
+						values, err := envValues(cache, ff.Value, &extra)
+						if err != nil {
+							return errors.Wrapf(err, "Variable %s", ff.Key)
+						}
+						a.environment = append(
+							a.environment,
+							fmt.Sprintf(
+								"%s=%s",
+								ff.Key,
+								strings.Join(dedupe(values), " "),
+							),
+						)
+						return nil
+					}),
+				},
+			); err != nil {
+				return err
+			}
+			actions = append(actions, a)
+			return nil
+		})),
+	)
+	return actions, extra, err
+}
+
+// dedupe removes all but the first occurrence of each value, e.g., of the
+// wheels which are provided by more than one of a rule's dependencies.
+func dedupe(values []string) []string {
+	seen := map[string]struct{}{}
+	var unique []string
+	for _, value := range values {
+		if _, found := seen[value]; !found {
+			seen[value] = struct{}{}
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// Rule builds targets declared by Starlark rules (see `rule()`). It runs the
+// target's actions in order with bash, each with `$OUTPUT` set to the path
+// of the artifact and `$OUTPUT_<NAME>` to the path of each named output.
+var Rule = core.Plugin{
+	Type: core.RuleBuilderType,
+	BuildScript: func(
+		ctx context.Context,
+		dag core.DAG,
+		cache core.LocalCache,
+		stdout io.Writer,
+		stderr io.Writer,
+	) error {
+		actions, extra, err := parseActions(dag, cache)
+		if err != nil {
+			return errors.Wrap(err, "Parsing rule actions")
+		}
+		outputs, err := parseOutputs(dag)
+		if err != nil {
+			return errors.Wrap(err, "Parsing rule outputs")
+		}
+
+		return buildutil.Build(
+			ctx,
+			dag,
+			cache,
+			stdout,
+			stderr,
+			func(ctx *buildutil.BuildContext) error {
+				ctx.ExtraInputs = extra
+				outputEnv, err := outputEnvironment(ctx, outputs)
+				if err != nil {
+					return err
+				}
+				for i, a := range actions {
+					if err := ctx.Call(
+						"bash",
+						ctx.Workspace,
+						append(
+							append(
+								append(os.Environ(), a.environment...),
+								outputEnv...,
+							),
+							fmt.Sprintf("OUTPUT=%s", ctx.Output),
+						),
+						"-c",
+						"set -e\nset -o pipefail\n"+a.command,
+					); err != nil {
+						return errors.Wrapf(err, "Running action %d", i)
+					}
+				}
+				return nil
+			},
+		)
+	},
+}
@@ -0,0 +1,30 @@
+package download
+
+const BuiltinModule = `
+def http_file(name, url, sha256, executable = False):
+	return mktarget(
+		name = name,
+		type = "http_file",
+		args = {"url": url, "sha256": sha256, "executable": executable},
+	)
+
+def http_archive(
+	name,
+	url,
+	sha256,
+	strip_prefix = "",
+	build_file = None,
+	type = "",
+):
+	return mktarget(
+		name = name,
+		type = "http_archive",
+		args = {
+			"url": url,
+			"sha256": sha256,
+			"strip_prefix": strip_prefix,
+			"build_file": build_file if build_file else "",
+			"type": type,
+		},
+	)
+`
@@ -0,0 +1,482 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/archiver"
+	"github.com/pkg/errors"
+	"github.com/weberc2/builder/core"
+)
+
+// ChecksumMismatchErr is returned when a download's SHA-256 digest doesn't
+// match the digest declared by its target.
+type ChecksumMismatchErr struct {
+	URL    string
+	Wanted string
+	Got    string
+}
+
+func (err ChecksumMismatchErr) Error() string {
+	return fmt.Sprintf(
+		"Checksum mismatch for %s: wanted sha256 %s, got %s",
+		err.URL,
+		err.Wanted,
+		err.Got,
+	)
+}
+
+// fetch downloads `url` to `dst`, verifying that the download's SHA-256
+// digest is `sha256Hex`. The download is aborted once `ctx` is done.
+func fetch(
+	ctx context.Context,
+	url string,
+	sha256Hex string,
+	dst string,
+	stdout io.Writer,
+) error {
+	wanted := strings.ToLower(sha256Hex)
+	if len(wanted) != hex.EncodedLen(sha256.Size) {
+		return errors.Errorf("Invalid sha256 '%s'", sha256Hex)
+	}
+
+	fmt.Fprintf(stdout, "Downloading %s\n", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return errors.Wrapf(err, "Downloading %s", url)
+	}
+	rsp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "Downloading %s", url)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return errors.Errorf("Downloading %s: %s", url, rsp.Status)
+	}
+
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, h), rsp.Body); err != nil {
+		return errors.Wrapf(err, "Downloading %s", url)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != wanted {
+		return ChecksumMismatchErr{URL: url, Wanted: wanted, Got: got}
+	}
+	return file.Close()
+}
+
+// parseInputs parses the `url` and `sha256` inputs shared by both builder
+// types.
+func parseInputs(
+	dag core.DAG,
+	more ...core.KeySpec,
+) (string, string, error) {
+	var url, sha256Hex string
+	err := dag.Inputs.VisitKeys(append(
+		[]core.KeySpec{
+			{Key: "url", Value: core.ParseString(&url)},
+			{Key: "sha256", Value: core.ParseString(&sha256Hex)},
+		},
+		more...,
+	)...)
+	return url, sha256Hex, err
+}
+
+// File downloads a single file. The artifact is the file itself.
+var File = core.Plugin{
+	Type: "http_file",
+	BuildScript: func(
+		ctx context.Context,
+		dag core.DAG,
+		cache core.LocalCache,
+		stdout io.Writer,
+		stderr io.Writer,
+	) error {
+		var executable bool
+		url, sha256Hex, err := parseInputs(dag, core.KeySpec{
+			Key: "executable",
+			Value: core.AssertBool(func(b bool) error {
+				executable = b
+				return nil
+			}),
+		})
+		if err != nil {
+			return errors.Wrap(err, "Parsing http_file inputs")
+		}
+
+		_, err = cache.TempDir(
+			func(dir string) (string, core.ArtifactID, error) {
+				dst := filepath.Join(dir, "file")
+				err := fetch(ctx, url, sha256Hex, dst, stdout)
+				if err != nil {
+					return "", core.ArtifactID{}, err
+				}
+				mode := os.FileMode(0644)
+				if executable {
+					mode = 0755
+				}
+				return "file", dag.ID.ArtifactID(), os.Chmod(dst, mode)
+			},
+		)
+		return errors.Wrap(err, "Running http_file build script")
+	},
+}
+
+// archiveName returns the name by which the archive's format is detected:
+// the last element of the URL's path, or, if the format is given explicitly,
+// a name with that extension.
+func archiveName(rawurl, archiveType string) string {
+	if archiveType != "" {
+		return "archive." + strings.TrimPrefix(archiveType, ".")
+	}
+	if u, err := url.Parse(rawurl); err == nil {
+		return path.Base(u.Path)
+	}
+	return path.Base(rawurl)
+}
+
+// within returns the path of `name` beneath `root`, or an error if `name`
+// would escape `root`.
+func within(root, name string) (string, error) {
+	cleaned := path.Clean(filepath.ToSlash(name))
+	if path.IsAbs(cleaned) || cleaned == ".." ||
+		strings.HasPrefix(cleaned, "../") {
+		return "", errors.Errorf("Illegal path in archive: %s", name)
+	}
+	return filepath.Join(root, filepath.FromSlash(cleaned)), nil
+}
+
+// throughSymlink returns an error if `path`, which is beneath `root`, or any
+// of its parents beneath `root` is an existing symlink. Archives may contain
+// symlinks which point within `root`, but nothing is extracted through them,
+// since a chain of them can point anywhere (e.g., `a -> .`, `a/b -> ..`).
+func throughSymlink(root, path, name string) error {
+	relpath, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+	current := root
+	for _, part := range strings.Split(relpath, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			// Nothing beneath a missing directory exists either.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf(
+				"Illegal path in archive: %s is beneath the symlink %s",
+				name,
+				current,
+			)
+		}
+	}
+	return nil
+}
+
+// extractEntry writes a single archive entry to `dst`, which is beneath
+// `root`. Links may not point outside of `root`, and no entry (nor the
+// target of a hard link) may be written or read through an existing symlink.
+func extractEntry(root, dst, name string, f archiver.File) error {
+	if err := throughSymlink(root, dst, name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	var link string
+	hardlink := false
+	switch h := f.Header.(type) {
+	case *tar.Header:
+		switch h.Typeflag {
+		case tar.TypeDir:
+			return os.MkdirAll(dst, 0755)
+		case tar.TypeSymlink:
+			link = h.Linkname
+		case tar.TypeLink:
+			link, hardlink = h.Linkname, true
+		case tar.TypeReg, tar.TypeRegA:
+		case tar.TypeXGlobalHeader:
+			return nil
+		default:
+			return errors.Errorf("Unsupported entry type in archive: %s", name)
+		}
+	case zip.FileHeader:
+		if f.IsDir() {
+			return os.MkdirAll(dst, 0755)
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			data, err := ioutil.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			link = string(data)
+		}
+	default:
+		return errors.Errorf("Unsupported archive header: %T", f.Header)
+	}
+
+	if hardlink {
+		// Hard link targets are named relative to the archive root.
+		target, err := within(root, link)
+		if err != nil {
+			return err
+		}
+		if err := throughSymlink(root, target, link); err != nil {
+			return err
+		}
+		return os.Link(target, dst)
+	}
+	if link != "" {
+		// Symlinks are relative to their own directory.
+		resolved := path.Join(path.Dir(filepath.ToSlash(name)), link)
+		if _, err := within(root, resolved); err != nil ||
+			filepath.IsAbs(link) {
+			return errors.Errorf(
+				"Illegal link in archive: %s -> %s",
+				name,
+				link,
+			)
+		}
+		return os.Symlink(link, dst)
+	}
+
+	out, err := os.OpenFile(
+		dst,
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
+		f.Mode().Perm()|0200,
+	)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, f); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// extract extracts the archive at `src` into the directory `dst`. Entries
+// outside of `stripPrefix` are skipped, and the prefix is removed from the
+// names of the rest.
+func extract(src, name, stripPrefix, dst string) error {
+	format, err := archiver.ByExtension(name)
+	if err != nil {
+		return errors.Wrapf(err, "Detecting archive format of %s", name)
+	}
+	reader, ok := format.(archiver.Reader)
+	if !ok {
+		return errors.Errorf("%s is not an archive format", name)
+	}
+
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := reader.Open(file, info.Size()); err != nil {
+		return errors.Wrap(err, "Opening archive")
+	}
+	defer reader.Close()
+
+	prefix := strings.Trim(filepath.ToSlash(stripPrefix), "/")
+	found := prefix == ""
+	for {
+		f, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "Reading archive")
+		}
+
+		entryName := f.Name()
+		switch h := f.Header.(type) {
+		case *tar.Header:
+			entryName = h.Name
+		case zip.FileHeader:
+			entryName = h.Name
+		}
+		entryName = strings.TrimPrefix(filepath.ToSlash(entryName), "./")
+		if prefix != "" {
+			trimmed := strings.TrimSuffix(entryName, "/")
+			if trimmed != prefix && !strings.HasPrefix(trimmed, prefix+"/") {
+				f.Close()
+				continue
+			}
+			found = true
+			entryName = strings.TrimPrefix(
+				strings.TrimPrefix(trimmed, prefix),
+				"/",
+			)
+		}
+
+		target, err := within(dst, entryName)
+		if err == nil && target != dst {
+			err = extractEntry(dst, target, entryName, f)
+		}
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "Extracting %s", entryName)
+		}
+	}
+
+	if !found {
+		return errors.Errorf(
+			"No entries in archive match strip_prefix '%s'",
+			stripPrefix,
+		)
+	}
+	return nil
+}
+
+// overlayBuildFile copies the file at `src` (or the only file in the
+// directory at `src`) to `dst`.
+func overlayBuildFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		var files []string
+		if err := filepath.Walk(src, func(
+			p string,
+			info os.FileInfo,
+			err error,
+		) error {
+			if err == nil && !info.IsDir() {
+				files = append(files, p)
+			}
+			return err
+		}); err != nil {
+			return err
+		}
+		if len(files) != 1 {
+			return errors.Errorf(
+				"build_file must contain exactly one file; found %d",
+				len(files),
+			)
+		}
+		src = files[0]
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// BuildFileName is the name given to an http_archive's `build_file` in the
+// extracted tree.
+const BuildFileName = "BUILD"
+
+// Archive downloads and extracts an archive. The artifact is the directory
+// of extracted files.
+var Archive = core.Plugin{
+	Type: "http_archive",
+	BuildScript: func(
+		ctx context.Context,
+		dag core.DAG,
+		cache core.LocalCache,
+		stdout io.Writer,
+		stderr io.Writer,
+	) error {
+		var stripPrefix, archiveType, buildFile string
+		url, sha256Hex, err := parseInputs(
+			dag,
+			core.KeySpec{Key: "strip_prefix", Value: core.ParseString(
+				&stripPrefix,
+			)},
+			core.KeySpec{Key: "type", Value: core.ParseString(&archiveType)},
+			core.KeySpec{Key: "build_file", Value: core.Match(
+				core.AssertString(func(s string) error {
+					if s != "" {
+						return errors.New(
+							"build_file must be a file group or target",
+						)
+					}
+					return nil
+				}),
+				core.AssertArtifactID(func(id core.ArtifactID) error {
+					buildFile = cache.Path(id)
+					return nil
+				}),
+			)},
+		)
+		if err != nil {
+			return errors.Wrap(err, "Parsing http_archive inputs")
+		}
+
+		_, err = cache.TempDir(
+			func(dir string) (string, core.ArtifactID, error) {
+				download := filepath.Join(dir, "download")
+				err := fetch(ctx, url, sha256Hex, download, stdout)
+				if err != nil {
+					return "", core.ArtifactID{}, err
+				}
+				out := filepath.Join(dir, "out")
+				if err := os.Mkdir(out, 0755); err != nil {
+					return "", core.ArtifactID{}, err
+				}
+				if err := extract(
+					download,
+					archiveName(url, archiveType),
+					stripPrefix,
+					out,
+				); err != nil {
+					return "", core.ArtifactID{}, err
+				}
+				if buildFile != "" {
+					if err := overlayBuildFile(
+						buildFile,
+						filepath.Join(out, BuildFileName),
+					); err != nil {
+						return "", core.ArtifactID{}, errors.Wrap(
+							err,
+							"Overlaying build_file",
+						)
+					}
+				}
+				return "out", dag.ID.ArtifactID(), nil
+			},
+		)
+		return errors.Wrap(err, "Running http_archive build script")
+	},
+}
@@ -0,0 +1,318 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/weberc2/builder/core"
+)
+
+type entry struct {
+	name string
+	body string
+	link string
+}
+
+func tarGz(t *testing.T, entries []entry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		h := tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body))}
+		switch {
+		case e.link != "":
+			h.Typeflag, h.Linkname, h.Size = tar.TypeSymlink, e.link, 0
+		case strings.HasSuffix(e.name, "/"):
+			h.Typeflag, h.Mode = tar.TypeDir, 0755
+		default:
+			h.Typeflag = tar.TypeReg
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if _, err := io.WriteString(tw, e.body); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func zipped(t *testing.T, entries []entry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if _, err := io.WriteString(w, e.body); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func serve(files map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, found := files[r.URL.Path]
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		},
+	))
+}
+
+func tempCache(t *testing.T) (core.LocalCache, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	return core.NewLocalCache("workspace", dir), func() { os.RemoveAll(dir) }
+}
+
+func dag(builderType core.BuilderType, inputs core.FrozenObject) core.DAG {
+	return core.DAG{FrozenTarget: core.FrozenTarget{
+		ID: core.FrozenTargetID{
+			Package: "pkg",
+			Target:  "download",
+		},
+		Inputs:      inputs,
+		BuilderType: builderType,
+	}}
+}
+
+func archiveInputs(
+	url string,
+	sha256Hex string,
+	stripPrefix string,
+	buildFile core.FrozenInput,
+) core.FrozenObject {
+	return core.FrozenObject{
+		{Key: "url", Value: core.String(url)},
+		{Key: "sha256", Value: core.String(sha256Hex)},
+		{Key: "strip_prefix", Value: core.String(stripPrefix)},
+		{Key: "type", Value: core.String("")},
+		{Key: "build_file", Value: buildFile},
+	}
+}
+
+func build(
+	t *testing.T,
+	plugin core.Plugin,
+	cache core.LocalCache,
+	dag core.DAG,
+) error {
+	return plugin.BuildScript(
+		context.Background(),
+		dag,
+		cache,
+		ioutil.Discard,
+		ioutil.Discard,
+	)
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	return string(data)
+}
+
+func TestFile(t *testing.T) {
+	data := []byte("#!/bin/sh\necho hello\n")
+	server := serve(map[string][]byte{"/tool.sh": data})
+	defer server.Close()
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+
+	d := dag(File.Type, core.FrozenObject{
+		{Key: "url", Value: core.String(server.URL + "/tool.sh")},
+		{Key: "sha256", Value: core.String(digest(data))},
+		{Key: "executable", Value: core.Bool(true)},
+	})
+	if err := build(t, File, cache, d); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	path := cache.Path(d.ID.ArtifactID())
+	if got := readFile(t, path); got != string(data) {
+		t.Fatalf("Wanted %q; got %q", data, got)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Fatalf("Wanted mode 0755; got %v", info.Mode().Perm())
+	}
+}
+
+func TestFile_ChecksumMismatch(t *testing.T) {
+	server := serve(map[string][]byte{"/file": []byte("tampered")})
+	defer server.Close()
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+
+	wanted := digest([]byte("original"))
+	d := dag(File.Type, core.FrozenObject{
+		{Key: "url", Value: core.String(server.URL + "/file")},
+		{Key: "sha256", Value: core.String(wanted)},
+		{Key: "executable", Value: core.Bool(false)},
+	})
+	err := build(t, File, cache, d)
+	mismatch, ok := errors.Cause(err).(ChecksumMismatchErr)
+	if !ok {
+		t.Fatalf("Wanted ChecksumMismatchErr; got %v", err)
+	}
+	if mismatch.Wanted != wanted {
+		t.Fatalf("Wanted %s; got %s", wanted, mismatch.Wanted)
+	}
+	if err := cache.Exists(d.ID.ArtifactID()); err == nil {
+		t.Fatal("Artifact was cached despite the checksum mismatch")
+	}
+}
+
+func TestArchive(t *testing.T) {
+	entries := []entry{
+		{name: "project-1.0/"},
+		{name: "project-1.0/README", body: "readme"},
+		{name: "project-1.0/src/main.c", body: "int main() {}"},
+		{name: "project-1.0/BUILD", body: "upstream"},
+		{name: "other/ignored", body: "ignored"},
+	}
+	tgz, zipData := tarGz(t, entries), zipped(t, entries)
+	server := serve(map[string][]byte{
+		"/project-1.0.tar.gz": tgz,
+		"/project-1.0.zip":    zipData,
+	})
+	defer server.Close()
+	cache, cleanup := tempCache(t)
+	defer cleanup()
+
+	// The build file is a file group containing a single file.
+	buildFile := core.ArtifactID{
+		Package:  "pkg",
+		Target:   "filegroup",
+		Checksum: core.ChecksumString("BUILD.project"),
+	}
+	if err := cache.Write(buildFile, func(w io.Writer) error {
+		_, err := io.WriteString(w, "overlay")
+		return err
+	}); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		data      []byte
+		buildFile core.FrozenInput
+		wantBuild string
+	}{
+		{"tar.gz", tgz, core.String(""), "upstream"},
+		{"zip", zipData, buildFile, "overlay"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := dag(Archive.Type, archiveInputs(
+				server.URL+"/project-1.0."+tc.name,
+				digest(tc.data),
+				"project-1.0",
+				tc.buildFile,
+			))
+			d.ID.Target = core.TargetName(tc.name)
+			if err := build(t, Archive, cache, d); err != nil {
+				t.Fatalf("Unexpected err: %v", err)
+			}
+
+			root := cache.Path(d.ID.ArtifactID())
+			for path, wanted := range map[string]string{
+				"README":     "readme",
+				"src/main.c": "int main() {}",
+				"BUILD":      tc.wantBuild,
+			} {
+				got := readFile(t, filepath.Join(root, path))
+				if got != wanted {
+					t.Fatalf("%s: wanted %q; got %q", path, wanted, got)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(root, "other")); !os.IsNotExist(
+				err,
+			) {
+				t.Fatalf("Wanted entries outside strip_prefix skipped: %v", err)
+			}
+		})
+	}
+}
+
+func TestArchive_IllegalPaths(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []entry
+	}{
+		{"parent", []entry{{name: "../escape", body: "x"}}},
+		{"nested", []entry{{name: "a/../../escape", body: "x"}}},
+		{"absolute", []entry{{name: "/etc/escape", body: "x"}}},
+		{"absolute link", []entry{{name: "link", link: "/etc/passwd"}}},
+		{"relative link", []entry{{name: "a/link", link: "../../etc"}}},
+		{"chained links", []entry{
+			{name: "d", link: "."},
+			{name: "d/x", link: ".."},
+			{name: "x/pwned", body: "x"},
+		}},
+		{"through link", []entry{
+			{name: "a/", body: ""},
+			{name: "link", link: "a"},
+			{name: "link/file", body: "x"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := tarGz(t, tc.entries)
+			server := serve(map[string][]byte{"/evil.tar.gz": data})
+			defer server.Close()
+			cache, cleanup := tempCache(t)
+			defer cleanup()
+
+			d := dag(Archive.Type, archiveInputs(
+				server.URL+"/evil.tar.gz",
+				digest(data),
+				"",
+				core.String(""),
+			))
+			err := build(t, Archive, cache, d)
+			if err == nil || !strings.Contains(err.Error(), "Illegal") {
+				t.Fatalf("Wanted illegal path error; got %v", err)
+			}
+		})
+	}
+}
@@ -1,10 +1,30 @@
 package git
 
 const BuiltinModule = `
-def git_clone(name, repo, sha = "master"):
+def git_clone(
+	name,
+	repo,
+	ref = None,
+	sha = None,
+	allow_unpinned = False,
+	subdirectory = "",
+	submodules = False,
+	shallow = False,
+):
+	# "sha" is the old name for "ref".
+	ref = ref if ref != None else sha
+	if ref == None:
+		fail("git_clone: 'ref' is required")
 	return mktarget(
 		name = name,
 		type = "git_clone",
-		args = {"repo": repo, "sha": sha},
+		args = {
+			"repo": repo,
+			"ref": ref,
+			"allow_unpinned": allow_unpinned,
+			"subdirectory": subdirectory,
+			"submodules": submodules,
+			"shallow": shallow,
+		},
 	)
 `
@@ -1,59 +1,631 @@
 package git
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/weberc2/builder/core"
 	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
+// refKind is what a ref resolved to. Commits and tags are considered pinned;
+// branches move, and since a target's checksum depends only on its inputs,
+// a clone of a branch would be cached at whatever commit it was first built
+// from.
+type refKind int
+
+const (
+	kindCommit refKind = iota
+	kindTag
+	kindBranch
+)
+
+// errRefNotFound is returned by resolve() if the ref isn't in the
+// repository (yet).
+var errRefNotFound = errors.New("Ref not found")
+
+// cloneSpec describes a clone, per the inputs of a `git_clone` target.
+type cloneSpec struct {
+	repo          string
+	ref           string
+	subdirectory  string
+	allowUnpinned bool
+	submodules    bool
+	shallow       bool
+}
+
+// lockMirror locks the mirror directory `dir`, so that concurrent builds of
+// targets which clone the same repository (in this or another builder
+// process) don't fetch into the same mirror at once.
+func lockMirror(ctx context.Context, dir string) (func(), error) {
+	return core.LockFile(ctx, dir+".lock")
+}
+
+// mirrorDir returns the directory of the bare mirror of `repo`. Mirrors are
+// shared between workspaces.
+func mirrorDir(cache core.LocalCache, repo string) string {
+	return filepath.Join(
+		cache.Directory,
+		"git",
+		core.ChecksumString(repo).String(),
+	)
+}
+
+// openBare opens the bare repository at `dir`, creating it with an `origin`
+// remote for `repo` if it doesn't exist.
+func openBare(dir, repo string) (*git.Repository, error) {
+	r, err := git.PlainOpen(dir)
+	if err == nil {
+		return r, nil
+	}
+	if err != git.ErrRepositoryNotExists {
+		return nil, errors.Wrapf(err, "Opening %s", dir)
+	}
+	if r, err = git.PlainInit(dir, true); err != nil {
+		return nil, errors.Wrapf(err, "Creating %s", dir)
+	}
+	if _, err := r.CreateRemote(&config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{repo},
+		Fetch: []config.RefSpec{
+			"+refs/heads/*:refs/heads/*",
+			"+refs/tags/*:refs/tags/*",
+		},
+	}); err != nil {
+		return nil, errors.Wrapf(err, "Creating %s", dir)
+	}
+	return r, nil
+}
+
+// fetch fetches `refSpecs` (or the remote's default refspecs, if none are
+// given) from `origin`.
+func fetch(
+	ctx context.Context,
+	r *git.Repository,
+	repo string,
+	refSpecs []config.RefSpec,
+	depth int,
+	stdout io.Writer,
+) error {
+	fmt.Fprintf(stdout, "Fetching %s\n", repo)
+	err := r.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   refSpecs,
+		Depth:      depth,
+		Tags:       git.NoTags,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return errors.Wrapf(err, "Fetching %s", repo)
+	}
+	return nil
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// peel returns the commit that the object `h` refers to, following tags.
+func peel(r *git.Repository, h plumbing.Hash) (plumbing.Hash, error) {
+	obj, err := r.Object(plumbing.AnyObject, h)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	switch o := obj.(type) {
+	case *object.Commit:
+		return o.Hash, nil
+	case *object.Tag:
+		return peel(r, o.Target)
+	default:
+		return plumbing.ZeroHash, errors.Errorf(
+			"%s is a %s, not a commit",
+			h,
+			obj.Type(),
+		)
+	}
+}
+
+// resolve resolves `ref` to a commit using only the objects and refs already
+// in `r`. As with `git rev-parse`, a full SHA takes precedence over a tag,
+// which takes precedence over a branch, which takes precedence over an
+// abbreviated SHA.
+func resolve(r *git.Repository, ref string) (plumbing.Hash, refKind, error) {
+	if len(ref) == 2*len(plumbing.ZeroHash) && isHex(ref) {
+		h, err := peel(r, plumbing.NewHash(ref))
+		if err == plumbing.ErrObjectNotFound {
+			return h, kindCommit, errRefNotFound
+		}
+		return h, kindCommit, err
+	}
+
+	for _, candidate := range []struct {
+		name plumbing.ReferenceName
+		kind refKind
+	}{
+		{plumbing.NewTagReferenceName(ref), kindTag},
+		{plumbing.NewBranchReferenceName(ref), kindBranch},
+	} {
+		reference, err := r.Reference(candidate.name, true)
+		if err == plumbing.ErrReferenceNotFound {
+			continue
+		}
+		if err != nil {
+			return plumbing.ZeroHash, candidate.kind, err
+		}
+		h, err := peel(r, reference.Hash())
+		return h, candidate.kind, err
+	}
+
+	if len(ref) < 4 || !isHex(ref) {
+		return plumbing.ZeroHash, kindCommit, errRefNotFound
+	}
+	commits, err := r.CommitObjects()
+	if err != nil {
+		return plumbing.ZeroHash, kindCommit, err
+	}
+	defer commits.Close()
+	prefix := strings.ToLower(ref)
+	var matches []plumbing.Hash
+	if err := commits.ForEach(func(c *object.Commit) error {
+		if strings.HasPrefix(c.Hash.String(), prefix) {
+			matches = append(matches, c.Hash)
+		}
+		return nil
+	}); err != nil {
+		return plumbing.ZeroHash, kindCommit, err
+	}
+	switch len(matches) {
+	case 0:
+		return plumbing.ZeroHash, kindCommit, errRefNotFound
+	case 1:
+		return matches[0], kindCommit, nil
+	default:
+		return plumbing.ZeroHash, kindCommit, errors.Errorf(
+			"Abbreviated SHA '%s' is ambiguous",
+			ref,
+		)
+	}
+}
+
+// resolveMirrored resolves `ref` in the mirror of `repo`, fetching into the
+// mirror only if `ref` isn't already there or is a branch (which may have
+// moved). The mirror must be locked.
+func resolveMirrored(
+	ctx context.Context,
+	r *git.Repository,
+	repo string,
+	ref string,
+	stdout io.Writer,
+) (plumbing.Hash, refKind, error) {
+	h, kind, err := resolve(r, ref)
+	if err == nil && kind != kindBranch {
+		return h, kind, nil
+	}
+	if err != nil && err != errRefNotFound {
+		return h, kind, err
+	}
+	if err := fetch(ctx, r, repo, nil, 0, stdout); err != nil {
+		return plumbing.ZeroHash, kind, err
+	}
+	return resolve(r, ref)
+}
+
+// resolveShallow fetches only the commit at the tip of `ref`, which must be
+// a branch or tag (or the full SHA of the tip of one), into the fresh
+// repository `r`.
+func resolveShallow(
+	ctx context.Context,
+	r *git.Repository,
+	repo string,
+	ref string,
+	stdout io.Writer,
+) (plumbing.Hash, refKind, error) {
+	remote, err := r.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return plumbing.ZeroHash, kindCommit, err
+	}
+	refs, err := remote.List(&git.ListOptions{})
+	if err != nil {
+		return plumbing.ZeroHash, kindCommit, errors.Wrapf(
+			err,
+			"Listing refs of %s",
+			repo,
+		)
+	}
+
+	// As in resolve(), a full SHA takes precedence over a tag, which takes
+	// precedence over a branch.
+	var match *plumbing.Reference
+	kind := kindBranch
+	for _, reference := range refs {
+		switch {
+		case reference.Type() != plumbing.HashReference:
+		case reference.Hash().String() == strings.ToLower(ref):
+			match, kind = reference, kindCommit
+		case reference.Name() == plumbing.NewTagReferenceName(ref) &&
+			(match == nil || kind == kindBranch):
+			match, kind = reference, kindTag
+		case reference.Name() == plumbing.NewBranchReferenceName(ref) &&
+			match == nil:
+			match = reference
+		}
+	}
+	if match == nil {
+		return plumbing.ZeroHash, kind, errors.Errorf(
+			"Shallow clones need a branch or tag (or the full SHA of the "+
+				"tip of one), but '%s' isn't one",
+			ref,
+		)
+	}
+
+	refSpec := config.RefSpec(fmt.Sprintf("+%s:%s", match.Name(), match.Name()))
+	err = fetch(ctx, r, repo, []config.RefSpec{refSpec}, 1, stdout)
+	if err != nil {
+		return plumbing.ZeroHash, kind, err
+	}
+	h, err := peel(r, match.Hash())
+	return h, kind, err
+}
+
+// submodule is a submodule commit to be checked out at `dir`.
+type submodule struct {
+	repo string
+	hash plumbing.Hash
+	dir  string
+}
+
+// exporter writes the tree of a commit to a directory.
+type exporter struct {
+	r *git.Repository
+
+	// repo is the URL of the repository, against which relative submodule
+	// URLs are resolved.
+	repo string
+
+	// modules maps the paths of submodules to their configuration. It's nil
+	// if submodules aren't to be checked out.
+	modules map[string]*config.Submodule
+
+	// submodules are collected as they're found, so that they can be checked
+	// out after the mirror of this repository is unlocked.
+	submodules []submodule
+}
+
+func (e *exporter) writeBlob(
+	h plumbing.Hash,
+	dst string,
+	mode os.FileMode,
+) error {
+	blob, err := e.r.BlobObject(h)
+	if err != nil {
+		return err
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	file, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, reader); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func (e *exporter) writeSymlink(h plumbing.Hash, dst string) error {
+	blob, err := e.r.BlobObject(h)
+	if err != nil {
+		return err
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	target, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(string(target), dst)
+}
+
+// writeTree writes `tree`, which is at `treePath` in the repository, to
+// `dst`.
+func (e *exporter) writeTree(tree *object.Tree, treePath, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	for _, entry := range tree.Entries {
+		if entry.Name == "" || entry.Name == "." || entry.Name == ".." ||
+			strings.ContainsAny(entry.Name, `/\`) {
+			return errors.Errorf("Illegal name in tree: %q", entry.Name)
+		}
+		entryPath := path.Join(treePath, entry.Name)
+		target := filepath.Join(dst, entry.Name)
+
+		var err error
+		switch entry.Mode {
+		case filemode.Dir:
+			var subtree *object.Tree
+			if subtree, err = e.r.TreeObject(entry.Hash); err == nil {
+				err = e.writeTree(subtree, entryPath, target)
+			}
+		case filemode.Regular, filemode.Deprecated:
+			err = e.writeBlob(entry.Hash, target, 0644)
+		case filemode.Executable:
+			err = e.writeBlob(entry.Hash, target, 0755)
+		case filemode.Symlink:
+			err = e.writeSymlink(entry.Hash, target)
+		case filemode.Submodule:
+			// As with `git clone`, submodules which aren't checked out are
+			// empty directories.
+			if err = os.Mkdir(target, 0755); err == nil && e.modules != nil {
+				err = e.addSubmodule(entryPath, entry.Hash, target)
+			}
+		default:
+			err = errors.Errorf("Unsupported file mode %s", entry.Mode)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Writing %s", entryPath)
+		}
+	}
+	return nil
+}
+
+func (e *exporter) addSubmodule(
+	submodulePath string,
+	h plumbing.Hash,
+	dir string,
+) error {
+	module, found := e.modules[submodulePath]
+	if !found {
+		return errors.Errorf(
+			"Submodule %s not found in .gitmodules",
+			submodulePath,
+		)
+	}
+	e.submodules = append(e.submodules, submodule{
+		repo: resolveURL(e.repo, module.URL),
+		hash: h,
+		dir:  dir,
+	})
+	return nil
+}
+
+// resolveURL resolves a submodule's URL, which may be relative to the URL of
+// its superproject.
+func resolveURL(base, ref string) string {
+	if !strings.HasPrefix(ref, "./") && !strings.HasPrefix(ref, "../") {
+		return ref
+	}
+	if u, err := url.Parse(base); err == nil && u.Scheme != "" {
+		u.Path = path.Join(u.Path, ref)
+		return u.String()
+	}
+	return path.Join(base, ref)
+}
+
+// readModules reads the .gitmodules file at the root of `tree`, if there is
+// one.
+func readModules(tree *object.Tree) (map[string]*config.Submodule, error) {
+	modules := map[string]*config.Submodule{}
+	file, err := tree.File(".gitmodules")
+	if err == object.ErrFileNotFound {
+		return modules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+	parsed := config.NewModules()
+	if err := parsed.Unmarshal([]byte(contents)); err != nil {
+		return nil, errors.Wrap(err, "Parsing .gitmodules")
+	}
+	for _, module := range parsed.Submodules {
+		modules[path.Clean(module.Path)] = module
+	}
+	return modules, nil
+}
+
+// checkout resolves the spec's ref in `r` (per `resolveRef`) and writes the
+// commit's tree (or the spec's subdirectory thereof) to `dst`. It returns the
+// submodules yet to be checked out.
+func checkout(
+	r *git.Repository,
+	spec cloneSpec,
+	dst string,
+	resolveRef func() (plumbing.Hash, refKind, error),
+) ([]submodule, error) {
+	h, kind, err := resolveRef()
+	if err == errRefNotFound {
+		return nil, errors.Errorf(
+			"Ref '%s' not found in %s",
+			spec.ref,
+			spec.repo,
+		)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Resolving ref '%s'", spec.ref)
+	}
+	if kind == kindBranch && !spec.allowUnpinned {
+		return nil, errors.Errorf(
+			"Ref '%s' is a branch, so it isn't pinned to a commit; use a "+
+				"tag or commit SHA, or pass allow_unpinned = True",
+			spec.ref,
+		)
+	}
+
+	commit, err := r.CommitObject(h)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading commit %s", h)
+	}
+	root, err := commit.Tree()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading tree of commit %s", h)
+	}
+	tree := root
+	treePath := path.Clean("/" + spec.subdirectory)[1:]
+	if treePath != "" {
+		if tree, err = root.Tree(treePath); err != nil {
+			return nil, errors.Wrapf(
+				err,
+				"Finding subdirectory %s in commit %s",
+				spec.subdirectory,
+				h,
+			)
+		}
+	}
+
+	e := exporter{r: r, repo: spec.repo}
+	if spec.submodules {
+		if e.modules, err = readModules(root); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.writeTree(tree, treePath, dst); err != nil {
+		return nil, err
+	}
+	return e.submodules, nil
+}
+
+// clone writes the tree specified by `spec` to `dst`, using (and updating)
+// the mirror of the repository unless the clone is shallow. Shallow clones
+// fetch into `scratch`.
+func clone(
+	ctx context.Context,
+	cache core.LocalCache,
+	spec cloneSpec,
+	dst string,
+	scratch string,
+	stdout io.Writer,
+) error {
+	var submodules []submodule
+	if spec.shallow {
+		r, err := openBare(scratch, spec.repo)
+		if err != nil {
+			return err
+		}
+		if submodules, err = checkout(
+			r,
+			spec,
+			dst,
+			func() (plumbing.Hash, refKind, error) {
+				return resolveShallow(ctx, r, spec.repo, spec.ref, stdout)
+			},
+		); err != nil {
+			return err
+		}
+	} else {
+		dir := mirrorDir(cache, spec.repo)
+		unlock, err := lockMirror(ctx, dir)
+		if err != nil {
+			return errors.Wrapf(err, "Locking mirror of %s", spec.repo)
+		}
+		r, err := openBare(dir, spec.repo)
+		if err == nil {
+			submodules, err = checkout(
+				r,
+				spec,
+				dst,
+				func() (plumbing.Hash, refKind, error) {
+					return resolveMirrored(
+						ctx,
+						r,
+						spec.repo,
+						spec.ref,
+						stdout,
+					)
+				},
+			)
+		}
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range submodules {
+		if err := clone(
+			ctx,
+			cache,
+			cloneSpec{repo: s.repo, ref: s.hash.String(), submodules: true},
+			s.dir,
+			"",
+			stdout,
+		); err != nil {
+			return errors.Wrapf(err, "Cloning submodule %s", s.repo)
+		}
+	}
+	return nil
+}
+
 func gitCloneBuildScript(
+	ctx context.Context,
 	dag core.DAG,
-	cache core.Cache,
+	cache core.LocalCache,
 	stdout io.Writer,
 	stderr io.Writer,
 ) error {
-	var repo, sha string
+	var spec cloneSpec
+	parseBool := func(b *bool) func(core.FrozenInput) error {
+		return core.AssertBool(func(v bool) error {
+			*b = v
+			return nil
+		})
+	}
 	if err := dag.Inputs.VisitKeys(
-		core.KeySpec{Key: "repo", Value: core.ParseString(&repo)},
-		core.KeySpec{Key: "sha", Value: core.ParseString(&sha)},
+		core.KeySpec{Key: "repo", Value: core.ParseString(&spec.repo)},
+		core.KeySpec{Key: "ref", Value: core.ParseString(&spec.ref)},
+		core.KeySpec{
+			Key:   "subdirectory",
+			Value: core.ParseString(&spec.subdirectory),
+		},
+		core.KeySpec{
+			Key:   "allow_unpinned",
+			Value: parseBool(&spec.allowUnpinned),
+		},
+		core.KeySpec{Key: "submodules", Value: parseBool(&spec.submodules)},
+		core.KeySpec{Key: "shallow", Value: parseBool(&spec.shallow)},
 	); err != nil {
 		return errors.Wrap(err, "Parsing git_clone inputs")
 	}
 
 	if _, err := cache.TempDir(
 		func(tmpDir string) (string, core.ArtifactID, error) {
-			r, err := git.PlainClone(
-				tmpDir,
-				false,
-				&git.CloneOptions{URL: string(repo)},
-			)
-			if err != nil {
-				return "", core.ArtifactID{}, errors.Wrap(err, "Cloning repo")
-			}
-
-			worktree, err := r.Worktree()
-			if err != nil {
-				return "", core.ArtifactID{}, errors.Wrap(
-					err,
-					"Getting worktree",
-				)
-			}
-
-			if err := worktree.Checkout(&git.CheckoutOptions{
-				Hash:  plumbing.NewHash(string(sha)),
-				Force: true,
-			}); err != nil {
-				return "", core.ArtifactID{}, errors.Wrapf(
-					err,
-					"Checking out sha %s",
-					sha,
-				)
+			if err := clone(
+				ctx,
+				cache,
+				spec,
+				filepath.Join(tmpDir, "out"),
+				filepath.Join(tmpDir, "repo"),
+				stdout,
+			); err != nil {
+				return "", core.ArtifactID{}, err
 			}
-
-			return "", dag.ID.ArtifactID(), nil
+			return "out", dag.ID.ArtifactID(), nil
 		},
 	); err != nil {
 		return errors.Wrap(err, "Cloning git repo")
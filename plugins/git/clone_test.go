@@ -0,0 +1,290 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/weberc2/builder/core"
+)
+
+// gitRepo is a scratch repository, manipulated with the git CLI (which the
+// go-git file transport needs anyway).
+type gitRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newRepo(t *testing.T, root, name string) gitRepo {
+	r := gitRepo{t: t, dir: filepath.Join(root, name)}
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	r.run("init", "--quiet", "--initial-branch=master")
+	return r
+}
+
+func (r gitRepo) url() string { return "file://" + r.dir }
+
+func (r gitRepo) run(args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", r.dir}, args...)...)
+	cmd.Env = append(
+		os.Environ(),
+		"GIT_AUTHOR_NAME=test",
+		"GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test",
+		"GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_CONFIG_NOSYSTEM=1",
+		"HOME="+r.dir,
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func (r gitRepo) commit(files map[string]string) string {
+	for path, contents := range files {
+		path = filepath.Join(r.dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			r.t.Fatalf("Unexpected err: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			r.t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+	r.run("add", "--all")
+	r.run("commit", "--quiet", "--message", "commit")
+	return r.run("rev-parse", "HEAD")
+}
+
+func cloneDAG(name string, spec cloneSpec) core.DAG {
+	return core.DAG{FrozenTarget: core.FrozenTarget{
+		ID: core.FrozenTargetID{
+			Package:  "pkg",
+			Target:   core.TargetName(name),
+			Checksum: core.ChecksumString(name),
+		},
+		Inputs: core.FrozenObject{
+			{Key: "repo", Value: core.String(spec.repo)},
+			{Key: "ref", Value: core.String(spec.ref)},
+			{Key: "subdirectory", Value: core.String(spec.subdirectory)},
+			{Key: "allow_unpinned", Value: core.Bool(spec.allowUnpinned)},
+			{Key: "submodules", Value: core.Bool(spec.submodules)},
+			{Key: "shallow", Value: core.Bool(spec.shallow)},
+		},
+		BuilderType: Clone.Type,
+	}}
+}
+
+func TestClone(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer os.RemoveAll(root)
+	cache := core.NewLocalCache("workspace", filepath.Join(root, "cache"))
+
+	repo := newRepo(t, root, "repo")
+	first := repo.commit(map[string]string{
+		"version":      "1",
+		"sub/file":     "sub 1",
+		"sub/sub/deep": "deep",
+	})
+	repo.run("tag", "--annotate", "--message", "v1", "v1")
+	second := repo.commit(map[string]string{
+		"version":  "2",
+		"sub/file": "sub 2",
+	})
+	repo.run("tag", "lightweight")
+
+	for _, tc := range []struct {
+		name      string
+		spec      cloneSpec
+		wanted    map[string]string
+		wantedErr string
+	}{
+		{
+			name:   "annotated-tag",
+			spec:   cloneSpec{ref: "v1"},
+			wanted: map[string]string{"version": "1", "sub/file": "sub 1"},
+		},
+		{
+			name:   "lightweight-tag",
+			spec:   cloneSpec{ref: "lightweight"},
+			wanted: map[string]string{"version": "2"},
+		},
+		{
+			name:   "full-sha",
+			spec:   cloneSpec{ref: first},
+			wanted: map[string]string{"version": "1"},
+		},
+		{
+			name:   "short-sha",
+			spec:   cloneSpec{ref: second[:7]},
+			wanted: map[string]string{"version": "2"},
+		},
+		{
+			name:      "unpinned-branch",
+			spec:      cloneSpec{ref: "master"},
+			wantedErr: "isn't pinned",
+		},
+		{
+			name:   "allowed-branch",
+			spec:   cloneSpec{ref: "master", allowUnpinned: true},
+			wanted: map[string]string{"version": "2"},
+		},
+		{
+			name:      "missing",
+			spec:      cloneSpec{ref: "v2"},
+			wantedErr: "not found",
+		},
+		{
+			name:   "subdirectory",
+			spec:   cloneSpec{ref: "v1", subdirectory: "sub"},
+			wanted: map[string]string{"file": "sub 1", "sub/deep": "deep"},
+		},
+		{
+			name:   "shallow",
+			spec:   cloneSpec{ref: "v1", shallow: true},
+			wanted: map[string]string{"version": "1"},
+		},
+		{
+			name:      "shallow-sha",
+			spec:      cloneSpec{ref: first, shallow: true},
+			wantedErr: "Shallow clones need a branch or tag",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.spec.repo = repo.url()
+			dag := cloneDAG(tc.name, tc.spec)
+			err := Clone.BuildScript(
+				context.Background(),
+				dag,
+				cache,
+				ioutil.Discard,
+				ioutil.Discard,
+			)
+			if tc.wantedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantedErr) {
+					t.Fatalf("Wanted error '%s'; got %v", tc.wantedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected err: %v", err)
+			}
+			dir := cache.Path(dag.ID.ArtifactID())
+			for path, wanted := range tc.wanted {
+				data, err := ioutil.ReadFile(filepath.Join(dir, path))
+				if err != nil {
+					t.Fatalf("Unexpected err: %v", err)
+				}
+				if string(data) != wanted {
+					t.Fatalf("%s: wanted %q; got %q", path, wanted, data)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+				t.Fatal("Wanted no .git directory in the artifact")
+			}
+		})
+	}
+
+	// Commits already in the mirror are checked out without fetching.
+	var stdout bytes.Buffer
+	dag := cloneDAG("refetch", cloneSpec{repo: repo.url(), ref: second})
+	err = Clone.BuildScript(
+		context.Background(),
+		dag,
+		cache,
+		&stdout,
+		ioutil.Discard,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if stdout.Len() > 0 {
+		t.Fatalf("Wanted no fetch; got output %q", stdout.String())
+	}
+}
+
+func TestClone_Submodules(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer os.RemoveAll(root)
+	cache := core.NewLocalCache("workspace", filepath.Join(root, "cache"))
+
+	lib := newRepo(t, root, "lib")
+	libCommit := lib.commit(map[string]string{"lib.txt": "library"})
+	lib.commit(map[string]string{"lib.txt": "newer library"})
+
+	// Add the submodule by hand rather than with `git submodule add`, which
+	// refuses file URLs by default.
+	app := newRepo(t, root, "app")
+	app.commit(map[string]string{
+		".gitmodules": "[submodule \"lib\"]\n" +
+			"\tpath = vendor/lib\n" +
+			"\turl = ../lib\n",
+		"app.txt": "application",
+	})
+	app.run(
+		"update-index",
+		"--add",
+		"--cacheinfo",
+		"160000,"+libCommit+",vendor/lib",
+	)
+	app.run("commit", "--quiet", "--message", "add submodule")
+	app.run("tag", "v1")
+
+	for _, submodules := range []bool{false, true} {
+		name := "without-submodules"
+		if submodules {
+			name = "with-submodules"
+		}
+		dag := cloneDAG(name, cloneSpec{
+			repo:       app.url(),
+			ref:        "v1",
+			submodules: submodules,
+		})
+		if err := Clone.BuildScript(
+			context.Background(),
+			dag,
+			cache,
+			ioutil.Discard,
+			ioutil.Discard,
+		); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+
+		dir := cache.Path(dag.ID.ArtifactID())
+		data, err := ioutil.ReadFile(filepath.Join(dir, "vendor/lib/lib.txt"))
+		if !submodules {
+			if !os.IsNotExist(err) {
+				t.Fatalf("Wanted empty submodule directory; got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		// The submodule is checked out at the commit recorded in the
+		// superproject, not the tip of its branch.
+		if string(data) != "library" {
+			t.Fatalf("Wanted %q; got %q", "library", data)
+		}
+	}
+}
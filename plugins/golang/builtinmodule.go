@@ -3,13 +3,58 @@ package golang
 const BuiltinModule = `
 load("std/command", "bash")
 
-def go_module(name, sources, directory = None):
-	return bash(
+def go_library(name, import_path, sources, directory = None, dependencies = None):
+	return mktarget(
 		name = name,
-		environment = {
-			"SOURCES": sources,
-			"DIRECTORY": directory if directory != None else ""
+		type = "go_library",
+		args = {
+			"import_path": import_path,
+			"sources": sources,
+			"directory": directory if directory != None else "",
+			"dependencies": dependencies if dependencies != None else [],
+		},
+	)
+
+def go_binary(name, sources, directory = None, dependencies = None):
+	return mktarget(
+		name = name,
+		type = "go_binary",
+		args = {
+			"sources": sources,
+			"directory": directory if directory != None else "",
+			"dependencies": dependencies if dependencies != None else [],
+		},
+	)
+
+def go_module(
+	name,
+	sources,
+	directory = None,
+	module_name = None,
+	dependencies = None,
+	provides = None,
+):
+	# Without a module name, the module is built as a binary with the go
+	# command, which resolves dependencies via the module's go.mod.
+	if module_name == None:
+		return bash(
+			name = name,
+			environment = {
+				"SOURCES": sources,
+				"DIRECTORY": directory if directory != None else ""
+			},
+			script = 'cd "$SOURCES/$DIRECTORY" && CGO_ENABLED=0 go build -o "$OUTPUT"',
+		)
+
+	return mktarget(
+		name = name,
+		type = "go_module",
+		args = {
+			"module_name": module_name,
+			"sources": sources,
+			"directory": directory if directory != None else "",
+			"dependencies": dependencies if dependencies != None else [],
+			"provides": provides if provides != None else ["."],
 		},
-		script = 'cd "$SOURCES/$DIRECTORY" && CGO_ENABLED=0 go build -o "$OUTPUT"',
 	)
 `
@@ -0,0 +1,753 @@
+package golang
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/weberc2/builder/buildutil"
+	"github.com/weberc2/builder/core"
+)
+
+// toolchain describes the Go toolchain on the PATH.
+type toolchain struct {
+	GOROOT  string
+	GOOS    string
+	GOARCH  string
+	GOAMD64 string
+
+	// The archives for the standard library, keyed by import path.
+	stdlib map[string]string
+}
+
+var (
+	toolchainOnce sync.Once
+	toolchainInfo toolchain
+	toolchainErr  error
+)
+
+// environment is the environment in which the Go tools are invoked. Cgo
+// isn't supported; packages are compiled from their pure-Go files only.
+func environment() []string {
+	return append(os.Environ(), "CGO_ENABLED=0")
+}
+
+func goOutput(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("go", args...)
+	cmd.Env = environment()
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"Running `go %s`: %s",
+			strings.Join(args, " "),
+			stderr.String(),
+		)
+	}
+	return output, nil
+}
+
+// loadToolchain queries the Go toolchain for its configuration and for the
+// locations of the standard library's archives. The standard library is
+// compiled into the Go build cache by `go list -export` on first use; the
+// result is shared by every target built by this process.
+func loadToolchain() (toolchain, error) {
+	toolchainOnce.Do(func() {
+		output, err := goOutput(
+			"env",
+			"-json",
+			"GOROOT",
+			"GOOS",
+			"GOARCH",
+			"GOAMD64",
+		)
+		if err != nil {
+			toolchainErr = err
+			return
+		}
+		if err := json.Unmarshal(output, &toolchainInfo); err != nil {
+			toolchainErr = errors.Wrap(err, "Parsing `go env` output")
+			return
+		}
+
+		output, err = goOutput(
+			"list",
+			"-export",
+			"-f",
+			"{{.ImportPath}}={{.Export}}",
+			"std",
+		)
+		if err != nil {
+			toolchainErr = err
+			return
+		}
+		toolchainInfo.stdlib = map[string]string{}
+		for _, line := range strings.Split(string(output), "\n") {
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) == 2 && parts[1] != "" {
+				toolchainInfo.stdlib[parts[0]] = parts[1]
+			}
+		}
+	})
+	return toolchainInfo, toolchainErr
+}
+
+// buildContext returns the context used to select a package's files (e.g.,
+// by build constraints) for the toolchain's target platform.
+func (tc toolchain) buildContext() build.Context {
+	ctx := build.Default
+	ctx.GOROOT = tc.GOROOT
+	ctx.GOOS = tc.GOOS
+	ctx.GOARCH = tc.GOARCH
+	ctx.CgoEnabled = false
+	return ctx
+}
+
+// goPackage is a package to be compiled from source.
+type goPackage struct {
+	importPath string
+	*build.Package
+}
+
+// resolvePackages finds the packages in the module rooted at `root` which
+// are named by `provides` (paths relative to the module root), along with
+// any other packages in the module that they import. The packages are
+// returned in dependency order.
+func resolvePackages(
+	tc toolchain,
+	moduleName string,
+	root string,
+	provides []string,
+) ([]goPackage, error) {
+	ctx := tc.buildContext()
+	var packages []goPackage
+	visiting := map[string]bool{}
+	done := map[string]bool{}
+
+	var visit func(importPath string) error
+	visit = func(importPath string) error {
+		if done[importPath] {
+			return nil
+		}
+		if visiting[importPath] {
+			return errors.Errorf("Import cycle through %s", importPath)
+		}
+		visiting[importPath] = true
+
+		rel := strings.TrimPrefix(
+			strings.TrimPrefix(importPath, moduleName),
+			"/",
+		)
+		pkg, err := ctx.ImportDir(
+			filepath.Join(root, filepath.FromSlash(rel)),
+			0,
+		)
+		if err != nil {
+			return errors.Wrapf(err, "Loading package %s", importPath)
+		}
+		for _, imp := range pkg.Imports {
+			if imp == moduleName || strings.HasPrefix(imp, moduleName+"/") {
+				if err := visit(imp); err != nil {
+					return err
+				}
+			}
+		}
+
+		done[importPath] = true
+		packages = append(packages, goPackage{
+			importPath: importPath,
+			Package:    pkg,
+		})
+		return nil
+	}
+
+	for _, rel := range provides {
+		importPath := moduleName
+		if rel = strings.Trim(rel, "/"); rel != "" && rel != "." {
+			importPath = moduleName + "/" + rel
+		}
+		if err := visit(importPath); err != nil {
+			return nil, err
+		}
+	}
+	return packages, nil
+}
+
+const (
+	libraryType core.BuilderType = "go_library"
+	moduleType  core.BuilderType = "go_module"
+	binaryType  core.BuilderType = "go_binary"
+)
+
+// GoInfoProvider is the name of the provider returned by Go libraries and
+// modules (see GoInfo).
+const GoInfoProvider = "GoInfo"
+
+// Archive is a compiled Go package.
+type Archive struct {
+	ImportPath string
+	File       core.File
+}
+
+// GoInfo describes the packages that a Go library or module provides.
+// `Archives` are the packages compiled into the target's own artifact, and
+// `TransitiveArchives` are those plus the packages of all of the target's
+// transitive dependencies, sorted by import path.
+type GoInfo struct {
+	Archives           []Archive
+	TransitiveArchives []Archive
+}
+
+func archivesInput(archives []Archive) core.FrozenArray {
+	fa := make(core.FrozenArray, len(archives))
+	for i, archive := range archives {
+		fa[i] = core.FrozenObject{
+			{Key: "import_path", Value: core.String(archive.ImportPath)},
+			{Key: "archive", Value: archive.File.Input()},
+		}
+	}
+	return fa
+}
+
+func parseArchives(archives *[]Archive) func(core.FrozenInput) error {
+	return core.AssertArrayOf(core.AssertObject(
+		func(fo core.FrozenObject) error {
+			var archive Archive
+			if err := fo.VisitKeys(
+				core.KeySpec{
+					Key:   "import_path",
+					Value: core.ParseString(&archive.ImportPath),
+				},
+				core.KeySpec{
+					Key: "archive",
+					Value: core.AssertFile(func(f core.File) error {
+						archive.File = f
+						return nil
+					}),
+				},
+			); err != nil {
+				return err
+			}
+			*archives = append(*archives, archive)
+			return nil
+		},
+	))
+}
+
+// Provider returns the info as a provider.
+func (info GoInfo) Provider() core.Provider {
+	return core.Provider{
+		Name: GoInfoProvider,
+		Fields: core.FrozenObject{
+			{Key: "archives", Value: archivesInput(info.Archives)},
+			{
+				Key:   "transitive_archives",
+				Value: archivesInput(info.TransitiveArchives),
+			},
+		},
+	}
+}
+
+// ReadGoInfo reads the GoInfo provider of the artifact `id`.
+func ReadGoInfo(cache core.LocalCache, id core.ArtifactID) (GoInfo, error) {
+	fields, err := cache.Provider(id, GoInfoProvider)
+	if err != nil {
+		return GoInfo{}, err
+	}
+	var info GoInfo
+	return info, errors.Wrapf(
+		fields.VisitKeys(
+			core.KeySpec{
+				Key:   "archives",
+				Value: parseArchives(&info.Archives),
+			},
+			core.KeySpec{
+				Key:   "transitive_archives",
+				Value: parseArchives(&info.TransitiveArchives),
+			},
+		),
+		"Parsing %s provider of %s",
+		GoInfoProvider,
+		id,
+	)
+}
+
+// unionArchives returns the union of sets of archives, sorted by import
+// path. It's an error for two different artifacts to provide the same
+// package.
+func unionArchives(sets ...[]Archive) ([]Archive, error) {
+	providers := map[string]Archive{}
+	for _, archives := range sets {
+		for _, archive := range archives {
+			other, found := providers[archive.ImportPath]
+			if !found {
+				providers[archive.ImportPath] = archive
+				continue
+			}
+			if other.File.Artifact != archive.File.Artifact {
+				return nil, errors.Errorf(
+					"Package %s is provided by both %s and %s",
+					archive.ImportPath,
+					other.File.Artifact,
+					archive.File.Artifact,
+				)
+			}
+		}
+	}
+
+	union := make([]Archive, 0, len(providers))
+	for _, archive := range providers {
+		union = append(union, archive)
+	}
+	sort.Slice(union, func(i, j int) bool {
+		return union[i].ImportPath < union[j].ImportPath
+	})
+	return union, nil
+}
+
+// dependencyArchives returns the archives provided by the transitive closure
+// of the target's Go library dependencies, per their GoInfo providers.
+func dependencyArchives(
+	dag core.DAG,
+	cache core.LocalCache,
+) ([]Archive, error) {
+	var sets [][]Archive
+	if err := dag.Inputs.VisitKey(
+		"dependencies",
+		core.AssertArrayOf(core.AssertArtifactID(
+			func(id core.ArtifactID) error {
+				info, err := ReadGoInfo(cache, id)
+				if err != nil {
+					return errors.Wrapf(
+						err,
+						"Dependency %s isn't a Go library",
+						id,
+					)
+				}
+				sets = append(sets, info.TransitiveArchives)
+				return nil
+			},
+		)),
+	); err != nil {
+		return nil, errors.Wrapf(err, "Parsing dependencies of %s", dag.ID)
+	}
+	return unionArchives(sets...)
+}
+
+// archivePaths returns the locations of `archives` in the cache, keyed by
+// import path, as well as the artifacts that contain them.
+func archivePaths(
+	cache core.LocalCache,
+	archives []Archive,
+) (map[string]string, []core.ArtifactID) {
+	paths := map[string]string{}
+	var ids []core.ArtifactID
+	seen := map[core.ArtifactID]struct{}{}
+	for _, archive := range archives {
+		paths[archive.ImportPath] = cache.FilePath(archive.File)
+		if _, found := seen[archive.File.Artifact]; !found {
+			seen[archive.File.Artifact] = struct{}{}
+			ids = append(ids, archive.File.Artifact)
+		}
+	}
+	return paths, ids
+}
+
+// writeImportConfig writes a config mapping import paths to the archives
+// which satisfy them. The compiler and linker resolve packages exclusively
+// via this file.
+func writeImportConfig(path string, archives ...map[string]string) error {
+	var lines []string
+	for _, m := range archives {
+		for importPath, archive := range m {
+			lines = append(
+				lines,
+				fmt.Sprintf("packagefile %s=%s", importPath, archive),
+			)
+		}
+	}
+	sort.Strings(lines)
+	return ioutil.WriteFile(
+		path,
+		[]byte(strings.Join(lines, "\n")+"\n"),
+		0644,
+	)
+}
+
+// compile compiles `pkg` into the archive at `out`, assembling and packing in
+// any assembly files.
+func compile(
+	ctx *buildutil.BuildContext,
+	tc toolchain,
+	importcfg string,
+	pkg goPackage,
+	out string,
+) error {
+	objdir := filepath.Join(
+		ctx.Workspace,
+		"obj",
+		filepath.FromSlash(pkg.importPath),
+	)
+	if err := os.MkdirAll(objdir, 0755); err != nil {
+		return errors.Wrap(err, "Creating object directory")
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return errors.Wrap(err, "Creating archive directory")
+	}
+
+	trimpath := fmt.Sprintf("%s=>%s", pkg.Dir, pkg.importPath)
+	asmArgs := []string{
+		"tool", "asm",
+		"-p", pkg.importPath,
+		"-trimpath", trimpath,
+		"-I", objdir,
+		"-I", filepath.Join(tc.GOROOT, "pkg", "include"),
+		"-D", "GOOS_" + tc.GOOS,
+		"-D", "GOARCH_" + tc.GOARCH,
+	}
+	if tc.GOARCH == "amd64" && tc.GOAMD64 != "" {
+		asmArgs = append(asmArgs, "-D", "GOAMD64_"+tc.GOAMD64)
+	}
+
+	args := []string{
+		"tool", "compile",
+		"-p", pkg.importPath,
+		"-o", out,
+		"-pack",
+		"-trimpath", trimpath,
+		"-importcfg", importcfg,
+	}
+	if len(pkg.SFiles) > 0 {
+		// The compiler needs to know which symbols the assembly files
+		// define, and the assembly files may refer to the Go code's
+		// constants via go_asm.h.
+		asmHeader := filepath.Join(objdir, "go_asm.h")
+		if err := ioutil.WriteFile(asmHeader, nil, 0644); err != nil {
+			return errors.Wrap(err, "Creating go_asm.h")
+		}
+		symabis := filepath.Join(objdir, "symabis")
+		if err := ctx.Call(
+			"go",
+			ctx.Workspace,
+			environment(),
+			append(
+				append(asmArgs, "-gensymabis", "-o", symabis),
+				joinAll(pkg.Dir, pkg.SFiles)...,
+			)...,
+		); err != nil {
+			return errors.Wrapf(err, "Generating symabis for %s", pkg.importPath)
+		}
+		args = append(args, "-symabis", symabis, "-asmhdr", asmHeader)
+	} else {
+		args = append(args, "-complete")
+	}
+
+	if err := ctx.Call(
+		"go",
+		ctx.Workspace,
+		environment(),
+		append(args, joinAll(pkg.Dir, pkg.GoFiles)...)...,
+	); err != nil {
+		return errors.Wrapf(err, "Compiling %s", pkg.importPath)
+	}
+
+	if len(pkg.SFiles) < 1 {
+		return nil
+	}
+	objects := make([]string, len(pkg.SFiles))
+	for i, file := range pkg.SFiles {
+		objects[i] = filepath.Join(objdir, strings.TrimSuffix(file, ".s")+".o")
+		if err := ctx.Call(
+			"go",
+			ctx.Workspace,
+			environment(),
+			append(asmArgs, "-o", objects[i], filepath.Join(pkg.Dir, file))...,
+		); err != nil {
+			return errors.Wrapf(err, "Assembling %s", file)
+		}
+	}
+	return errors.Wrapf(
+		ctx.Call(
+			"go",
+			ctx.Workspace,
+			environment(),
+			append([]string{"tool", "pack", "r", out}, objects...)...,
+		),
+		"Packing %s",
+		pkg.importPath,
+	)
+}
+
+func joinAll(dir string, files []string) []string {
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = filepath.Join(dir, file)
+	}
+	return paths
+}
+
+// sourceDirectory returns the directory containing the target's sources.
+func sourceDirectory(dag core.DAG, cache core.LocalCache) (string, error) {
+	var sources core.ArtifactID
+	var directory string
+	if err := dag.Inputs.VisitKeys(
+		core.KeySpec{Key: "sources", Value: core.ParseArtifactID(&sources)},
+		core.KeySpec{Key: "directory", Value: core.ParseString(&directory)},
+	); err != nil {
+		return "", err
+	}
+	return filepath.Join(cache.Path(sources), directory), nil
+}
+
+// buildLibrary compiles the packages in `provides` (and the packages in the
+// same module that they import) into a library artifact.
+func buildLibrary(
+	ctx context.Context,
+	dag core.DAG,
+	cache core.LocalCache,
+	stdout io.Writer,
+	stderr io.Writer,
+	moduleName string,
+	provides []string,
+) error {
+	root, err := sourceDirectory(dag, cache)
+	if err != nil {
+		return errors.Wrapf(err, "Parsing %s inputs", dag.BuilderType)
+	}
+
+	tc, err := loadToolchain()
+	if err != nil {
+		return err
+	}
+
+	dependencies, err := dependencyArchives(dag, cache)
+	if err != nil {
+		return err
+	}
+	archives, inputs := archivePaths(cache, dependencies)
+
+	packages, err := resolvePackages(tc, moduleName, root, provides)
+	if err != nil {
+		return err
+	}
+
+	var info GoInfo
+	for _, pkg := range packages {
+		info.Archives = append(info.Archives, Archive{
+			ImportPath: pkg.importPath,
+			File: core.File{
+				Artifact: dag.ID.ArtifactID(),
+				Path:     pkg.importPath + ".a",
+			},
+		})
+	}
+	info.TransitiveArchives, err = unionArchives(info.Archives, dependencies)
+	if err != nil {
+		return err
+	}
+
+	return buildutil.Build(
+		ctx,
+		dag,
+		cache,
+		stdout,
+		stderr,
+		func(ctx *buildutil.BuildContext) error {
+			ctx.ExtraInputs = inputs
+			ctx.Providers = core.Providers{info.Provider()}
+			compiled := map[string]string{}
+			importcfg := filepath.Join(ctx.Workspace, "importcfg")
+			for _, pkg := range packages {
+				if err := writeImportConfig(
+					importcfg,
+					tc.stdlib,
+					archives,
+					compiled,
+				); err != nil {
+					return errors.Wrap(err, "Writing importcfg")
+				}
+
+				out := filepath.Join(
+					ctx.Output,
+					filepath.FromSlash(pkg.importPath)+".a",
+				)
+				if err := compile(ctx, tc, importcfg, pkg, out); err != nil {
+					return err
+				}
+				compiled[pkg.importPath] = out
+			}
+			return nil
+		},
+	)
+}
+
+// Library compiles a single Go package into an archive. Its artifact may be
+// used as a dependency of other libraries, modules, and binaries.
+var Library = core.Plugin{
+	Type: libraryType,
+	BuildScript: func(
+		ctx context.Context,
+		dag core.DAG,
+		cache core.LocalCache,
+		stdout io.Writer,
+		stderr io.Writer,
+	) error {
+		var importPath string
+		if err := dag.Inputs.VisitKey(
+			"import_path",
+			core.ParseString(&importPath),
+		); err != nil {
+			return errors.Wrap(err, "Parsing go_library inputs")
+		}
+		return buildLibrary(
+			ctx,
+			dag,
+			cache,
+			stdout,
+			stderr,
+			importPath,
+			[]string{"."},
+		)
+	},
+}
+
+// Module compiles the packages that a third-party Go module provides (and
+// the packages within the module that they import) into archives. Its
+// artifact may be used as a dependency of libraries, modules, and binaries.
+var Module = core.Plugin{
+	Type: moduleType,
+	BuildScript: func(
+		ctx context.Context,
+		dag core.DAG,
+		cache core.LocalCache,
+		stdout io.Writer,
+		stderr io.Writer,
+	) error {
+		var moduleName string
+		var provides []string
+		if err := dag.Inputs.VisitKeys(
+			core.KeySpec{
+				Key:   "module_name",
+				Value: core.ParseString(&moduleName),
+			},
+			core.KeySpec{
+				Key: "provides",
+				Value: core.AssertArrayOf(core.AssertString(
+					func(s string) error {
+						provides = append(provides, s)
+						return nil
+					},
+				)),
+			},
+		); err != nil {
+			return errors.Wrap(err, "Parsing go_module inputs")
+		}
+		return buildLibrary(
+			ctx,
+			dag,
+			cache,
+			stdout,
+			stderr,
+			moduleName,
+			provides,
+		)
+	},
+}
+
+// Binary compiles a `main` package and links it with its dependencies into
+// an executable.
+var Binary = core.Plugin{
+	Type: binaryType,
+	BuildScript: func(
+		ctx context.Context,
+		dag core.DAG,
+		cache core.LocalCache,
+		stdout io.Writer,
+		stderr io.Writer,
+	) error {
+		dir, err := sourceDirectory(dag, cache)
+		if err != nil {
+			return errors.Wrap(err, "Parsing go_binary inputs")
+		}
+
+		tc, err := loadToolchain()
+		if err != nil {
+			return err
+		}
+
+		dependencies, err := dependencyArchives(dag, cache)
+		if err != nil {
+			return err
+		}
+		archives, inputs := archivePaths(cache, dependencies)
+
+		bctx := tc.buildContext()
+		pkg, err := bctx.ImportDir(dir, 0)
+		if err != nil {
+			return errors.Wrap(err, "Loading main package")
+		}
+		if pkg.Name != "main" {
+			return errors.Errorf(
+				"go_binary sources must be package main; found package %s",
+				pkg.Name,
+			)
+		}
+
+		return buildutil.Build(
+			ctx,
+			dag,
+			cache,
+			stdout,
+			stderr,
+			func(ctx *buildutil.BuildContext) error {
+				ctx.ExtraInputs = inputs
+				importcfg := filepath.Join(ctx.Workspace, "importcfg")
+				if err := writeImportConfig(
+					importcfg,
+					tc.stdlib,
+					archives,
+				); err != nil {
+					return errors.Wrap(err, "Writing importcfg")
+				}
+
+				archive := filepath.Join(ctx.Workspace, "main.a")
+				if err := compile(
+					ctx,
+					tc,
+					importcfg,
+					goPackage{importPath: "main", Package: pkg},
+					archive,
+				); err != nil {
+					return err
+				}
+
+				return errors.Wrap(
+					ctx.Call(
+						"go",
+						ctx.Workspace,
+						environment(),
+						"tool", "link",
+						"-importcfg", importcfg,
+						"-buildmode", "exe",
+						"-o", ctx.Output,
+						archive,
+					),
+					"Linking",
+				)
+			},
+		)
+	},
+}
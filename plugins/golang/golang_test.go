@@ -0,0 +1,139 @@
+package golang
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/weberc2/builder/core"
+	"github.com/weberc2/builder/plugins/command"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for path, contents := range files {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+}
+
+func TestBinary(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Compiles the standard library on first use")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("Go toolchain not found")
+	}
+
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer os.RemoveAll(root)
+	writeFiles(t, root, map[string]string{
+		"mod/greet/greet.go": `package greet
+
+import "example.com/mod/internal/name"
+
+func Greeting() string { return "hello, " + name.Name }
+`,
+		"mod/internal/name/name.go": `package name
+
+const Name = "world"
+`,
+		"lib/lib.go": `package lib
+
+import (
+	"strings"
+
+	"example.com/mod/greet"
+)
+
+func Greeting() string { return strings.ToUpper(greet.Greeting()) }
+`,
+		"cmd/main.go": `package main
+
+import (
+	"fmt"
+
+	"example.com/lib"
+)
+
+func main() { fmt.Print(lib.Greeting()) }
+`,
+		"BUILD": `
+load("std/golang", "go_library", "go_module", "go_binary")
+
+mod = go_module(
+    name = "mod",
+    module_name = "example.com/mod",
+    sources = glob("mod/**/*.go"),
+    directory = "mod",
+    provides = ["greet"],
+)
+
+lib = go_library(
+    name = "lib",
+    import_path = "example.com/lib",
+    sources = glob("lib/*.go"),
+    directory = "lib",
+    dependencies = [mod],
+)
+
+cmd = go_binary(
+    name = "cmd",
+    sources = glob("cmd/*.go"),
+    directory = "cmd",
+    dependencies = [lib],
+)
+`,
+	})
+
+	targets, err := core.Evaluate("", root, map[string]string{
+		"std/golang":  BuiltinModule,
+		"std/command": command.BuiltinModule,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	var target core.Target
+	for _, target = range targets {
+		if target.ID.Target == "cmd" {
+			break
+		}
+	}
+
+	cache := core.NewLocalCache("workspace", filepath.Join(root, "cache"))
+	dag, err := core.FreezeTarget(root, cache, target)
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if err := core.Build(
+		context.Background(),
+		core.LocalExecutor(
+			[]core.Plugin{Library, Module, Binary},
+			cache,
+			nil,
+			func(core.Event) {},
+		),
+		1,
+		dag,
+	); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	output, err := exec.Command(cache.Path(dag.ID.ArtifactID())).Output()
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if wanted := "HELLO, WORLD"; string(output) != wanted {
+		t.Fatalf("Wanted '%s'; got '%s'", wanted, output)
+	}
+}
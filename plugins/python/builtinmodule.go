@@ -1,36 +1,29 @@
 package python
 
 const BuiltinModule = `
-load("std/command", "bash")
+load("std/command", "bash", "bash_test")
 
 def pypi(name, pypi_name = None, constraint = None, dependencies = None):
-    dependencies = dependencies if dependencies != None else []
-    return bash(
+    return mktarget(
         name = name,
-        environment = {
-            "DEPENDENCY_{}".format(i): dependency
-            for i, dependency in enumerate(dependencies)
+        type = "py_wheel",
+        args = {
+            "requirement": "{}{}".format(
+                pypi_name if pypi_name != None else name,
+                constraint if constraint != None else "",
+            ),
+            "dependencies": dependencies if dependencies != None else [],
+            "python": "python",
         },
-        script = "\n".join(
-            [
-                "python -m pip wheel --no-deps -w $OUTPUT {}{}".format(
-                    pypi_name if pypi_name != None else name,
-                    constraint if constraint != None else "",
-                ),
-                'touch "$OUTPUT/DEPENDENCIES"',
-            ] + [
-                'echo "$DEPENDENCY_{}" >> "$OUTPUT/DEPENDENCIES"'.format(i)
-                for i, _ in enumerate(dependencies)
-            ],
-        ),
     )
 
-def venv(name, dependencies = None):
+def venv(name, dependencies = None, python = "python3"):
     return mktarget(
         name = name,
         type = "virtualenv",
         args = {
             "dependencies": dependencies if dependencies != None else [],
+            "python": python,
         },
     )
 
@@ -44,6 +37,33 @@ python -m pex --disable-cache --python python3.6 pex -o $OUTPUT -c pex
     """,
 )
 
+def _pex_binary_impl(ctx):
+    ctx.actions.run_shell(
+        "$PEX --disable-cache --python python3.6 --no-index $WHEELS " +
+        "-o $OUTPUT -e {}:{}".format(
+            ctx.attr.bin_package_name,
+            ctx.attr.entry_point,
+        ),
+        env = {
+            "PEX": ctx.attr.pex,
+            "WHEELS": [
+                ctx.provider(package, "PyInfo", "transitive_wheels")
+                for package in [ctx.attr.bin_package] + ctx.attr.dependencies
+            ],
+        },
+    )
+
+_pex_binary = rule(
+    _pex_binary_impl,
+    attrs = {
+        "pex": attr.label(mandatory = True),
+        "bin_package": attr.label(mandatory = True),
+        "bin_package_name": attr.string(mandatory = True),
+        "entry_point": attr.string(mandatory = True),
+        "dependencies": attr.label_list(),
+    },
+)
+
 def pex(
     name,
     entry_point,
@@ -51,41 +71,14 @@ def pex(
     bin_package_name = None,
     dependencies = None,
 ):
-    dependencies = {
-        "DEPENDENCY_{}".format(i): dependency
-        for i, dependency in enumerate(dependencies)
-    } if dependencies != None else {}
-
-    bin_package_name = bin_package_name if bin_package_name != None else name
-    environment = dict(dependencies)
-    environment["PEX"] = _pex
-    environment["BIN"] = bin_package
-    return bash(
+    return _pex_binary(
         name = name,
-        environment = environment,
-        script = """
-function fetchDeps() {{
-    for dep in $@; do
-        echo $dep
-        fetchDeps $(cat $dep/DEPENDENCIES)
-    done
-}}
-
-# Get full dependency list (including transitive deps) and put into the local
-# env var $deps
-deps=$(fetchDeps {} $BIN | sort | uniq)
-
-# Get the wheel for each dep
-wheels=$(for dep in $deps; do echo $dep/$(ls $dep | grep '.whl'); done)
-
-# Build a pex file from the wheels, storing it in $OUTPUT and setting the
-# package/entrypoint appropriately
-$PEX --disable-cache --python python3.6 --no-index $wheels -o $OUTPUT -e {}:{}
-""".format(
-            " ".join(["${}".format(k) for k in dependencies.keys()]),
-            bin_package_name,
-            entry_point,
-        ),
+        pex = _pex,
+        bin_package = bin_package,
+        bin_package_name = bin_package_name if bin_package_name != None
+            else name,
+        entry_point = entry_point,
+        dependencies = dependencies if dependencies != None else [],
     )
 
 atomicwrites = pypi(name = "atomicwrites")
@@ -119,7 +112,7 @@ _pytest_wheel = pypi(
 )
 
 def pytest(name, sources, directory = None, dependencies = None):
-    return bash(
+    return bash_test(
         name = name,
         environment = {
             "SOURCES": sources,
@@ -131,7 +124,7 @@ def pytest(name, sources, directory = None, dependencies = None):
                 dependencies = dependencies,
             ),
         },
-        script = '$PYTEST $SOURCES{} | tee $OUTPUT'.format(
+        script = '$PYTEST --junitxml="$JUNIT_OUTPUT" $SOURCES{}'.format(
             "/"+directory if directory != None else "",
         ),
     )
@@ -156,23 +149,13 @@ def py_source_binary(
     )
 
 def py_source_library(name, sources, package_name = None, dependencies = None):
-    dependencies = dependencies if dependencies != None else []
-    environment = {
-        "DEPENDENCY_{}".format(i): dependency
-        for i, dependency in enumerate(dependencies)
-    }
-    environment["SOURCES"] = sources
-    return bash(
+    return mktarget(
         name = name,
-        environment = environment,
-        script = "\n".join(
-            [
-                "python -m pip wheel --no-cache-dir -w $OUTPUT $SOURCES",
-                'touch "$OUTPUT/DEPENDENCIES"',
-            ] + [
-                'echo "$DEPENDENCY_{}" >> "$OUTPUT/DEPENDENCIES"'.format(i)
-                for i, _ in enumerate(dependencies)
-            ],
-        ),
+        type = "py_wheel",
+        args = {
+            "requirement": sources,
+            "dependencies": dependencies if dependencies != None else [],
+            "python": "python",
+        },
     )
 `
@@ -0,0 +1,196 @@
+package python
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/weberc2/builder/buildutil"
+	"github.com/weberc2/builder/core"
+)
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// relocatableShebang replaces the absolute interpreter path in the shebangs
+// of the scripts that pip installs. It's the same trick that pip uses for
+// interpreter paths which are too long for a shebang: the script is run by
+// /bin/sh, which execs the Python beside the script, and to Python the shell
+// preamble is just a string literal.
+const relocatableShebang = `#!/bin/sh
+'''exec' "$(dirname -- "$(realpath -- "$0")")/python" "$0" "$@"
+' '''
+`
+
+// relocatableActivate replaces the assignment of the absolute path of the
+// virtualenv in `bin/activate`. The script must be sourced by bash or zsh.
+const relocatableActivate = `VIRTUAL_ENV="$(cd "$(dirname -- ` +
+	`"${BASH_SOURCE[0]:-$0}")/.." && pwd)"`
+
+// makeRelocatable rewrites the files in the virtualenv at `venv` that refer
+// to its absolute path, so that the virtualenv works from wherever it's
+// moved (namely, the cache). Activation scripts for shells which can't find
+// the script's own path when it's sourced are removed.
+func makeRelocatable(venv string) error {
+	bin := filepath.Join(venv, "bin")
+	for _, name := range []string{
+		"activate.csh",
+		"activate.fish",
+		"Activate.ps1",
+	} {
+		if err := os.Remove(filepath.Join(bin, name)); err != nil &&
+			!os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	entries, err := ioutil.ReadDir(bin)
+	if err != nil {
+		return err
+	}
+	prefix := []byte("#!" + bin + "/")
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(bin, entry.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var rewritten []byte
+		switch {
+		case entry.Name() == "activate":
+			var lines []string
+			for _, line := range strings.Split(string(data), "\n") {
+				if strings.HasPrefix(line, "VIRTUAL_ENV=") {
+					line = relocatableActivate
+				}
+				lines = append(lines, line)
+			}
+			rewritten = []byte(strings.Join(lines, "\n"))
+		case bytes.HasPrefix(data, prefix):
+			newline := bytes.IndexByte(data, '\n')
+			if newline < 0 {
+				continue
+			}
+			rewritten = append(
+				[]byte(relocatableShebang),
+				data[newline+1:]...,
+			)
+		default:
+			continue
+		}
+		if err := ioutil.WriteFile(path, rewritten, entry.Mode()); err != nil {
+			return errors.Wrapf(err, "Rewriting %s", path)
+		}
+	}
+	return nil
+}
+
+// VirtualEnv builds a virtualenv with the wheels of its dependencies and
+// their transitive dependencies installed. The artifact is the virtualenv's
+// directory, which may be used from the cache (e.g., `$VENV/bin/python` or
+// `source $VENV/bin/activate`).
+var VirtualEnv = core.Plugin{
+	Type: "virtualenv",
+	BuildScript: func(
+		ctx context.Context,
+		dag core.DAG,
+		cache core.LocalCache,
+		stdout io.Writer,
+		stderr io.Writer,
+	) error {
+		var python string
+		var dependencies []core.ArtifactID
+		if err := dag.Inputs.VisitKeys(
+			core.KeySpec{Key: "python", Value: core.ParseString(&python)},
+			core.KeySpec{
+				Key:   "dependencies",
+				Value: parseDependencies(&dependencies),
+			},
+		); err != nil {
+			return errors.Wrap(err, "Parsing virtualenv inputs")
+		}
+
+		wheels, err := transitiveWheels(cache, nil, dependencies)
+		if err != nil {
+			return errors.Wrap(err, "Collecting wheels")
+		}
+
+		return buildutil.Build(
+			ctx,
+			dag,
+			cache,
+			stdout,
+			stderr,
+			func(ctx *buildutil.BuildContext) error {
+				// Copy the wheels into the workspace; only the direct
+				// dependencies are visible to sandboxed commands.
+				wheelDir := filepath.Join(ctx.Workspace, "wheels")
+				if err := os.Mkdir(wheelDir, 0755); err != nil {
+					return err
+				}
+				args := []string{
+					"-m", "pip", "install",
+					"--no-index",
+					"--no-deps",
+					"--no-compile",
+					"--disable-pip-version-check",
+				}
+				for _, wheel := range wheels {
+					src := ctx.Cache.FilePath(wheel)
+					dst := filepath.Join(wheelDir, filepath.Base(src))
+					if err := copyFile(src, dst); err != nil {
+						return errors.Wrap(err, "Copying wheel")
+					}
+					args = append(args, dst)
+				}
+
+				env := os.Environ()
+				if err := ctx.Call(
+					python,
+					ctx.Workspace,
+					env,
+					"-m", "venv", ctx.Output,
+				); err != nil {
+					return errors.Wrap(err, "Creating virtualenv")
+				}
+				if len(wheels) > 0 {
+					if err := ctx.Call(
+						filepath.Join(ctx.Output, "bin", "python"),
+						ctx.Workspace,
+						env,
+						args...,
+					); err != nil {
+						return errors.Wrap(err, "Installing wheels")
+					}
+				}
+				if err := makeRelocatable(ctx.Output); err != nil {
+					return errors.Wrap(err, "Making virtualenv relocatable")
+				}
+				return os.RemoveAll(wheelDir)
+			},
+		)
+	},
+}
@@ -0,0 +1,155 @@
+package python
+
+import (
+	"archive/zip"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/weberc2/builder/core"
+)
+
+// writeWheel writes a minimal pure-Python wheel for `name` into `dir`.
+func writeWheel(t *testing.T, dir, name string, files map[string]string) {
+	distInfo := name + "-1.0.dist-info/"
+	files[distInfo+"METADATA"] = "Metadata-Version: 2.1\nName: " + name +
+		"\nVersion: 1.0\n"
+	files[distInfo+"WHEEL"] = "Wheel-Version: 1.0\nGenerator: test\n" +
+		"Root-Is-Purelib: true\nTag: py3-none-any\n"
+	var record []string
+	for path := range files {
+		record = append(record, path+",,")
+	}
+	files[distInfo+"RECORD"] = strings.Join(record, "\n") + "\n" +
+		distInfo + "RECORD,,\n"
+
+	file, err := os.Create(filepath.Join(dir, name+"-1.0-py3-none-any.whl"))
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer file.Close()
+	w := zip.NewWriter(file)
+	for path, contents := range files {
+		f, err := w.Create(path)
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if _, err := f.Write([]byte(contents)); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+}
+
+func TestVirtualEnv(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Creates a virtualenv")
+	}
+	venvHelp := exec.Command("python3", "-m", "venv", "--help")
+	if err := venvHelp.Run(); err != nil {
+		t.Skip("python3 with the venv module not found")
+	}
+
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	defer os.RemoveAll(root)
+	cache := core.NewLocalCache("workspace", root)
+
+	// `beta` depends on `alpha`, which is only reachable via beta's PyInfo
+	// provider.
+	artifact := func(name string) core.ArtifactID {
+		return core.ArtifactID{
+			Package:  "3rdParty/python",
+			Target:   core.TargetName(name),
+			Checksum: core.ChecksumString(name),
+		}
+	}
+	alpha, beta := artifact("alpha"), artifact("beta")
+	for _, id := range []core.ArtifactID{alpha, beta} {
+		if err := os.MkdirAll(cache.Path(id), 0755); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+	writeWheel(t, cache.Path(alpha), "alpha", map[string]string{
+		"alpha.py": "NAME = 'alpha'\n",
+	})
+	writeWheel(t, cache.Path(beta), "beta", map[string]string{
+		"beta.py": "import alpha\n\ndef main():\n    print(alpha.NAME)\n",
+		"beta-1.0.dist-info/entry_points.txt": "[console_scripts]\n" +
+			"beta = beta:main\n",
+	})
+	alphaWheel := core.File{Artifact: alpha, Path: "alpha-1.0-py3-none-any.whl"}
+	betaWheel := core.File{Artifact: beta, Path: "beta-1.0-py3-none-any.whl"}
+	for id, info := range map[core.ArtifactID]PyInfo{
+		alpha: {
+			Wheels:           []core.File{alphaWheel},
+			TransitiveWheels: []core.File{alphaWheel},
+		},
+		beta: {
+			Wheels:           []core.File{betaWheel},
+			TransitiveWheels: []core.File{alphaWheel, betaWheel},
+		},
+	} {
+		if err := cache.WriteProviders(
+			id,
+			core.Providers{info.Provider()},
+		); err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+	}
+
+	dag := core.DAG{FrozenTarget: core.FrozenTarget{
+		ID: core.FrozenTargetID{
+			Package:  "pkg",
+			Target:   "venv",
+			Checksum: core.ChecksumString("venv"),
+		},
+		Inputs: core.FrozenObject{
+			{Key: "python", Value: core.String("python3")},
+			{Key: "dependencies", Value: core.FrozenArray{beta}},
+		},
+		BuilderType: VirtualEnv.Type,
+	}}
+	if err := VirtualEnv.BuildScript(
+		context.Background(),
+		dag,
+		cache,
+		ioutil.Discard,
+		ioutil.Discard,
+	); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+
+	// The virtualenv was built elsewhere and moved into the cache, so these
+	// only work if it's relocatable.
+	venv := cache.Path(dag.ID.ArtifactID())
+	output, err := exec.Command(filepath.Join(venv, "bin", "beta")).Output()
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if got := strings.TrimSpace(string(output)); got != "alpha" {
+		t.Fatalf("Wanted 'alpha'; got '%s'", got)
+	}
+
+	output, err = exec.Command(
+		"bash",
+		"-c",
+		`source "$1/bin/activate" && echo "$VIRTUAL_ENV"`,
+		"bash",
+		venv,
+	).Output()
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if got := strings.TrimSpace(string(output)); got != venv {
+		t.Fatalf("Wanted VIRTUAL_ENV '%s'; got '%s'", venv, got)
+	}
+}
@@ -0,0 +1,205 @@
+package python
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/weberc2/builder/buildutil"
+	"github.com/weberc2/builder/core"
+)
+
+// PyInfoProvider is the name of the provider returned by Python targets (see
+// PyInfo).
+const PyInfoProvider = "PyInfo"
+
+// PyInfo describes the wheels that a Python target provides. `Wheels` are the
+// wheels in the target's own artifact, and `TransitiveWheels` are those plus
+// the wheels of all of the target's transitive dependencies, sorted and
+// without duplicates.
+type PyInfo struct {
+	Wheels           []core.File
+	TransitiveWheels []core.File
+}
+
+func filesInput(files []core.File) core.FrozenArray {
+	fa := make(core.FrozenArray, len(files))
+	for i, file := range files {
+		fa[i] = file.Input()
+	}
+	return fa
+}
+
+func parseFiles(files *[]core.File) func(core.FrozenInput) error {
+	return core.AssertArrayOf(core.AssertFile(func(file core.File) error {
+		*files = append(*files, file)
+		return nil
+	}))
+}
+
+// Provider returns the info as a provider.
+func (info PyInfo) Provider() core.Provider {
+	return core.Provider{
+		Name: PyInfoProvider,
+		Fields: core.FrozenObject{
+			{Key: "wheels", Value: filesInput(info.Wheels)},
+			{
+				Key:   "transitive_wheels",
+				Value: filesInput(info.TransitiveWheels),
+			},
+		},
+	}
+}
+
+// ReadPyInfo reads the PyInfo provider of the artifact `id`.
+func ReadPyInfo(cache core.LocalCache, id core.ArtifactID) (PyInfo, error) {
+	fields, err := cache.Provider(id, PyInfoProvider)
+	if err != nil {
+		return PyInfo{}, err
+	}
+	var info PyInfo
+	return info, errors.Wrapf(
+		fields.VisitKeys(
+			core.KeySpec{Key: "wheels", Value: parseFiles(&info.Wheels)},
+			core.KeySpec{
+				Key:   "transitive_wheels",
+				Value: parseFiles(&info.TransitiveWheels),
+			},
+		),
+		"Parsing %s provider of %s",
+		PyInfoProvider,
+		id,
+	)
+}
+
+// transitiveWheels returns the union of `wheels` and the transitive wheels
+// of `dependencies`, sorted so that it's stable regardless of the order in
+// which dependencies were declared.
+func transitiveWheels(
+	cache core.LocalCache,
+	wheels []core.File,
+	dependencies []core.ArtifactID,
+) ([]core.File, error) {
+	seen := map[core.File]struct{}{}
+	var closure []core.File
+	add := func(files []core.File) {
+		for _, file := range files {
+			if _, found := seen[file]; !found {
+				seen[file] = struct{}{}
+				closure = append(closure, file)
+			}
+		}
+	}
+	add(wheels)
+	for _, id := range dependencies {
+		info, err := ReadPyInfo(cache, id)
+		if err != nil {
+			return nil, errors.Wrap(err, "Reading Python dependency")
+		}
+		add(info.TransitiveWheels)
+	}
+	sort.Slice(closure, func(i, j int) bool {
+		return cache.FilePath(closure[i]) < cache.FilePath(closure[j])
+	})
+	return closure, nil
+}
+
+func parseDependencies(ids *[]core.ArtifactID) func(core.FrozenInput) error {
+	return core.AssertArrayOf(core.AssertArtifactID(
+		func(id core.ArtifactID) error {
+			*ids = append(*ids, id)
+			return nil
+		},
+	))
+}
+
+// Wheel builds a wheel with pip, either of a requirement from the package
+// index or of a source directory. The artifact is the directory containing
+// the wheel. Wheels are built without their dependencies, which must instead
+// be declared as `dependencies` (other wheel targets); the target's PyInfo
+// provider records the wheels of its transitive dependencies.
+var Wheel = core.Plugin{
+	Type: "py_wheel",
+	BuildScript: func(
+		ctx context.Context,
+		dag core.DAG,
+		cache core.LocalCache,
+		stdout io.Writer,
+		stderr io.Writer,
+	) error {
+		var python string
+		var dependencies []core.ArtifactID
+		args := []string{"-m", "pip", "wheel", "--disable-pip-version-check"}
+		if err := dag.Inputs.VisitKeys(
+			core.KeySpec{Key: "python", Value: core.ParseString(&python)},
+			core.KeySpec{
+				Key: "requirement",
+				Value: core.Match(
+					core.AssertString(func(requirement string) error {
+						args = append(args, "--no-deps", requirement)
+						return nil
+					}),
+					core.AssertArtifactID(func(id core.ArtifactID) error {
+						args = append(args, "--no-cache-dir", cache.Path(id))
+						return nil
+					}),
+				),
+			},
+			core.KeySpec{
+				Key:   "dependencies",
+				Value: parseDependencies(&dependencies),
+			},
+		); err != nil {
+			return errors.Wrap(err, "Parsing py_wheel inputs")
+		}
+
+		id := dag.ID.ArtifactID()
+		return buildutil.Build(
+			ctx,
+			dag,
+			cache,
+			stdout,
+			stderr,
+			func(ctx *buildutil.BuildContext) error {
+				if err := ctx.Call(
+					python,
+					ctx.Workspace,
+					os.Environ(),
+					append(args, "--wheel-dir", ctx.Output)...,
+				); err != nil {
+					return errors.Wrap(err, "Building wheel")
+				}
+
+				found, err := filepath.Glob(
+					filepath.Join(ctx.Output, "*.whl"),
+				)
+				if err != nil {
+					return err
+				}
+				if len(found) < 1 {
+					return errors.New("pip built no wheels")
+				}
+				var info PyInfo
+				for _, path := range found {
+					info.Wheels = append(info.Wheels, core.File{
+						Artifact: id,
+						Path:     filepath.Base(path),
+					})
+				}
+				info.TransitiveWheels, err = transitiveWheels(
+					cache,
+					info.Wheels,
+					dependencies,
+				)
+				if err != nil {
+					return err
+				}
+				ctx.Providers = core.Providers{info.Provider()}
+				return nil
+			},
+		)
+	},
+}
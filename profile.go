@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/weberc2/builder/core"
+)
+
+var profileFlag = cli.StringFlag{
+	Name: "profile",
+	Usage: "Write a Chrome trace of the build to this file and print the " +
+		"build's critical path",
+}
+
+// startProfiling enables tracing if `--profile` is set. It runs before the
+// command's action so that evaluating and freezing are traced as well as
+// building.
+func startProfiling(ctx *cli.Context) error {
+	if ctx.String("profile") != "" {
+		core.Tracing = core.NewTracer()
+	}
+	return nil
+}
+
+// writeProfile writes the trace to the file named by `--profile`. It runs
+// after the command's action, even if the action failed.
+func writeProfile(ctx *cli.Context) error {
+	path := ctx.String("profile")
+	if path == "" || core.Tracing == nil {
+		return nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "Creating profile")
+	}
+	defer file.Close()
+	if err := core.Tracing.WriteJSON(file); err != nil {
+		return errors.Wrap(err, "Writing profile")
+	}
+	fmt.Printf("Wrote profile to %s\n", path)
+	return nil
+}
+
+// durationRecorder records how long each target took to execute, from build
+// events.
+type durationRecorder struct {
+	lock      sync.Mutex
+	durations map[core.FrozenTargetID]time.Duration
+}
+
+func (r *durationRecorder) record(e core.Event) {
+	if e.Type != core.EventTargetFinished && e.Type != core.EventTargetFailed {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.durations[e.Target] = e.Duration
+}
+
+func printCriticalPath(
+	dags []core.DAG,
+	durations map[core.FrozenTargetID]time.Duration,
+	elapsed time.Duration,
+) {
+	path, total := core.CriticalPath(dags, durations)
+	fmt.Printf(
+		"\nCritical path: %s of %s elapsed\n",
+		total.Round(time.Millisecond),
+		elapsed.Round(time.Millisecond),
+	)
+	for _, id := range path {
+		fmt.Printf(
+			"  %8s  //%s:%s\n",
+			durations[id].Round(time.Millisecond),
+			id.Package,
+			id.Target,
+		)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/weberc2/builder/core"
+	"github.com/weberc2/builder/query"
+)
+
+var queryCommand = cli.Command{
+	Name:      "query",
+	Usage:     "Queries the dependency graph",
+	UsageText: "Queries the dependency graph",
+	Description: "Evaluates a query expression over the target graph and " +
+		"prints the matching targets. For example, " +
+		"'rdeps(//..., //3rdParty/python:requests)' finds every target " +
+		"which depends on //3rdParty/python:requests. Supported functions " +
+		"are deps(x[, depth]), rdeps(universe, x[, depth]), kind(regex, x), " +
+		"attr(name, regex, x), and somepath(from, to); sets are combined " +
+		"with 'union' (+), 'intersect' (^), and 'except' (-).",
+	ArgsUsage: "Takes a query expression whose terms are target patterns",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "The output format: label, json, or dot",
+			Value: "label",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return errors.New("Missing query expression")
+		}
+
+		var write func(targets []core.Target) error
+		switch output := ctx.String("output"); output {
+		case "label":
+			write = func(ts []core.Target) error {
+				return query.WriteLabels(os.Stdout, ts)
+			}
+		case "json":
+			write = func(ts []core.Target) error {
+				return query.WriteJSON(os.Stdout, ts)
+			}
+		case "dot":
+			write = func(ts []core.Target) error {
+				return query.WriteDOT(os.Stdout, ts)
+			}
+		default:
+			return errors.Errorf("Invalid output format '%s'", output)
+		}
+
+		workspace, pwd, err := currentWorkspace()
+		if err != nil {
+			return err
+		}
+
+		// The expression may be passed as one argument or split across
+		// several (e.g., if it wasn't quoted).
+		targets, err := query.Run(
+			strings.Join(ctx.Args(), " "),
+			func(pattern string) ([]core.Target, error) {
+				return loadTargets(workspace, pwd, []string{pattern})
+			},
+		)
+		if err != nil {
+			return err
+		}
+		return write(targets)
+	},
+}
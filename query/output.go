@@ -0,0 +1,94 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/weberc2/builder/core"
+)
+
+// WriteLabels writes the label of each target, one per line.
+func WriteLabels(w io.Writer, targets []core.Target) error {
+	for _, target := range targets {
+		if _, err := fmt.Fprintln(w, Label(target.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type jsonTarget struct {
+	Label        string   `json:"label"`
+	Package      string   `json:"package"`
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Dependencies []string `json:"dependencies"`
+}
+
+// WriteJSON writes the targets as a JSON array. Each target's dependencies
+// are listed by label (whether or not they're among the targets) rather than
+// inlined.
+func WriteJSON(w io.Writer, targets []core.Target) error {
+	results := make([]jsonTarget, len(targets))
+	for i, target := range targets {
+		dependencies := []string{}
+		for _, dependency := range Dependencies(target) {
+			dependencies = append(dependencies, Label(dependency.ID))
+		}
+		results[i] = jsonTarget{
+			Label:        Label(target.ID),
+			Package:      string(target.ID.Package),
+			Name:         string(target.ID.Target),
+			Type:         string(target.Kind()),
+			Dependencies: dependencies,
+		}
+	}
+	data, err := json.MarshalIndent(results, "", "    ")
+	if err != nil {
+		return errors.Wrap(err, "Marshaling query results")
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// WriteDOT writes the targets as a Graphviz digraph. Only the dependency
+// edges between targets in the result are drawn.
+func WriteDOT(w io.Writer, targets []core.Target) error {
+	included := map[core.TargetID]struct{}{}
+	for _, target := range targets {
+		included[target.ID] = struct{}{}
+	}
+
+	if _, err := fmt.Fprintln(w, "digraph query {"); err != nil {
+		return err
+	}
+	for _, target := range targets {
+		if _, err := fmt.Fprintf(
+			w,
+			"  %q [label=%q];\n",
+			Label(target.ID),
+			fmt.Sprintf("%s\n%s", Label(target.ID), target.Kind()),
+		); err != nil {
+			return err
+		}
+	}
+	for _, target := range targets {
+		for _, dependency := range Dependencies(target) {
+			if _, found := included[dependency.ID]; !found {
+				continue
+			}
+			if _, err := fmt.Fprintf(
+				w,
+				"  %q -> %q;\n",
+				Label(target.ID),
+				Label(dependency.ID),
+			); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
@@ -0,0 +1,701 @@
+// Package query implements a small language for querying the target graph,
+// e.g., `rdeps(//..., //3rdParty/python:requests)` finds every target which
+// depends on `//3rdParty/python:requests`. Queries operate on the evaluated
+// (unfrozen) targets, so file groups needn't be frozen to answer them.
+//
+// An expression is a target pattern, a function call, a parenthesized
+// expression, or two expressions joined by a set operator:
+//
+//   - `a union b` (or `a + b`) is the targets in either set
+//   - `a intersect b` (or `a ^ b`) is the targets in both sets
+//   - `a except b` (or `a - b`) is the targets in `a` but not in `b`
+//
+// Operators have equal precedence and associate to the left. They must be
+// separated from their operands by whitespace. The set operators may also be
+// called as functions, e.g., `union(a, b)`. The other functions are:
+//
+//   - `deps(x[, depth])`: `x` and the targets it depends on, transitively
+//     or up to `depth` edges away
+//   - `rdeps(universe, x[, depth])`: the targets among `universe` and its
+//     dependencies which depend on `x`, including `x` itself
+//   - `kind(regex, x)`: the targets in `x` whose type matches `regex`
+//   - `attr(name, regex, x)`: the targets in `x` with an input `name` whose
+//     value matches `regex`. Nested inputs are named by joining keys with
+//     `.` (e.g., `environment.PYTHON`). Targets match by label, file groups
+//     by their patterns, and lists and objects if any of their values match.
+//   - `somepath(from, to)`: the targets along a dependency path from a
+//     target in `from` to a target in `to`, or none if there is no path
+//
+// Strings may be quoted with `"` or `'`; target patterns only need quoting if
+// they contain whitespace, commas, or parentheses.
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/weberc2/builder/core"
+)
+
+// Loader returns the targets matched by a target pattern.
+type Loader func(pattern string) ([]core.Target, error)
+
+// Label returns the canonical label for a target, e.g., `//pkg:target`.
+func Label(tid core.TargetID) string {
+	return fmt.Sprintf("//%s:%s", tid.Package, tid.Target)
+}
+
+// Dependencies returns the targets among a target's inputs (i.e., its direct
+// dependencies) in the order they first appear.
+func Dependencies(t core.Target) []core.Target {
+	var dependencies []core.Target
+	seen := map[core.TargetID]struct{}{}
+	var visit func(input core.Input)
+	visit = func(input core.Input) {
+		switch x := input.(type) {
+		case core.Target:
+			if _, found := seen[x.ID]; !found {
+				seen[x.ID] = struct{}{}
+				dependencies = append(dependencies, x)
+			}
+		case core.TargetOutput:
+			visit(x.Target)
+		case core.Array:
+			for _, elt := range x {
+				visit(elt)
+			}
+		case core.Object:
+			for _, field := range x {
+				visit(field.Value)
+			}
+		}
+	}
+	visit(t.Inputs)
+	return dependencies
+}
+
+// SyntaxErr is returned for malformed query expressions.
+type SyntaxErr struct {
+	Offset  int
+	Message string
+}
+
+func (err SyntaxErr) Error() string {
+	return fmt.Sprintf("Syntax error at offset %d: %s", err.Offset, err.Message)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	offset int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{tokenComma, ",", i})
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, SyntaxErr{i, "Unterminated string"}
+			}
+			tokens = append(tokens, token{tokenString, s[i+1 : i+1+end], i})
+			i += end + 2
+		default:
+			start := i
+			for i < len(s) && !unicode.IsSpace(rune(s[i])) &&
+				!strings.ContainsRune("(),\"'", rune(s[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokenWord, s[start:i], start})
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(s)}), nil
+}
+
+var operators = map[string]string{
+	"union":     "union",
+	"+":         "union",
+	"intersect": "intersect",
+	"^":         "intersect",
+	"except":    "except",
+	"-":         "except",
+}
+
+type parser struct {
+	tokens []token
+	i      int
+}
+
+func (p *parser) peek() token { return p.tokens[p.i] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokenEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, description string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, SyntaxErr{
+			t.offset,
+			fmt.Sprintf("Expected %s; found %s", description, t),
+		}
+	}
+	return t, nil
+}
+
+func (p *parser) parseExpr() (Expr, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		op, found := operators[t.text]
+		if t.kind != tokenWord || !found {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		left = setExpr{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenLParen:
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	case tokenString:
+		return literal{text: t.text, quoted: true, offset: t.offset}, nil
+	case tokenWord:
+		if _, found := operators[t.text]; found &&
+			p.peek().kind != tokenLParen {
+			return nil, SyntaxErr{
+				t.offset,
+				fmt.Sprintf("Expected an expression; found %s", t),
+			}
+		}
+		if p.peek().kind == tokenLParen {
+			p.next()
+			return p.parseCall(t)
+		}
+		return literal{text: t.text, offset: t.offset}, nil
+	}
+	return nil, SyntaxErr{
+		t.offset,
+		fmt.Sprintf("Expected an expression; found %s", t),
+	}
+}
+
+func (p *parser) parseCall(name token) (Expr, error) {
+	var args []Expr
+	if p.peek().kind == tokenRParen {
+		p.next()
+	} else {
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			t := p.next()
+			if t.kind == tokenRParen {
+				break
+			}
+			if t.kind != tokenComma {
+				return nil, SyntaxErr{
+					t.offset,
+					fmt.Sprintf("Expected ',' or ')'; found %s", t),
+				}
+			}
+		}
+	}
+
+	arity := func(min, max int) error {
+		if len(args) < min || len(args) > max {
+			wanted := strconv.Itoa(min)
+			if max > min {
+				wanted = fmt.Sprintf("%d or %d", min, max)
+			}
+			return SyntaxErr{
+				name.offset,
+				fmt.Sprintf(
+					"%s() takes %s arguments; found %d",
+					name.text,
+					wanted,
+					len(args),
+				),
+			}
+		}
+		return nil
+	}
+
+	switch name.text {
+	case "deps":
+		if err := arity(1, 2); err != nil {
+			return nil, err
+		}
+		depth, err := depthArg(args[1:])
+		return depsExpr{x: args[0], depth: depth}, err
+	case "rdeps":
+		if err := arity(2, 3); err != nil {
+			return nil, err
+		}
+		depth, err := depthArg(args[2:])
+		return rdepsExpr{universe: args[0], x: args[1], depth: depth}, err
+	case "kind":
+		if err := arity(2, 2); err != nil {
+			return nil, err
+		}
+		pattern, err := regexArg(args[0])
+		return kindExpr{pattern: pattern, x: args[1]}, err
+	case "attr":
+		if err := arity(3, 3); err != nil {
+			return nil, err
+		}
+		name, err := stringArg(args[0])
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := regexArg(args[1])
+		return attrExpr{name: name, pattern: pattern, x: args[2]}, err
+	case "somepath":
+		if err := arity(2, 2); err != nil {
+			return nil, err
+		}
+		return somepathExpr{from: args[0], to: args[1]}, nil
+	case "union", "intersect", "except":
+		if err := arity(2, 2); err != nil {
+			return nil, err
+		}
+		return setExpr{op: name.text, left: args[0], right: args[1]}, nil
+	}
+	return nil, SyntaxErr{
+		name.offset,
+		fmt.Sprintf("Unknown function '%s'", name.text),
+	}
+}
+
+func stringArg(arg Expr) (string, error) {
+	if l, ok := arg.(literal); ok {
+		return l.text, nil
+	}
+	return "", errors.New("Expected a string argument; found an expression")
+}
+
+func regexArg(arg Expr) (*regexp.Regexp, error) {
+	s, err := stringArg(arg)
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := regexp.Compile(s)
+	return pattern, errors.Wrapf(err, "Parsing regex '%s'", s)
+}
+
+// depthArg parses the optional depth argument. A negative depth is
+// unbounded.
+func depthArg(args []Expr) (int, error) {
+	if len(args) < 1 {
+		return -1, nil
+	}
+	if l, ok := args[0].(literal); ok && !l.quoted {
+		if depth, err := strconv.Atoi(l.text); err == nil && depth >= 0 {
+			return depth, nil
+		}
+	}
+	return 0, errors.New("Expected a non-negative integer depth")
+}
+
+// Expr is a parsed query expression.
+type Expr interface {
+	eval(e *evaluator) (targetSet, error)
+}
+
+// Parse parses a query expression.
+func Parse(s string) (Expr, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{tokens: tokens}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokenEOF, "end of query"); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+// Run parses and evaluates a query expression, returning the resulting
+// targets ordered by label.
+func Run(s string, load Loader) ([]core.Target, error) {
+	expr, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	e := evaluator{load: load, loaded: map[string]targetSet{}}
+	set, err := expr.eval(&e)
+	if err != nil {
+		return nil, err
+	}
+	return set.sorted(), nil
+}
+
+type targetSet map[core.TargetID]core.Target
+
+func (s targetSet) sorted() []core.Target {
+	targets := make([]core.Target, 0, len(s))
+	for _, target := range s {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return Label(targets[i].ID) < Label(targets[j].ID)
+	})
+	return targets
+}
+
+// closure returns the targets within `depth` edges of `roots` (or any
+// distance, if `depth` is negative) along the edges returned by `edges`.
+func closure(
+	roots targetSet,
+	depth int,
+	edges func(t core.Target) []core.Target,
+) targetSet {
+	result := targetSet{}
+	frontier := roots.sorted()
+	for _, target := range frontier {
+		result[target.ID] = target
+	}
+	for ; len(frontier) > 0 && depth != 0; depth-- {
+		var next []core.Target
+		for _, target := range frontier {
+			for _, neighbor := range edges(target) {
+				if _, found := result[neighbor.ID]; !found {
+					result[neighbor.ID] = neighbor
+					next = append(next, neighbor)
+				}
+			}
+		}
+		frontier = next
+	}
+	return result
+}
+
+type evaluator struct {
+	load   Loader
+	loaded map[string]targetSet
+}
+
+type literal struct {
+	text   string
+	quoted bool
+	offset int
+}
+
+// eval treats the literal as a target pattern.
+func (l literal) eval(e *evaluator) (targetSet, error) {
+	if set, found := e.loaded[l.text]; found {
+		return set, nil
+	}
+	targets, err := e.load(l.text)
+	if err != nil {
+		return nil, err
+	}
+	set := targetSet{}
+	for _, target := range targets {
+		set[target.ID] = target
+	}
+	e.loaded[l.text] = set
+	return set, nil
+}
+
+type setExpr struct {
+	op          string
+	left, right Expr
+}
+
+func (x setExpr) eval(e *evaluator) (targetSet, error) {
+	left, err := x.left.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	right, err := x.right.eval(e)
+	if err != nil {
+		return nil, err
+	}
+
+	result := targetSet{}
+	switch x.op {
+	case "union":
+		for id, target := range left {
+			result[id] = target
+		}
+		for id, target := range right {
+			result[id] = target
+		}
+	case "intersect":
+		for id, target := range left {
+			if _, found := right[id]; found {
+				result[id] = target
+			}
+		}
+	case "except":
+		for id, target := range left {
+			if _, found := right[id]; !found {
+				result[id] = target
+			}
+		}
+	}
+	return result, nil
+}
+
+type depsExpr struct {
+	x     Expr
+	depth int
+}
+
+func (x depsExpr) eval(e *evaluator) (targetSet, error) {
+	roots, err := x.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	return closure(roots, x.depth, Dependencies), nil
+}
+
+type rdepsExpr struct {
+	universe, x Expr
+	depth       int
+}
+
+func (x rdepsExpr) eval(e *evaluator) (targetSet, error) {
+	universe, err := x.universe.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := x.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+
+	universe = closure(universe, -1, Dependencies)
+	dependents := map[core.TargetID][]core.Target{}
+	for _, target := range universe.sorted() {
+		for _, dependency := range Dependencies(target) {
+			dependents[dependency.ID] = append(
+				dependents[dependency.ID],
+				target,
+			)
+		}
+	}
+
+	roots := targetSet{}
+	for id, target := range targets {
+		if _, found := universe[id]; found {
+			roots[id] = target
+		}
+	}
+	return closure(roots, x.depth, func(t core.Target) []core.Target {
+		return dependents[t.ID]
+	}), nil
+}
+
+type kindExpr struct {
+	pattern *regexp.Regexp
+	x       Expr
+}
+
+func (x kindExpr) eval(e *evaluator) (targetSet, error) {
+	targets, err := x.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	result := targetSet{}
+	for id, target := range targets {
+		if x.pattern.MatchString(string(target.Kind())) {
+			result[id] = target
+		}
+	}
+	return result, nil
+}
+
+type attrExpr struct {
+	name    string
+	pattern *regexp.Regexp
+	x       Expr
+}
+
+// lookup finds the (possibly nested) input named by a `.`-separated key path.
+func lookup(inputs core.Object, name string) (core.Input, bool) {
+	keys := strings.Split(name, ".")
+	var input core.Input = inputs
+	for _, key := range keys {
+		object, ok := input.(core.Object)
+		if !ok {
+			return nil, false
+		}
+		found := false
+		for _, field := range object {
+			if field.Key == key {
+				input, found = field.Value, true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return input, true
+}
+
+// matches returns true if the input (or, for lists and objects, any of its
+// values) matches the pattern.
+func matches(pattern *regexp.Regexp, input core.Input) bool {
+	switch x := input.(type) {
+	case core.String:
+		return pattern.MatchString(string(x))
+	case core.Int:
+		return pattern.MatchString(strconv.FormatInt(int64(x), 10))
+	case core.Bool:
+		if x {
+			return pattern.MatchString("True")
+		}
+		return pattern.MatchString("False")
+	case core.Target:
+		return pattern.MatchString(Label(x.ID))
+	case core.TargetOutput:
+		return pattern.MatchString(Label(x.Target.ID))
+	case core.FileGroup:
+		for _, p := range x.Patterns {
+			if pattern.MatchString(p) {
+				return true
+			}
+		}
+	case core.Array:
+		for _, elt := range x {
+			if matches(pattern, elt) {
+				return true
+			}
+		}
+	case core.Object:
+		for _, field := range x {
+			if matches(pattern, field.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (x attrExpr) eval(e *evaluator) (targetSet, error) {
+	targets, err := x.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	result := targetSet{}
+	for id, target := range targets {
+		if input, found := lookup(target.Inputs, x.name); found &&
+			matches(x.pattern, input) {
+			result[id] = target
+		}
+	}
+	return result, nil
+}
+
+type somepathExpr struct {
+	from, to Expr
+}
+
+func (x somepathExpr) eval(e *evaluator) (targetSet, error) {
+	from, err := x.from.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	to, err := x.to.eval(e)
+	if err != nil {
+		return nil, err
+	}
+
+	// Breadth-first search from every target in `from`, remembering how
+	// each target was reached so the path can be retraced.
+	parents := map[core.TargetID]*core.Target{}
+	frontier := from.sorted()
+	for _, target := range frontier {
+		parents[target.ID] = nil
+	}
+	for len(frontier) > 0 {
+		var next []core.Target
+		for i := range frontier {
+			target := frontier[i]
+			if _, found := to[target.ID]; found {
+				path := targetSet{}
+				for t := &target; t != nil; t = parents[t.ID] {
+					path[t.ID] = *t
+				}
+				return path, nil
+			}
+			for _, dependency := range Dependencies(target) {
+				if _, found := parents[dependency.ID]; !found {
+					parents[dependency.ID] = &target
+					next = append(next, dependency)
+				}
+			}
+		}
+		frontier = next
+	}
+	return targetSet{}, nil
+}
@@ -0,0 +1,211 @@
+package query
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/weberc2/builder/core"
+)
+
+func testTargets() []core.Target {
+	requests := core.Target{
+		ID: core.TargetID{
+			Package: "3rdParty/python",
+			Target:  "requests",
+		},
+		BuilderType: "virtualenv",
+		Inputs: core.Object{
+			{Key: "packages", Value: core.Array{core.String("requests")}},
+		},
+	}
+	lib := core.Target{
+		ID:          core.TargetID{Package: "lib", Target: "lib"},
+		BuilderType: "command",
+		Inputs: core.Object{
+			{Key: "command", Value: core.String("bash")},
+			{Key: "environment", Value: core.Object{
+				{Key: "DEPENDENCY_0", Value: requests},
+			}},
+		},
+	}
+	bin := core.Target{
+		ID:          core.TargetID{Package: "app", Target: "bin"},
+		BuilderType: "command",
+		Inputs: core.Object{
+			{Key: "command", Value: core.String("python")},
+			{Key: "args", Value: core.Array{lib, core.FileGroup{
+				Package:  "app",
+				Patterns: []string{"main.py"},
+			}}},
+		},
+	}
+	test := core.Target{
+		ID:          core.TargetID{Package: "app", Target: "test"},
+		BuilderType: core.TestBuilderType,
+		Inputs:      core.Object{{Key: "command", Value: bin}},
+	}
+	other := core.Target{
+		ID:          core.TargetID{Package: "other", Target: "other"},
+		BuilderType: "command",
+		Inputs:      core.Object{{Key: "command", Value: core.String("bash")}},
+	}
+	wheel := core.Target{
+		ID: core.TargetID{
+			Package: "3rdParty/python",
+			Target:  "wheel",
+		},
+		BuilderType: core.RuleBuilderType,
+		Inputs: core.Object{
+			{Key: "kind", Value: core.String("py_wheel")},
+			{Key: "attrs", Value: core.Object{}},
+		},
+	}
+	return []core.Target{requests, wheel, lib, bin, test, other}
+}
+
+func testLoader() Loader {
+	targets := testTargets()
+	return func(s string) ([]core.Target, error) {
+		pattern, err := core.ParseTargetPattern("/ws", "/ws", s)
+		if err != nil {
+			return nil, err
+		}
+		var matched []core.Target
+		for _, target := range targets {
+			if pattern.Matches(target.ID) {
+				matched = append(matched, target)
+			}
+		}
+		return matched, nil
+	}
+}
+
+func TestRun(t *testing.T) {
+	for _, tc := range []struct {
+		query  string
+		wanted []string
+	}{
+		{
+			"rdeps(//..., //3rdParty/python:requests)",
+			[]string{
+				"//3rdParty/python:requests",
+				"//app:bin",
+				"//app:test",
+				"//lib:lib",
+			},
+		},
+		{
+			"rdeps(//..., //3rdParty/python:requests, 1)",
+			[]string{"//3rdParty/python:requests", "//lib:lib"},
+		},
+		{
+			"rdeps(//app:bin, //lib:lib)",
+			[]string{"//app:bin", "//lib:lib"},
+		},
+		{
+			"deps(//app:test)",
+			[]string{
+				"//3rdParty/python:requests",
+				"//app:bin",
+				"//app:test",
+				"//lib:lib",
+			},
+		},
+		{"deps(//app:test, 1)", []string{"//app:bin", "//app:test"}},
+		{`kind("test", //...)`, []string{"//app:test"}},
+		{`kind("^py_", //...)`, []string{"//3rdParty/python:wheel"}},
+		{"kind(rule, //...)", []string{}},
+		{
+			"kind(command, deps(//app:test))",
+			[]string{"//app:bin", "//lib:lib"},
+		},
+		{
+			`attr(command, "^bash$", //...)`,
+			[]string{"//lib:lib", "//other:other"},
+		},
+		{"attr(args, main, //...)", []string{"//app:bin"}},
+		{
+			"attr(environment.DEPENDENCY_0, requests, //...)",
+			[]string{"//lib:lib"},
+		},
+		{
+			"//app:all + //other:other",
+			[]string{"//app:bin", "//app:test", "//other:other"},
+		},
+		{
+			"//... except //app/... except //3rdParty/...",
+			[]string{"//lib:lib", "//other:other"},
+		},
+		{"//... ^ deps(//app:bin, 1)", []string{"//app:bin", "//lib:lib"}},
+		{
+			"intersect(//..., (//lib:lib union //other:other))",
+			[]string{"//lib:lib", "//other:other"},
+		},
+		{
+			"somepath(//app:test, //3rdParty/python:requests)",
+			[]string{
+				"//3rdParty/python:requests",
+				"//app:bin",
+				"//app:test",
+				"//lib:lib",
+			},
+		},
+		{"somepath(//other:other, //lib:lib)", []string{}},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			targets, err := Run(tc.query, testLoader())
+			if err != nil {
+				t.Fatalf("Unexpected err: %v", err)
+			}
+			got := []string{}
+			for _, target := range targets {
+				got = append(got, Label(target.ID))
+			}
+			if !reflect.DeepEqual(got, tc.wanted) {
+				t.Fatalf("Wanted %v; got %v", tc.wanted, got)
+			}
+		})
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, query := range []string{
+		"",
+		"deps(",
+		"deps(//a:b",
+		"deps(//a:b, x)",
+		"deps(//a:b, 1, 2)",
+		"kind(//a:b)",
+		"kind(deps(//a:b), //a:b)",
+		"attr(name, '(', //a:b)",
+		"nope(//a:b)",
+		"//a:b union",
+		"//a:b //c:d",
+		`"unterminated`,
+	} {
+		if _, err := Parse(query); err == nil {
+			t.Errorf("%s: Expected an error", query)
+		}
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	targets, err := Run("deps(//app:bin, 1)", testLoader())
+	if err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteDOT(&buf, targets); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	wanted := `digraph query {
+  "//app:bin" [label="//app:bin\ncommand"];
+  "//lib:lib" [label="//lib:lib\ncommand"];
+  "//app:bin" -> "//lib:lib";
+}
+`
+	if got := buf.String(); got != wanted {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", wanted, got)
+	}
+}
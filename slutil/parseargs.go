@@ -180,7 +180,7 @@ NEXT_KW:
 
 		for i, kwSpec := range spec.KwSpecs {
 			if kwSpec.Keyword == kw[0].(starlark.String) {
-				if i < len(args.Pos) {
+				if len(spec.PosSpecs)+i < len(args.Pos) {
 					return MultipleValuesForArgErr{
 						Fn:  fn,
 						Arg: string(kwSpec.Keyword),
@@ -300,3 +300,19 @@ func AssertObjectOf(
 		return NewTypeErr("str", k)
 	})
 }
+
+func AssertBool(f func(b bool) error) func(starlark.Value) error {
+	return func(v starlark.Value) error {
+		if b, ok := v.(starlark.Bool); ok {
+			return f(bool(b))
+		}
+		return NewTypeErr("bool", v)
+	}
+}
+
+func ParseBool(bptr *bool) func(starlark.Value) error {
+	return AssertBool(func(b bool) error {
+		*bptr = b
+		return nil
+	})
+}
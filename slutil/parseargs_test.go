@@ -214,3 +214,33 @@ func TestParseArgs_UnexpectedKwarg(t *testing.T) {
 		t.Fatalf("Expected err '%v'; got '%v'", expectedErr, err)
 	}
 }
+
+func TestParseArgs_PosArgAndKwArgAssignedByKeyword(t *testing.T) {
+	var bar, baz string
+	if err := ParseArgs(
+		"foo",
+		Args{
+			Pos: starlark.Tuple{starlark.String("bar")},
+			Kw: []starlark.Tuple{{
+				starlark.String("baz"),
+				starlark.String("baz"),
+			}},
+		},
+		ArgsSpec{
+			PosSpecs: []PosSpec{{
+				Keyword: "bar",
+				Value:   ParseString(&bar),
+			}},
+			KwSpecs: []KwSpec{{
+				Keyword: "baz",
+				Value:   ParseString(&baz),
+				Default: starlark.String("qux"),
+			}},
+		},
+	); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if baz != "baz" {
+		t.Fatalf("Wanted 'baz', got '%s'", baz)
+	}
+}
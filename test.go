@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/weberc2/builder/core"
+)
+
+// testRecorder collects the results of test targets from build events.
+type testRecorder struct {
+	lock    sync.Mutex
+	results map[core.FrozenTargetID]*core.TestResult
+	outputs map[core.FrozenTargetID]*bytes.Buffer
+}
+
+func newTestRecorder(dags []core.DAG) *testRecorder {
+	r := &testRecorder{
+		results: map[core.FrozenTargetID]*core.TestResult{},
+		outputs: map[core.FrozenTargetID]*bytes.Buffer{},
+	}
+	for _, dag := range dags {
+		r.results[dag.ID] = &core.TestResult{
+			Target: dag.ID,
+			Status: core.TestNotRun,
+		}
+		r.outputs[dag.ID] = &bytes.Buffer{}
+	}
+	return r
+}
+
+func (r *testRecorder) record(e core.Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result, found := r.results[e.Target]
+	if !found {
+		return
+	}
+	switch e.Type {
+	case core.EventCacheHit:
+		result.Status = core.TestCached
+	case core.EventStdout, core.EventStderr:
+		r.outputs[e.Target].WriteString(e.Data)
+	case core.EventTargetFinished:
+		if result.Status != core.TestCached {
+			result.Status = core.TestPassed
+			result.Duration = e.Duration
+		}
+	case core.EventTargetFailed:
+		result.Status = core.TestFailed
+		result.Duration = e.Duration
+		result.Output = r.outputs[e.Target].String()
+	}
+}
+
+// sorted returns the results ordered by target.
+func (r *testRecorder) sorted() []core.TestResult {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	results := make([]core.TestResult, 0, len(r.results))
+	for _, result := range r.results {
+		results = append(results, *result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Target.ArtifactID().String() <
+			results[j].Target.ArtifactID().String()
+	})
+	return results
+}
+
+func printTestSummary(results []core.TestResult) map[core.TestStatus]int {
+	counts := map[core.TestStatus]int{}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tSTATUS\tDURATION")
+	for _, result := range results {
+		counts[result.Status]++
+		duration := "-"
+		if result.Status == core.TestPassed ||
+			result.Status == core.TestFailed {
+			duration = result.Duration.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(
+			w,
+			"//%s:%s\t%s\t%s\n",
+			result.Target.Package,
+			result.Target.Target,
+			result.Status,
+			duration,
+		)
+	}
+	w.Flush()
+	fmt.Printf(
+		"\n%d passed, %d cached, %d failed, %d not run\n",
+		counts[core.TestPassed],
+		counts[core.TestCached],
+		counts[core.TestFailed],
+		counts[core.TestNotRun],
+	)
+	return counts
+}
+
+// runTests builds and runs test targets. A failing test (or a dependency
+// which fails to build) doesn't stop the other tests from running, but the
+// targets which depend on it (e.g., on a failed test's outputs) are skipped.
+func runTests(ctx *cli.Context, cache core.LocalCache, dags []core.DAG) error {
+	events, closeEvents, err := eventSink(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeEvents()
+
+	recorder := newTestRecorder(dags)
+	execute := executor(
+		ctx,
+		cache,
+		core.MultiSink(events, recorder.record),
+	)
+	buildCtx, stop := interruptible()
+	defer stop()
+	summary, err := core.KeepGoing(buildCtx, execute, ctx.Int("jobs"), dags...)
+	var buildErr error
+	if err == context.Canceled {
+		buildErr = errInterrupted
+	}
+	for _, failure := range summary.Failed {
+		// Failed tests are reported by the summary below.
+		_, ok := errors.Cause(failure.Err).(core.TestFailedErr)
+		if !ok && buildErr == nil {
+			buildErr = failure.Err
+		}
+	}
+
+	fmt.Println()
+	results := recorder.sorted()
+	counts := printTestSummary(results)
+
+	if path := ctx.String("junit"); path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			return errors.Wrap(err, "Creating JUnit report")
+		}
+		defer file.Close()
+		if err := core.WriteJUnit(file, cache, results); err != nil {
+			return err
+		}
+	}
+
+	if buildErr != nil {
+		return buildErr
+	}
+	if counts[core.TestFailed] > 0 {
+		return errors.Errorf(
+			"%d of %d tests failed",
+			counts[core.TestFailed],
+			len(results),
+		)
+	}
+	return nil
+}
+
+// testTargets returns the test targets among `targets`. Patterns may match
+// non-test targets; only the tests are run.
+func testTargets(targets []core.Target) ([]core.Target, error) {
+	var tests []core.Target
+	for _, target := range targets {
+		if target.BuilderType == core.TestBuilderType {
+			tests = append(tests, target)
+		}
+	}
+	if len(tests) < 1 {
+		return nil, errors.New("No test targets match")
+	}
+	return tests, nil
+}
+
+var testCommand = cli.Command{
+	Name:      "test",
+	Usage:     "Runs test targets",
+	UsageText: "Runs test targets",
+	Description: "Builds and runs each test target matched by the " +
+		"patterns, printing a summary of the results. Passing results are " +
+		"cached, so a test is only re-run if it previously failed or if it " +
+		"or any of its dependencies have changed. Exits non-zero if any " +
+		"test fails.",
+	ArgsUsage: patternsUsage,
+	Flags: []cli.Flag{
+		jobsFlag,
+		buildEventFileFlag,
+		cli.StringFlag{
+			Name:  "junit",
+			Usage: "Write a JUnit XML report of the results to this file",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 1 {
+			return errors.New("Missing PACKAGE:TARGET argument")
+		}
+
+		workspace, pwd, err := currentWorkspace()
+		if err != nil {
+			return err
+		}
+		cache := core.NewLocalCache(workspace.id, cacheDirectory())
+
+		targets, err := loadTargets(workspace, pwd, ctx.Args())
+		if err != nil {
+			return err
+		}
+
+		tests, err := testTargets(targets)
+		if err != nil {
+			return err
+		}
+
+		dags, err := freeze(workspace, cache, tests)
+		if err != nil {
+			return err
+		}
+		return runTests(ctx, cache, dags)
+	},
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/weberc2/builder/core"
+)
+
+// process is an artifact started by `builder watch --run`.
+type process struct {
+	cmd     *exec.Cmd
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func startProcess(path string) (*process, error) {
+	p := &process{
+		cmd:     exec.Command(path),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	p.cmd.Stdout = os.Stdout
+	p.cmd.Stderr = os.Stderr
+	if err := startProcessGroup(p.cmd); err != nil {
+		return nil, errors.Wrapf(err, "Starting %s", path)
+	}
+	go func() {
+		defer close(p.done)
+		err := p.cmd.Wait()
+		select {
+		case <-p.stopped:
+		default:
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s exited: %v\n", path, err)
+			}
+		}
+	}()
+	return p, nil
+}
+
+// stop kills the process (if it's still running), along with any processes
+// it started, and waits for it to exit.
+func (p *process) stop() {
+	if p == nil {
+		return
+	}
+	select {
+	case <-p.done:
+	default:
+		close(p.stopped)
+		killProcessGroup(p.cmd)
+		<-p.done
+	}
+}
+
+// rebuild evaluates, freezes, and builds (or tests or runs) the targets
+// matched by `patterns`. Because artifacts are cached by checksum, only the
+// targets whose inputs changed since the last rebuild are actually rebuilt.
+// It returns the directories to watch for the next change, which are
+// returned even if the build fails so that a fix is noticed. If they can't be
+// determined, it returns none.
+func rebuild(
+	ctx *cli.Context,
+	workspace workspace,
+	cache core.LocalCache,
+	patterns []core.TargetPattern,
+	running **process,
+) ([]string, error) {
+	targets, loads, evalErr := core.ExpandPatternsLoads(
+		workspace.root,
+		builtinModules,
+		patterns...,
+	)
+	dirs, err := core.WatchDirs(workspace.root, patterns, loads, targets)
+	if err != nil {
+		return nil, err
+	}
+	if evalErr != nil {
+		return dirs, evaluationError(evalErr)
+	}
+
+	if ctx.Bool("test") {
+		if targets, err = testTargets(targets); err != nil {
+			return dirs, err
+		}
+	}
+	dags, err := freeze(workspace, cache, targets)
+	if err != nil {
+		return dirs, err
+	}
+
+	switch {
+	case ctx.Bool("test"):
+		return dirs, runTests(ctx, cache, dags)
+	case ctx.Bool("run"):
+		if len(dags) != 1 {
+			return dirs, errors.Errorf(
+				"--run requires exactly one target; %d match",
+				len(dags),
+			)
+		}
+		if err := build(ctx, cache, dags[0]); err != nil {
+			return dirs, err
+		}
+		*running, err = startProcess(cache.Path(dags[0].ID.ArtifactID()))
+		return dirs, err
+	default:
+		return dirs, build(ctx, cache, dags...)
+	}
+}
+
+func watch(ctx *cli.Context) error {
+	if len(ctx.Args()) < 1 {
+		return errors.New("Missing PACKAGE:TARGET argument")
+	}
+	if ctx.Bool("run") && ctx.Bool("test") {
+		return errors.New("--run and --test are mutually exclusive")
+	}
+
+	workspace, pwd, err := currentWorkspace()
+	if err != nil {
+		return err
+	}
+	patterns, err := parsePatterns(workspace, pwd, ctx.Args())
+	if err != nil {
+		return err
+	}
+	cache := core.NewLocalCache(workspace.id, cacheDirectory())
+
+	watcher, err := core.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// The process started by --run is in its own process group, so it
+	// doesn't receive the terminal's signals; it's stopped when builder is
+	// interrupted instead, even while builder is waiting for a change.
+	interrupted, stopInterrupts := interruptible()
+	defer stopInterrupts()
+	var running *process
+	defer func() { running.stop() }()
+	for {
+		dirs, err := rebuild(ctx, workspace, cache, patterns, &running)
+		if err == errInterrupted {
+			return err
+		}
+		if dirs == nil && err != nil {
+			// Without the directories, no change would ever be noticed.
+			return err
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if dirs != nil {
+			if err := watcher.Watch(dirs); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Watching %d directories for changes...\n", len(dirs))
+
+		changed, err := nextChange(
+			interrupted,
+			watcher,
+			ctx.Duration("debounce"),
+		)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\n%s changed; rebuilding\n", describeChanges(
+			workspace.root,
+			changed,
+		))
+		running.stop()
+		running = nil
+	}
+}
+
+// nextChange is like Watcher.Next(), but it returns errInterrupted once `ctx`
+// is done.
+func nextChange(
+	ctx context.Context,
+	watcher *core.Watcher,
+	quiet time.Duration,
+) ([]string, error) {
+	type result struct {
+		changed []string
+		err     error
+	}
+	results := make(chan result, 1)
+	go func() {
+		changed, err := watcher.Next(quiet)
+		results <- result{changed: changed, err: err}
+	}()
+	select {
+	case r := <-results:
+		return r.changed, r.err
+	case <-ctx.Done():
+		return nil, errInterrupted
+	}
+}
+
+// describeChanges names the first changed path (relative to the workspace)
+// and counts the rest.
+func describeChanges(root string, changed []string) string {
+	first := changed[0]
+	if first == "" {
+		return "Something"
+	}
+	if relpath, err := filepath.Rel(root, first); err == nil {
+		first = "//" + filepath.ToSlash(relpath)
+	}
+	if len(changed) > 1 {
+		return fmt.Sprintf("%s and %d other file(s)", first, len(changed)-1)
+	}
+	return first
+}
+
+var watchCommand = cli.Command{
+	Name:      "watch",
+	Usage:     "Rebuilds targets whenever their sources change",
+	UsageText: "Rebuilds targets whenever their sources change",
+	Description: "Builds the targets matched by the patterns and then " +
+		"watches the BUILD files which were read to evaluate them and " +
+		"the directories covered by their file groups (Linux only). When " +
+		"a file changes, the targets are re-evaluated, re-frozen, and " +
+		"rebuilt; only targets whose inputs changed are actually rebuilt. " +
+		"Changes made in quick succession trigger a single rebuild. With " +
+		"--test, only the matched tests are run; with --run, the single " +
+		"matched target is run after each successful build and killed " +
+		"before the next.",
+	ArgsUsage: patternsUsage,
+	Flags: []cli.Flag{
+		jobsFlag,
+		buildEventFileFlag,
+		cli.BoolFlag{
+			Name:  "run",
+			Usage: "Run the target's artifact after each successful build",
+		},
+		cli.BoolFlag{
+			Name:  "test",
+			Usage: "Run the matched tests instead of building the targets",
+		},
+		cli.DurationFlag{
+			Name:  "debounce",
+			Usage: "How long to wait for further changes before rebuilding",
+			Value: 200 * time.Millisecond,
+		},
+	},
+	Action: watch,
+}
@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startProcessGroup starts `cmd` in a new process group, so that the
+// processes it starts (e.g., a server's workers) can be killed along with it
+// by killProcessGroup().
+func startProcessGroup(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	return cmd.Start()
+}
+
+// killProcessGroup kills every process in the group of `cmd`, which must have
+// been started by startProcessGroup().
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
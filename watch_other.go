@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os/exec"
+
+// startProcessGroup starts `cmd`. Unlike on Linux, the processes which it
+// starts aren't killed along with it by killProcessGroup().
+func startProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
+
+// killProcessGroup kills `cmd`.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}